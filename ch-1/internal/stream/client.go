@@ -1,10 +1,12 @@
 package stream
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
-	"strings"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-1/internal/sse"
 )
 
 const streamURL = "https://stream.wikimedia.org/v2/stream/recentchange"
@@ -28,20 +30,26 @@ func (wc *WikipediaClient) Connect() error {
 	}
 	defer resp.Body.Close()
 
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data:") {
+	dec := sse.NewDecoder(resp.Body)
+	for {
+		msg, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, sse.ErrEventTooLarge) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Type != "message" {
 			continue
 		}
 
-		line = strings.TrimPrefix(line, "data:")
 		var ev ChangeEvent
-		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+		if err := json.Unmarshal([]byte(msg.Data), &ev); err != nil {
 			continue
 		}
 		wc.stats.Record(ev)
 	}
-
-	return scanner.Err()
-}
\ No newline at end of file
+}
@@ -0,0 +1,162 @@
+package sse_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-3/internal/sse"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeAll(t *testing.T, dec *sse.Decoder) []sse.Event {
+	t.Helper()
+	var events []sse.Event
+	for {
+		ev, err := dec.Decode()
+		if err == io.EOF {
+			return events
+		}
+		if !assert.NoError(t, err) {
+			return events
+		}
+		events = append(events, ev)
+	}
+}
+
+func TestDecoder_DispatchesOnBlankLine(t *testing.T) {
+	input := "event: message\nid: 1\ndata: {\"a\":1}\n\nid: 2\ndata: {\"a\":2}\n\n"
+
+	events := decodeAll(t, sse.NewDecoder(strings.NewReader(input)))
+
+	assert.Equal(t, []sse.Event{
+		{ID: "1", Type: "message", Data: `{"a":1}`},
+		{ID: "2", Type: "message", Data: `{"a":2}`},
+	}, events)
+}
+
+func TestDecoder_JoinsMultiLineData(t *testing.T) {
+	input := "data: first\ndata:second\ndata\n\n"
+
+	events := decodeAll(t, sse.NewDecoder(strings.NewReader(input)))
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, "first\nsecond\n", events[0].Data)
+}
+
+func TestDecoder_IgnoresCommentsAndUnknownFields(t *testing.T) {
+	input := ": keep-alive\nfoo: bar\ndata: x\n\n:\n\n"
+
+	events := decodeAll(t, sse.NewDecoder(strings.NewReader(input)))
+
+	assert.Equal(t, []sse.Event{{Type: "message", Data: "x"}}, events)
+}
+
+func TestDecoder_CustomEventTypeResetsAfterDispatch(t *testing.T) {
+	input := "event: ping\ndata: 1\n\ndata: 2\n\n"
+
+	events := decodeAll(t, sse.NewDecoder(strings.NewReader(input)))
+
+	assert.Equal(t, "ping", events[0].Type)
+	assert.Equal(t, "message", events[1].Type)
+}
+
+func TestDecoder_IDPersistsAcrossEvents(t *testing.T) {
+	input := "id: abc\ndata: 1\n\ndata: 2\n\nid\ndata: 3\n\n"
+
+	dec := sse.NewDecoder(strings.NewReader(input))
+	events := decodeAll(t, dec)
+
+	assert.Equal(t, "abc", events[0].ID)
+	assert.Equal(t, "abc", events[1].ID)
+	assert.Equal(t, "", events[2].ID)
+	assert.Equal(t, "", dec.LastEventID())
+}
+
+func TestDecoder_IDWithNullIsIgnored(t *testing.T) {
+	input := "id: good\ndata: 1\n\nid: ba\x00d\ndata: 2\n\n"
+
+	events := decodeAll(t, sse.NewDecoder(strings.NewReader(input)))
+
+	assert.Equal(t, "good", events[1].ID)
+}
+
+func TestDecoder_Retry(t *testing.T) {
+	dec := sse.NewDecoder(strings.NewReader("retry: 2500\n\nretry: soon\ndata: x\n\n"))
+
+	events := decodeAll(t, dec)
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, 2500*time.Millisecond, dec.Retry())
+}
+
+func TestDecoder_LineEndings(t *testing.T) {
+	input := "\ufeffdata: crlf\r\n\r\ndata: cr\r\rdata: lf\n\n"
+
+	events := decodeAll(t, sse.NewDecoder(strings.NewReader(input)))
+
+	assert.Len(t, events, 3)
+	assert.Equal(t, "crlf", events[0].Data)
+	assert.Equal(t, "cr", events[1].Data)
+	assert.Equal(t, "lf", events[2].Data)
+}
+
+func TestDecoder_DiscardsIncompleteTrailingEvent(t *testing.T) {
+	events := decodeAll(t, sse.NewDecoder(strings.NewReader("data: done\n\ndata: partial\n")))
+
+	assert.Len(t, events, 1)
+}
+
+func TestDecoder_LongLinesBeyondScannerDefault(t *testing.T) {
+	payload := strings.Repeat("x", 200*1024)
+
+	events := decodeAll(t, sse.NewDecoder(strings.NewReader("data: "+payload+"\n\n")))
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, payload, events[0].Data)
+}
+
+func TestDecoder_MaxEventSize(t *testing.T) {
+	t.Run("single line too long", func(t *testing.T) {
+		dec := sse.NewDecoderSize(strings.NewReader("data: "+strings.Repeat("x", 64)+"\n\n"), 32)
+		_, err := dec.Decode()
+		assert.Equal(t, sse.ErrEventTooLarge, err)
+	})
+
+	t.Run("accumulated data too large", func(t *testing.T) {
+		line := "data: " + strings.Repeat("x", 20) + "\n"
+		dec := sse.NewDecoderSize(strings.NewReader(line+line+"\n"), 32)
+		_, err := dec.Decode()
+		assert.Equal(t, sse.ErrEventTooLarge, err)
+	})
+}
+
+func TestDecoder_SkipsOversizedEvents(t *testing.T) {
+	big := strings.Repeat("x", 64)
+	for name, input := range map[string]string{
+		"single line too long":       "id: 1\ndata: ok\n\nid: 2\ndata: " + big + "\ndata: more\n\nid: 3\ndata: next\n\n",
+		"accumulated data too large": "id: 1\ndata: ok\n\nid: 2\ndata: " + big[:20] + "\ndata: " + big[:20] + "\n\nid: 3\ndata: next\n\n",
+		"line split across reads":    "id: 1\ndata: ok\r\n\r\nid: 2\r\ndata: " + big + big + "\r\n\r\nid: 3\r\ndata: next\r\n\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dec := sse.NewDecoderSize(iotest.OneByteReader(strings.NewReader(input)), 32)
+
+			ev, err := dec.Decode()
+			assert.NoError(t, err)
+			assert.Equal(t, sse.Event{ID: "1", Type: "message", Data: "ok"}, ev)
+
+			ev, err = dec.Decode()
+			assert.Equal(t, sse.ErrEventTooLarge, err)
+			assert.Equal(t, "2", ev.ID)
+
+			ev, err = dec.Decode()
+			assert.NoError(t, err)
+			assert.Equal(t, sse.Event{ID: "3", Type: "message", Data: "next"}, ev)
+
+			_, err = dec.Decode()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+}
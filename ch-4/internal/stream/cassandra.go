@@ -4,13 +4,23 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/gocql/gocql"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-4/internal/hll"
 )
 
+// sketchFlushInterval is how often the users seen since the last flush are
+// merged into the stored sketch.
+const sketchFlushInterval = 5 * time.Second
+
 type CassandraStats struct {
 	session *gocql.Session
+
+	mu sync.Mutex
+	// users are the users recorded since the last flush.
+	users *hll.Sketch
 }
 
 func NewCassandraStats(host string) (*CassandraStats, error) {
@@ -27,7 +37,9 @@ func NewCassandraStats(host string) (*CassandraStats, error) {
 		session, err = cluster.CreateSession()
 		if err == nil {
 			log.Printf("Connected to Cassandra on attempt %d", i+1)
-			return &CassandraStats{session: session}, nil
+			cs := &CassandraStats{session: session, users: hll.New()}
+			go cs.flushUsersEvery(sketchFlushInterval)
+			return cs, nil
 		}
 
 		log.Printf("Waiting for Cassandra (%d/10): %v", i+1, err)
@@ -38,6 +50,10 @@ func NewCassandraStats(host string) (*CassandraStats, error) {
 }
 
 func (cs *CassandraStats) Record(ev ChangeEvent) {
+	cs.mu.Lock()
+	cs.users.Add(ev.User)
+	cs.mu.Unlock()
+
 	go func() {
 		ctx := context.Background()
 
@@ -55,10 +71,6 @@ func (cs *CassandraStats) Record(ev ChangeEvent) {
 			}
 		}
 
-		if err := cs.session.Query(`INSERT INTO unique_users (username) VALUES (?)`, ev.User).WithContext(ctx).Exec(); err != nil {
-			log.Printf("error inserting unique_user: %v", err)
-		}
-
 		if err := cs.session.Query(`UPDATE server_counts SET count = count + 1 WHERE server_url = ?`, ev.ServerURL).WithContext(ctx).Exec(); err != nil {
 			log.Printf("error updating server_counts: %v", err)
 		}
@@ -73,17 +85,16 @@ func (cs *CassandraStats) GetSnapshot() StatsSnapshot {
 		log.Printf("error fetching summary: %v", err)
 	}
 
-	iter := cs.session.Query(`SELECT username FROM unique_users`).WithContext(ctx).Iter()
-	totalUsers := 0
-	for iter.Scan(new(string)) {
-		totalUsers++
+	users, _, err := cs.readUserSketch(ctx)
+	if err != nil {
+		log.Printf("error fetching user_sketches: %v", err)
 	}
-	if err := iter.Close(); err != nil {
-		log.Printf("error closing iterator for unique_users: %v", err)
+	if users == nil {
+		users = hll.New()
 	}
 
 	serverCounts := make(map[string]int)
-	iter = cs.session.Query(`SELECT server_url, count FROM server_counts`).WithContext(ctx).Iter()
+	iter := cs.session.Query(`SELECT server_url, count FROM server_counts`).WithContext(ctx).Iter()
 	var url string
 	var count int
 	for iter.Scan(&url, &count) {
@@ -94,10 +105,98 @@ func (cs *CassandraStats) GetSnapshot() StatsSnapshot {
 	}
 
 	return StatsSnapshot{
-		Messages:      total,
-		DistinctUsers: totalUsers,
-		Bots:          bots,
-		NonBots:       nonBots,
-		ByServer:      serverCounts,
+		Messages:              total,
+		DistinctUsers:         int(users.Estimate()),
+		DistinctUsersStdError: users.StdError(),
+		Bots:                  bots,
+		NonBots:               nonBots,
+		ByServer:              serverCounts,
+	}
+}
+
+// flushUsersEvery merges the users recorded since the last flush into the
+// stored sketch every interval, so the shared row sees one conditional write
+// per interval rather than one per event. Users that fail to merge are kept
+// for the next flush; merging them twice is harmless.
+func (cs *CassandraStats) flushUsersEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		cs.mu.Lock()
+		users := cs.users
+		cs.users = hll.New()
+		cs.mu.Unlock()
+		if users.Estimate() == 0 {
+			continue
+		}
+
+		if err := cs.mergeUserSketch(context.Background(), users); err != nil {
+			log.Printf("error merging user_sketches, will retry: %v", err)
+			cs.mu.Lock()
+			if err := cs.users.Merge(users); err != nil {
+				log.Printf("error keeping users for the next flush: %v", err)
+			}
+			cs.mu.Unlock()
+		}
+	}
+}
+
+// maxSketchMergeAttempts bounds the compare-and-set retries when other
+// writers keep winning the race for the sketch row.
+const maxSketchMergeAttempts = 5
+
+// mergeUserSketch folds local into the stored distinct-users sketch with a
+// read, merge and conditional write, retrying when another writer got there
+// first.
+func (cs *CassandraStats) mergeUserSketch(ctx context.Context, local *hll.Sketch) error {
+	for attempt := 0; attempt < maxSketchMergeAttempts; attempt++ {
+		stored, current, err := cs.readUserSketch(ctx)
+		if err != nil {
+			return err
+		}
+
+		merged := local
+		if stored != nil {
+			merged = stored
+			if err := merged.Merge(local); err != nil {
+				return err
+			}
+		}
+		blob, err := merged.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		var q *gocql.Query
+		if current == nil {
+			q = cs.session.Query(`INSERT INTO user_sketches (id, sketch) VALUES ('global', ?) IF NOT EXISTS`, blob)
+		} else {
+			q = cs.session.Query(`UPDATE user_sketches SET sketch = ? WHERE id = 'global' IF sketch = ?`, blob, current)
+		}
+		applied, err := q.WithContext(ctx).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+		if applied {
+			return nil
+		}
+	}
+	return fmt.Errorf("user_sketches: gave up after %d conflicting writes", maxSketchMergeAttempts)
+}
+
+// readUserSketch returns the stored sketch and its raw blob, or nils if it
+// has not been written yet.
+func (cs *CassandraStats) readUserSketch(ctx context.Context) (*hll.Sketch, []byte, error) {
+	var blob []byte
+	err := cs.session.Query(`SELECT sketch FROM user_sketches WHERE id = 'global'`).WithContext(ctx).Scan(&blob)
+	if err == gocql.ErrNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sketch hll.Sketch
+	if err := sketch.UnmarshalBinary(blob); err != nil {
+		return nil, nil, err
 	}
+	return &sketch, blob, nil
 }
@@ -23,7 +23,9 @@ func (m *mockStatsStore) GetSnapshot() StatsSnapshot {
 
 func TestWikipediaClient_Connect(t *testing.T) {
 	fakeData := `data: {"user":"bob","bot":false,"server_url":"en.wikipedia.org"}
-data: {"user":"alice","bot":true,"server_url":"fr.wikipedia.org"}`
+
+data: {"user":"alice","bot":true,"server_url":"fr.wikipedia.org"}
+`
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/event-stream")
@@ -58,7 +60,7 @@ func TestWikipediaClient_Connect_ErrorPaths(t *testing.T) {
 	})
 
 	t.Run("Unmarshal error for invalid JSON", func(t *testing.T) {
-		fakeData := `data: {invalid json`
+		fakeData := "data: {invalid json\n"
 
 		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "text/event-stream")
@@ -76,19 +78,31 @@ func TestWikipediaClient_Connect_ErrorPaths(t *testing.T) {
 }
 
 func TestWikipediaClient_Connect_IgnoresNonDataLines(t *testing.T) {
-	fakeData := `event: ping`
-
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/event-stream")
-		_, _ = w.Write([]byte(fakeData + "\n"))
-	}))
-	defer ts.Close()
-
-	mockStore := &mockStatsStore{}
-	client := NewWikipediaClient(mockStore, ts.URL)
-
-	err := client.Connect()
-	assert.NoError(t, err)
-
-	assert.Len(t, mockStore.Recorded, 0)
+	// Each fixture ends with a message from alice, so a test that records
+	// nothing at all fails rather than passing by accident.
+	tests := map[string]string{
+		"non-message event type": "event: ping\ndata: {\"user\":\"bob\"}\n\n" +
+			"data: {\"user\":\"alice\"}\n\n",
+		"comments and unknown fields": ": keep-alive\nevent: ping\nfoo: bar\n\n" +
+			"data: {\"user\":\"alice\"}\n\n",
+	}
+	for name, fakeData := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				_, _ = w.Write([]byte(fakeData))
+			}))
+			defer ts.Close()
+
+			mockStore := &mockStatsStore{}
+			client := NewWikipediaClient(mockStore, ts.URL)
+
+			err := client.Connect()
+			assert.NoError(t, err)
+
+			if assert.Len(t, mockStore.Recorded, 1) {
+				assert.Equal(t, "alice", mockStore.Recorded[0].User)
+			}
+		})
+	}
 }
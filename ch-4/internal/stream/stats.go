@@ -2,14 +2,19 @@ package stream
 
 import (
 	"sync"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-4/internal/hll"
 )
 
 type StatsSnapshot struct {
-	Messages      int            `json:"messages"`
-	DistinctUsers int            `json:"distinct_users"`
-	Bots          int            `json:"bots"`
-	NonBots       int            `json:"non_bots"`
-	ByServer      map[string]int `json:"by_server_url"`
+	Messages int `json:"messages"`
+	// DistinctUsers is a HyperLogLog estimate; DistinctUsersStdError is its
+	// relative standard error, e.g. 0.0081 for ±0.81%.
+	DistinctUsers         int            `json:"distinct_users"`
+	DistinctUsersStdError float64        `json:"distinct_users_std_error"`
+	Bots                  int            `json:"bots"`
+	NonBots               int            `json:"non_bots"`
+	ByServer              map[string]int `json:"by_server_url"`
 }
 
 type StatsStore interface {
@@ -17,11 +22,10 @@ type StatsStore interface {
 	GetSnapshot() StatsSnapshot
 }
 
-
 type Stats struct {
 	mu           sync.RWMutex
 	Total        int
-	Users        map[string]struct{}
+	Users        *hll.Sketch
 	BotCount     int
 	NonBotCount  int
 	ServerCounts map[string]int
@@ -29,7 +33,7 @@ type Stats struct {
 
 func NewStats() *Stats {
 	return &Stats{
-		Users:        make(map[string]struct{}),
+		Users:        hll.New(),
 		ServerCounts: make(map[string]int),
 	}
 }
@@ -39,7 +43,7 @@ func (s *Stats) Record(ev ChangeEvent) {
 	defer s.mu.Unlock()
 
 	s.Total++
-	s.Users[ev.User] = struct{}{}
+	s.Users.Add(ev.User)
 	if ev.Bot {
 		s.BotCount++
 	} else {
@@ -53,10 +57,11 @@ func (s *Stats) GetSnapshot() StatsSnapshot {
 	defer s.mu.RUnlock()
 
 	return StatsSnapshot{
-		Messages:      s.Total,
-		DistinctUsers: len(s.Users),
-		Bots:          s.BotCount,
-		NonBots:       s.NonBotCount,
-		ByServer:      s.ServerCounts,
+		Messages:              s.Total,
+		DistinctUsers:         int(s.Users.Estimate()),
+		DistinctUsersStdError: s.Users.StdError(),
+		Bots:                  s.BotCount,
+		NonBots:               s.NonBotCount,
+		ByServer:              s.ServerCounts,
 	}
 }
@@ -1,14 +1,15 @@
 package stream
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-5/internal/sse"
 	"github.com/twmb/franz-go/pkg/kgo"
 )
 
@@ -53,20 +54,32 @@ func StreamWikipediaEvents(ctx context.Context, broker string, wikipediaURL stri
 
 	log.Println("Connected to Wikipedia stream. Streaming events...")
 
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
+	dec := sse.NewDecoder(resp.Body)
+	for {
+		msg, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, sse.ErrEventTooLarge) {
+			log.Printf("skipping event: %v", err)
+			continue
+		}
+		if err != nil {
+			log.Printf("error reading stream: %v", err)
+			break
+		}
+
 		select {
 		case <-ctx.Done():
 			log.Println("Producer shutting down...")
 			return nil
 		default:
-			line := scanner.Text()
-			if !strings.HasPrefix(line, "data: ") {
+			if msg.Type != "message" {
 				continue
 			}
 
 			var raw map[string]interface{}
-			if err := json.Unmarshal([]byte(line[6:]), &raw); err != nil {
+			if err := json.Unmarshal([]byte(msg.Data), &raw); err != nil {
 				log.Printf("skipping malformed event: %v", err)
 				continue
 			}
@@ -111,9 +124,5 @@ func StreamWikipediaEvents(ctx context.Context, broker string, wikipediaURL stri
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("error reading stream: %v", err)
-	}
-
 	return nil
 }
@@ -47,7 +47,7 @@ func TestStreamWikipediaEvents_Success(t *testing.T) {
 	}
 	eventJSON, _ := json.Marshal(event)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "data: %s\n", eventJSON)
+		fmt.Fprintf(w, "data: %s\n\n", eventJSON)
 	}))
 	defer ts.Close()
 
@@ -72,7 +72,7 @@ func TestStreamWikipediaEvents_ProduceError(t *testing.T) {
 	eventJSON, _ := json.Marshal(event)
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "data: %s\n", eventJSON)
+		fmt.Fprintf(w, "data: %s\n\n", eventJSON)
 	}))
 	defer ts.Close()
 
@@ -86,7 +86,7 @@ func TestStreamWikipediaEvents_ProduceError(t *testing.T) {
 
 func TestStreamWikipediaEvents_MalformedJSON(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprint(w, "data: {bad json}\n")
+		fmt.Fprint(w, "data: {bad json}\n\n")
 	}))
 	defer ts.Close()
 
@@ -109,7 +109,7 @@ func TestStreamWikipediaEvents_BadConnection(t *testing.T) {
 func TestStreamWikipediaEvents_GracefulShutdown(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(100 * time.Millisecond)
-		fmt.Fprint(w, "data: {}\n")
+		fmt.Fprint(w, "data: {}\n\n")
 	}))
 	defer ts.Close()
 
@@ -129,7 +129,7 @@ func TestStreamWikipediaEvents_ShutdownMidScan(t *testing.T) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "data: %s\n", data)
+		fmt.Fprintf(w, "data: %s\n\n", data)
 		time.AfterFunc(50*time.Millisecond, cancel)
 	}))
 	defer ts.Close()
@@ -146,7 +146,7 @@ func TestStreamWikipediaEvents_MissingMeta(t *testing.T) {
 	data, _ := json.Marshal(payload)
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "data: %s\n", data)
+		fmt.Fprintf(w, "data: %s\n\n", data)
 	}))
 	defer ts.Close()
 
@@ -163,7 +163,7 @@ func TestStreamWikipediaEvents_IncompleteFields(t *testing.T) {
 	data, _ := json.Marshal(payload)
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "data: %s\n", data)
+		fmt.Fprintf(w, "data: %s\n\n", data)
 	}))
 	defer ts.Close()
 
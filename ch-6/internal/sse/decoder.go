@@ -0,0 +1,243 @@
+// Package sse implements a Server-Sent Events decoder following the WHATWG
+// "text/event-stream" interpretation rules.
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxEventSize bounds a single line and the accumulated data of one
+// event. Wikimedia RecentChange payloads are well below this.
+const DefaultMaxEventSize = 1 << 20
+
+// ErrEventTooLarge is returned by Decode for an event with a line or data
+// larger than the configured maximum. The event has been read and dropped,
+// so decoding can carry on with the next one.
+var ErrEventTooLarge = errors.New("sse: event exceeds maximum size")
+
+// Event is a single dispatched Server-Sent Event.
+type Event struct {
+	// ID is the stream's last event ID at dispatch time. Per the spec it
+	// carries over from earlier events when this one has no id field.
+	ID string
+	// Type is the event type, "message" unless an event field said otherwise.
+	Type string
+	// Data is the event payload; multiple data lines are joined with "\n".
+	Data string
+}
+
+// Decoder reads events from an event stream.
+type Decoder struct {
+	scanner      *bufio.Scanner
+	maxEventSize int
+	firstLine    bool
+
+	lastID    string
+	retry     time.Duration
+	eventType string
+	data      bytes.Buffer
+
+	// discarding is set while the rest of an over-long line is skipped, and
+	// lineTooLong once it has been. oversized marks the current event as
+	// too large; it is dropped when it ends.
+	discarding  bool
+	lineTooLong bool
+	oversized   bool
+	// skipLF swallows the LF of a CRLF split across two reads.
+	skipLF bool
+}
+
+// NewDecoder returns a decoder reading from r with DefaultMaxEventSize.
+func NewDecoder(r io.Reader) *Decoder {
+	return NewDecoderSize(r, DefaultMaxEventSize)
+}
+
+// NewDecoderSize returns a decoder that rejects lines and events larger than
+// maxEventSize bytes.
+func NewDecoderSize(r io.Reader, maxEventSize int) *Decoder {
+	d := &Decoder{
+		scanner:      bufio.NewScanner(r),
+		maxEventSize: maxEventSize,
+		firstLine:    true,
+	}
+	d.scanner.Buffer(make([]byte, 0, min(64*1024, maxEventSize+1)), maxEventSize+1)
+	d.scanner.Split(d.scanLines)
+	return d
+}
+
+// Decode returns the next dispatched event. It returns io.EOF once the
+// stream ends; a trailing event without its terminating blank line is
+// discarded, as the spec requires. An event that is too large is read to
+// its end and dropped, then reported as ErrEventTooLarge with only its ID
+// set, so the caller can resume after it.
+func (d *Decoder) Decode() (Event, error) {
+	for d.scanner.Scan() {
+		if d.lineTooLong {
+			d.lineTooLong = false
+			d.firstLine = false
+			d.oversized = true
+			continue
+		}
+		line := d.scanner.Text()
+		if d.firstLine {
+			line = strings.TrimPrefix(line, "\ufeff")
+			d.firstLine = false
+		}
+
+		if line == "" {
+			if d.oversized {
+				d.reset()
+				return Event{ID: d.lastID}, ErrEventTooLarge
+			}
+			if ev, ok := d.dispatch(); ok {
+				return ev, nil
+			}
+			continue
+		}
+
+		d.processLine(line)
+	}
+
+	if err := d.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
+
+// LastEventID returns the last event ID seen on the stream, which is what a
+// client should send as Last-Event-ID when reconnecting.
+func (d *Decoder) LastEventID() string {
+	return d.lastID
+}
+
+// Retry returns the most recent reconnection time requested by the server,
+// or zero if none was sent.
+func (d *Decoder) Retry() time.Duration {
+	return d.retry
+}
+
+func (d *Decoder) processLine(line string) {
+	if strings.HasPrefix(line, ":") {
+		return // comment
+	}
+
+	field, value := line, ""
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		field, value = line[:i], line[i+1:]
+		value = strings.TrimPrefix(value, " ")
+	}
+
+	switch field {
+	case "event":
+		d.eventType = value
+	case "data":
+		if d.oversized {
+			return
+		}
+		if d.data.Len()+len(value)+1 > d.maxEventSize {
+			d.oversized = true
+			d.data.Reset()
+			return
+		}
+		d.data.WriteString(value)
+		d.data.WriteByte('\n')
+	case "id":
+		if !strings.ContainsRune(value, 0) {
+			d.lastID = value
+		}
+	case "retry":
+		if !isDigits(value) {
+			return
+		}
+		if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+			d.retry = time.Duration(ms) * time.Millisecond
+		}
+	}
+}
+
+// reset clears the event being built.
+func (d *Decoder) reset() {
+	d.data.Reset()
+	d.eventType = ""
+	d.oversized = false
+}
+
+func (d *Decoder) dispatch() (Event, bool) {
+	defer d.reset()
+
+	if d.data.Len() == 0 {
+		return Event{}, false
+	}
+
+	data := d.data.String()
+	ev := Event{
+		ID:   d.lastID,
+		Type: d.eventType,
+		Data: data[:len(data)-1],
+	}
+	if ev.Type == "" {
+		ev.Type = "message"
+	}
+	return ev, true
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// scanLines splits on LF, CRLF or a lone CR, the three line endings the
+// event-stream format allows. A line longer than maxEventSize is skipped
+// rather than failing the scanner: its bytes are dropped as they arrive and
+// lineTooLong is set when it ends.
+func (d *Decoder) scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if d.skipLF {
+		d.skipLF = false
+		if data[0] == '\n' {
+			return 1, nil, nil
+		}
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		end := i + 1
+		if data[i] == '\r' {
+			// A CR may be followed by an LF we haven't read yet.
+			switch {
+			case i+1 < len(data):
+				if data[i+1] == '\n' {
+					end = i + 2
+				}
+			case !atEOF && !d.discarding && len(data) <= d.maxEventSize:
+				return 0, nil, nil
+			default:
+				d.skipLF = !atEOF
+			}
+		}
+		if d.discarding {
+			d.discarding = false
+			d.lineTooLong = true
+			return end, data[:0], nil
+		}
+		return end, data[:i], nil
+	}
+	if d.discarding || len(data) > d.maxEventSize {
+		d.discarding = !atEOF
+		return len(data), nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
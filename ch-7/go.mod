@@ -2,7 +2,10 @@ module github.com/joshua-daniels-red/go-backend-challenge/ch-7
 
 go 1.24.3
 
-require github.com/twmb/franz-go v1.19.4
+require (
+	github.com/prometheus/client_golang v1.22.0
+	github.com/twmb/franz-go v1.19.4
+)
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
@@ -12,7 +15,6 @@ require (
 	github.com/hailocab/go-hostpool v0.0.0-20160125115350-e80d13ce29ed // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/prometheus/client_golang v1.22.0 // indirect
 	github.com/prometheus/client_model v0.6.1 // indirect
 	github.com/prometheus/common v0.62.0 // indirect
 	github.com/prometheus/procfs v0.15.1 // indirect
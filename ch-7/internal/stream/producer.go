@@ -1,14 +1,15 @@
 package stream
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-7/internal/sse"
 	pb "github.com/joshua-daniels-red/go-backend-challenge/ch-7/proto"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"google.golang.org/protobuf/proto"
@@ -72,9 +73,21 @@ func StreamWikipediaEvents(ctx context.Context, broker string, wikipediaURL stri
 	defer resp.Body.Close()
 
 	log.Println("🌐 Connected to Wikipedia stream. Streaming events...")
-	scanner := bufio.NewScanner(resp.Body)
+	dec := sse.NewDecoder(resp.Body)
+	for {
+		msg, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, sse.ErrEventTooLarge) {
+			log.Printf("skipping event: %v", err)
+			continue
+		}
+		if err != nil {
+			log.Printf("error reading stream: %v", err)
+			break
+		}
 
-	for scanner.Scan() {
 		select {
 		case <-ctx.Done():
 			log.Println("🛑 Context cancelled, flushing pending messages before shutdown...")
@@ -82,14 +95,12 @@ func StreamWikipediaEvents(ctx context.Context, broker string, wikipediaURL stri
 			log.Println("✅ Producer flushed and shutting down.")
 			return nil
 		default:
-			line := scanner.Text()
-
-			if !strings.HasPrefix(line, "data: ") {
+			if msg.Type != "message" {
 				continue
 			}
 
 			var raw map[string]interface{}
-			if err := json.Unmarshal([]byte(line[6:]), &raw); err != nil {
+			if err := json.Unmarshal([]byte(msg.Data), &raw); err != nil {
 				log.Printf("❌ Skipping malformed JSON event: %v", err)
 				continue
 			}
@@ -145,9 +156,5 @@ func StreamWikipediaEvents(ctx context.Context, broker string, wikipediaURL stri
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("error reading stream: %v", err)
-	}
-
 	return nil
 }
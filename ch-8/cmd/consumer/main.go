@@ -3,29 +3,46 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"sync"
+	"strconv"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gocql/gocql"
 	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/config"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/health"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/registry"
 	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
-	pb "github.com/joshua-daniels-red/go-backend-challenge/ch-8/proto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kgo"
-	"google.golang.org/protobuf/proto"
+	"github.com/twmb/franz-go/pkg/kmsg"
 )
 
+// consumerClient is the subset of *kgo.Client the consume loop needs.
+type consumerClient interface {
+	PollFetches(ctx context.Context) kgo.Fetches
+	AllowRebalance()
+	PauseFetchPartitions(partitions map[string][]int32) map[string][]int32
+	ResumeFetchPartitions(partitions map[string][]int32)
+	ProduceSync(ctx context.Context, rs ...*kgo.Record) kgo.ProduceResults
+	CommitOffsetsSync(ctx context.Context, offsets map[string]map[int32]kgo.EpochOffset,
+		onDone func(*kgo.Client, *kmsg.OffsetCommitRequest, *kmsg.OffsetCommitResponse, error))
+}
+
 var (
-	configLoadFunc           = config.Load
-	newKafkaClientFunc       = kgo.NewClient
-	newCassandraSessionFn    = defaultCassandraSessionFn
-	streamWikipediaHandlerFn = http.ListenAndServe
+	configLoadFunc        = loadConfig
+	newKafkaClientFunc    = kgo.NewClient
+	newCassandraSessionFn = defaultCassandraSessionFn
+	listenAndServeFunc    = (*http.Server).ListenAndServe
 )
 
 func main() {
@@ -34,6 +51,11 @@ func main() {
 	}
 }
 
+// run consumes until SIGINT or SIGTERM, then shuts down in order within
+// SHUTDOWN_TIMEOUT: it stops polling, drains the worker queues, flushes and
+// commits what the workers hold, shuts the HTTP servers down and closes the
+// Cassandra session and the Kafka client. Most of that runs in defers, so
+// it unwinds in reverse order of setup.
 func run() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -42,123 +64,576 @@ func run() error {
 	go handleShutdown(cancel, sigCh)
 
 	cfg, err := configLoadFunc()
+	if errors.Is(err, config.ErrPrinted) || errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
+	stopCtx, stopCancel := shutdownContext(ctx, cfg.ShutdownTimeout)
+	defer stopCancel()
 
-	log.Printf("📥 CONSUMER TOPIC: %s", cfg.WikipediaTopic)
-
-	client, err := newKafkaClientFunc(
+	hooks := &rebalanceHooks{}
+	client, err := newKafkaClientFunc(append(topicOptions(cfg),
 		kgo.SeedBrokers(cfg.RedpandaBroker),
-		kgo.ConsumeTopics(cfg.WikipediaTopic),
-		kgo.ConsumerGroup("wikipedia-consumer-group"),
+		kgo.ConsumerGroup(cfg.GroupID),
+		// Offsets are committed by the batcher once events are durable.
+		kgo.DisableAutoCommit(),
+		// Rebalances wait until polled records are dispatched, so a revoke
+		// can flush everything this member took from the partition.
+		kgo.BlockRebalanceOnPoll(),
+		kgo.OnPartitionsAssigned(hooks.assigned),
+		kgo.OnPartitionsRevoked(hooks.revoked),
+		kgo.OnPartitionsLost(hooks.lost),
 		kgo.MaxConcurrentFetches(5),
-	)
+	)...)
 	if err != nil {
 		return fmt.Errorf("failed to create Kafka client: %w", err)
 	}
-	defer client.Close()
+	defer func() {
+		// On an early return ctx is still live; cancelling it starts the
+		// shutdown deadline. Leaving the group revokes our partitions,
+		// which is a no-op once the pool has drained and committed.
+		cancel()
+		if err := client.LeaveGroupContext(stopCtx); err != nil {
+			log.Printf("⚠️ Failed to leave the consumer group cleanly: %v", err)
+		}
+		client.Close()
+		log.Println("🔌 Kafka client closed")
+	}()
 
 	var store stream.StatsStore
+	var session stream.Session
 	if cfg.Storage == "cassandra" {
-		sess, err := newCassandraSessionFn()
+		sess, err := newCassandraSessionFn(cfg)
 		if err != nil {
 			return fmt.Errorf("failed to connect to Cassandra: %w", err)
 		}
-		defer sess.Close()
-		store = stream.NewCassandraStats(stream.NewCassandraSessionAdapter(sess))
+		defer func() {
+			sess.Close()
+			log.Println("🔌 Cassandra session closed")
+		}()
+		session = stream.NewCassandraSessionAdapter(sess)
+		cassandraStats := stream.NewCassandraStats(session)
+		go cassandraStats.Run(ctx)
+		// Runs once the pool has drained, before the session closes.
+		defer func() {
+			if err := cassandraStats.FlushSketches(stopCtx); err != nil {
+				log.Printf("⚠️ Failed to write distinct-user sketches: %v", err)
+			}
+		}()
+		store = cassandraStats
 	} else {
 		store = stream.NewInMemoryStats()
 	}
+	topK := stream.NewTopKStats(store, cfg.TopKCapacity)
+	store = topK
 
 	// Register Prometheus metrics
 	stream.RegisterMetrics()
-	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		log.Println("📊 Prometheus metrics available at :2112/metrics")
-		log.Fatal(http.ListenAndServe(":2112", nil))
-	}()
+	metrics := http.NewServeMux()
+	metrics.Handle("/metrics", promhttp.Handler())
+	metricsServer := startServer("Prometheus metrics", cfg.MetricsAddr, metrics)
 
-	// Stats endpoint
-	go func() {
-		http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			if err := json.NewEncoder(w).Encode(store.GetSnapshot()); err != nil {
-				http.Error(w, "failed to encode stats", http.StatusInternalServerError)
-			}
+	// Stats and health endpoints
+	checker := health.NewChecker().
+		WithCheck("kafka", client.Ping).
+		WithCheck("consumer_group", groupCheck(client, cfg.GroupID))
+	if session != nil {
+		checker.WithCheck("cassandra", func(ctx context.Context) error {
+			return stream.PingCassandra(ctx, session)
 		})
-		log.Println("HTTP server listening on :8080")
-		if err := streamWikipediaHandlerFn(":8080", nil); err != nil {
-			log.Printf("HTTP server error: %v", err)
+	}
+	statsServer := startServer("Stats", cfg.StatsAddr, newStatsMux(store, topK, checker))
+
+	defer func() {
+		if err := shutdownServers(stopCtx, statsServer, metricsServer); err != nil {
+			log.Printf("⚠️ HTTP servers did not shut down cleanly: %v", err)
 		}
 	}()
 
-	// Multithreaded Kafka consumers
-	numWorkers := 3 // or get from os.Getenv("NUM_CONSUMERS")
-	var wg sync.WaitGroup
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func(id int) {
-			defer wg.Done()
-			log.Printf("🧵 Worker %d started", id)
-			runConsumerLoop(ctx, client, store)
-			log.Printf("🧵 Worker %d exited", id)
-		}(i + 1)
+	deduplicator, err := newDeduplicator(cfg, session)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
 	}
 
-	wg.Wait()
+	log.Printf("🧵 Group %s dispatching to %d workers by %s", cfg.GroupID, cfg.Workers, cfg.DispatchKey)
+	pool := newWorkerPool(cfg, client, store, deduplicator)
+	hooks.setPool(pool)
+	runConsumerLoop(ctx, client, pool, newDecoder(cfg), newDeadLetterQueue(client, cfg.DeadLetterTopic), cfg.ShutdownTimeout)
 	log.Println("All workers shut down gracefully")
 	return nil
 }
 
-func runConsumerLoop(ctx context.Context, client *kgo.Client, store stream.StatsStore) {
-	batcher := stream.NewBatcher(store, 20, 5*time.Second)
-	batcher.Start(ctx)
-	defer batcher.Stop()
+// errShutdownTimeout is the cause of a shutdown context's cancellation.
+var errShutdownTimeout = errors.New("shutdown deadline exceeded")
+
+// shutdownContext returns a context that is cancelled timeout after ctx is,
+// for the steps that run once ctx has been cancelled. Every step shares the
+// one deadline, however long the earlier ones took.
+func shutdownContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	stopCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(timeout, func() { cancel(errShutdownTimeout) })
+	})
+	return stopCtx, func() {
+		stop()
+		cancel(context.Canceled)
+	}
+}
+
+// newStatsMux serves the stats, /healthz and /readyz.
+func newStatsMux(store stream.StatsStore, topK *stream.TopKStats, checker *health.Checker) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", statsHandler(store))
+	mux.HandleFunc("/stats/top/users", topHandler(topK, stream.TopUsers))
+	mux.HandleFunc("/stats/top/domains", topHandler(topK, stream.TopDomains))
+	checker.Register(mux)
+	return mux
+}
+
+// groupMember is the part of *kgo.Client that reports group membership.
+type groupMember interface {
+	GroupMetadata() (memberID string, generation int32)
+}
+
+// groupCheck fails until the client has joined group and been given a
+// generation, i.e. until it can be assigned partitions.
+func groupCheck(client groupMember, group string) health.Check {
+	return func(context.Context) error {
+		if member, generation := client.GroupMetadata(); member == "" || generation < 0 {
+			return fmt.Errorf("not a member of group %s yet", group)
+		}
+		return nil
+	}
+}
+
+// startServer serves handler on addr in the background until it is shut
+// down.
+func startServer(name, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	listen := listenAndServeFunc
+	go func() {
+		log.Printf("🌐 %s server listening on %s", name, addr)
+		if err := listen(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("❌ %s server error: %v", name, err)
+		}
+	}()
+	return srv
+}
+
+// shutdownServers stops the servers accepting connections and waits for
+// requests in progress, until ctx is done.
+func shutdownServers(ctx context.Context, servers ...*http.Server) error {
+	var errs []error
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", srv.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// topicOptions subscribes to cfg.ConsumerTopicRegex if it is set, which
+// picks up matching topics as they are created, or else to WikipediaTopic.
+func topicOptions(cfg *config.Config) []kgo.Opt {
+	if cfg.ConsumerTopicRegex != "" {
+		log.Printf("📥 CONSUMER TOPICS: /%s/ (dead letters to %s)", cfg.ConsumerTopicRegex, cfg.DeadLetterTopic)
+		return []kgo.Opt{kgo.ConsumeRegex(), kgo.ConsumeTopics(cfg.ConsumerTopicRegex)}
+	}
+	log.Printf("📥 CONSUMER TOPIC: %s (dead letters to %s)", cfg.WikipediaTopic, cfg.DeadLetterTopic)
+	return []kgo.Opt{kgo.ConsumeTopics(cfg.WikipediaTopic)}
+}
+
+// newWorkerPool builds the pool cfg describes. Validate has already
+// checked DISPATCH_KEY. dedup, when set, skips events whose id was already
+// counted.
+func newWorkerPool(cfg *config.Config, client consumerClient, store stream.StatsStore, dedup stream.Deduplicator) *stream.WorkerPool {
+	pool := stream.NewWorkerPool(store, cfg.Workers, cfg.BatchSize, cfg.FlushInterval).
+		WithDispatchKey(stream.DispatchKey(cfg.DispatchKey)).
+		WithBufferLimits(cfg.BatchMaxEvents, cfg.BatchMaxBytes).
+		WithMaxInFlightFlushes(cfg.BatchMaxInFlight).
+		WithCommitter(commitOffsetsFunc(client))
+	if dedup != nil {
+		pool.WithDeduplicator(dedup)
+	}
+	return pool
+}
+
+// newDecoder reads every event format; with a schema registry it also
+// reads framed records.
+func newDecoder(cfg *config.Config) *stream.Decoder {
+	decoder := stream.NewDecoder()
+	if cfg.SchemaRegistryURL != "" {
+		decoder.WithSchemaRegistry(registry.NewClient(cfg.SchemaRegistryURL).
+			WithHTTPClient(&http.Client{Timeout: 10 * time.Second}))
+	}
+	return decoder
+}
+
+// newDeduplicator builds the configured dedup layer. The Cassandra store
+// needs a session, so it is only available with Cassandra storage.
+func newDeduplicator(cfg *config.Config, session stream.Session) (stream.Deduplicator, error) {
+	switch cfg.DedupStore {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		return stream.NewSeenSet(cfg.DedupCapacity, cfg.DedupWindow), nil
+	case "cassandra":
+		if session == nil {
+			return nil, fmt.Errorf("DEDUP_STORE=cassandra requires STORAGE=cassandra")
+		}
+		return stream.NewTieredDeduplicator(
+			stream.NewSeenSet(cfg.DedupCapacity, cfg.DedupWindow),
+			stream.NewCassandraDeduplicator(session, cfg.DedupTTL),
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown dedup store %q", cfg.DedupStore)
+	}
+}
+
+// newDeadLetterQueue publishes dead letters with the consuming client, which
+// can produce to any topic.
+func newDeadLetterQueue(client consumerClient, topic string) *stream.DeadLetterQueue {
+	return stream.NewDeadLetterQueue(topic, func(ctx context.Context, record *kgo.Record) error {
+		return client.ProduceSync(ctx, record).FirstErr()
+	})
+}
+
+// rebalanceHooks connects the group's rebalance callbacks to the worker
+// pool. The client may call them before the pool exists or after it has
+// drained; both are no-ops.
+type rebalanceHooks struct {
+	pool atomic.Pointer[stream.WorkerPool]
+}
+
+func (h *rebalanceHooks) setPool(pool *stream.WorkerPool) {
+	h.pool.Store(pool)
+}
+
+func (h *rebalanceHooks) assigned(_ context.Context, _ *kgo.Client, partitions map[string][]int32) {
+	log.Printf("➕ Partitions assigned: %v", partitions)
+	if pool := h.pool.Load(); pool != nil {
+		pool.Forget(partitions)
+	}
+}
+
+// revoked flushes and commits before returning, because the next owner
+// starts from the committed offset as soon as the revoke completes.
+func (h *rebalanceHooks) revoked(ctx context.Context, _ *kgo.Client, partitions map[string][]int32) {
+	log.Printf("➖ Partitions revoked: %v", partitions)
+	if pool := h.pool.Load(); pool != nil {
+		if err := pool.Revoke(ctx, partitions); err != nil {
+			log.Printf("❌ Flush before revoke failed, new owner may recount events: %v", err)
+		}
+	}
+}
+
+// lost partitions already belong to someone else, so there is nothing left
+// to commit for them.
+func (h *rebalanceHooks) lost(_ context.Context, _ *kgo.Client, partitions map[string][]int32) {
+	log.Printf("⚠️ Partitions lost: %v", partitions)
+	if pool := h.pool.Load(); pool != nil {
+		pool.Forget(partitions)
+	}
+}
 
-	var uncommitted []*kgo.Record
+// runConsumerLoop is the only caller of PollFetches. It decodes each record
+// with decoder and hands it to the worker pool, then drains the pool once
+// ctx is cancelled, giving up shutdownTimeout after that. Records that
+// cannot be decoded go to deadLetters instead.
+func runConsumerLoop(ctx context.Context, client consumerClient, pool *stream.WorkerPool, decoder *stream.Decoder,
+	deadLetters *stream.DeadLetterQueue, shutdownTimeout time.Duration) {
+	pool.Start()
+	stopCtx, stopCancel := shutdownContext(ctx, shutdownTimeout)
+	defer stopCancel()
+	defer drainPool(stopCtx, pool)
 
 	for {
-		select {
-		case <-ctx.Done():
+		if pool.Saturated() {
+			waitForCapacity(ctx, client, pool)
+		}
+
+		fetches := client.PollFetches(ctx)
+		if ctx.Err() != nil {
+			client.AllowRebalance()
 			return
-		default:
-			fetches := client.PollFetches(ctx)
-			fetches.EachPartition(func(p kgo.FetchTopicPartition) {
-				for _, record := range p.Records {
-					var protoEvent pb.Event
-					if err := proto.Unmarshal(record.Value, &protoEvent); err != nil {
-						stream.EventsFailedToProcess.Inc()
-						continue
-					}
+		}
 
-					e := stream.Event{
-						Domain: protoEvent.GetDomain(),
-						Title:  protoEvent.GetTitle(),
-						User:   protoEvent.GetUser(),
+		// stopped abandons the rest of the fetch, every partition of it,
+		// once a record could not be handed on because we are shutting
+		// down.
+		stopped := false
+		fetches.EachPartition(func(p kgo.FetchTopicPartition) {
+			if stopped {
+				return
+			}
+			for _, record := range p.Records {
+				at := fmt.Sprintf("%s[%d]@%d", record.Topic, record.Partition, record.Offset)
+				var (
+					event  stream.Event
+					meta   stream.RecordMetadata
+					reason stream.DeadLetterReason
+					err    error
+				)
+				// A record whose schema cannot be fetched may be fine, so it
+				// waits for the registry rather than being dead-lettered.
+				if retryErr := retry(ctx, "look up the schema of record "+at, func() error {
+					event, meta, reason, err = decoder.Decode(ctx, record)
+					if errors.Is(err, stream.ErrSchemaUnavailable) {
+						return err
+					}
+					return nil
+				}); retryErr != nil {
+					// Shutting down; the record is redelivered.
+					stopped = true
+					return
+				}
+				if err != nil {
+					stream.EventsFailedToProcess.Inc()
+					// The dead letter is written before any later record of
+					// the partition can be committed, retrying until it is.
+					if err := retry(ctx, "dead-letter record "+at, func() error {
+						return deadLetters.Send(ctx, stream.NewDeadLetter(reason, err, record))
+					}); err != nil {
+						stopped = true
+						return
 					}
+					continue
+				}
 
-					batcher.Add(e)
-					uncommitted = append(uncommitted, record)
-					stream.EventsConsumedFromRedpanda.Inc()
+				stream.ObserveLag(meta, record, time.Now())
+				if err := pool.Dispatch(ctx, event, record); err != nil {
+					// Shutting down; undispatched records are redelivered.
+					stopped = true
+					return
 				}
+				stream.EventsConsumedFromRedpanda.Inc()
+			}
+		})
+		client.AllowRebalance()
+		if stopped {
+			return
+		}
+	}
+}
+
+// Failed dead-letter writes and schema lookups are retried after
+// retryMin, doubling up to retryMax.
+const (
+	retryMin = 100 * time.Millisecond
+	retryMax = 10 * time.Second
+)
+
+// retry calls fn until it succeeds, backing off between attempts, or until
+// ctx is done. Polling stops meanwhile: skipping the record instead would
+// let the next commit of its partition pass it, losing it.
+func retry(ctx context.Context, what string, fn func() error) error {
+	wait := retryMin
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("❌ Failed to %s, retrying in %s: %v", what, wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, retryMax)
+	}
+}
+
+// drainPool lets the workers write and commit everything dispatched to
+// them, unless ctx runs out first.
+func drainPool(ctx context.Context, pool *stream.WorkerPool) {
+	log.Println("🛑 Stopped polling, draining workers...")
+	start := time.Now()
+	if err := pool.Shutdown(ctx); err != nil {
+		log.Printf("❌ Workers not drained before the shutdown deadline, uncommitted records will be redelivered: %v", context.Cause(ctx))
+		return
+	}
+	log.Printf("✅ Workers drained and offsets committed in %s", time.Since(start).Round(time.Millisecond))
+}
+
+// waitForCapacity pauses fetching while the workers' batchers are full, so
+// records wait in the broker rather than in memory until the store catches
+// up. Rebalances may run meanwhile; newly assigned partitions are fetched
+// once polling resumes.
+func waitForCapacity(ctx context.Context, client consumerClient, pool *stream.WorkerPool) {
+	paused := pool.Partitions()
+	client.PauseFetchPartitions(paused)
+	stream.ConsumerFetchPaused.Set(1)
+	log.Printf("⏸️ Batchers full, pausing fetches for %v", paused)
+
+	start := time.Now()
+	if err := pool.WaitForCapacity(ctx); err == nil {
+		log.Printf("▶️ Resuming fetches after %s", time.Since(start).Round(time.Millisecond))
+	}
+	client.ResumeFetchPartitions(paused)
+	stream.ConsumerFetchPaused.Set(0)
+}
 
-				// If we flushed, commit those records
-				if flushed := batcher.FlushIfThresholdMet(); len(flushed) > 0 {
-					client.CommitRecords(ctx, uncommitted...)
-					uncommitted = nil
-					stream.EventsProcessedSuccessfully.Inc()
+// commitOffsetsFunc adapts the client's commit API to a stream.CommitFunc,
+// turning per-partition error codes into an error.
+func commitOffsetsFunc(client consumerClient) stream.CommitFunc {
+	return func(ctx context.Context, offsets stream.Offsets) error {
+		var commitErr error
+		client.CommitOffsetsSync(ctx, offsets, func(_ *kgo.Client, _ *kmsg.OffsetCommitRequest, resp *kmsg.OffsetCommitResponse, err error) {
+			if err != nil {
+				commitErr = err
+				return
+			}
+			for _, t := range resp.Topics {
+				for _, p := range t.Partitions {
+					if err := kerr.ErrorForCode(p.ErrorCode); err != nil {
+						commitErr = fmt.Errorf("commit %s[%d]: %w", t.Topic, p.Partition, err)
+					}
 				}
-			})
+			}
+		})
+		return commitErr
+	}
+}
+
+// statsHandler serves the current snapshot, or 503 when the store cannot be
+// read so callers don't mistake an outage for empty stats. With any of the
+// from, to or granularity parameters it serves a time series instead.
+func statsHandler(store stream.StatsStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		if params.Has("from") || params.Has("to") || params.Has("granularity") {
+			seriesHandler(store, w, r)
+			return
+		}
+
+		snapshot, err := store.GetSnapshot(r.Context())
+		if err != nil {
+			log.Printf("❌ Failed to read stats: %v", err)
+			http.Error(w, "stats store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, snapshot)
+	}
+}
+
+// defaultTopK is how many entries /stats/top/* returns without a k.
+const defaultTopK = 10
+
+// topHandler serves the heaviest users or domains with their error bounds.
+func topHandler(topK *stream.TopKStats, dim stream.TopDimension) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k := defaultTopK
+		if v := r.URL.Query().Get("k"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid k %q", v), http.StatusBadRequest)
+				return
+			}
+			k = n
+		}
+
+		top, err := topK.Top(dim, k)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, top)
+	}
+}
+
+// defaultSeriesBuckets is how far back a time series reaches when the
+// request gives no from.
+const defaultSeriesBuckets = 60
+
+func seriesHandler(store stream.StatsStore, w http.ResponseWriter, r *http.Request) {
+	q, err := parseSeriesQuery(r.URL.Query(), time.Now())
+	if err == nil {
+		err = q.Validate()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	series, err := store.GetTimeSeries(r.Context(), q)
+	if err != nil {
+		log.Printf("❌ Failed to read stats series: %v", err)
+		http.Error(w, "stats store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, series)
+}
+
+// parseSeriesQuery reads granularity (default minute), to (default now) and
+// from (default 60 buckets before to). Times are RFC 3339 or Unix seconds.
+func parseSeriesQuery(params url.Values, now time.Time) (stream.SeriesQuery, error) {
+	q := stream.SeriesQuery{Granularity: stream.GranularityMinute, To: now.UTC()}
+
+	if v := params.Get("granularity"); v != "" {
+		g, err := stream.ParseGranularity(v)
+		if err != nil {
+			return q, err
+		}
+		q.Granularity = g
+	}
+	if v := params.Get("to"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid to: %w", err)
+		}
+		q.To = t
+	}
+	q.From = q.To.Add(-defaultSeriesBuckets * q.Granularity.Duration())
+	if v := params.Get("from"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid from: %w", err)
 		}
+		q.From = t
 	}
+	return q, nil
 }
 
-func defaultCassandraSessionFn() (*gocql.Session, error) {
-	cluster := gocql.NewCluster("cassandra")
-	cluster.Keyspace = "goanalytics"
+func parseTime(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC 3339 nor Unix seconds", v)
+	}
+	return t.UTC(), nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "failed to encode stats", http.StatusInternalServerError)
+	}
+}
+
+// loadConfig layers the config file, the environment and the command-line
+// flags.
+func loadConfig() (*config.Config, error) {
+	return config.LoadArgs("consumer", os.Args[1:], os.Stdout)
+}
+
+func defaultCassandraSessionFn(cfg *config.Config) (*gocql.Session, error) {
+	cluster := gocql.NewCluster(cfg.CassandraHosts...)
+	cluster.Keyspace = cfg.CassandraKeyspace
 	cluster.Consistency = gocql.Quorum
-	cluster.ConnectTimeout = 5 * time.Second
+	cluster.ConnectTimeout = cfg.CassandraTimeout
+	if cfg.CassandraUsername != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: cfg.CassandraUsername,
+			Password: cfg.CassandraPassword,
+		}
+	}
 	return cluster.CreateSession()
 }
 
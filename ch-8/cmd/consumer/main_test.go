@@ -2,16 +2,32 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/gocql/gocql"
 	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/config"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/health"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/registry"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	pb "github.com/joshua-daniels-red/go-backend-challenge/ch-8/proto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestRun_ConfigFails(t *testing.T) {
@@ -73,7 +89,7 @@ func TestRun_CassandraSessionFails(t *testing.T) {
 		)
 	}
 
-	newCassandraSessionFn = func() (*gocql.Session, error) {
+	newCassandraSessionFn = func(*config.Config) (*gocql.Session, error) {
 		return nil, errors.New("cassandra boom")
 	}
 
@@ -81,3 +97,1031 @@ func TestRun_CassandraSessionFails(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to connect to Cassandra")
 }
+
+// fakeKafkaClient serves one batch of fetches, then blocks until the
+// context is cancelled, recording every commit it receives. With idle set
+// it returns an empty poll after idle instead of blocking.
+type fakeKafkaClient struct {
+	mu      sync.Mutex
+	fetches []kgo.Fetches
+	commits []map[string]map[int32]kgo.EpochOffset
+	allowed int
+	sent    []*kgo.Record
+	paused  []map[string][]int32
+	resumed []map[string][]int32
+	idle    time.Duration
+	// pausedPolls counts polls made while fetching was paused.
+	pausedPolls int
+}
+
+func (f *fakeKafkaClient) ProduceSync(_ context.Context, rs ...*kgo.Record) kgo.ProduceResults {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var results kgo.ProduceResults
+	for _, r := range rs {
+		f.sent = append(f.sent, r)
+		results = append(results, kgo.ProduceResult{Record: r})
+	}
+	return results
+}
+
+func (f *fakeKafkaClient) produced() []*kgo.Record {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*kgo.Record(nil), f.sent...)
+}
+
+func (f *fakeKafkaClient) AllowRebalance() {
+	f.mu.Lock()
+	f.allowed++
+	f.mu.Unlock()
+}
+
+func (f *fakeKafkaClient) rebalancesAllowed() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.allowed
+}
+
+func (f *fakeKafkaClient) PauseFetchPartitions(p map[string][]int32) map[string][]int32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paused = append(f.paused, p)
+	return p
+}
+
+func (f *fakeKafkaClient) ResumeFetchPartitions(p map[string][]int32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resumed = append(f.resumed, p)
+}
+
+func (f *fakeKafkaClient) pauses() (paused, resumed, pausedPolls int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.paused), len(f.resumed), f.pausedPolls
+}
+
+func (f *fakeKafkaClient) PollFetches(ctx context.Context) kgo.Fetches {
+	f.mu.Lock()
+	if len(f.paused) > len(f.resumed) {
+		f.pausedPolls++
+	}
+	if len(f.fetches) > 0 {
+		next := f.fetches[0]
+		f.fetches = f.fetches[1:]
+		f.mu.Unlock()
+		return next
+	}
+	idle := f.idle
+	f.mu.Unlock()
+
+	if idle > 0 {
+		select {
+		case <-time.After(idle):
+			return nil
+		case <-ctx.Done():
+		}
+	}
+	<-ctx.Done()
+	return kgo.NewErrFetch(ctx.Err())
+}
+
+func (f *fakeKafkaClient) CommitOffsetsSync(_ context.Context, offsets map[string]map[int32]kgo.EpochOffset,
+	onDone func(*kgo.Client, *kmsg.OffsetCommitRequest, *kmsg.OffsetCommitResponse, error)) {
+	f.mu.Lock()
+	f.commits = append(f.commits, offsets)
+	f.mu.Unlock()
+	onDone(nil, nil, &kmsg.OffsetCommitResponse{}, nil)
+}
+
+func (f *fakeKafkaClient) pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.fetches)
+}
+
+func (f *fakeKafkaClient) committed() []map[string]map[int32]kgo.EpochOffset {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]map[int32]kgo.EpochOffset(nil), f.commits...)
+}
+
+func protoRecord(t *testing.T, partition int32, offset int64, domain string) *kgo.Record {
+	t.Helper()
+	data, err := proto.Marshal(&pb.Event{Domain: domain, Title: "T", User: "U"})
+	assert.NoError(t, err)
+	return &kgo.Record{Topic: "wiki", Partition: partition, Offset: offset, Value: data}
+}
+
+func fetchesOf(records ...*kgo.Record) kgo.Fetches {
+	byPartition := map[int32][]*kgo.Record{}
+	var order []int32
+	for _, r := range records {
+		if _, ok := byPartition[r.Partition]; !ok {
+			order = append(order, r.Partition)
+		}
+		byPartition[r.Partition] = append(byPartition[r.Partition], r)
+	}
+	topic := kgo.FetchTopic{Topic: "wiki"}
+	for _, p := range order {
+		topic.Partitions = append(topic.Partitions, kgo.FetchPartition{Partition: p, Records: byPartition[p]})
+	}
+	return kgo.Fetches{{Topics: []kgo.FetchTopic{topic}}}
+}
+
+func snapshotMessages(t *testing.T, store stream.StatsStore) int {
+	t.Helper()
+	snapshot, err := store.GetSnapshot(context.Background())
+	assert.NoError(t, err)
+	return snapshot.Messages
+}
+
+// testConfig is the default config with batches of size flushed every
+// interval.
+func testConfig(size int, interval time.Duration) *config.Config {
+	cfg := config.Default()
+	cfg.BatchSize, cfg.FlushInterval = size, interval
+	return cfg
+}
+
+func TestRunConsumerLoop_CommitsOffsetsPerPartitionOnThreshold(t *testing.T) {
+	cfg := testConfig(3, time.Hour)
+	cfg.Workers = 1
+
+	client := &fakeKafkaClient{fetches: []kgo.Fetches{fetchesOf(
+		protoRecord(t, 0, 10, "a"),
+		protoRecord(t, 0, 11, "a"),
+		protoRecord(t, 1, 5, "b"),
+	)}}
+	store := stream.NewInMemoryStats()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil), stream.NewDecoder(), newDeadLetterQueue(client, ""), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return len(client.committed()) == 1 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	commits := client.committed()
+	assert.Len(t, commits, 1, "nothing left to commit on shutdown")
+	assert.Equal(t, int64(12), commits[0]["wiki"][0].Offset)
+	assert.Equal(t, int64(6), commits[0]["wiki"][1].Offset)
+	assert.Equal(t, 3, snapshotMessages(t, store))
+}
+
+func TestRunConsumerLoop_CommitsTickerFlush(t *testing.T) {
+	cfg := testConfig(100, 20*time.Millisecond)
+
+	client := &fakeKafkaClient{fetches: []kgo.Fetches{fetchesOf(protoRecord(t, 2, 41, "a"))}}
+	store := stream.NewInMemoryStats()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil), stream.NewDecoder(), newDeadLetterQueue(client, ""), cfg.ShutdownTimeout)
+
+	assert.Eventually(t, func() bool { return len(client.committed()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(42), client.committed()[0]["wiki"][2].Offset)
+}
+
+func TestRunConsumerLoop_CommitsShutdownFlush(t *testing.T) {
+	cfg := testConfig(100, time.Hour)
+
+	client := &fakeKafkaClient{fetches: []kgo.Fetches{fetchesOf(
+		protoRecord(t, 0, 0, "a"),
+		protoRecord(t, 0, 1, "a"),
+	)}}
+	store := stream.NewInMemoryStats()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil), stream.NewDecoder(), newDeadLetterQueue(client, ""), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return client.pending() == 0 }, time.Second, 5*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+
+	commits := client.committed()
+	assert.Len(t, commits, 1)
+	assert.Equal(t, int64(2), commits[0]["wiki"][0].Offset)
+	assert.Equal(t, 2, snapshotMessages(t, store))
+}
+
+func TestRunConsumerLoop_UndecodableRecordIsNotCommittedAlone(t *testing.T) {
+	cfg := testConfig(1, time.Hour)
+
+	client := &fakeKafkaClient{fetches: []kgo.Fetches{fetchesOf(
+		&kgo.Record{Topic: "wiki", Partition: 0, Offset: 0, Value: []byte{0xff}},
+	)}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, stream.NewInMemoryStats(), nil), stream.NewDecoder(), newDeadLetterQueue(client, ""), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Empty(t, client.committed())
+}
+
+func TestRunConsumerLoop_DeadLettersUndecodableRecord(t *testing.T) {
+	cfg := testConfig(1, time.Hour)
+	cfg.Workers = 1
+
+	bad := &kgo.Record{Topic: "wiki", Partition: 0, Offset: 0, Value: []byte{0xff}}
+	client := &fakeKafkaClient{fetches: []kgo.Fetches{fetchesOf(bad, protoRecord(t, 0, 1, "a"))}}
+	store := stream.NewInMemoryStats()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil), stream.NewDecoder(), newDeadLetterQueue(client, "wiki.dlq"), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return len(client.committed()) == 1 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	sent := client.produced()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, "wiki.dlq", sent[0].Topic)
+		assert.Equal(t, bad.Value, sent[0].Value)
+		d, err := stream.ParseDeadLetter(sent[0])
+		assert.NoError(t, err)
+		assert.Equal(t, stream.ReasonDecodeFailed, d.Reason)
+		assert.Equal(t, "wiki", d.SourceTopic)
+		assert.Equal(t, int64(0), d.SourceOffset)
+	}
+	// The good record still counts, and the commit covers the dead letter.
+	assert.Equal(t, 1, snapshotMessages(t, store))
+	assert.Equal(t, int64(2), client.committed()[0]["wiki"][0].Offset)
+}
+
+// failingProduceClient fails the first failures produces, or every one if
+// failures is negative.
+type failingProduceClient struct {
+	fakeKafkaClient
+	failures int
+	attempts atomic.Int32
+}
+
+func (f *failingProduceClient) ProduceSync(ctx context.Context, rs ...*kgo.Record) kgo.ProduceResults {
+	if n := int(f.attempts.Add(1)); f.failures < 0 || n <= f.failures {
+		return kgo.ProduceResults{{Record: rs[0], Err: errors.New("broker unavailable")}}
+	}
+	return f.fakeKafkaClient.ProduceSync(ctx, rs...)
+}
+
+func TestRunConsumerLoop_RetriesDeadLetterUntilSent(t *testing.T) {
+	cfg := testConfig(1, time.Hour)
+	cfg.Workers = 1
+
+	bad := &kgo.Record{Topic: "wiki", Partition: 0, Offset: 0, Value: []byte{0xff}}
+	client := &failingProduceClient{failures: 2}
+	client.fetches = []kgo.Fetches{fetchesOf(bad, protoRecord(t, 0, 1, "a"))}
+	store := stream.NewInMemoryStats()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil), stream.NewDecoder(), newDeadLetterQueue(client, "wiki.dlq"), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return len(client.committed()) == 1 }, 2*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, int32(3), client.attempts.Load())
+	assert.Len(t, client.produced(), 1)
+	assert.Equal(t, int64(2), client.committed()[0]["wiki"][0].Offset)
+}
+
+func TestRunConsumerLoop_UnsentDeadLetterIsNotCommittedPast(t *testing.T) {
+	cfg := testConfig(1, time.Hour)
+	cfg.Workers = 1
+
+	bad := &kgo.Record{Topic: "wiki", Partition: 0, Offset: 1, Value: []byte{0xff}}
+	client := &failingProduceClient{failures: -1}
+	client.fetches = []kgo.Fetches{fetchesOf(protoRecord(t, 0, 0, "a"), bad, protoRecord(t, 0, 2, "a"))}
+	store := stream.NewInMemoryStats()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil), stream.NewDecoder(), newDeadLetterQueue(client, "wiki.dlq"), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return client.attempts.Load() >= 2 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	// Only the record before the dead letter is counted and committed, so
+	// the dead letter is redelivered.
+	assert.Equal(t, 1, snapshotMessages(t, store))
+	for _, c := range client.committed() {
+		assert.LessOrEqual(t, c["wiki"][0].Offset, int64(1))
+	}
+}
+
+func TestCommitOffsetsFunc_ReportsPartitionErrors(t *testing.T) {
+	client := &erroringCommitClient{}
+	err := commitOffsetsFunc(client)(context.Background(), stream.Offsets{"wiki": {0: {Offset: 1}}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "wiki[0]")
+}
+
+type erroringCommitClient struct{ fakeKafkaClient }
+
+func (e *erroringCommitClient) CommitOffsetsSync(_ context.Context, _ map[string]map[int32]kgo.EpochOffset,
+	onDone func(*kgo.Client, *kmsg.OffsetCommitRequest, *kmsg.OffsetCommitResponse, error)) {
+	resp := &kmsg.OffsetCommitResponse{Topics: []kmsg.OffsetCommitResponseTopic{{
+		Topic:      "wiki",
+		Partitions: []kmsg.OffsetCommitResponseTopicPartition{{Partition: 0, ErrorCode: kerr.RebalanceInProgress.Code}},
+	}}}
+	onDone(nil, nil, resp, nil)
+}
+
+type unavailableStore struct{ stream.StatsStore }
+
+func (unavailableStore) GetSnapshot(context.Context) (stream.StatsSnapshot, error) {
+	return stream.StatsSnapshot{}, errors.New("no hosts available")
+}
+
+func (unavailableStore) GetTimeSeries(context.Context, stream.SeriesQuery) (stream.TimeSeries, error) {
+	return stream.TimeSeries{}, errors.New("no hosts available")
+}
+
+func TestStatsHandler_OK(t *testing.T) {
+	store := stream.NewInMemoryStats()
+	assert.NoError(t, store.Record(context.Background(), stream.Event{Domain: "en.wikipedia.org", User: "alice"}))
+
+	rec := httptest.NewRecorder()
+	statsHandler(store)(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"messages":1`)
+}
+
+func TestStatsHandler_StoreUnavailable(t *testing.T) {
+	rec := httptest.NewRecorder()
+	statsHandler(unavailableStore{})(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestStatsHandler_TimeSeries(t *testing.T) {
+	store := stream.NewInMemoryStats()
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, store.Record(context.Background(), stream.Event{Domain: "en.wikipedia.org", User: "alice", Timestamp: base.Add(90 * time.Second).Unix()}))
+
+	rec := httptest.NewRecorder()
+	url := "/stats?granularity=minute&from=2025-06-01T12:00:00Z&to=" + strconv.FormatInt(base.Add(3*time.Minute).Unix(), 10)
+	statsHandler(store)(rec, httptest.NewRequest(http.MethodGet, url, nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var series stream.TimeSeries
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&series))
+	assert.Equal(t, stream.GranularityMinute, series.Granularity)
+	assert.Len(t, series.Buckets, 3)
+	assert.Equal(t, 1, series.Buckets[1].ByDomain["en.wikipedia.org"])
+}
+
+func TestStatsHandler_TimeSeries_BadRequest(t *testing.T) {
+	for _, query := range []string{
+		"granularity=week",
+		"from=yesterday",
+		"from=2025-06-02T00:00:00Z&to=2025-06-01T00:00:00Z",
+		"granularity=minute&from=2025-06-01T00:00:00Z&to=2025-06-03T00:00:00Z",
+	} {
+		rec := httptest.NewRecorder()
+		statsHandler(stream.NewInMemoryStats())(rec, httptest.NewRequest(http.MethodGet, "/stats?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func TestStatsHandler_TimeSeries_StoreUnavailable(t *testing.T) {
+	rec := httptest.NewRecorder()
+	statsHandler(unavailableStore{})(rec, httptest.NewRequest(http.MethodGet, "/stats?granularity=hour", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestParseSeriesQuery_Defaults(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	q, err := parseSeriesQuery(map[string][]string{"granularity": {"hour"}}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, stream.GranularityHour, q.Granularity)
+	assert.Equal(t, now, q.To)
+	assert.Equal(t, now.Add(-60*time.Hour), q.From)
+}
+
+func TestTopHandler(t *testing.T) {
+	topK := stream.NewTopKStats(stream.NewInMemoryStats(), 10)
+	assert.NoError(t, topK.RecordMany(context.Background(), []stream.Event{
+		{Domain: "en.wikipedia.org", User: "alice"},
+		{Domain: "en.wikipedia.org", User: "alice"},
+		{Domain: "de.wikipedia.org", User: "bob"},
+	}))
+
+	rec := httptest.NewRecorder()
+	topHandler(topK, stream.TopUsers)(rec, httptest.NewRequest(http.MethodGet, "/stats/top/users?k=1", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var top stream.TopK
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&top))
+	assert.Equal(t, []stream.HeavyHitter{{Key: "alice", Count: 2, Guaranteed: true}}, top.Items)
+	assert.Equal(t, int64(3), top.Total)
+}
+
+func TestTopHandler_BadK(t *testing.T) {
+	topK := stream.NewTopKStats(stream.NewInMemoryStats(), 10)
+
+	for _, k := range []string{"abc", "0", "11"} {
+		rec := httptest.NewRecorder()
+		topHandler(topK, stream.TopDomains)(rec, httptest.NewRequest(http.MethodGet, "/stats/top/domains?k="+k, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, k)
+	}
+}
+
+func TestRunConsumerLoop_FansOutAndDrainsOnShutdown(t *testing.T) {
+	cfg := testConfig(100, time.Hour)
+	cfg.Workers = 4
+
+	var records []*kgo.Record
+	for p := int32(0); p < 8; p++ {
+		for o := int64(0); o < 5; o++ {
+			records = append(records, protoRecord(t, p, o, "a"))
+		}
+	}
+	client := &fakeKafkaClient{fetches: []kgo.Fetches{fetchesOf(records...)}}
+	store := stream.NewInMemoryStats()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil), stream.NewDecoder(), newDeadLetterQueue(client, ""), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return client.pending() == 0 }, time.Second, 5*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, 40, snapshotMessages(t, store))
+	final := map[int32]int64{}
+	for _, c := range client.committed() {
+		for p, o := range c["wiki"] {
+			final[p] = o.Offset
+		}
+	}
+	for p := int32(0); p < 8; p++ {
+		assert.Equal(t, int64(5), final[p], "partition %d", p)
+	}
+}
+
+func TestRunConsumerLoop_AllowsRebalanceAfterDispatching(t *testing.T) {
+	cfg := config.Default()
+	client := &fakeKafkaClient{fetches: []kgo.Fetches{fetchesOf(protoRecord(t, 0, 0, "a"))}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, stream.NewInMemoryStats(), nil), stream.NewDecoder(), newDeadLetterQueue(client, ""), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return client.rebalancesAllowed() == 1 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, 2, client.rebalancesAllowed(), "the final poll must not leave rebalances blocked")
+}
+
+func TestRebalanceHooks_RevokeFlushesAndCommitsPendingBatch(t *testing.T) {
+	cfg := testConfig(100, time.Hour)
+	cfg.Workers = 2
+
+	client := &fakeKafkaClient{}
+	store := stream.NewInMemoryStats()
+	pool := newWorkerPool(cfg, client, store, nil)
+	hooks := &rebalanceHooks{}
+
+	// Before the pool exists the hooks have nothing to do.
+	hooks.revoked(context.Background(), nil, map[string][]int32{"wiki": {0}})
+
+	hooks.setPool(pool)
+	pool.Start()
+	defer pool.Stop()
+	hooks.assigned(context.Background(), nil, map[string][]int32{"wiki": {0, 1}})
+
+	for o := int64(0); o < 3; o++ {
+		assert.NoError(t, pool.Dispatch(context.Background(), stream.Event{Domain: "a"}, protoRecord(t, 0, o, "a")))
+	}
+	assert.NoError(t, pool.Dispatch(context.Background(), stream.Event{Domain: "b"}, protoRecord(t, 1, 7, "b")))
+
+	hooks.revoked(context.Background(), nil, map[string][]int32{"wiki": {0}})
+
+	// Below the batch size, yet written and committed before revoke returns.
+	assert.Equal(t, 4, snapshotMessages(t, store))
+	final := map[int32]int64{}
+	for _, c := range client.committed() {
+		for p, o := range c["wiki"] {
+			final[p] = o.Offset
+		}
+	}
+	assert.Equal(t, map[int32]int64{0: 3, 1: 8}, final)
+}
+
+func TestRebalanceHooks_AfterStopIsNoop(t *testing.T) {
+	cfg := config.Default()
+	client := &fakeKafkaClient{}
+	pool := newWorkerPool(cfg, client, stream.NewInMemoryStats(), nil)
+	hooks := &rebalanceHooks{}
+	hooks.setPool(pool)
+	pool.Start()
+	pool.Stop()
+
+	hooks.revoked(context.Background(), nil, map[string][]int32{"wiki": {0}})
+	hooks.lost(context.Background(), nil, map[string][]int32{"wiki": {0}})
+	assert.Empty(t, client.committed())
+}
+
+func withEventID(record *kgo.Record, id string) *kgo.Record {
+	record.Headers = stream.RecordMetadata{
+		SchemaVersion: stream.SchemaVersion,
+		ContentType:   stream.ContentTypeProtobuf,
+		EventID:       id,
+		EventTime:     time.Now().Add(-time.Second),
+	}.Headers()
+	return record
+}
+
+func TestRunConsumerLoop_SkipsDuplicateEventIDs(t *testing.T) {
+	cfg := testConfig(2, time.Hour)
+	cfg.Workers = 1
+	dedup := stream.NewSeenSet(100, time.Hour)
+
+	client := &fakeKafkaClient{fetches: []kgo.Fetches{fetchesOf(
+		withEventID(protoRecord(t, 0, 0, "a"), "e-1"),
+		withEventID(protoRecord(t, 0, 1, "a"), "e-1"),
+		withEventID(protoRecord(t, 0, 2, "b"), "e-2"),
+		protoRecord(t, 0, 3, "c"),
+	)}}
+	store := stream.NewInMemoryStats()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, dedup), stream.NewDecoder(), newDeadLetterQueue(client, ""), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return client.pending() == 0 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	// The re-produced e-1 is skipped; records without an id are kept.
+	assert.Equal(t, 3, snapshotMessages(t, store))
+	commits := client.committed()
+	assert.Equal(t, int64(4), commits[len(commits)-1]["wiki"][0].Offset)
+}
+
+func TestNewDeduplicator(t *testing.T) {
+	d, err := newDeduplicator(&config.Config{DedupStore: "none"}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+
+	d, err = newDeduplicator(&config.Config{DedupStore: "memory", DedupCapacity: 10, DedupWindow: time.Minute}, nil)
+	assert.NoError(t, err)
+	assert.IsType(t, &stream.SeenSet{}, d)
+
+	_, err = newDeduplicator(&config.Config{DedupStore: "cassandra"}, nil)
+	assert.ErrorContains(t, err, "STORAGE=cassandra")
+}
+
+func TestDecodeRecord(t *testing.T) {
+	decoder := stream.NewDecoder()
+	record := withEventID(protoRecord(t, 0, 0, "a"), "e-1")
+	event, meta, _, err := decoder.Decode(context.Background(), record)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", event.Domain)
+	assert.Equal(t, "e-1", meta.EventID)
+
+	// Records from producers without headers are protobuf.
+	_, _, _, err = decoder.Decode(context.Background(), protoRecord(t, 0, 0, "a"))
+	assert.NoError(t, err)
+
+	record.Headers = []kgo.RecordHeader{{Key: stream.HeaderContentType, Value: []byte("text/csv")}}
+	_, _, reason, err := decoder.Decode(context.Background(), record)
+	assert.Error(t, err)
+	assert.Equal(t, stream.ReasonUnsupportedContentType, reason)
+
+	record.Headers = []kgo.RecordHeader{{Key: stream.HeaderSchemaVersion, Value: []byte("one")}}
+	_, _, reason, err = decoder.Decode(context.Background(), record)
+	assert.Error(t, err)
+	assert.Equal(t, stream.ReasonInvalidHeaders, reason)
+
+	_, _, reason, err = decoder.Decode(context.Background(), &kgo.Record{Value: []byte{0xff}})
+	assert.Error(t, err)
+	assert.Equal(t, stream.ReasonDecodeFailed, reason)
+}
+
+func framed(t *testing.T, schemaID int, indexes []int, event *pb.Event) *kgo.Record {
+	t.Helper()
+	value, err := proto.MarshalOptions{}.MarshalAppend(registry.AppendProtobufFrame(nil, schemaID, indexes), event)
+	assert.NoError(t, err)
+	return &kgo.Record{Topic: "wiki", Value: value}
+}
+
+func TestDecodeRecord_SchemaRegistryFraming(t *testing.T) {
+	reg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/schemas/ids/1":
+			json.NewEncoder(w).Encode(map[string]string{"schema": pb.EventSchema, "schemaType": "PROTOBUF"})
+		case "/schemas/ids/2":
+			json.NewEncoder(w).Encode(map[string]string{"schema": `"string"`})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error_code": 40403, "message": "Schema not found"}`)
+		}
+	}))
+	defer reg.Close()
+	ctx := context.Background()
+	decoder := stream.NewDecoder()
+
+	record := framed(t, 1, pb.EventMessageIndexes, &pb.Event{Domain: "a", Title: "T", User: "U"})
+	_, _, reason, err := decoder.Decode(ctx, record)
+	assert.Error(t, err, "framed records need a registry")
+	assert.Equal(t, stream.ReasonUnknownSchema, reason)
+
+	decoder = newDecoder(&config.Config{SchemaRegistryURL: reg.URL})
+	event, _, _, err := decoder.Decode(ctx, record)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", event.Domain)
+
+	// A newer schema version adds fields this consumer does not know;
+	// protobuf skips them.
+	newer := framed(t, 1, pb.EventMessageIndexes, &pb.Event{Domain: "b"})
+	newer.Value = protowire.AppendString(protowire.AppendTag(newer.Value, 99, protowire.BytesType), "future")
+	event, _, _, err = decoder.Decode(ctx, newer)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", event.Domain)
+
+	for name, record := range map[string]*kgo.Record{
+		"unregistered id": framed(t, 99, pb.EventMessageIndexes, &pb.Event{}),
+		"avro schema":     framed(t, 2, pb.EventMessageIndexes, &pb.Event{}),
+		"other message":   framed(t, 1, []int{1}, &pb.Event{}),
+	} {
+		_, _, reason, err := decoder.Decode(ctx, record)
+		assert.Error(t, err, name)
+		assert.Equal(t, stream.ReasonUnknownSchema, reason, name)
+	}
+}
+
+func TestRunConsumerLoop_WaitsForUnavailableRegistry(t *testing.T) {
+	cfg := testConfig(1, time.Hour)
+	cfg.Workers = 1
+	var lookups atomic.Int32
+	reg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if lookups.Add(1) <= 2 {
+			http.Error(w, `{"error_code": 50001, "message": "overloaded"}`, http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"schema": pb.EventSchema, "schemaType": "PROTOBUF"})
+	}))
+	defer reg.Close()
+	decoder := newDecoder(&config.Config{SchemaRegistryURL: reg.URL})
+
+	client := &fakeKafkaClient{fetches: []kgo.Fetches{fetchesOf(framed(t, 1, pb.EventMessageIndexes, &pb.Event{Domain: "a", Title: "T", User: "U"}))}}
+	store := stream.NewInMemoryStats()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil), decoder, newDeadLetterQueue(client, "wiki.dlq"), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return len(client.committed()) == 1 }, 2*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, int32(3), lookups.Load())
+	assert.Empty(t, client.produced(), "an unavailable registry is not a dead letter")
+	assert.Equal(t, 1, snapshotMessages(t, store))
+}
+
+func TestTopicOptions(t *testing.T) {
+	client, err := kgo.NewClient(topicOptions(&config.Config{WikipediaTopic: "wikipedia.protobuf"})...)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.Equal(t, false, client.OptValue(kgo.ConsumeRegex))
+	assert.Contains(t, client.OptValue(kgo.ConsumeTopics), "wikipedia.protobuf")
+
+	client, err = kgo.NewClient(topicOptions(&config.Config{ConsumerTopicRegex: `^wikipedia\.`})...)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.Equal(t, true, client.OptValue(kgo.ConsumeRegex))
+	assert.Contains(t, client.OptValue(kgo.ConsumeTopics), `^wikipedia\.`)
+}
+
+// gatedStore blocks writes until release is closed.
+type gatedStore struct {
+	*stream.InMemoryStats
+	release chan struct{}
+}
+
+func (s *gatedStore) RecordMany(ctx context.Context, events []stream.Event) error {
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.InMemoryStats.RecordMany(ctx, events)
+}
+
+func TestRunConsumerLoop_PausesFetchingWhileBuffersAreFull(t *testing.T) {
+	cfg := testConfig(100, time.Hour)
+	cfg.Workers = 1
+	cfg.BatchMaxEvents = 2
+
+	client := &fakeKafkaClient{idle: 5 * time.Millisecond, fetches: []kgo.Fetches{
+		fetchesOf(protoRecord(t, 0, 0, "a"), protoRecord(t, 0, 1, "a"), protoRecord(t, 0, 2, "a")),
+		fetchesOf(protoRecord(t, 0, 3, "a")),
+	}}
+	store := &gatedStore{InMemoryStats: stream.NewInMemoryStats(), release: make(chan struct{})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil), stream.NewDecoder(), newDeadLetterQueue(client, ""), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { paused, _, _ := client.pauses(); return paused > 0 }, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	_, resumed, pausedPolls := client.pauses()
+	assert.Zero(t, resumed)
+	assert.Zero(t, pausedPolls, "polled while fetching was paused")
+
+	close(store.release)
+	assert.Eventually(t, func() bool { paused, resumed, _ := client.pauses(); return resumed == paused }, time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool { return snapshotMessages(t, store) == 4 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	client.mu.Lock()
+	assert.Equal(t, map[string][]int32{"wiki": {0}}, client.paused[0])
+	client.mu.Unlock()
+}
+
+// slowStore takes delay to write each batch.
+type slowStore struct {
+	*stream.InMemoryStats
+	delay time.Duration
+}
+
+func (s *slowStore) RecordMany(ctx context.Context, events []stream.Event) error {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.InMemoryStats.RecordMany(ctx, events)
+}
+
+func TestRunConsumerLoop_ShutdownLosesNoEvents(t *testing.T) {
+	cfg := testConfig(7, time.Hour)
+	cfg.Workers = 3
+
+	// Each partition's events are counted under its own domain.
+	var fetches []kgo.Fetches
+	for o := int64(0); o < 200; o += 10 {
+		var records []*kgo.Record
+		for p := int32(0); p < 4; p++ {
+			for i := o; i < o+10; i++ {
+				records = append(records, protoRecord(t, p, i, strconv.Itoa(int(p))))
+			}
+		}
+		fetches = append(fetches, fetchesOf(records...))
+	}
+	client := &fakeKafkaClient{fetches: fetches}
+	store := &slowStore{InMemoryStats: stream.NewInMemoryStats(), delay: 2 * time.Millisecond}
+	consumed := testutil.ToFloat64(stream.EventsConsumedFromRedpanda)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil), stream.NewDecoder(), newDeadLetterQueue(client, ""), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	// Shut down mid-stream, with records queued, buffered and in flight.
+	assert.Eventually(t, func() bool { return client.pending() < len(fetches)/2 }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+
+	snapshot, err := store.GetSnapshot(context.Background())
+	assert.NoError(t, err)
+	dispatched := int(testutil.ToFloat64(stream.EventsConsumedFromRedpanda) - consumed)
+	assert.Positive(t, dispatched)
+	assert.Equal(t, dispatched, snapshot.Messages, "dispatched events were not all written")
+
+	final := map[int32]int64{}
+	for _, c := range client.committed() {
+		for p, o := range c["wiki"] {
+			final[p] = o.Offset
+		}
+	}
+	for p := int32(0); p < 4; p++ {
+		assert.Equal(t, int64(snapshot.ByDomain[strconv.Itoa(int(p))]), final[p],
+			"partition %d: committed offsets do not match written events", p)
+	}
+}
+
+func TestRunConsumerLoop_DrainGivesUpAtShutdownDeadline(t *testing.T) {
+	cfg := testConfig(1, time.Hour)
+	cfg.Workers = 1
+	cfg.ShutdownTimeout = 50 * time.Millisecond
+
+	client := &fakeKafkaClient{fetches: []kgo.Fetches{fetchesOf(protoRecord(t, 0, 0, "a"))}}
+	store := &gatedStore{InMemoryStats: stream.NewInMemoryStats(), release: make(chan struct{})}
+	defer close(store.release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil), stream.NewDecoder(), newDeadLetterQueue(client, ""), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return client.pending() == 0 }, time.Second, 5*time.Millisecond)
+	start := time.Now()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not give up at its deadline")
+	}
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Empty(t, client.committed())
+}
+
+func TestRunConsumerLoop_ShutdownAbandonsTheRestOfTheFetch(t *testing.T) {
+	cfg := testConfig(1, time.Hour)
+	cfg.Workers = 2
+	cfg.BatchMaxEvents = 1
+
+	// Worker 0 holds one batch in flight and one buffered, then blocks with
+	// one more queued, so the fifth record of partition 0 cannot be
+	// dispatched. Partition 1 goes to the idle worker 1.
+	var records []*kgo.Record
+	for i := int64(0); i < 5; i++ {
+		records = append(records, protoRecord(t, 0, i, "a"))
+	}
+	records = append(records, protoRecord(t, 1, 0, "b"), protoRecord(t, 1, 1, "b"))
+	client := &fakeKafkaClient{fetches: []kgo.Fetches{fetchesOf(records...)}}
+	store := &gatedStore{InMemoryStats: stream.NewInMemoryStats(), release: make(chan struct{})}
+	consumed := testutil.ToFloat64(stream.EventsConsumedFromRedpanda)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runConsumerLoop(ctx, client, newWorkerPool(cfg, client, store, nil).WithQueueSize(1), stream.NewDecoder(), newDeadLetterQueue(client, ""), cfg.ShutdownTimeout)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(stream.EventsConsumedFromRedpanda)-consumed == 4
+	}, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	close(store.release)
+	<-done
+
+	assert.Equal(t, 4.0, testutil.ToFloat64(stream.EventsConsumedFromRedpanda)-consumed,
+		"records of other partitions were dispatched after shutdown began")
+	snapshot, err := store.GetSnapshot(context.Background())
+	assert.NoError(t, err)
+	assert.Zero(t, snapshot.ByDomain["b"])
+}
+
+func TestShutdownContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopCtx, stopCancel := shutdownContext(ctx, 20*time.Millisecond)
+	defer stopCancel()
+
+	time.Sleep(40 * time.Millisecond)
+	assert.NoError(t, stopCtx.Err(), "deadline started before shutdown")
+
+	cancel()
+	assert.NoError(t, stopCtx.Err())
+	<-stopCtx.Done()
+	assert.ErrorIs(t, context.Cause(stopCtx), errShutdownTimeout)
+}
+
+func TestShutdownServers(t *testing.T) {
+	mux := http.NewServeMux()
+	started, release := make(chan struct{}), make(chan struct{})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	response := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/slow")
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			response <- resp.StatusCode
+		}
+	}()
+	<-started
+
+	// Shutdown waits for the request in progress.
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- shutdownServers(context.Background(), srv.Config) }()
+	select {
+	case <-shutdownDone:
+		t.Fatal("shut down with a request in progress")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	assert.NoError(t, <-shutdownDone)
+	assert.Equal(t, http.StatusOK, <-response)
+}
+
+func TestStartServer(t *testing.T) {
+	original := listenAndServeFunc
+	t.Cleanup(func() { listenAndServeFunc = original })
+	served := make(chan *http.Server, 1)
+	listenAndServeFunc = func(srv *http.Server) error {
+		served <- srv
+		return http.ErrServerClosed
+	}
+
+	srv := startServer("Stats", ":8080", http.NotFoundHandler())
+	assert.Same(t, srv, <-served)
+	assert.Equal(t, ":8080", srv.Addr)
+}
+
+type fakeGroupMember struct {
+	member     string
+	generation int32
+}
+
+func (f fakeGroupMember) GroupMetadata() (string, int32) { return f.member, f.generation }
+
+func TestGroupCheck(t *testing.T) {
+	check := groupCheck(fakeGroupMember{generation: -1}, "g")
+	assert.EqualError(t, check(context.Background()), "not a member of group g yet")
+
+	check = groupCheck(fakeGroupMember{member: "m-1", generation: -1}, "g")
+	assert.Error(t, check(context.Background()), "joined but not yet synced")
+
+	check = groupCheck(fakeGroupMember{member: "m-1", generation: 3}, "g")
+	assert.NoError(t, check(context.Background()))
+}
+
+func TestNewStatsMux_ServesHealth(t *testing.T) {
+	checker := health.NewChecker().
+		WithCheck("kafka", func(context.Context) error { return nil }).
+		WithCheck("consumer_group", groupCheck(fakeGroupMember{generation: -1}, "g"))
+	store := stream.NewInMemoryStats()
+	mux := newStatsMux(store, stream.NewTopKStats(store, 10), checker)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	var report health.Report
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	assert.Equal(t, health.StatusOK, report.Checks["kafka"].Status)
+	assert.Equal(t, health.StatusFail, report.Checks["consumer_group"].Status)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
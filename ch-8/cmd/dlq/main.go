@@ -0,0 +1,262 @@
+// Command dlq inspects the dead-letter topic and replays dead letters to the
+// topic they came from.
+//
+//	dlq inspect [-reason decode_failed] [-limit 10] [-- config flags]
+//	dlq replay  [-reason decode_failed] [-to wikipedia.protobuf] [-dry-run] [-- config flags]
+//
+// Config flags, such as --config dlq.yaml or --print-config, follow "--" so
+// they are kept apart from the command's own. Both commands read the
+// dead-letter topic from the beginning and stop once no new record arrives
+// for -wait. Replaying does not remove anything from the
+// dead-letter topic, so running replay twice publishes the records twice.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/config"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// HeaderReplayedFrom marks a replayed record with the dead letter it came
+// from, as topic/partition@offset.
+const HeaderReplayedFrom = "dlq-replayed-from"
+
+// recordSource is the subset of *kgo.Client used to read the dead letters.
+type recordSource interface {
+	PollFetches(ctx context.Context) kgo.Fetches
+}
+
+// recordSink is the subset of *kgo.Client used to replay them.
+type recordSink interface {
+	ProduceSync(ctx context.Context, rs ...*kgo.Record) kgo.ProduceResults
+}
+
+var (
+	configLoadFunc     = loadConfig
+	newKafkaClientFunc = kgo.NewClient
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		log.Fatalf("dlq: %v", err)
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: dlq inspect|replay [flags] [-- config flags]")
+	fmt.Fprintln(w, "run 'dlq <command> -h' for the flags of a command, 'dlq <command> -- -h' for the config flags")
+}
+
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return errors.New("missing command")
+	}
+	command := args[0]
+	if command != "inspect" && command != "replay" {
+		usage(os.Stderr)
+		return fmt.Errorf("unknown command %q", command)
+	}
+
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	topic := fs.String("topic", "", "dead-letter topic to read (default DEAD_LETTER_TOPIC)")
+	opts := readOptions{}
+	fs.StringVar(&opts.reason, "reason", "", "only dead letters with this reason, e.g. decode_failed")
+	fs.IntVar(&opts.limit, "limit", 0, "stop after this many matching dead letters (0 for all)")
+	fs.DurationVar(&opts.wait, "wait", 5*time.Second, "stop once no record arrives for this long")
+	to := fs.String("to", "", "replay: topic to publish to instead of each record's source topic")
+	dryRun := fs.Bool("dry-run", false, "replay: print what would be replayed without publishing")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	cfg, err := configLoadFunc(command, fs.Args(), out)
+	if errors.Is(err, config.ErrPrinted) || errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if *topic == "" {
+		*topic = cfg.DeadLetterTopic
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	client, err := newKafkaClientFunc(
+		kgo.SeedBrokers(cfg.RedpandaBroker),
+		kgo.ConsumeTopics(*topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create Kafka client: %w", err)
+	}
+	defer client.Close()
+
+	switch command {
+	case "inspect":
+		n, err := inspect(ctx, client, out, opts)
+		log.Printf("🔎 %d dead letters in %s", n, *topic)
+		return err
+	default:
+		var sink recordSink = client
+		if *dryRun {
+			sink = nil
+		}
+		replayed, skipped, err := replay(ctx, client, sink, out, opts, *to)
+		log.Printf("🔁 Replayed %d dead letters from %s, skipped %d", replayed, *topic, skipped)
+		return err
+	}
+}
+
+// loadConfig reads the config flags that follow "--" on top of the file and
+// environment. --print-config writes to out.
+func loadConfig(command string, args []string, out io.Writer) (*config.Config, error) {
+	return config.LoadArgs("dlq "+command+" --", args, out)
+}
+
+type readOptions struct {
+	reason string
+	limit  int
+	wait   time.Duration
+}
+
+// readDeadLetters calls fn for every matching dead letter until the topic
+// has been idle for opts.wait or opts.limit dead letters were seen.
+// Records without dead-letter headers are logged and skipped.
+func readDeadLetters(ctx context.Context, src recordSource, opts readOptions, fn func(*kgo.Record, stream.DeadLetter) error) (int, error) {
+	seen := 0
+	for {
+		pollCtx, cancel := context.WithTimeout(ctx, opts.wait)
+		fetches := src.PollFetches(pollCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return seen, ctx.Err()
+		}
+		for _, fe := range fetches.Errors() {
+			if errors.Is(fe.Err, context.DeadlineExceeded) || errors.Is(fe.Err, context.Canceled) {
+				continue
+			}
+			return seen, fmt.Errorf("fetch %s[%d]: %w", fe.Topic, fe.Partition, fe.Err)
+		}
+
+		records := fetches.Records()
+		if len(records) == 0 {
+			return seen, nil
+		}
+		for _, record := range records {
+			d, err := stream.ParseDeadLetter(record)
+			if err != nil {
+				log.Printf("⚠️ Skipping %s[%d]@%d: %v", record.Topic, record.Partition, record.Offset, err)
+				continue
+			}
+			if opts.reason != "" && string(d.Reason) != opts.reason {
+				continue
+			}
+			if err := fn(record, d); err != nil {
+				return seen, err
+			}
+			seen++
+			if opts.limit > 0 && seen >= opts.limit {
+				return seen, nil
+			}
+		}
+	}
+}
+
+// deadLetterView is how inspect prints a dead letter: one JSON object per
+// line. Value is the payload as text when it is valid UTF-8, else base64.
+type deadLetterView struct {
+	Partition       int32     `json:"partition"`
+	Offset          int64     `json:"offset"`
+	Reason          string    `json:"reason"`
+	Error           string    `json:"error,omitempty"`
+	SourceTopic     string    `json:"source_topic,omitempty"`
+	SourcePartition int32     `json:"source_partition"`
+	SourceOffset    int64     `json:"source_offset"`
+	SourceTimestamp time.Time `json:"source_timestamp,omitzero"`
+	Timestamp       time.Time `json:"timestamp"`
+	Encoding        string    `json:"encoding"`
+	Value           string    `json:"value"`
+}
+
+func viewOf(record *kgo.Record, d stream.DeadLetter) deadLetterView {
+	v := deadLetterView{
+		Partition:       record.Partition,
+		Offset:          record.Offset,
+		Reason:          string(d.Reason),
+		Error:           d.Err,
+		SourceTopic:     d.SourceTopic,
+		SourcePartition: d.SourcePartition,
+		SourceOffset:    d.SourceOffset,
+		SourceTimestamp: d.SourceTimestamp,
+		Timestamp:       d.Timestamp,
+		Encoding:        "utf8",
+		Value:           string(d.Value),
+	}
+	if !utf8.Valid(d.Value) {
+		v.Encoding = "base64"
+		v.Value = base64.StdEncoding.EncodeToString(d.Value)
+	}
+	return v
+}
+
+func inspect(ctx context.Context, src recordSource, out io.Writer, opts readOptions) (int, error) {
+	enc := json.NewEncoder(out)
+	return readDeadLetters(ctx, src, opts, func(record *kgo.Record, d stream.DeadLetter) error {
+		return enc.Encode(viewOf(record, d))
+	})
+}
+
+// replay publishes each dead letter's original key, value and headers to
+// to, or to its source topic when to is empty. Dead letters the producer
+// rejected never had a source topic and are skipped unless to is set. A nil
+// sink only prints what would be replayed.
+func replay(ctx context.Context, src recordSource, sink recordSink, out io.Writer, opts readOptions, to string) (replayed, skipped int, err error) {
+	_, err = readDeadLetters(ctx, src, opts, func(record *kgo.Record, d stream.DeadLetter) error {
+		target := to
+		if target == "" {
+			target = d.SourceTopic
+		}
+		if target == "" {
+			log.Printf("⏭️ Skipping %s[%d]@%d (%s): no source topic, pass -to to replay it",
+				record.Topic, record.Partition, record.Offset, d.Reason)
+			skipped++
+			return nil
+		}
+
+		origin := fmt.Sprintf("%s/%d@%d", record.Topic, record.Partition, record.Offset)
+		fmt.Fprintf(out, "%s -> %s\n", origin, target)
+		if sink == nil {
+			replayed++
+			return nil
+		}
+		replay := &kgo.Record{
+			Topic:   target,
+			Key:     d.Key,
+			Value:   d.Value,
+			Headers: append(append([]kgo.RecordHeader(nil), d.Headers...), kgo.RecordHeader{Key: HeaderReplayedFrom, Value: []byte(origin)}),
+		}
+		if err := sink.ProduceSync(ctx, replay).FirstErr(); err != nil {
+			return fmt.Errorf("replay %s to %s: %w", origin, target, err)
+		}
+		replayed++
+		return nil
+	})
+	return replayed, skipped, err
+}
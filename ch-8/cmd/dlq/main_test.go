@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/config"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// fakeSource serves each batch once, then reports an idle poll.
+type fakeSource struct {
+	batches [][]*kgo.Record
+}
+
+func (f *fakeSource) PollFetches(ctx context.Context) kgo.Fetches {
+	if len(f.batches) == 0 {
+		<-ctx.Done()
+		return kgo.NewErrFetch(ctx.Err())
+	}
+	batch := f.batches[0]
+	f.batches = f.batches[1:]
+	return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+		Topic:      "wiki.dlq",
+		Partitions: []kgo.FetchPartition{{Partition: 0, Records: batch}},
+	}}}}
+}
+
+type fakeSink struct {
+	records []*kgo.Record
+	err     error
+}
+
+func (f *fakeSink) ProduceSync(_ context.Context, rs ...*kgo.Record) kgo.ProduceResults {
+	var results kgo.ProduceResults
+	for _, r := range rs {
+		if f.err == nil {
+			f.records = append(f.records, r)
+		}
+		results = append(results, kgo.ProduceResult{Record: r, Err: f.err})
+	}
+	return results
+}
+
+func deadLetterRecord(offset int64, d stream.DeadLetter) *kgo.Record {
+	r := d.Record("wiki.dlq")
+	r.Offset = offset
+	return r
+}
+
+func decodeFailure(offset int64) stream.DeadLetter {
+	return stream.NewDeadLetter(stream.ReasonDecodeFailed, errors.New("proto: bad wire type"),
+		&kgo.Record{Topic: "wiki", Partition: 2, Offset: offset, Key: []byte("k"), Value: []byte{0xff, 0x01}})
+}
+
+var quick = readOptions{wait: 10 * time.Millisecond}
+
+func TestInspect_PrintsOneJSONLinePerDeadLetter(t *testing.T) {
+	src := &fakeSource{batches: [][]*kgo.Record{
+		{
+			deadLetterRecord(0, decodeFailure(40)),
+			deadLetterRecord(1, stream.NewRejectedEvent(stream.ReasonMalformedJSON, errors.New("eof"), []byte("{bad"))),
+		},
+		{{Offset: 2, Value: []byte("not a dead letter")}},
+	}}
+
+	var out bytes.Buffer
+	n, err := inspect(context.Background(), src, &out, quick)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+
+	var first, second deadLetterView
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+	assert.Equal(t, "decode_failed", first.Reason)
+	assert.Equal(t, "wiki", first.SourceTopic)
+	assert.Equal(t, int64(40), first.SourceOffset)
+	assert.Equal(t, "base64", first.Encoding)
+	assert.Equal(t, "/wE=", first.Value)
+	assert.Equal(t, "utf8", second.Encoding)
+	assert.Equal(t, "{bad", second.Value)
+	assert.Equal(t, int32(-1), second.SourcePartition)
+}
+
+func TestInspect_FiltersByReasonAndLimit(t *testing.T) {
+	src := &fakeSource{batches: [][]*kgo.Record{{
+		deadLetterRecord(0, stream.NewRejectedEvent(stream.ReasonMissingFields, nil, []byte("{}"))),
+		deadLetterRecord(1, decodeFailure(1)),
+		deadLetterRecord(2, decodeFailure(2)),
+		deadLetterRecord(3, decodeFailure(3)),
+	}}}
+
+	var out bytes.Buffer
+	opts := quick
+	opts.reason, opts.limit = "decode_failed", 2
+	n, err := inspect(context.Background(), src, &out, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.NotContains(t, out.String(), "missing_fields")
+}
+
+func TestReplay_PublishesOriginalBytesToSourceTopic(t *testing.T) {
+	src := &fakeSource{batches: [][]*kgo.Record{{
+		deadLetterRecord(5, decodeFailure(40)),
+		deadLetterRecord(6, stream.NewRejectedEvent(stream.ReasonMalformedJSON, nil, []byte("{bad"))),
+	}}}
+	sink := &fakeSink{}
+
+	var out bytes.Buffer
+	replayed, skipped, err := replay(context.Background(), src, sink, &out, quick, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, 1, skipped, "producer rejects have no source topic")
+
+	if assert.Len(t, sink.records, 1) {
+		r := sink.records[0]
+		assert.Equal(t, "wiki", r.Topic)
+		assert.Equal(t, []byte{0xff, 0x01}, r.Value)
+		assert.Equal(t, []byte("k"), r.Key)
+		assert.Equal(t, []kgo.RecordHeader{{Key: HeaderReplayedFrom, Value: []byte("wiki.dlq/0@5")}}, r.Headers)
+	}
+}
+
+func TestReplay_ToOverridesTargetAndDryRunPublishesNothing(t *testing.T) {
+	records := []*kgo.Record{
+		deadLetterRecord(0, decodeFailure(1)),
+		deadLetterRecord(1, stream.NewRejectedEvent(stream.ReasonMalformedJSON, nil, []byte("{bad"))),
+	}
+
+	var out bytes.Buffer
+	replayed, skipped, err := replay(context.Background(), &fakeSource{batches: [][]*kgo.Record{records}}, nil, &out, quick, "wiki.retry")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+	assert.Equal(t, 0, skipped)
+	assert.Equal(t, "wiki.dlq/0@0 -> wiki.retry\nwiki.dlq/0@1 -> wiki.retry\n", out.String())
+}
+
+func TestReplay_StopsOnProduceError(t *testing.T) {
+	src := &fakeSource{batches: [][]*kgo.Record{{deadLetterRecord(0, decodeFailure(1)), deadLetterRecord(1, decodeFailure(2))}}}
+	sink := &fakeSink{err: errors.New("broker down")}
+
+	var out bytes.Buffer
+	replayed, _, err := replay(context.Background(), src, sink, &out, quick, "")
+	assert.ErrorContains(t, err, "broker down")
+	assert.Equal(t, 0, replayed)
+}
+
+func TestRun_RejectsUnknownCommand(t *testing.T) {
+	assert.ErrorContains(t, run(nil, &bytes.Buffer{}), "missing command")
+	assert.ErrorContains(t, run([]string{"purge"}, &bytes.Buffer{}), "unknown command")
+}
+
+func TestRun_ConfigFails(t *testing.T) {
+	original := configLoadFunc
+	t.Cleanup(func() { configLoadFunc = original })
+	configLoadFunc = func(string, []string, io.Writer) (*config.Config, error) {
+		return nil, errors.New("config load failed")
+	}
+
+	err := run([]string{"inspect"}, &bytes.Buffer{})
+	assert.ErrorContains(t, err, "failed to load config")
+}
+
+func TestRun_ConfigFlagsFollowDoubleDash(t *testing.T) {
+	t.Setenv("REDPANDA_BROKER", "localhost:9092")
+	t.Setenv("DEAD_LETTER_TOPIC", "")
+	original := newKafkaClientFunc
+	t.Cleanup(func() { newKafkaClientFunc = original })
+	newKafkaClientFunc = func(...kgo.Opt) (*kgo.Client, error) {
+		t.Fatal("--print-config must not connect")
+		return nil, nil
+	}
+
+	var out bytes.Buffer
+	err := run([]string{"inspect", "-limit", "1", "--", "--dead-letter-topic=wiki.dead", "--print-config"}, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "dead_letter_topic: wiki.dead\n")
+}
@@ -2,20 +2,26 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/config"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/health"
 	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	configLoadFunc            = config.Load
+	configLoadFunc            = loadConfig
 	streamWikipediaEventsFunc = stream.StreamWikipediaEvents
+	listenAndServeFunc        = (*http.Server).ListenAndServe
 )
 
 func main() {
@@ -35,19 +41,101 @@ func run() error {
 	go handleShutdown(cancel)
 
 	cfg, err := configLoadFunc()
+	if errors.Is(err, config.ErrPrinted) || errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	log.Printf("📥 PRODUCER TOPIC: %s", cfg.WikipediaTopic)
+	log.Printf("📥 PRODUCER TOPIC: %s (dead letters to %s)", cfg.WikipediaTopic, cfg.DeadLetterTopic)
+
+	var codec stream.Codec = stream.ProtobufCodec{}
+	if cfg.EventFormat != "" {
+		if codec, err = stream.CodecByName(cfg.EventFormat); err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+	}
+
+	filter, err := stream.ParseFilter(cfg.ProducerFilter)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if len(filter.Rules()) > 0 {
+		log.Printf("🔍 Publishing only events matching: %s", filter)
+	}
+
+	router, err := stream.ParseRoutes(cfg.ProducerRoutes, cfg.WikipediaTopic)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if cfg.ProducerRoutes != "" {
+		log.Printf("🔀 Routing events: %s", router)
+	}
+
+	heartbeat := &health.Heartbeat{}
+	checker := health.NewChecker().WithCheck("wikimedia", heartbeat.Check(cfg.ReadyMaxEventAge))
+	srv := startServer(cfg.MetricsAddr, newMux(checker))
+	defer shutdownServer(srv, cfg.ShutdownTimeout)
 
-	if err := streamWikipediaEventsFunc(ctx, cfg.RedpandaBroker, cfg.WikipediaStreamURL, cfg.WikipediaTopic); err != nil {
+	err = streamWikipediaEventsFunc(ctx, stream.ProducerConfig{
+		Broker:            cfg.RedpandaBroker,
+		StreamURL:         cfg.WikipediaStreamURL,
+		Topic:             cfg.WikipediaTopic,
+		DeadLetterTopic:   cfg.DeadLetterTopic,
+		MaxInFlight:       cfg.ProducerMaxInFlight,
+		PartitionKey:      stream.PartitionKey(cfg.PartitionKey),
+		Router:            router,
+		Filter:            filter,
+		Codec:             codec,
+		SchemaRegistryURL: cfg.SchemaRegistryURL,
+		Health:            checker,
+		Heartbeat:         heartbeat,
+	})
+	if err != nil {
 		return fmt.Errorf("streaming failed: %w", err)
 	}
 
 	return nil
 }
 
+// newMux serves the metrics and the health endpoints. /readyz reports the
+// "wikimedia" check and, once streaming has started, "kafka".
+func newMux(checker *health.Checker) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	checker.Register(mux)
+	return mux
+}
+
+// loadConfig layers the config file, the environment and the command-line
+// flags.
+func loadConfig() (*config.Config, error) {
+	return config.LoadArgs("producer", os.Args[1:], os.Stdout)
+}
+
+// startServer serves /metrics, /healthz and /readyz on addr.
+func startServer(addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	listen := listenAndServeFunc
+	go func() {
+		log.Printf("📊 Metrics and health checks available at %s", srv.Addr)
+		if err := listen(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("❌ HTTP server error: %v", err)
+		}
+	}()
+	return srv
+}
+
+// shutdownServer waits up to timeout for requests in progress.
+func shutdownServer(srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("⚠️ HTTP server did not shut down cleanly: %v", err)
+	}
+}
+
 func handleShutdown(cancel context.CancelFunc) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
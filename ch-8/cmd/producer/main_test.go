@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/config"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/health"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,7 +31,7 @@ func TestRun_Success(t *testing.T) {
 			WikipediaTopic:     "test-topic",
 		}, nil
 	}
-	streamWikipediaEventsFunc = func(_ context.Context, _, _, _ string) error {
+	streamWikipediaEventsFunc = func(_ context.Context, _ stream.ProducerConfig) error {
 		return nil
 	}
 
@@ -60,7 +67,7 @@ func TestRun_StreamFails(t *testing.T) {
 			WikipediaTopic:     "test-topic",
 		}, nil
 	}
-	streamWikipediaEventsFunc = func(_ context.Context, _, _, _ string) error {
+	streamWikipediaEventsFunc = func(_ context.Context, _ stream.ProducerConfig) error {
 		return errors.New("kafka error")
 	}
 
@@ -68,3 +75,169 @@ func TestRun_StreamFails(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "streaming failed")
 }
+
+func TestRun_PassesEventFormat(t *testing.T) {
+	originalLoad := configLoadFunc
+	originalStream := streamWikipediaEventsFunc
+	t.Cleanup(func() {
+		configLoadFunc = originalLoad
+		streamWikipediaEventsFunc = originalStream
+	})
+
+	configLoadFunc = func() (*config.Config, error) {
+		return &config.Config{RedpandaBroker: "test-broker", WikipediaTopic: "test-topic", EventFormat: "avro"}, nil
+	}
+	var got stream.ProducerConfig
+	streamWikipediaEventsFunc = func(_ context.Context, cfg stream.ProducerConfig) error {
+		got = cfg
+		return nil
+	}
+
+	assert.NoError(t, run())
+	assert.Equal(t, stream.AvroCodec{}, got.Codec)
+
+	configLoadFunc = func() (*config.Config, error) {
+		return &config.Config{RedpandaBroker: "test-broker", EventFormat: "xml"}, nil
+	}
+	assert.ErrorContains(t, run(), "invalid config")
+}
+
+func TestRun_PassesFilter(t *testing.T) {
+	originalLoad := configLoadFunc
+	originalStream := streamWikipediaEventsFunc
+	t.Cleanup(func() {
+		configLoadFunc = originalLoad
+		streamWikipediaEventsFunc = originalStream
+	})
+
+	configLoadFunc = func() (*config.Config, error) {
+		return &config.Config{RedpandaBroker: "test-broker", ProducerFilter: "not bot and namespace == 0"}, nil
+	}
+	var got stream.ProducerConfig
+	streamWikipediaEventsFunc = func(_ context.Context, cfg stream.ProducerConfig) error {
+		got = cfg
+		return nil
+	}
+
+	assert.NoError(t, run())
+	assert.Equal(t, []string{"not bot", "namespace == 0"}, got.Filter.Rules())
+
+	configLoadFunc = func() (*config.Config, error) {
+		return &config.Config{RedpandaBroker: "test-broker", ProducerFilter: "bot =="}, nil
+	}
+	assert.ErrorContains(t, run(), "invalid config: filter")
+}
+
+func TestRun_PassesRoutes(t *testing.T) {
+	originalLoad := configLoadFunc
+	originalStream := streamWikipediaEventsFunc
+	t.Cleanup(func() {
+		configLoadFunc = originalLoad
+		streamWikipediaEventsFunc = originalStream
+	})
+
+	configLoadFunc = func() (*config.Config, error) {
+		return &config.Config{RedpandaBroker: "test-broker", WikipediaTopic: "wikipedia.protobuf", ProducerRoutes: "bot => wikipedia.bots"}, nil
+	}
+	var got stream.ProducerConfig
+	streamWikipediaEventsFunc = func(_ context.Context, cfg stream.ProducerConfig) error {
+		got = cfg
+		return nil
+	}
+
+	assert.NoError(t, run())
+	assert.Equal(t, "wikipedia.bots", got.Router.Topic(stream.Event{Bot: true}))
+	assert.Equal(t, "wikipedia.protobuf", got.Router.Topic(stream.Event{}))
+
+	configLoadFunc = func() (*config.Config, error) {
+		return &config.Config{RedpandaBroker: "test-broker", ProducerRoutes: "bot => wikipedia/bots"}, nil
+	}
+	assert.ErrorContains(t, run(), "invalid config: route 1")
+}
+
+func TestNewMux_ServesHealthAndMetrics(t *testing.T) {
+	heartbeat := &health.Heartbeat{}
+	checker := health.NewChecker().WithCheck("wikimedia", heartbeat.Check(time.Minute))
+	srv := httptest.NewServer(newMux(checker))
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	code, _ := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = get("/metrics")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, `"wikimedia":{"status":"fail","error":"nothing seen yet"`)
+
+	heartbeat.Beat()
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestRun_ServesHealthWhileStreaming(t *testing.T) {
+	originalLoad := configLoadFunc
+	originalStream := streamWikipediaEventsFunc
+	originalListen := listenAndServeFunc
+	t.Cleanup(func() {
+		configLoadFunc = originalLoad
+		streamWikipediaEventsFunc = originalStream
+		listenAndServeFunc = originalListen
+	})
+
+	configLoadFunc = func() (*config.Config, error) {
+		return &config.Config{WikipediaTopic: "test-topic", ReadyMaxEventAge: time.Minute, MetricsAddr: ":9191"}, nil
+	}
+	served := make(chan *http.Server, 1)
+	listenAndServeFunc = func(srv *http.Server) error {
+		served <- srv
+		return http.ErrServerClosed
+	}
+	var got stream.ProducerConfig
+	streamWikipediaEventsFunc = func(_ context.Context, cfg stream.ProducerConfig) error {
+		got = cfg
+		cfg.Heartbeat.Beat()
+		return nil
+	}
+
+	assert.NoError(t, run())
+	srv := <-served
+	assert.Equal(t, ":9191", srv.Addr)
+	if assert.NotNil(t, got.Health) {
+		report := got.Health.Run(context.Background())
+		assert.Equal(t, health.StatusOK, report.Checks["wikimedia"].Status)
+	}
+}
+
+func TestRun_PrintConfigExitsWithoutStreaming(t *testing.T) {
+	originalLoad := configLoadFunc
+	originalStream := streamWikipediaEventsFunc
+	t.Cleanup(func() {
+		configLoadFunc = originalLoad
+		streamWikipediaEventsFunc = originalStream
+	})
+
+	var out bytes.Buffer
+	configLoadFunc = func() (*config.Config, error) {
+		return config.LoadArgs("producer", []string{"--print-config", "--redpanda-broker=test-broker"}, &out)
+	}
+	streamed := false
+	streamWikipediaEventsFunc = func(context.Context, stream.ProducerConfig) error {
+		streamed = true
+		return nil
+	}
+
+	assert.NoError(t, run())
+	assert.False(t, streamed)
+	assert.Contains(t, out.String(), "redpanda_broker: test-broker\n")
+}
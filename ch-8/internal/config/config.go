@@ -0,0 +1,239 @@
+// Package config is the configuration of the producer, the consumer and
+// dlq. Every setting has a default, and may be overridden by a YAML or JSON
+// config file, then by an environment variable, then by a command-line
+// flag. The environment variable names a setting everywhere: the file key
+// is its lower-case form and the flag its lower-case form with dashes, so
+// NUM_CONSUMERS is num_consumers in a file and --num-consumers on the
+// command line.
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	RedpandaBroker     string
+	WikipediaStreamURL string
+	// Storage is where the consumer keeps its stats: "memory" or
+	// "cassandra".
+	Storage        string
+	WikipediaTopic string
+	// Workers is the number of consumer workers; DispatchKey is how records
+	// are assigned to them, "partition" or "domain".
+	Workers     int
+	DispatchKey string
+	// BatchSize is how many events a worker buffers before writing them,
+	// and FlushInterval how long it waits for that many.
+	BatchSize     int
+	FlushInterval time.Duration
+	// BatchMaxEvents and BatchMaxBytes bound each worker's buffer of
+	// unwritten events; when one fills, the consumer pauses fetching.
+	BatchMaxEvents int
+	BatchMaxBytes  int
+	// BatchMaxInFlight is how many batches each worker writes at once.
+	BatchMaxInFlight int
+	// TopKCapacity is how many users and domains the consumer's top-k
+	// sketches track.
+	TopKCapacity int
+	// ShutdownTimeout bounds the consumer's shutdown, from the signal until
+	// workers are drained, offsets committed and connections closed.
+	ShutdownTimeout time.Duration
+	// ReadyMaxEventAge is how long the producer may go without a Wikimedia
+	// event before /readyz fails.
+	ReadyMaxEventAge time.Duration
+	// StatsAddr serves the consumer's /stats, /healthz and /readyz;
+	// MetricsAddr serves /metrics, and the producer's health endpoints.
+	StatsAddr   string
+	MetricsAddr string
+	// GroupID is the Kafka consumer group the consumer joins.
+	GroupID string
+	// DeadLetterTopic receives records that could not be processed, with
+	// headers saying why and where they came from.
+	DeadLetterTopic string
+	// ProducerMaxInFlight bounds how many records the producer lets await
+	// delivery before it stops reading the stream.
+	ProducerMaxInFlight int
+	// PartitionKey is what the producer keys records by: "domain", "user",
+	// "title" or "none".
+	PartitionKey string
+	// DedupStore is where the consumer remembers processed event ids:
+	// "memory", "cassandra" (memory in front of the processed_events
+	// table) or "none". DedupWindow and DedupCapacity bound the in-memory
+	// set; DedupTTL is how long processed_events keeps an id.
+	DedupStore    string
+	DedupWindow   time.Duration
+	DedupCapacity int
+	DedupTTL      time.Duration
+	// ProducerRoutes are stream.Router rules sending events to topics other
+	// than WikipediaTopic. Empty sends everything to WikipediaTopic.
+	ProducerRoutes string
+	// ConsumerTopicRegex, when set, subscribes the consumer to every topic
+	// matching it instead of WikipediaTopic. It must not match the
+	// dead-letter topic.
+	ConsumerTopicRegex string
+	// ProducerFilter is a stream.Filter expression choosing the events the
+	// producer publishes. Empty publishes every valid event.
+	ProducerFilter string
+	// EventFormat is how the producer encodes events: "protobuf", "json"
+	// or "avro". The consumer reads all of them.
+	EventFormat string
+	// SchemaRegistryURL is the schema registry the producer registers
+	// event.proto with and the consumer resolves schema ids from. Empty
+	// produces bare protobuf.
+	SchemaRegistryURL string
+	// CassandraHosts and CassandraKeyspace are where the consumer writes
+	// when Storage is "cassandra". CassandraUsername and CassandraPassword
+	// are only needed if the cluster requires authentication.
+	CassandraHosts    []string
+	CassandraKeyspace string
+	CassandraUsername string
+	CassandraPassword string
+	// CassandraTimeout bounds connecting to Cassandra.
+	CassandraTimeout time.Duration
+}
+
+// Default is the configuration before any file, environment variable or
+// flag is applied. It is not valid on its own: REDPANDA_BROKER has no
+// default.
+func Default() *Config {
+	return &Config{
+		WikipediaStreamURL:  "https://stream.wikimedia.org/v2/stream/recentchange",
+		Storage:             "memory",
+		WikipediaTopic:      "wikipedia.changes",
+		Workers:             3,
+		DispatchKey:         "partition",
+		BatchSize:           20,
+		FlushInterval:       5 * time.Second,
+		BatchMaxEvents:      10000,
+		BatchMaxBytes:       8 << 20,
+		BatchMaxInFlight:    1,
+		TopKCapacity:        1000,
+		ShutdownTimeout:     30 * time.Second,
+		ReadyMaxEventAge:    time.Minute,
+		StatsAddr:           ":8080",
+		MetricsAddr:         ":2112",
+		GroupID:             "wikipedia-consumer-group",
+		ProducerMaxInFlight: 1000,
+		PartitionKey:        "domain",
+		DedupStore:          "memory",
+		DedupWindow:         time.Hour,
+		DedupCapacity:       100000,
+		DedupTTL:            24 * time.Hour,
+		EventFormat:         "protobuf",
+		CassandraHosts:      []string{"cassandra"},
+		CassandraKeyspace:   "goanalytics",
+		CassandraTimeout:    5 * time.Second,
+	}
+}
+
+// setting is one field of a Config as the file, environment and flag
+// layers see it.
+type setting struct {
+	// env is the setting's environment variable, and its name in
+	// validation errors.
+	env   string
+	usage string
+	// secret settings are redacted when the config is printed.
+	secret bool
+	// value is the field: a *string, *int, *time.Duration or *[]string.
+	value any
+}
+
+// key is the setting's name in a config file.
+func (s setting) key() string { return strings.ToLower(s.env) }
+
+// flag is the setting's command-line flag, without dashes.
+func (s setting) flag() string { return strings.ReplaceAll(s.key(), "_", "-") }
+
+// set parses raw into the field. Lists are comma-separated.
+func (s setting) set(raw string) error {
+	switch v := s.value.(type) {
+	case *string:
+		*v = raw
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s must be an integer, got %q", s.env, raw)
+		}
+		*v = n
+	case *time.Duration:
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s must be a duration such as 30s, got %q", s.env, raw)
+		}
+		*v = d
+	case *[]string:
+		var list []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*v = list
+	default:
+		panic(fmt.Sprintf("config: %s has unsupported type %T", s.env, s.value))
+	}
+	return nil
+}
+
+// String formats the field the way set parses it.
+func (s setting) String() string {
+	switch v := s.value.(type) {
+	case *string:
+		return *v
+	case *int:
+		return strconv.Itoa(*v)
+	case *time.Duration:
+		return v.String()
+	case *[]string:
+		return strings.Join(*v, ",")
+	}
+	return fmt.Sprint(s.value)
+}
+
+// settings lists every field of c, in the order they are printed.
+func (c *Config) settings() []setting {
+	return []setting{
+		{env: "REDPANDA_BROKER", usage: "Kafka broker to connect to, as host:port", value: &c.RedpandaBroker},
+		{env: "WIKIPEDIA_TOPIC", usage: "topic the producer writes to and the consumer reads", value: &c.WikipediaTopic},
+		{env: "DEAD_LETTER_TOPIC", usage: "topic for records that could not be processed (default WIKIPEDIA_TOPIC.dlq)", value: &c.DeadLetterTopic},
+		{env: "EVENT_FORMAT", usage: "how the producer encodes events: protobuf, json or avro", value: &c.EventFormat},
+		{env: "SCHEMA_REGISTRY_URL", usage: "schema registry for event.proto; empty produces bare protobuf", value: &c.SchemaRegistryURL},
+
+		{env: "WIKIPEDIA_STREAM_URL", usage: "Wikimedia server-sent events stream the producer reads", value: &c.WikipediaStreamURL},
+		{env: "PRODUCER_MAX_IN_FLIGHT", usage: "records the producer lets await delivery before it stops reading", value: &c.ProducerMaxInFlight},
+		{env: "PARTITION_KEY", usage: "what the producer keys records by: domain, user, title or none", value: &c.PartitionKey},
+		{env: "PRODUCER_FILTER", usage: "expression choosing the events the producer publishes; empty publishes all", value: &c.ProducerFilter},
+		{env: "PRODUCER_ROUTES", usage: "rules sending events to other topics, one 'expression => topic' per line", value: &c.ProducerRoutes},
+		{env: "READY_MAX_EVENT_AGE", usage: "how long the producer may go without an event before /readyz fails", value: &c.ReadyMaxEventAge},
+
+		{env: "CONSUMER_GROUP_ID", usage: "Kafka consumer group the consumer joins", value: &c.GroupID},
+		{env: "CONSUMER_TOPIC_REGEX", usage: "subscribe to every topic matching this instead of WIKIPEDIA_TOPIC", value: &c.ConsumerTopicRegex},
+		{env: "NUM_CONSUMERS", usage: "number of consumer workers", value: &c.Workers},
+		{env: "DISPATCH_KEY", usage: "how records are assigned to workers: partition or domain", value: &c.DispatchKey},
+		{env: "BATCH_SIZE", usage: "events a worker buffers before writing them", value: &c.BatchSize},
+		{env: "FLUSH_INTERVAL", usage: "longest a worker waits for BATCH_SIZE events before writing", value: &c.FlushInterval},
+		{env: "BATCH_MAX_EVENTS", usage: "unwritten events a worker holds before the consumer pauses fetching", value: &c.BatchMaxEvents},
+		{env: "BATCH_MAX_BYTES", usage: "unwritten bytes a worker holds before the consumer pauses fetching", value: &c.BatchMaxBytes},
+		{env: "BATCH_MAX_IN_FLIGHT", usage: "batches each worker writes at once", value: &c.BatchMaxInFlight},
+		{env: "TOP_K_CAPACITY", usage: "users and domains tracked by the top-k sketches", value: &c.TopKCapacity},
+		{env: "DEDUP_STORE", usage: "where processed event ids are remembered: memory, cassandra or none", value: &c.DedupStore},
+		{env: "DEDUP_CAPACITY", usage: "event ids remembered in memory", value: &c.DedupCapacity},
+		{env: "DEDUP_WINDOW", usage: "how long event ids are remembered in memory", value: &c.DedupWindow},
+		{env: "DEDUP_TTL", usage: "how long Cassandra remembers an event id", value: &c.DedupTTL},
+		{env: "SHUTDOWN_TIMEOUT", usage: "how long the consumer may take to drain, commit and close on shutdown", value: &c.ShutdownTimeout},
+
+		{env: "STORAGE", usage: "where the consumer keeps its stats: memory or cassandra", value: &c.Storage},
+		{env: "CASSANDRA_HOSTS", usage: "Cassandra contact points, comma-separated", value: &c.CassandraHosts},
+		{env: "CASSANDRA_KEYSPACE", usage: "Cassandra keyspace holding the stats tables", value: &c.CassandraKeyspace},
+		{env: "CASSANDRA_USERNAME", usage: "Cassandra user, if the cluster requires authentication", value: &c.CassandraUsername},
+		{env: "CASSANDRA_PASSWORD", usage: "Cassandra password for CASSANDRA_USERNAME", secret: true, value: &c.CassandraPassword},
+		{env: "CASSANDRA_TIMEOUT", usage: "how long connecting to Cassandra may take", value: &c.CassandraTimeout},
+
+		{env: "STATS_ADDR", usage: "address the consumer serves /stats, /healthz and /readyz on", value: &c.StatsAddr},
+		{env: "METRICS_ADDR", usage: "address serving /metrics, and the producer's /healthz and /readyz", value: &c.MetricsAddr},
+	}
+}
@@ -1,35 +1,205 @@
 package config
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+
+	"gopkg.in/yaml.v3"
 )
 
-type Config struct {
-	RedpandaBroker     string
-	WikipediaStreamURL string
-	Storage            string
-	WikipediaTopic     string
+// ErrPrinted is returned by LoadArgs once --print-config has printed the
+// config. The command should exit successfully without running.
+var ErrPrinted = errors.New("config printed")
+
+// assignment is a raw value from a layer for the setting named env.
+type assignment struct {
+	env string
+	raw string
 }
 
+// Load layers the defaults, the config file named by CONFIG_FILE, if any,
+// and the environment, then validates the result.
 func Load() (*Config, error) {
-	cfg := &Config{
-		RedpandaBroker:     os.Getenv("REDPANDA_BROKER"),
-		WikipediaStreamURL: os.Getenv("WIKIPEDIA_STREAM_URL"),
-		Storage:            os.Getenv("STORAGE"),
-		WikipediaTopic:     os.Getenv("WIKIPEDIA_TOPIC"),
+	cfg, err := load(os.Getenv("CONFIG_FILE"), nil)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadArgs is Load with the command-line flags in args on top. --config
+// names the config file instead of CONFIG_FILE. With --print-config it
+// writes the effective config, secrets redacted, to out and returns
+// ErrPrinted, or the validation error if the config is not valid. -h
+// returns flag.ErrHelp.
+func LoadArgs(name string, args []string, out io.Writer) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON config file (env CONFIG_FILE)")
+	printConfig := fs.Bool("print-config", false, "print the effective config, secrets redacted, and exit")
+
+	var flags []assignment
+	for _, s := range Default().settings() {
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		if def := s.String(); def != "" {
+			usage = fmt.Sprintf("%s (env %s, default %q)", s.usage, s.env, def)
+		}
+		fs.Func(s.flag(), usage, func(raw string) error {
+			flags = append(flags, assignment{env: s.env, raw: raw})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", fs.Args())
 	}
 
-	if cfg.RedpandaBroker == "" {
-		return nil, fmt.Errorf("REDPANDA_BROKER must be set")
+	cfg, err := load(*file, flags)
+	if *printConfig && cfg != nil {
+		if perr := cfg.Print(out); perr != nil {
+			return nil, perr
+		}
+		if err == nil {
+			err = ErrPrinted
+		}
 	}
-	if cfg.WikipediaStreamURL == "" {
-		cfg.WikipediaStreamURL = "https://stream.wikimedia.org/v2/stream/recentchange"
+	if err != nil {
+		return nil, err
 	}
+	return cfg, nil
+}
+
+// load applies each layer in turn and validates the result. Problems with
+// any setting are collected rather than stopping at the first, so the
+// *ValidationError lists all of them; cfg is returned with it.
+func load(file string, flags []assignment) (*Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	var problems []string
+	if file != "" {
+		assignments, fileProblems, err := readFile(file, settings)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, fileProblems...)
+		problems = append(problems, apply(cfg, assignments, file)...)
+	}
+	problems = append(problems, apply(cfg, fromEnv(settings), "env")...)
+	problems = append(problems, apply(cfg, flags, "flag")...)
 
-	if cfg.WikipediaTopic == "" {
-		cfg.WikipediaTopic = "wikipedia.changes"
+	if cfg.DeadLetterTopic == "" {
+		cfg.DeadLetterTopic = cfg.WikipediaTopic + ".dlq"
 	}
 
+	var verr *ValidationError
+	if err := cfg.Validate(); errors.As(err, &verr) {
+		problems = append(problems, verr.Problems...)
+	}
+	if len(problems) > 0 {
+		return cfg, &ValidationError{Problems: problems}
+	}
 	return cfg, nil
 }
+
+// apply sets each assignment on cfg and returns the values that did not
+// parse, saying which layer they came from.
+func apply(cfg *Config, assignments []assignment, source string) []string {
+	byEnv := make(map[string]setting)
+	for _, s := range cfg.settings() {
+		byEnv[s.env] = s
+	}
+	var problems []string
+	for _, a := range assignments {
+		s := byEnv[a.env]
+		if err := s.set(a.raw); err != nil {
+			from := source
+			if source == "flag" {
+				from = "flag --" + s.flag()
+			}
+			problems = append(problems, fmt.Sprintf("%v (from %s)", err, from))
+		}
+	}
+	return problems
+}
+
+// fromEnv is every setting whose environment variable is set and not
+// empty.
+func fromEnv(settings []setting) []assignment {
+	var assignments []assignment
+	for _, s := range settings {
+		if v := os.Getenv(s.env); v != "" {
+			assignments = append(assignments, assignment{env: s.env, raw: v})
+		}
+	}
+	return assignments
+}
+
+// readFile reads a config file: a mapping of setting keys to scalars, or
+// to sequences for list settings. JSON is read as the YAML it also is.
+// Unknown keys and values of the wrong shape are returned as problems; err
+// is only for a file that cannot be read or parsed at all.
+func readFile(path string, settings []setting) (assignments []assignment, problems []string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("config file %s must be a mapping of settings", path)
+	}
+
+	byKey := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byKey[s.key()] = s
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i].Value, root.Content[i+1]
+		s, ok := byKey[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown setting %q (line %d of %s)", key, root.Content[i].Line, path))
+			continue
+		}
+		raw, err := scalar(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %v (line %d of %s)", s.env, err, value.Line, path))
+			continue
+		}
+		if value.Tag != "!!null" {
+			assignments = append(assignments, assignment{env: s.env, raw: raw})
+		}
+	}
+	return assignments, problems, nil
+}
+
+// scalar is a file value as set parses it; sequences are comma-joined.
+func scalar(n *yaml.Node) (string, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return n.Value, nil
+	case yaml.SequenceNode:
+		raw := ""
+		for i, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("must be a list of plain values")
+			}
+			if i > 0 {
+				raw += ","
+			}
+			raw += item.Value
+		}
+		return raw, nil
+	}
+	return "", errors.New("must be a plain value or a list")
+}
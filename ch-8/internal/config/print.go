@@ -0,0 +1,72 @@
+package config
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Redacted replaces a secret's value when the config is printed.
+const Redacted = "REDACTED"
+
+// Print writes c as a YAML config file, each setting under a comment
+// saying what it is. Secrets, and passwords in URLs, are redacted, so the
+// output is safe to log but not to load back if it had any.
+func (c *Config) Print(w io.Writer) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range c.settings() {
+		key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s.key(), HeadComment: s.usage}
+		root.Content = append(root.Content, key, printed(s))
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// printed is the node for s's value, redacted if it is a secret.
+func printed(s setting) *yaml.Node {
+	str := func(v string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+	}
+	switch v := s.value.(type) {
+	case *string:
+		if s.secret && *v != "" {
+			return str(Redacted)
+		}
+		return str(redactURL(*v))
+	case *int:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(*v)}
+	case *time.Duration:
+		return str(v.String())
+	case *[]string:
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		for _, item := range *v {
+			seq.Content = append(seq.Content, str(item))
+		}
+		return seq
+	}
+	return str(s.String())
+}
+
+// redactURL hides the password in v if v is a URL with one.
+func redactURL(v string) string {
+	if !strings.Contains(v, "://") {
+		return v
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.User == nil {
+		return v
+	}
+	if _, ok := u.User.Password(); !ok {
+		return v
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+)
+
+// ValidationError lists every setting that is not valid, each named by its
+// environment variable.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid config: " + e.Problems[0]
+	}
+	return "invalid config:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Validate checks every setting, returning a *ValidationError listing all
+// that are not valid.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	if c.RedpandaBroker == "" {
+		v.addf("REDPANDA_BROKER must be set")
+	}
+	v.oneOf("STORAGE", c.Storage, "memory", "in-memory", "cassandra")
+	v.oneOf("EVENT_FORMAT", c.EventFormat, "protobuf", "json", "avro")
+	v.oneOf("PARTITION_KEY", c.PartitionKey, "domain", "user", "title", "none")
+	v.oneOf("DISPATCH_KEY", c.DispatchKey, "partition", "domain")
+	v.oneOf("DEDUP_STORE", c.DedupStore, "memory", "cassandra", "none")
+
+	if c.WikipediaTopic == "" {
+		v.addf("WIKIPEDIA_TOPIC must be set")
+	}
+	if c.DeadLetterTopic == c.WikipediaTopic {
+		v.addf("DEAD_LETTER_TOPIC must differ from WIKIPEDIA_TOPIC %q", c.WikipediaTopic)
+	}
+	if c.ConsumerTopicRegex != "" {
+		re, err := regexp.Compile(c.ConsumerTopicRegex)
+		switch {
+		case err != nil:
+			v.addf("CONSUMER_TOPIC_REGEX is not a valid regular expression: %v", err)
+		case re.MatchString(c.DeadLetterTopic):
+			v.addf("CONSUMER_TOPIC_REGEX %q must not match DEAD_LETTER_TOPIC %q", c.ConsumerTopicRegex, c.DeadLetterTopic)
+		}
+	}
+	if _, err := stream.ParseFilter(c.ProducerFilter); err != nil {
+		v.addf("PRODUCER_FILTER is not valid: %v", err)
+	}
+	if _, err := stream.ParseRoutes(c.ProducerRoutes, c.WikipediaTopic); err != nil {
+		v.addf("PRODUCER_ROUTES is not valid: %v", err)
+	}
+	if c.GroupID == "" {
+		v.addf("CONSUMER_GROUP_ID must be set")
+	}
+
+	v.positive("NUM_CONSUMERS", c.Workers)
+	v.positive("BATCH_SIZE", c.BatchSize)
+	v.positive("BATCH_MAX_EVENTS", c.BatchMaxEvents)
+	v.positive("BATCH_MAX_BYTES", c.BatchMaxBytes)
+	v.positive("BATCH_MAX_IN_FLIGHT", c.BatchMaxInFlight)
+	v.positive("TOP_K_CAPACITY", c.TopKCapacity)
+	v.positive("PRODUCER_MAX_IN_FLIGHT", c.ProducerMaxInFlight)
+	v.positive("DEDUP_CAPACITY", c.DedupCapacity)
+
+	v.positiveDuration("FLUSH_INTERVAL", c.FlushInterval)
+	v.positiveDuration("SHUTDOWN_TIMEOUT", c.ShutdownTimeout)
+	v.positiveDuration("READY_MAX_EVENT_AGE", c.ReadyMaxEventAge)
+	v.positiveDuration("DEDUP_WINDOW", c.DedupWindow)
+	v.positiveDuration("DEDUP_TTL", c.DedupTTL)
+	v.positiveDuration("CASSANDRA_TIMEOUT", c.CassandraTimeout)
+
+	if c.Storage == "cassandra" {
+		if len(c.CassandraHosts) == 0 {
+			v.addf("CASSANDRA_HOSTS must be set when STORAGE is cassandra")
+		}
+		if c.CassandraKeyspace == "" {
+			v.addf("CASSANDRA_KEYSPACE must be set when STORAGE is cassandra")
+		}
+	}
+	if c.CassandraPassword != "" && c.CassandraUsername == "" {
+		v.addf("CASSANDRA_PASSWORD is set but CASSANDRA_USERNAME is not")
+	}
+
+	v.addr("STATS_ADDR", c.StatsAddr)
+	v.addr("METRICS_ADDR", c.MetricsAddr)
+	if c.StatsAddr != "" && c.StatsAddr == c.MetricsAddr {
+		v.addf("STATS_ADDR and METRICS_ADDR must differ, both are %q", c.StatsAddr)
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(format string, args ...any) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) oneOf(name, value string, allowed ...string) {
+	if !slices.Contains(allowed, value) {
+		v.addf("%s must be %s or %s, got %q", name,
+			strings.Join(allowed[:len(allowed)-1], ", "), allowed[len(allowed)-1], value)
+	}
+}
+
+func (v *validator) positive(name string, n int) {
+	if n < 1 {
+		v.addf("%s must be a positive integer, got %d", name, n)
+	}
+}
+
+func (v *validator) positiveDuration(name string, d time.Duration) {
+	if d <= 0 {
+		v.addf("%s must be a positive duration such as 30s, got %s", name, d)
+	}
+}
+
+func (v *validator) addr(name, addr string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		v.addf("%s must be host:port or :port, got %q", name, addr)
+	}
+}
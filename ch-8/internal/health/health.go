@@ -0,0 +1,195 @@
+// Package health serves liveness and readiness endpoints. /healthz only
+// says the process is up; /readyz runs a set of named checks against the
+// service's dependencies and reports each of them, so Kubernetes probes
+// and people can both see what is wrong.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status is the outcome of a check, or of all of them.
+type Status string
+
+const (
+	StatusOK   Status = "ok"
+	StatusFail Status = "fail"
+)
+
+// DefaultCheckTimeout bounds each check unless WithTimeout says otherwise.
+const DefaultCheckTimeout = 2 * time.Second
+
+// Check reports whether a dependency is usable. It should give up when ctx
+// is done.
+type Check func(ctx context.Context) error
+
+// Result is one check's outcome in a Report.
+type Result struct {
+	Status     Status  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Report is the body of /readyz. Status is ok only if every check is.
+type Report struct {
+	Status Status            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs readiness checks. Checks may be added while it is serving.
+type Checker struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	checks []namedCheck
+}
+
+func NewChecker() *Checker {
+	return &Checker{timeout: DefaultCheckTimeout}
+}
+
+// WithTimeout bounds each check to d.
+func (c *Checker) WithTimeout(d time.Duration) *Checker {
+	c.timeout = d
+	return c
+}
+
+// WithCheck adds a check reported under name, replacing any check already
+// registered under it.
+func (c *Checker) WithCheck(name string, check Check) *Checker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, nc := range c.checks {
+		if nc.name == name {
+			c.checks[i].check = check
+			return c
+		}
+	}
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+	return c
+}
+
+// Run runs every check concurrently, each within the checker's timeout.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.Lock()
+	checks := append([]namedCheck(nil), c.checks...)
+	c.mu.Unlock()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.run(ctx, nc.check)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	for i, nc := range checks {
+		report.Checks[nc.name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	result := Result{Status: StatusOK, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// ReadyHandler serves the report as JSON, with 200 if every check passed
+// and 503 otherwise.
+func (c *Checker) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Run(r.Context())
+		code := http.StatusOK
+		if report.Status != StatusOK {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, report)
+	})
+}
+
+// LiveHandler always answers 200: a process that can serve it is alive.
+// Dependencies are left to readiness, so an outage does not restart pods
+// that would only find it still there.
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, Report{Status: StatusOK, Checks: map[string]Result{}})
+	})
+}
+
+// Register serves LiveHandler on /healthz and c's ReadyHandler on /readyz.
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.Handle("/healthz", LiveHandler())
+	mux.Handle("/readyz", c.ReadyHandler())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// Heartbeat records when something last happened, for a check that it
+// happened recently. The zero value has never beaten.
+type Heartbeat struct {
+	last atomic.Int64
+}
+
+// Beat records that it happened now.
+func (h *Heartbeat) Beat() {
+	h.last.Store(time.Now().UnixNano())
+}
+
+// Last is when Beat was last called, or the zero time.
+func (h *Heartbeat) Last() time.Time {
+	n := h.last.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// ErrNoHeartbeat is returned by a heartbeat check before the first beat.
+var ErrNoHeartbeat = errors.New("nothing seen yet")
+
+// Check fails unless the last beat was within maxAge.
+func (h *Heartbeat) Check(maxAge time.Duration) Check {
+	return func(context.Context) error {
+		last := h.Last()
+		if last.IsZero() {
+			return ErrNoHeartbeat
+		}
+		if age := time.Since(last); age > maxAge {
+			return fmt.Errorf("last seen %s ago, more than %s", age.Round(time.Millisecond), maxAge)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,107 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/health"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, mux *http.ServeMux, path string) (int, health.Report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var report health.Report
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	return rec.Code, report
+}
+
+func TestReadyz_AllChecksPass(t *testing.T) {
+	mux := http.NewServeMux()
+	health.NewChecker().
+		WithCheck("kafka", func(context.Context) error { return nil }).
+		WithCheck("cassandra", func(context.Context) error { return nil }).
+		Register(mux)
+
+	code, report := get(t, mux, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOK, report.Status)
+	assert.Len(t, report.Checks, 2)
+	assert.Equal(t, health.StatusOK, report.Checks["kafka"].Status)
+	assert.Empty(t, report.Checks["kafka"].Error)
+}
+
+func TestReadyz_ReportsEachFailingCheck(t *testing.T) {
+	mux := http.NewServeMux()
+	health.NewChecker().
+		WithCheck("kafka", func(context.Context) error { return nil }).
+		WithCheck("cassandra", func(context.Context) error { return errors.New("no hosts available") }).
+		Register(mux)
+
+	code, report := get(t, mux, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, health.StatusFail, report.Status)
+	assert.Equal(t, health.StatusOK, report.Checks["kafka"].Status)
+	assert.Equal(t, health.StatusFail, report.Checks["cassandra"].Status)
+	assert.Equal(t, "no hosts available", report.Checks["cassandra"].Error)
+}
+
+func TestReadyz_TimesOutSlowChecks(t *testing.T) {
+	checker := health.NewChecker().WithTimeout(20*time.Millisecond).
+		WithCheck("stuck", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}).
+		WithCheck("also stuck", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+	start := time.Now()
+	report := checker.Run(context.Background())
+	assert.Less(t, time.Since(start), 200*time.Millisecond, "checks did not run concurrently")
+	assert.Equal(t, health.StatusFail, report.Status)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks["stuck"].Error)
+}
+
+func TestChecker_WithCheckReplacesByName(t *testing.T) {
+	checker := health.NewChecker().
+		WithCheck("kafka", func(context.Context) error { return errors.New("down") }).
+		WithCheck("kafka", func(context.Context) error { return nil })
+
+	report := checker.Run(context.Background())
+	assert.Equal(t, health.StatusOK, report.Status)
+	assert.Len(t, report.Checks, 1)
+}
+
+func TestHealthz_AlwaysOK(t *testing.T) {
+	mux := http.NewServeMux()
+	health.NewChecker().
+		WithCheck("kafka", func(context.Context) error { return errors.New("down") }).
+		Register(mux)
+
+	code, report := get(t, mux, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOK, report.Status)
+}
+
+func TestHeartbeat(t *testing.T) {
+	var h health.Heartbeat
+	check := h.Check(50 * time.Millisecond)
+	assert.True(t, h.Last().IsZero())
+	assert.ErrorIs(t, check(context.Background()), health.ErrNoHeartbeat)
+
+	h.Beat()
+	assert.NoError(t, check(context.Background()))
+	assert.WithinDuration(t, time.Now(), h.Last(), time.Second)
+
+	time.Sleep(60 * time.Millisecond)
+	assert.ErrorContains(t, check(context.Background()), "more than 50ms")
+}
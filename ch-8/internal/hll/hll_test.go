@@ -0,0 +1,99 @@
+package hll_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/hll"
+	"github.com/stretchr/testify/assert"
+)
+
+func within(t *testing.T, s *hll.Sketch, want int, sigmas float64) {
+	t.Helper()
+	got := float64(s.Estimate())
+	tolerance := sigmas * s.StdError() * float64(want)
+	assert.InDelta(t, float64(want), got, math.Max(tolerance, 2), "estimate %v for %d distinct", got, want)
+}
+
+func TestSketch_Empty(t *testing.T) {
+	assert.Equal(t, uint64(0), hll.New().Estimate())
+}
+
+func TestSketch_SmallCardinalityIsNearExact(t *testing.T) {
+	s := hll.New()
+	for i := 0; i < 100; i++ {
+		s.Add(fmt.Sprintf("user%d", i))
+		s.Add(fmt.Sprintf("user%d", i))
+	}
+	within(t, s, 100, 1)
+}
+
+func TestSketch_LargeCardinalityWithinStdError(t *testing.T) {
+	s := hll.New()
+	for i := 0; i < 500000; i++ {
+		s.Add(fmt.Sprintf("user%d", i))
+	}
+	within(t, s, 500000, 3)
+	assert.InDelta(t, 0.0081, s.StdError(), 0.0001)
+}
+
+func TestSketch_MergeEstimatesUnion(t *testing.T) {
+	a, b := hll.New(), hll.New()
+	for i := 0; i < 30000; i++ {
+		a.Add(fmt.Sprintf("user%d", i))
+	}
+	for i := 20000; i < 50000; i++ {
+		b.Add(fmt.Sprintf("user%d", i))
+	}
+
+	assert.NoError(t, a.Merge(b))
+	within(t, a, 50000, 3)
+}
+
+func TestSketch_MergePrecisionMismatch(t *testing.T) {
+	small, err := hll.NewWithPrecision(10)
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, hll.New().Merge(small), hll.ErrPrecisionMismatch)
+}
+
+func TestNewWithPrecision_OutOfRange(t *testing.T) {
+	_, err := hll.NewWithPrecision(3)
+	assert.Error(t, err)
+	_, err = hll.NewWithPrecision(19)
+	assert.Error(t, err)
+}
+
+func TestSketch_BinaryRoundTrip(t *testing.T) {
+	s, _ := hll.NewWithPrecision(12)
+	for i := 0; i < 1000; i++ {
+		s.Add(fmt.Sprintf("user%d", i))
+	}
+
+	data, err := s.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Len(t, data, 2+4096)
+
+	var decoded hll.Sketch
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, uint8(12), decoded.Precision())
+	assert.Equal(t, s.Estimate(), decoded.Estimate())
+}
+
+func TestSketch_UnmarshalRejectsGarbage(t *testing.T) {
+	var s hll.Sketch
+	for _, data := range [][]byte{nil, {2, 12}, {1, 12, 0, 0}, {1, 30}} {
+		assert.ErrorIs(t, s.UnmarshalBinary(data), hll.ErrInvalidEncoding)
+	}
+}
+
+func TestSketch_CloneIsIndependent(t *testing.T) {
+	s := hll.New()
+	s.Add("alice")
+	c := s.Clone()
+	c.Add("bob")
+
+	assert.Equal(t, uint64(1), s.Estimate())
+	assert.Equal(t, uint64(2), c.Estimate())
+}
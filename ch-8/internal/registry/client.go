@@ -0,0 +1,200 @@
+// Package registry talks to a Confluent-compatible schema registry, such as
+// the one built into Redpanda, and implements its wire format.
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+// SchemaType is the registry's name for a schema language. The registry
+// omits it for Avro, the original and default type.
+type SchemaType string
+
+const (
+	TypeAvro     SchemaType = "AVRO"
+	TypeProtobuf SchemaType = "PROTOBUF"
+	TypeJSON     SchemaType = "JSON"
+)
+
+// Schema is a registered schema. IDs are global to the registry; the same
+// schema registered under several subjects keeps one id.
+type Schema struct {
+	ID     int
+	Type   SchemaType
+	Schema string
+}
+
+// SubjectVersion is one version of a subject.
+type SubjectVersion struct {
+	Subject string
+	Version int
+	Schema  Schema
+}
+
+// ErrNotFound matches registry errors for unknown subjects, versions or
+// schema ids.
+var ErrNotFound = errors.New("not found in schema registry")
+
+// Error is an error response from the registry.
+type Error struct {
+	StatusCode int
+	Code       int    `json:"error_code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("schema registry: %s (status %d, code %d)", e.Message, e.StatusCode, e.Code)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// TopicSubject is the subject a topic's record values are registered
+// under by the default TopicNameStrategy.
+func TopicSubject(topic string) string {
+	return topic + "-value"
+}
+
+// Client registers and looks up schemas. Schemas never change once
+// registered, so lookups by id are cached for the life of the client.
+type Client struct {
+	baseURL string
+	http    *http.Client
+
+	mu   sync.RWMutex
+	byID map[int]Schema
+}
+
+// NewClient creates a client for the registry at baseURL, e.g.
+// http://redpanda:8081, using http.DefaultClient.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    http.DefaultClient,
+		byID:    make(map[int]Schema),
+	}
+}
+
+// WithHTTPClient overrides the HTTP client, e.g. to set a timeout.
+func (c *Client) WithHTTPClient(h *http.Client) *Client {
+	c.http = h
+	return c
+}
+
+// schemaJSON is the registry's representation of a schema in requests and
+// responses.
+type schemaJSON struct {
+	Subject    string     `json:"subject,omitempty"`
+	Version    int        `json:"version,omitempty"`
+	ID         int        `json:"id,omitempty"`
+	Schema     string     `json:"schema"`
+	SchemaType SchemaType `json:"schemaType,omitempty"`
+}
+
+func (s schemaJSON) schema(id int) Schema {
+	t := s.SchemaType
+	if t == "" {
+		t = TypeAvro
+	}
+	return Schema{ID: id, Type: t, Schema: s.Schema}
+}
+
+// Register adds schema to subject, or finds it if it is already there, and
+// returns its id. The registry rejects schemas that break the subject's
+// compatibility rules.
+func (c *Client) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	body := schemaJSON{Schema: schema.Schema}
+	if schema.Type != TypeAvro {
+		body.SchemaType = schema.Type
+	}
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", body, &resp); err != nil {
+		return 0, fmt.Errorf("register schema under %s: %w", subject, err)
+	}
+	schema.ID = resp.ID
+	c.remember(schema)
+	return resp.ID, nil
+}
+
+// SchemaByID returns the schema registered with id.
+func (c *Client) SchemaByID(ctx context.Context, id int) (Schema, error) {
+	c.mu.RLock()
+	s, ok := c.byID[id]
+	c.mu.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	var resp schemaJSON
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &resp); err != nil {
+		return Schema{}, fmt.Errorf("look up schema %d: %w", id, err)
+	}
+	s = resp.schema(id)
+	c.remember(s)
+	return s, nil
+}
+
+// Latest returns the newest version of subject.
+func (c *Client) Latest(ctx context.Context, subject string) (SubjectVersion, error) {
+	var resp schemaJSON
+	if err := c.do(ctx, http.MethodGet, "/subjects/"+url.PathEscape(subject)+"/versions/latest", nil, &resp); err != nil {
+		return SubjectVersion{}, fmt.Errorf("look up latest %s: %w", subject, err)
+	}
+	s := resp.schema(resp.ID)
+	c.remember(s)
+	return SubjectVersion{Subject: resp.Subject, Version: resp.Version, Schema: s}, nil
+}
+
+func (c *Client) remember(s Schema) {
+	c.mu.Lock()
+	c.byID[s.ID] = s
+	c.mu.Unlock()
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		regErr := &Error{StatusCode: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(regErr); err != nil || regErr.Message == "" {
+			regErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return regErr
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,173 @@
+package registry_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRegistry implements the parts of the schema registry API the client
+// uses, keeping schemas in memory.
+type fakeRegistry struct {
+	mu       sync.Mutex
+	schemas  []map[string]any // index is id-1
+	subjects map[string][]int // subject -> schema id per version
+	lookups  int
+}
+
+func newFakeRegistry(t *testing.T) (*fakeRegistry, *httptest.Server) {
+	f := &fakeRegistry{subjects: make(map[string][]int)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "subjects" && parts[2] == "versions":
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["schema"] == "" {
+			f.fail(w, http.StatusUnprocessableEntity, 42201, "Invalid schema")
+			return
+		}
+		id := f.find(body)
+		if id == 0 {
+			f.schemas = append(f.schemas, body)
+			id = len(f.schemas)
+		}
+		if versions := f.subjects[parts[1]]; len(versions) == 0 || versions[len(versions)-1] != id {
+			f.subjects[parts[1]] = append(versions, id)
+		}
+		json.NewEncoder(w).Encode(map[string]int{"id": id})
+
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "schemas" && parts[1] == "ids":
+		f.lookups++
+		id, _ := strconv.Atoi(parts[2])
+		if id < 1 || id > len(f.schemas) {
+			f.fail(w, http.StatusNotFound, 40403, "Schema not found")
+			return
+		}
+		json.NewEncoder(w).Encode(f.schemas[id-1])
+
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[0] == "subjects" && parts[3] == "latest":
+		versions := f.subjects[parts[1]]
+		if len(versions) == 0 {
+			f.fail(w, http.StatusNotFound, 40401, "Subject not found")
+			return
+		}
+		id := versions[len(versions)-1]
+		resp := map[string]any{"subject": parts[1], "version": len(versions), "id": id}
+		for k, v := range f.schemas[id-1] {
+			resp[k] = v
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	default:
+		f.fail(w, http.StatusNotFound, 404, "HTTP 404 Not Found")
+	}
+}
+
+func (f *fakeRegistry) find(body map[string]any) int {
+	for i, s := range f.schemas {
+		if s["schema"] == body["schema"] && s["schemaType"] == body["schemaType"] {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (f *fakeRegistry) fail(w http.ResponseWriter, status, code int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error_code": code, "message": msg})
+}
+
+const eventV1 = `syntax = "proto3"; message Event { string domain = 1; }`
+const eventV2 = `syntax = "proto3"; message Event { string domain = 1; bool bot = 10; }`
+
+func TestClient_RegisterIsIdempotent(t *testing.T) {
+	_, srv := newFakeRegistry(t)
+	client := registry.NewClient(srv.URL + "/")
+	ctx := context.Background()
+
+	id, err := client.Register(ctx, "wikipedia-value", registry.Schema{Type: registry.TypeProtobuf, Schema: eventV1})
+	assert.NoError(t, err)
+	again, err := client.Register(ctx, "wikipedia-value", registry.Schema{Type: registry.TypeProtobuf, Schema: eventV1})
+	assert.NoError(t, err)
+	assert.Equal(t, id, again)
+
+	v2, err := client.Register(ctx, "wikipedia-value", registry.Schema{Type: registry.TypeProtobuf, Schema: eventV2})
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, v2)
+
+	latest, err := client.Latest(ctx, "wikipedia-value")
+	assert.NoError(t, err)
+	assert.Equal(t, registry.SubjectVersion{
+		Subject: "wikipedia-value",
+		Version: 2,
+		Schema:  registry.Schema{ID: v2, Type: registry.TypeProtobuf, Schema: eventV2},
+	}, latest)
+}
+
+func TestClient_SchemaByIDIsCached(t *testing.T) {
+	fake, srv := newFakeRegistry(t)
+	id, err := registry.NewClient(srv.URL).Register(context.Background(), "a-value",
+		registry.Schema{Type: registry.TypeProtobuf, Schema: eventV1})
+	assert.NoError(t, err)
+
+	client := registry.NewClient(srv.URL)
+	for i := 0; i < 3; i++ {
+		s, err := client.SchemaByID(context.Background(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, registry.Schema{ID: id, Type: registry.TypeProtobuf, Schema: eventV1}, s)
+	}
+	assert.Equal(t, 1, fake.lookups)
+}
+
+func TestClient_AvroIsTheDefaultType(t *testing.T) {
+	_, srv := newFakeRegistry(t)
+	client := registry.NewClient(srv.URL)
+	id, err := client.Register(context.Background(), "a-value", registry.Schema{Type: registry.TypeAvro, Schema: `"string"`})
+	assert.NoError(t, err)
+
+	s, err := registry.NewClient(srv.URL).SchemaByID(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, registry.TypeAvro, s.Type)
+}
+
+func TestClient_NotFound(t *testing.T) {
+	_, srv := newFakeRegistry(t)
+	client := registry.NewClient(srv.URL)
+
+	_, err := client.SchemaByID(context.Background(), 99)
+	assert.ErrorIs(t, err, registry.ErrNotFound)
+	var regErr *registry.Error
+	assert.ErrorAs(t, err, &regErr)
+	assert.Equal(t, 40403, regErr.Code)
+
+	_, err = client.Latest(context.Background(), "missing-value")
+	assert.ErrorIs(t, err, registry.ErrNotFound)
+}
+
+func TestClient_RejectedSchema(t *testing.T) {
+	_, srv := newFakeRegistry(t)
+	_, err := registry.NewClient(srv.URL).Register(context.Background(), "a-value", registry.Schema{Type: registry.TypeProtobuf})
+	assert.ErrorContains(t, err, "Invalid schema")
+	assert.NotErrorIs(t, err, registry.ErrNotFound)
+}
+
+func TestTopicSubject(t *testing.T) {
+	assert.Equal(t, "wikipedia.protobuf-value", registry.TopicSubject("wikipedia.protobuf"))
+}
@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Confluent wire format: a zero magic byte, the schema id as a big-endian
+// uint32, then the encoded message. Protobuf payloads also carry the
+// message indexes that locate the message type inside the schema file.
+const (
+	magicByte  = 0
+	headerSize = 5
+	// maxMessageIndexes bounds nesting depth so a corrupt count cannot
+	// allocate much.
+	maxMessageIndexes = 64
+)
+
+var ErrNotFramed = errors.New("payload is not in schema registry wire format")
+
+// IsFramed reports whether data starts with the wire format header. A
+// protobuf message never starts with a zero byte, since field number 0 is
+// invalid, so framed and unframed Event payloads cannot be confused.
+func IsFramed(data []byte) bool {
+	return len(data) >= headerSize && data[0] == magicByte
+}
+
+// AppendFrame appends the header for schemaID to dst. The encoded message
+// follows it.
+func AppendFrame(dst []byte, schemaID int) []byte {
+	dst = append(dst, magicByte)
+	return binary.BigEndian.AppendUint32(dst, uint32(schemaID))
+}
+
+// ParseFrame splits data into its schema id and the rest of the payload.
+func ParseFrame(data []byte) (schemaID int, payload []byte, err error) {
+	if !IsFramed(data) {
+		return 0, nil, ErrNotFramed
+	}
+	return int(binary.BigEndian.Uint32(data[1:headerSize])), data[headerSize:], nil
+}
+
+// AppendProtobufFrame appends the header and message indexes for a
+// protobuf message. indexes is the path to the message type: [0] is the
+// first message in the file, [1, 0] the first message nested in the
+// second. The common [0] is written as a single zero byte.
+func AppendProtobufFrame(dst []byte, schemaID int, indexes []int) []byte {
+	dst = AppendFrame(dst, schemaID)
+	if len(indexes) == 1 && indexes[0] == 0 {
+		return append(dst, 0)
+	}
+	dst = binary.AppendVarint(dst, int64(len(indexes)))
+	for _, i := range indexes {
+		dst = binary.AppendVarint(dst, int64(i))
+	}
+	return dst
+}
+
+// ParseProtobufFrame is ParseFrame for protobuf payloads, also returning
+// the message indexes.
+func ParseProtobufFrame(data []byte) (schemaID int, indexes []int, payload []byte, err error) {
+	schemaID, rest, err := ParseFrame(data)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	count, n := binary.Varint(rest)
+	if n <= 0 || count < 0 || count > maxMessageIndexes {
+		return 0, nil, nil, fmt.Errorf("%w: bad message index count", ErrNotFramed)
+	}
+	rest = rest[n:]
+	if count == 0 {
+		return schemaID, []int{0}, rest, nil
+	}
+	indexes = make([]int, count)
+	for i := range indexes {
+		v, n := binary.Varint(rest)
+		if n <= 0 || v < 0 {
+			return 0, nil, nil, fmt.Errorf("%w: bad message index", ErrNotFramed)
+		}
+		indexes[i] = int(v)
+		rest = rest[n:]
+	}
+	return schemaID, indexes, rest, nil
+}
@@ -0,0 +1,47 @@
+package registry_test
+
+import (
+	"testing"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrame_RoundTrip(t *testing.T) {
+	data := append(registry.AppendFrame(nil, 42), "avro"...)
+	assert.Equal(t, []byte{0, 0, 0, 0, 42}, data[:5])
+
+	id, payload, err := registry.ParseFrame(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, id)
+	assert.Equal(t, []byte("avro"), payload)
+}
+
+func TestProtobufFrame_RoundTrip(t *testing.T) {
+	for _, indexes := range [][]int{{0}, {1}, {2, 0, 3}} {
+		data := append(registry.AppendProtobufFrame(nil, 7, indexes), 0x0a, 0x01, 'x')
+
+		id, got, payload, err := registry.ParseProtobufFrame(data)
+		assert.NoError(t, err)
+		assert.Equal(t, 7, id)
+		assert.Equal(t, indexes, got)
+		assert.Equal(t, []byte{0x0a, 0x01, 'x'}, payload)
+	}
+}
+
+func TestProtobufFrame_FirstMessageIsOneByte(t *testing.T) {
+	assert.Equal(t, []byte{0, 0, 0, 1, 0, 0}, registry.AppendProtobufFrame(nil, 256, []int{0}))
+}
+
+func TestParseFrame_RejectsUnframed(t *testing.T) {
+	for _, data := range [][]byte{nil, {0, 0, 0}, {0x0a, 0, 0, 0, 1, 0}} {
+		_, _, err := registry.ParseFrame(data)
+		assert.ErrorIs(t, err, registry.ErrNotFramed)
+		assert.False(t, registry.IsFramed(data))
+	}
+
+	_, _, _, err := registry.ParseProtobufFrame([]byte{0, 0, 0, 0, 1})
+	assert.ErrorIs(t, err, registry.ErrNotFramed, "missing message indexes")
+	_, _, _, err = registry.ParseProtobufFrame([]byte{0, 0, 0, 0, 1, 0x7f})
+	assert.ErrorIs(t, err, registry.ErrNotFramed, "negative index count")
+}
@@ -0,0 +1,203 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultMinBackoff = 1 * time.Second
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// Reader reads a Server-Sent Events stream and transparently reconnects
+// when the connection drops. The id of the last delivered event is sent back
+// as Last-Event-ID so the server resumes right after it.
+type Reader struct {
+	client       *http.Client
+	url          string
+	since        time.Time
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	maxEventSize int
+
+	lastEventID string
+	retry       time.Duration
+}
+
+// NewReader creates a reader for streamURL using http.DefaultClient.
+func NewReader(streamURL string) *Reader {
+	return &Reader{
+		client:       http.DefaultClient,
+		url:          streamURL,
+		minBackoff:   defaultMinBackoff,
+		maxBackoff:   defaultMaxBackoff,
+		maxEventSize: DefaultMaxEventSize,
+	}
+}
+
+// WithBackoff overrides the reconnect backoff bounds.
+func (r *Reader) WithBackoff(min, max time.Duration) *Reader {
+	r.minBackoff = min
+	r.maxBackoff = max
+	return r
+}
+
+// WithMaxEventSize overrides the largest line or event the reader accepts.
+func (r *Reader) WithMaxEventSize(n int) *Reader {
+	r.maxEventSize = n
+	return r
+}
+
+// WithSince asks the server to replay events from t on the first connection,
+// before any event id is known. Wikimedia EventStreams honours `since`.
+func (r *Reader) WithSince(t time.Time) *Reader {
+	r.since = t
+	return r
+}
+
+// LastEventID returns the id of the last event handed to the handler.
+func (r *Reader) LastEventID() string {
+	return r.lastEventID
+}
+
+// Run streams events until ctx is cancelled, calling handle for every
+// dispatched event. A failure on the very first connection is returned so
+// misconfiguration surfaces immediately; later drops are retried with
+// exponential backoff and jitter.
+func (r *Reader) Run(ctx context.Context, handle func(Event)) error {
+	backoff := r.minBackoff
+	connected := false
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		ok, delivered, err := r.readOnce(ctx, handle)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !ok && !connected {
+			return err
+		}
+		connected = true
+
+		if delivered > 0 {
+			backoff = r.minBackoff
+			// Honour the server's retry hint as the base delay, within bounds.
+			if r.retry > backoff && r.retry <= r.maxBackoff {
+				backoff = r.retry
+			}
+		}
+
+		wait := jitter(backoff)
+		if err != nil {
+			log.Printf("⚠️ Stream connection lost: %v (reconnecting in %s)", err, wait)
+		} else {
+			log.Printf("⚠️ Stream closed by server (reconnecting in %s)", wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+// readOnce opens a single connection and consumes it until it ends. It
+// reports whether the connection was established and how many events were
+// delivered to handle.
+func (r *Reader) readOnce(ctx context.Context, handle func(Event)) (bool, int, error) {
+	req, err := r.newRequest(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, 0, fmt.Errorf("unexpected status from stream: %s", resp.Status)
+	}
+
+	log.Printf("🌐 Connected to %s. Streaming events...", r.url)
+
+	delivered := 0
+	dec := NewDecoderSize(resp.Body, r.maxEventSize)
+	for {
+		ev, err := dec.Decode()
+		if dec.Retry() > 0 {
+			r.retry = dec.Retry()
+		}
+		if err == io.EOF {
+			return true, delivered, nil
+		}
+		if errors.Is(err, ErrEventTooLarge) {
+			// Reconnecting would only replay it; move the resume point past
+			// it instead.
+			log.Printf("⚠️ Skipping event %q larger than %d bytes", ev.ID, r.maxEventSize)
+			r.lastEventID = ev.ID
+			continue
+		}
+		if err != nil {
+			return true, delivered, err
+		}
+
+		handle(ev)
+		delivered++
+		// Only advance the resume point once the event has been handled,
+		// so a drop mid-event replays it on the next connection.
+		r.lastEventID = ev.ID
+	}
+}
+
+func (r *Reader) newRequest(ctx context.Context) (*http.Request, error) {
+	target := r.url
+	if r.lastEventID == "" && !r.since.IsZero() {
+		u, err := url.Parse(r.url)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("since", r.since.UTC().Format(time.RFC3339))
+		u.RawQuery = q.Encode()
+		target = u.String()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if r.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", r.lastEventID)
+	}
+	return req, nil
+}
+
+// jitter returns a duration in [d/2, d) so reconnecting replicas spread out
+// without ever retrying immediately.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
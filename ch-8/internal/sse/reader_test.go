@@ -0,0 +1,170 @@
+package sse_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/sse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReader_ReconnectsWithLastEventID(t *testing.T) {
+	var mu sync.Mutex
+	var lastEventIDs []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+		attempt := len(lastEventIDs)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		switch attempt {
+		case 1:
+			fmt.Fprint(w, "id: 1\ndata: one\n\nid: 2\ndata: two\n\n")
+			// Drop the connection mid-event: the id arrives, the data never does.
+			fmt.Fprint(w, "id: 3\n")
+		default:
+			fmt.Fprint(w, "id: 3\ndata: three\n\n")
+		}
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var got []string
+	reader := sse.NewReader(ts.URL).WithBackoff(10*time.Millisecond, 20*time.Millisecond)
+	err := reader.Run(ctx, func(ev sse.Event) {
+		got = append(got, ev.Data)
+		if len(got) == 3 {
+			cancel()
+		}
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one", "two", "three"}, got)
+	assert.Equal(t, "3", reader.LastEventID())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "", lastEventIDs[0])
+	assert.Equal(t, "2", lastEventIDs[1])
+}
+
+func TestReader_SinceOnFirstConnect(t *testing.T) {
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	var gotSince string
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSince = r.URL.Query().Get("since")
+		cancel()
+	}))
+	defer ts.Close()
+
+	err := sse.NewReader(ts.URL).WithSince(since).Run(ctx, func(sse.Event) {})
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-01-02T03:04:05Z", gotSince)
+}
+
+func TestReader_InitialConnectFailure(t *testing.T) {
+	err := sse.NewReader("http://127.0.0.1:0").Run(context.Background(), func(sse.Event) {})
+	assert.Error(t, err)
+}
+
+func TestReader_InitialBadStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	err := sse.NewReader(ts.URL).Run(context.Background(), func(sse.Event) {})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "503")
+}
+
+func TestReader_RetriesAfterServerError(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		attempt := attempts
+		mu.Unlock()
+
+		switch attempt {
+		case 1:
+			fmt.Fprint(w, "id: a\ndata: first\n\n")
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			fmt.Fprint(w, "id: b\ndata: second\n\n")
+		}
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var got []string
+	reader := sse.NewReader(ts.URL).WithBackoff(5*time.Millisecond, 10*time.Millisecond)
+	err := reader.Run(ctx, func(ev sse.Event) {
+		got = append(got, ev.Data)
+		if len(got) == 2 {
+			cancel()
+		}
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, got)
+}
+
+func TestReader_SkipsOversizedEventInsteadOfReconnecting(t *testing.T) {
+	var mu sync.Mutex
+	var lastEventIDs []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		switch r.Header.Get("Last-Event-ID") {
+		case "":
+			fmt.Fprint(w, "id: 1\ndata: one\n\nid: 2\ndata: "+strings.Repeat("x", 100)+"\n\nid: 3\ndata: three\n\n")
+		default:
+			// Resuming from anything before 3 would replay the big event.
+			fmt.Fprint(w, "id: 4\ndata: four\n\n")
+		}
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var got []string
+	reader := sse.NewReader(ts.URL).WithBackoff(10*time.Millisecond, 20*time.Millisecond).WithMaxEventSize(64)
+	err := reader.Run(ctx, func(ev sse.Event) {
+		got = append(got, ev.Data)
+		if len(got) == 3 {
+			cancel()
+		}
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one", "three", "four"}, got)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"", "3"}, lastEventIDs)
+}
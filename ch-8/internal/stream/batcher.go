@@ -2,31 +2,170 @@ package stream
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
 )
 
+const (
+	// defaultFinalFlushTimeout bounds the flush and commit that run after
+	// the batcher's context has been cancelled or Stop was called. Shutdown
+	// bounds them by its context instead.
+	defaultFinalFlushTimeout = 5 * time.Second
+
+	defaultWriteAttempts = 3
+	defaultRetryBackoff  = 200 * time.Millisecond
+)
+
+// Offsets maps topic -> partition -> next offset to consume, the shape
+// kgo.Client.CommitOffsetsSync expects.
+type Offsets = map[string]map[int32]kgo.EpochOffset
+
+// ErrBufferFull is returned by TryAddRecord when the batcher holds as many
+// events or bytes as its limits allow.
+var ErrBufferFull = errors.New("batcher buffer is full")
+
+// CommitFunc is called after a flush has been durably written to the store,
+// with the offsets that flush covered.
+type CommitFunc func(ctx context.Context, offsets Offsets) error
+
+// Batcher buffers events and writes them to the store in batches, by size
+// or on a timer. With limits set, the buffer holds at most maxEvents events
+// and maxBytes bytes: adding to a full buffer waits for a flush to make room,
+// which is how a slow store pushes back on the consumer.
+//
+// A flush swaps the buffer out under the lock and writes it without holding
+// it, so adding never waits for the store unless the buffer is full. Up to
+// maxInFlight flushes write at once. Offsets are always committed in the
+// order the flushes started, and never past a flush that failed: its events
+// go back into the buffer, or, if the store applied part of them, wait for
+// the next flush to resume the write, and later flushes leave their offsets
+// to the flush that retries them. With one flush in flight, events are written in
+// the order they were added, so per key as the pool dispatched them; with
+// more, a later batch may reach the store before an earlier one, which only
+// matters to stores whose writes do not commute.
 type Batcher struct {
 	store         StatsStore
 	batchSize     int
 	flushInterval time.Duration
+	commit        CommitFunc
+	dedup         Deduplicator
+	attempts      int
+	retryBackoff  time.Duration
+	maxEvents     int
+	maxBytes      int
+	label         string
+	// slots holds a token per flush allowed to write at once.
+	slots    chan struct{}
+	inflight sync.WaitGroup
 
 	mu      sync.Mutex
 	buffer  []Event
-	ticker  *time.Ticker
-	wg      sync.WaitGroup
-	flushCh chan struct{}
+	bytes   int
+	oldest  time.Time
+	offsets Offsets
+	// unfinished are failed flushes the store applied part of. The next
+	// flush resumes them rather than writing their events again. Their
+	// events count toward the limits.
+	unfinished []unfinishedWrite
+	// space is closed and replaced by every flush that empties the buffer,
+	// waking adds that wait for room.
+	space chan struct{}
+	// full mirrors the buffer being at a limit, readable without b.mu.
+	full atomic.Bool
+	// seq numbers flushes in the order they swapped the buffer out; last
+	// is closed once the latest of them has committed or given up.
+	seq  uint64
+	last chan struct{}
+	// finalCtx, set by Shutdown, bounds the final flush.
+	finalCtx context.Context
+	// requeueBefore is one past the last flush that was in flight when a
+	// flush failed. Those flushes hand their offsets back to the buffer
+	// instead of committing them past the failed events.
+	requeueBefore uint64
+	ticker        *time.Ticker
+	wg            sync.WaitGroup
+	flushCh       chan struct{}
+	// stop is closed by Stop. flushCh stays open, so adds racing with Stop
+	// cannot send on a closed channel.
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 func NewBatcher(store StatsStore, batchSize int, flushInterval time.Duration) *Batcher {
+	last := make(chan struct{})
+	close(last)
 	b := &Batcher{
 		store:         store,
 		batchSize:     batchSize,
 		flushInterval: flushInterval,
+		attempts:      defaultWriteAttempts,
+		retryBackoff:  defaultRetryBackoff,
 		buffer:        make([]Event, 0, batchSize),
+		offsets:       make(Offsets),
+		space:         make(chan struct{}),
+		label:         "0",
+		slots:         make(chan struct{}, 1),
+		last:          last,
 		ticker:        time.NewTicker(flushInterval),
 		flushCh:       make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+	return b
+}
+
+// WithCommitter registers fn to commit the offsets of every successful
+// flush, whether it was triggered by size, by the ticker or by shutdown.
+func (b *Batcher) WithCommitter(fn CommitFunc) *Batcher {
+	b.commit = fn
+	return b
+}
+
+// WithDeduplicator makes every successful flush record its events' ids as
+// processed in d, before their offsets are committed.
+func (b *Batcher) WithDeduplicator(d Deduplicator) *Batcher {
+	b.dedup = d
+	return b
+}
+
+// WithRetry sets how many times a flush tries to write to the store and the
+// initial backoff between tries, which doubles after each failure.
+func (b *Batcher) WithRetry(attempts int, backoff time.Duration) *Batcher {
+	if attempts < 1 {
+		attempts = 1
+	}
+	b.attempts = attempts
+	b.retryBackoff = backoff
+	return b
+}
+
+// WithLimits bounds the buffer to maxEvents events and maxBytes bytes, as
+// estimated by EventSize. Zero leaves a limit off. A single event larger
+// than maxBytes is still accepted into an empty buffer.
+func (b *Batcher) WithLimits(maxEvents, maxBytes int) *Batcher {
+	b.maxEvents = maxEvents
+	b.maxBytes = maxBytes
+	return b
+}
+
+// WithMaxInFlight lets up to n flushes write to the store at once. The
+// default is 1. It must be called before the batcher is used.
+func (b *Batcher) WithMaxInFlight(n int) *Batcher {
+	if n < 1 {
+		n = 1
 	}
+	b.slots = make(chan struct{}, n)
+	return b
+}
+
+// WithLabel names the batcher in its metrics, e.g. by worker.
+func (b *Batcher) WithLabel(label string) *Batcher {
+	b.label = label
 	return b
 }
 
@@ -37,61 +176,508 @@ func (b *Batcher) Start(ctx context.Context) {
 		for {
 			select {
 			case <-ctx.Done():
-				b.flush()
+				b.finalFlush()
 				return
 			case <-b.ticker.C:
-				b.flush()
+				if ctx.Err() != nil {
+					b.finalFlush()
+					return
+				}
+				b.flushAsync(ctx)
+			case <-b.stop:
+				b.finalFlush()
+				return
 			case <-b.flushCh:
-				b.flush()
+				if ctx.Err() != nil {
+					b.finalFlush()
+					return
+				}
+				b.flushAsync(ctx)
 			}
 		}
 	}()
 }
 
 func (b *Batcher) Add(event Event) {
+	b.AddRecord(event, nil)
+}
+
+// AddRecord buffers event and remembers record's offset so it is committed
+// once the event has been written. record may be nil. If the buffer is full
+// it waits until a flush makes room.
+func (b *Batcher) AddRecord(event Event, record *kgo.Record) {
+	_ = b.AddRecordContext(context.Background(), event, record)
+}
+
+// AddRecordContext is AddRecord that gives up when ctx is done, leaving
+// event out.
+func (b *Batcher) AddRecordContext(ctx context.Context, event Event, record *kgo.Record) error {
+	size := EventSize(event)
+	b.mu.Lock()
+	for b.wouldOverflow(size) {
+		b.full.Store(true)
+		space := b.space
+		b.requestFlush()
+		b.mu.Unlock()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		b.mu.Lock()
+	}
+	b.add(event, record, size)
+	b.mu.Unlock()
+	return nil
+}
+
+// TryAddRecord is AddRecord that returns ErrBufferFull instead of waiting.
+func (b *Batcher) TryAddRecord(event Event, record *kgo.Record) error {
+	size := EventSize(event)
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.wouldOverflow(size) {
+		b.full.Store(true)
+		b.requestFlush()
+		return ErrBufferFull
+	}
+	b.add(event, record, size)
+	return nil
+}
+
+// Full reports whether the buffer is at one of its limits or an add is
+// waiting for room. It does not wait for a flush in progress.
+func (b *Batcher) Full() bool {
+	return b.full.Load()
+}
+
+// wouldOverflow reports whether an event of size does not fit. An empty
+// buffer always takes it. Must be called with b.mu held.
+func (b *Batcher) wouldOverflow(size int) bool {
+	buffered := b.buffered()
+	if buffered == 0 {
+		return false
+	}
+	return (b.maxEvents > 0 && buffered >= b.maxEvents) ||
+		(b.maxBytes > 0 && b.bytes+size > b.maxBytes)
+}
+
+// buffered is how many events wait to be written, including those of
+// unfinished writes. Must be called with b.mu held.
+func (b *Batcher) buffered() int {
+	n := len(b.buffer)
+	for _, u := range b.unfinished {
+		n += len(u.events)
+	}
+	return n
+}
 
+// add must be called with b.mu held.
+func (b *Batcher) add(event Event, record *kgo.Record, size int) {
+	if b.buffered() == 0 {
+		b.oldest = time.Now()
+	}
 	b.buffer = append(b.buffer, event)
+	b.bytes += size
+	if record != nil {
+		b.track(record)
+	}
+	b.observeOccupancy()
 
-	if len(b.buffer) >= b.batchSize {
-		select {
-		case b.flushCh <- struct{}{}:
-		default:
+	// A full buffer is flushed early rather than left to wait for the
+	// ticker with the consumer paused behind it.
+	if len(b.buffer) >= b.batchSize || b.full.Load() {
+		b.requestFlush()
+	}
+}
+
+// requestFlush wakes the flush loop without waiting for it.
+func (b *Batcher) requestFlush() {
+	select {
+	case b.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// observeOccupancy must be called with b.mu held.
+func (b *Batcher) observeOccupancy() {
+	b.full.Store(b.wouldOverflow(1))
+	BatcherBufferedEvents.WithLabelValues(b.label).Set(float64(b.buffered()))
+	BatcherBufferedBytes.WithLabelValues(b.label).Set(float64(b.bytes))
+}
+
+// EventSize estimates the memory an event holds in a buffer: its strings
+// plus a fixed amount for the rest.
+func EventSize(e Event) int {
+	const fixed = 96
+	return fixed + len(e.Domain) + len(e.Title) + len(e.User) + len(e.Type) +
+		len(e.Wiki) + len(e.ServerURL) + len(e.EventID)
+}
+
+// SkipRecord commits record's offset with the next flush without counting
+// an event for it, e.g. because it is a duplicate.
+func (b *Batcher) SkipRecord(record *kgo.Record) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.track(record)
+}
+
+// track must be called with b.mu held.
+func (b *Batcher) track(record *kgo.Record) {
+	partitions, ok := b.offsets[record.Topic]
+	if !ok {
+		partitions = make(map[int32]kgo.EpochOffset)
+		b.offsets[record.Topic] = partitions
+	}
+	next := kgo.EpochOffset{Epoch: record.LeaderEpoch, Offset: record.Offset + 1}
+	if current, ok := partitions[record.Partition]; !ok || current.Less(next) {
+		partitions[record.Partition] = next
+	}
+}
+
+// finalFlush runs once the batcher's context is gone, so it gets its own
+// deadline to let the last offsets be committed: Shutdown's context, or
+// defaultFinalFlushTimeout. Flushes still in flight finish first; whatever
+// they fail to write is retried here.
+func (b *Batcher) finalFlush() {
+	b.inflight.Wait()
+	b.mu.Lock()
+	ctx := b.finalCtx
+	b.mu.Unlock()
+	if ctx == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), defaultFinalFlushTimeout)
+		defer cancel()
+	}
+	if _, err := b.flush(ctx); err != nil {
+		log.Printf("❌ Final flush failed, events will be redelivered: %v", err)
+	}
+}
+
+// flushAsync swaps the buffer out and writes it in the background. It waits
+// for a free slot first, so at most maxInFlight flushes run at once.
+func (b *Batcher) flushAsync(ctx context.Context) {
+	job, err := b.begin(ctx, false)
+	if err != nil || job == nil {
+		return
+	}
+	b.inflight.Add(1)
+	go func() {
+		defer b.inflight.Done()
+		// A deferred flush was written; the flush that failed logged.
+		if err := b.finish(ctx, job); err != nil && !errors.Is(err, errFlushDeferred) {
+			log.Printf("❌ Flush failed, keeping events buffered: %v", err)
 		}
+	}()
+}
+
+// errFlushDeferred is returned by a flush that wrote its events while an
+// earlier flush failed, so its offsets could not be committed yet.
+var errFlushDeferred = errors.New("an earlier flush failed, offsets are committed once it is retried")
+
+// flushJob is a buffer swapped out for writing.
+type flushJob struct {
+	seq        uint64
+	events     []Event
+	bytes      int
+	oldest     time.Time
+	offsets    Offsets
+	unfinished []unfinishedWrite
+	// prev is closed once the flush before this one has resolved, and done
+	// once this one has.
+	prev <-chan struct{}
+	done chan struct{}
+}
+
+// written is every event the job writes, its unfinished writes' first.
+func (j *flushJob) written() []Event {
+	if len(j.unfinished) == 0 {
+		return j.events
+	}
+	var events []Event
+	for _, u := range j.unfinished {
+		events = append(events, u.events...)
+	}
+	return append(events, j.events...)
+}
+
+// unfinishedWrite is a batch the store applied only part of. resume writes
+// the rest.
+type unfinishedWrite struct {
+	events []Event
+	bytes  int
+	resume func(context.Context) error
+}
+
+// flush writes the buffer to the store and commits its offsets. If every
+// write attempt fails the events go back into the buffer, or are left for
+// the next flush to resume if the store applied part of them, their offsets
+// stay uncommitted, and the error is returned. Offsets of skipped records are
+// committed even when there is nothing to write.
+//
+// Even with nothing buffered it waits for the flushes before it, so that on
+// return everything added earlier is committed unless an error says not.
+func (b *Batcher) flush(ctx context.Context) ([]Event, error) {
+	job, err := b.begin(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.finish(ctx, job); err != nil {
+		return nil, err
+	}
+	written := job.written()
+	if len(written) == 0 {
+		return nil, nil
 	}
+	return written, nil
 }
 
-func (b *Batcher) flush() []Event {
+// begin takes a flush slot and swaps the buffer out. Unless always is set
+// it returns nil when there is nothing to flush.
+func (b *Batcher) begin(ctx context.Context, always bool) (*flushJob, error) {
+	select {
+	case b.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if !always && b.buffered() == 0 && len(b.offsets) == 0 {
+		<-b.slots
+		return nil, nil
+	}
+
+	b.seq++
+	job := &flushJob{
+		seq:        b.seq,
+		events:     b.buffer,
+		bytes:      b.bytes,
+		oldest:     b.oldest,
+		offsets:    b.offsets,
+		unfinished: b.unfinished,
+		prev:       b.last,
+		done:       make(chan struct{}),
+	}
+	for _, u := range job.unfinished {
+		job.bytes -= u.bytes
+	}
+	b.last = job.done
+	b.buffer = make([]Event, 0, b.batchSize)
+	b.bytes = 0
+	b.offsets = make(Offsets)
+	b.unfinished = nil
+	b.makeRoom()
+	return job, nil
+}
+
+// finish writes job without holding the lock, then, once every earlier
+// flush has resolved, commits its offsets or hands job back to the buffer.
+func (b *Batcher) finish(ctx context.Context, job *flushJob) error {
+	defer func() { <-b.slots }()
+	defer close(job.done)
+
+	var (
+		unfinished []unfinishedWrite
+		unwritten  bool
+		err        error
+	)
+	if len(job.events) > 0 || len(job.unfinished) > 0 {
+		start := time.Now()
+		unfinished, unwritten, err = b.write(ctx, job)
+		BatcherFlushDuration.Observe(time.Since(start).Seconds())
+	}
+	<-job.prev
+
+	b.mu.Lock()
+	if err != nil {
+		StoreWriteFailures.Inc()
+		b.requeue(job, unfinished, unwritten)
+		b.requeueBefore = b.seq + 1
+		b.mu.Unlock()
+		return err
+	}
+	deferred := job.seq < b.requeueBefore
+	if deferred {
+		b.mergeOffsets(job.offsets)
+	}
+	b.mu.Unlock()
+
+	written := job.written()
+	if len(written) > 0 {
+		BatcherFlushSize.Observe(float64(len(written)))
+		BatcherFlushLatency.Observe(time.Since(job.oldest).Seconds())
+		EventsProcessedSuccessfully.Add(float64(len(written)))
+	}
+
+	if b.dedup != nil && len(written) > 0 {
+		// The events are counted either way; failing to record them only
+		// lets a later duplicate through.
+		if err := b.dedup.Processed(ctx, eventIDs(written)); err != nil {
+			log.Printf("⚠️ Failed to record processed event ids: %v", err)
+		}
+	}
+
+	if deferred {
+		return errFlushDeferred
+	}
+	if b.commit != nil && len(job.offsets) > 0 {
+		// A failed commit only means these records may be redelivered; later
+		// flushes commit higher offsets for the same partitions.
+		if err := b.commit(ctx, job.offsets); err != nil {
+			log.Printf("❌ Failed to commit offsets: %v", err)
+		}
+	}
+	return nil
+}
+
+// requeue puts a failed flush's unfinished writes in front of the others
+// and, if unwritten, its events back in front of the buffer. Must be called
+// with b.mu held.
+func (b *Batcher) requeue(job *flushJob, unfinished []unfinishedWrite, unwritten bool) {
+	if (unwritten && len(job.events) > 0) || len(unfinished) > 0 {
+		if b.buffered() == 0 || job.oldest.Before(b.oldest) {
+			b.oldest = job.oldest
+		}
+	}
+	if unwritten && len(job.events) > 0 {
+		b.buffer = append(job.events, b.buffer...)
+		b.bytes += job.bytes
+	}
+	for _, u := range unfinished {
+		b.bytes += u.bytes
+	}
+	b.unfinished = append(unfinished, b.unfinished...)
+	b.mergeOffsets(job.offsets)
+	b.observeOccupancy()
+}
 
-	if len(b.buffer) == 0 {
-		return nil
+// mergeOffsets must be called with b.mu held.
+func (b *Batcher) mergeOffsets(offsets Offsets) {
+	for topic, partitions := range offsets {
+		for partition, next := range partitions {
+			b.track(&kgo.Record{Topic: topic, Partition: partition, LeaderEpoch: next.Epoch, Offset: next.Offset - 1})
+		}
 	}
+}
 
-	toFlush := make([]Event, len(b.buffer))
-	copy(toFlush, b.buffer)
+// makeRoom wakes adds waiting for space. Must be called with b.mu held.
+func (b *Batcher) makeRoom() {
+	close(b.space)
+	b.space = make(chan struct{})
+	b.observeOccupancy()
+}
+
+func eventIDs(events []Event) []string {
+	var ids []string
+	for _, e := range events {
+		if e.EventID != "" {
+			ids = append(ids, e.EventID)
+		}
+	}
+	return ids
+}
 
-	b.store.RecordMany(toFlush)
-	b.buffer = b.buffer[:0]
+// write resumes the job's unfinished writes, then writes its events. On
+// failure it returns the writes still unfinished, and whether the events
+// were left unwritten, for requeue.
+func (b *Batcher) write(ctx context.Context, job *flushJob) ([]unfinishedWrite, bool, error) {
+	for i, u := range job.unfinished {
+		resume, err := b.writeWithRetry(ctx, u.resume)
+		if err != nil {
+			if resume != nil {
+				u.resume = resume
+			}
+			return append([]unfinishedWrite{u}, job.unfinished[i+1:]...), true, err
+		}
+	}
+	if len(job.events) == 0 {
+		return nil, false, nil
+	}
 
-	return toFlush
+	resume, err := b.writeWithRetry(ctx, func(ctx context.Context) error {
+		return b.store.RecordMany(ctx, job.events)
+	})
+	if err != nil && resume != nil {
+		return []unfinishedWrite{{events: job.events, bytes: job.bytes, resume: resume}}, false, err
+	}
+	return nil, err != nil, err
 }
 
+// writeWithRetry calls write until it succeeds or the attempts run out.
+// Once the store reports a partial write it retries with its Resume, so
+// nothing is applied twice, and on failure returns the latest Resume, or
+// nil if nothing was applied.
+func (b *Batcher) writeWithRetry(ctx context.Context, write func(context.Context) error) (func(context.Context) error, error) {
+	backoff := b.retryBackoff
+	var (
+		resume func(context.Context) error
+		err    error
+	)
+	for attempt := 1; attempt <= b.attempts; attempt++ {
+		if err = write(ctx); err == nil {
+			return nil, nil
+		}
+		var partial *PartialWriteError
+		if errors.As(err, &partial) {
+			write, resume = partial.Resume, partial.Resume
+		}
+		if attempt == b.attempts {
+			break
+		}
+
+		log.Printf("⚠️ Store write failed (attempt %d/%d): %v", attempt, b.attempts, err)
+		select {
+		case <-ctx.Done():
+			return resume, fmt.Errorf("store write aborted: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return resume, fmt.Errorf("store write failed after %d attempts: %w", b.attempts, err)
+}
+
+// Stop flushes and commits what is buffered, waits for it and for every
+// flush in flight, and stops the flush loop. It may be called more than
+// once; events added afterwards stay buffered until the next Flush.
 func (b *Batcher) Stop() {
 	b.ticker.Stop()
-	close(b.flushCh)
+	b.stopOnce.Do(func() { close(b.stop) })
 	b.wg.Wait()
 }
 
-func (b *Batcher) FlushIfThresholdMet() []Event {
+// Shutdown is Stop with the final flush and commit bounded by ctx, e.g. the
+// consumer's shutdown deadline. Whatever is not committed by then is
+// redelivered.
+func (b *Batcher) Shutdown(ctx context.Context) {
 	b.mu.Lock()
-	shouldFlush := len(b.buffer) >= b.batchSize
+	b.finalCtx = ctx
+	b.mu.Unlock()
+	b.Stop()
+}
+
+// Flush writes and commits whatever is buffered, regardless of size. It
+// first waits for flushes in flight, so that it retries anything they fail
+// to write and returns only once everything added before it is committed.
+func (b *Batcher) Flush(ctx context.Context) ([]Event, error) {
+	b.mu.Lock()
+	last := b.last
+	b.mu.Unlock()
+	select {
+	case <-last:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return b.flush(ctx)
+}
+
+func (b *Batcher) FlushIfThresholdMet(ctx context.Context) ([]Event, error) {
+	b.mu.Lock()
+	shouldFlush := b.buffered() >= b.batchSize
 	b.mu.Unlock()
 
 	if shouldFlush {
-		return b.flush()
+		return b.flush(ctx)
 	}
-	return nil
+	return nil, nil
 }
@@ -0,0 +1,581 @@
+package stream_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+type commitRecorder struct {
+	mu      sync.Mutex
+	commits []stream.Offsets
+	err     error
+}
+
+func (c *commitRecorder) commit(_ context.Context, offsets stream.Offsets) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commits = append(c.commits, offsets)
+	return c.err
+}
+
+func (c *commitRecorder) all() []stream.Offsets {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]stream.Offsets(nil), c.commits...)
+}
+
+func TestBatcher_FlushCommitsHighestOffsetPerPartition(t *testing.T) {
+	store := stream.NewInMemoryStats()
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 3, time.Hour).WithCommitter(recorder.commit)
+
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Partition: 0, Offset: 7})
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Partition: 0, Offset: 5})
+	b.AddRecord(stream.Event{Domain: "b"}, &kgo.Record{Topic: "t", Partition: 1, Offset: 2})
+
+	flushed, err := b.FlushIfThresholdMet(context.Background())
+	assert.NoError(t, err)
+
+	assert.Len(t, flushed, 3)
+	commits := recorder.all()
+	assert.Len(t, commits, 1)
+	assert.Equal(t, int64(8), commits[0]["t"][0].Offset)
+	assert.Equal(t, int64(3), commits[0]["t"][1].Offset)
+	assert.Equal(t, 3, snapshotOf(t, store).Messages)
+}
+
+func TestBatcher_BelowThresholdDoesNotFlush(t *testing.T) {
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(stream.NewInMemoryStats(), 3, time.Hour).WithCommitter(recorder.commit)
+
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 1})
+
+	flushed, err := b.FlushIfThresholdMet(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, flushed)
+	assert.Empty(t, recorder.all())
+}
+
+func TestBatcher_TickerFlushCommits(t *testing.T) {
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(stream.NewInMemoryStats(), 100, 10*time.Millisecond).WithCommitter(recorder.commit)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Start(ctx)
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Partition: 3, Offset: 9})
+
+	assert.Eventually(t, func() bool { return len(recorder.all()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(10), recorder.all()[0]["t"][3].Offset)
+
+	cancel()
+	b.Stop()
+}
+
+func TestBatcher_ShutdownFlushCommitsWithLiveContext(t *testing.T) {
+	var commitCtxErr error
+	b := stream.NewBatcher(stream.NewInMemoryStats(), 100, time.Hour).
+		WithCommitter(func(ctx context.Context, _ stream.Offsets) error {
+			commitCtxErr = ctx.Err()
+			return nil
+		})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Start(ctx)
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 1})
+
+	cancel()
+	b.Stop()
+
+	assert.NoError(t, commitCtxErr)
+}
+
+func TestBatcher_EventsWithoutRecordsSkipCommit(t *testing.T) {
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(stream.NewInMemoryStats(), 1, time.Hour).WithCommitter(recorder.commit)
+
+	b.Add(stream.Event{Domain: "a"})
+
+	flushed, err := b.FlushIfThresholdMet(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, flushed, 1)
+	assert.Empty(t, recorder.all())
+}
+
+func TestBatcher_CommitErrorDoesNotBlockLaterFlushes(t *testing.T) {
+	recorder := &commitRecorder{err: errors.New("commit failed")}
+	b := stream.NewBatcher(stream.NewInMemoryStats(), 1, time.Hour).WithCommitter(recorder.commit)
+
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 1})
+	_, err := b.FlushIfThresholdMet(context.Background())
+	assert.NoError(t, err)
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 2})
+	_, err = b.FlushIfThresholdMet(context.Background())
+	assert.NoError(t, err)
+
+	commits := recorder.all()
+	assert.Len(t, commits, 2)
+	assert.Equal(t, int64(3), commits[1]["t"][0].Offset)
+}
+
+type flakyStore struct {
+	*stream.InMemoryStats
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (f *flakyStore) RecordMany(ctx context.Context, events []stream.Event) error {
+	f.mu.Lock()
+	f.calls++
+	fail := f.failures > 0
+	if fail {
+		f.failures--
+	}
+	f.mu.Unlock()
+	if fail {
+		return errors.New("cassandra unavailable")
+	}
+	return f.InMemoryStats.RecordMany(ctx, events)
+}
+
+func TestBatcher_RetriesFailedWrites(t *testing.T) {
+	store := &flakyStore{InMemoryStats: stream.NewInMemoryStats(), failures: 2}
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 1, time.Hour).WithCommitter(recorder.commit).WithRetry(3, time.Millisecond)
+
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 4})
+	flushed, err := b.FlushIfThresholdMet(context.Background())
+
+	assert.NoError(t, err)
+	assert.Len(t, flushed, 1)
+	assert.Equal(t, 3, store.calls)
+	assert.Len(t, recorder.all(), 1)
+}
+
+func TestBatcher_ExhaustedRetriesKeepEventsAndSkipCommit(t *testing.T) {
+	store := &flakyStore{InMemoryStats: stream.NewInMemoryStats(), failures: 2}
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 1, time.Hour).WithCommitter(recorder.commit).WithRetry(2, time.Millisecond)
+
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 4})
+	_, err := b.FlushIfThresholdMet(context.Background())
+	assert.Error(t, err)
+	assert.Empty(t, recorder.all())
+
+	// The store recovers: the same events and offsets go out on the next flush.
+	flushed, err := b.FlushIfThresholdMet(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, flushed, 1)
+	assert.Equal(t, int64(5), recorder.all()[0]["t"][0].Offset)
+	assert.Equal(t, 1, snapshotOf(t, store).Messages)
+}
+
+// partialStore applies the first event of every batch, then fails; Resume
+// fails resumeFailures times before applying the rest.
+type partialStore struct {
+	*stream.InMemoryStats
+	mu             sync.Mutex
+	resumeFailures int
+	resumes        int
+}
+
+func (p *partialStore) RecordMany(ctx context.Context, events []stream.Event) error {
+	if err := p.InMemoryStats.RecordMany(ctx, events[:1]); err != nil {
+		return err
+	}
+	return &stream.PartialWriteError{Err: errors.New("cassandra unavailable"), Resume: func(ctx context.Context) error {
+		p.mu.Lock()
+		p.resumes++
+		fail := p.resumeFailures > 0
+		if fail {
+			p.resumeFailures--
+		}
+		p.mu.Unlock()
+		if fail {
+			return errors.New("cassandra still unavailable")
+		}
+		return p.InMemoryStats.RecordMany(ctx, events[1:])
+	}}
+}
+
+func TestBatcher_RetriesOnlyTheUnwrittenPartOfABatch(t *testing.T) {
+	store := &partialStore{InMemoryStats: stream.NewInMemoryStats(), resumeFailures: 1}
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 3, time.Hour).WithCommitter(recorder.commit).WithRetry(3, time.Millisecond)
+
+	for i := range 3 {
+		b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: int64(i)})
+	}
+	flushed, err := b.FlushIfThresholdMet(context.Background())
+
+	assert.NoError(t, err)
+	assert.Len(t, flushed, 3)
+	assert.Equal(t, 2, store.resumes)
+	assert.Equal(t, 3, snapshotOf(t, store).Messages)
+	assert.Equal(t, int64(3), recorder.all()[0]["t"][0].Offset)
+}
+
+func TestBatcher_NextFlushResumesAPartialWrite(t *testing.T) {
+	store := &partialStore{InMemoryStats: stream.NewInMemoryStats(), resumeFailures: 1}
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 2, time.Hour).WithCommitter(recorder.commit).WithRetry(2, time.Millisecond)
+
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 0})
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 1})
+	_, err := b.FlushIfThresholdMet(context.Background())
+	assert.Error(t, err)
+	assert.Empty(t, recorder.all())
+	assert.Equal(t, 1, snapshotOf(t, store).Messages)
+
+	// The next flush writes the second event, not both again.
+	flushed, err := b.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, flushed, 2)
+	assert.Equal(t, 2, snapshotOf(t, store).Messages)
+	assert.Equal(t, int64(2), recorder.all()[0]["t"][0].Offset)
+}
+
+func TestBatcher_SkippedRecordsCommitWithoutWriting(t *testing.T) {
+	store := &flakyStore{InMemoryStats: stream.NewInMemoryStats(), failures: 100}
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 10, time.Hour).WithCommitter(recorder.commit)
+
+	b.SkipRecord(&kgo.Record{Topic: "t", Offset: 9})
+	flushed, err := b.Flush(context.Background())
+	assert.NoError(t, err, "nothing to write, so the failing store is never called")
+	assert.Empty(t, flushed)
+	assert.Equal(t, int64(10), recorder.all()[0]["t"][0].Offset)
+}
+
+func TestBatcher_RecordsProcessedIDsBeforeCommit(t *testing.T) {
+	dedup := &recordingDeduplicator{}
+	var processedAtCommit []string
+	b := stream.NewBatcher(stream.NewInMemoryStats(), 10, time.Hour).
+		WithDeduplicator(dedup).
+		WithCommitter(func(context.Context, stream.Offsets) error {
+			processedAtCommit = append([]string(nil), dedup.processed...)
+			return nil
+		})
+
+	b.AddRecord(stream.Event{Domain: "a", EventID: "e-1"}, &kgo.Record{Topic: "t", Offset: 0})
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 1})
+	_, err := b.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e-1"}, processedAtCommit)
+}
+
+func TestBatcher_FailedWriteRecordsNothingProcessed(t *testing.T) {
+	dedup := &recordingDeduplicator{}
+	store := &flakyStore{InMemoryStats: stream.NewInMemoryStats(), failures: 1}
+	b := stream.NewBatcher(store, 10, time.Hour).WithDeduplicator(dedup).WithRetry(1, 0)
+
+	b.Add(stream.Event{Domain: "a", EventID: "e-1"})
+	_, err := b.Flush(context.Background())
+	assert.Error(t, err)
+	assert.Empty(t, dedup.processed)
+}
+
+func TestBatcher_TryAddRecordStopsAtEventLimit(t *testing.T) {
+	b := stream.NewBatcher(stream.NewInMemoryStats(), 10, time.Hour).WithLimits(2, 0)
+
+	assert.NoError(t, b.TryAddRecord(stream.Event{Domain: "a"}, nil))
+	assert.False(t, b.Full())
+	assert.NoError(t, b.TryAddRecord(stream.Event{Domain: "a"}, nil))
+	assert.True(t, b.Full())
+	assert.ErrorIs(t, b.TryAddRecord(stream.Event{Domain: "a"}, nil), stream.ErrBufferFull)
+
+	_, err := b.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, b.Full())
+	assert.NoError(t, b.TryAddRecord(stream.Event{Domain: "a"}, nil))
+}
+
+func TestBatcher_TryAddRecordStopsAtByteLimit(t *testing.T) {
+	small := stream.Event{Domain: "a"}
+	large := stream.Event{Domain: "a", Title: string(make([]byte, 1000))}
+	b := stream.NewBatcher(stream.NewInMemoryStats(), 10, time.Hour).WithLimits(0, 2*stream.EventSize(small))
+
+	assert.NoError(t, b.TryAddRecord(small, nil))
+	assert.ErrorIs(t, b.TryAddRecord(large, nil), stream.ErrBufferFull)
+	assert.NoError(t, b.TryAddRecord(small, nil))
+	assert.ErrorIs(t, b.TryAddRecord(small, nil), stream.ErrBufferFull)
+
+	// An event over the limit on its own still fits an empty buffer.
+	_, err := b.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, b.TryAddRecord(large, nil))
+}
+
+func TestBatcher_AddRecordWaitsForFlushWhenFull(t *testing.T) {
+	store := &gatedStore{StatsStore: stream.NewInMemoryStats(), domain: "slow", release: make(chan struct{})}
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 10, time.Hour).WithLimits(1, 0).WithCommitter(recorder.commit)
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Start(ctx)
+
+	// The first event is swapped out and stuck in the store; the second
+	// fills the buffer again while the only flush slot is taken.
+	b.AddRecord(stream.Event{Domain: "slow"}, &kgo.Record{Topic: "t", Offset: 0})
+	b.AddRecord(stream.Event{Domain: "fast"}, &kgo.Record{Topic: "t", Offset: 1})
+	added := make(chan struct{})
+	go func() {
+		b.AddRecord(stream.Event{Domain: "fast"}, &kgo.Record{Topic: "t", Offset: 2})
+		close(added)
+	}()
+
+	select {
+	case <-added:
+		t.Fatal("added to a full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.True(t, b.Full())
+
+	close(store.release)
+	<-added
+	cancel()
+	b.Stop()
+
+	commits := recorder.all()
+	if assert.NotEmpty(t, commits) {
+		assert.Equal(t, int64(3), commits[len(commits)-1]["t"][0].Offset)
+	}
+}
+
+func TestBatcher_AddRecordContextGivesUpWhenCancelled(t *testing.T) {
+	b := stream.NewBatcher(stream.NewInMemoryStats(), 10, time.Hour).WithLimits(1, 0)
+	b.AddRecord(stream.Event{Domain: "a"}, nil)
+
+	// Nothing flushes, so only the context ends the wait.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := b.AddRecordContext(ctx, stream.Event{Domain: "b"}, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	flushed, err := b.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, flushed, 1)
+}
+
+// slowStore takes delay(call) to write each batch, fails the calls listed
+// in fail, and tracks how many writes overlap.
+type slowStore struct {
+	*stream.InMemoryStats
+	delay func(call int) time.Duration
+	fail  map[int]bool
+
+	mu        sync.Mutex
+	calls     int
+	active    int
+	maxActive int
+}
+
+func (s *slowStore) RecordMany(ctx context.Context, events []stream.Event) error {
+	s.mu.Lock()
+	call := s.calls
+	s.calls++
+	s.active++
+	if s.active > s.maxActive {
+		s.maxActive = s.active
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(s.delay(call)):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if s.fail[call] {
+		return errors.New("write timed out")
+	}
+	return s.InMemoryStats.RecordMany(ctx, events)
+}
+
+func (s *slowStore) overlap() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxActive
+}
+
+// checkedCommits fails the test if offsets are committed before every
+// event below them is in store, or out of order.
+func checkedCommits(t *testing.T, store stream.StatsStore, recorder *commitRecorder) stream.CommitFunc {
+	var mu sync.Mutex
+	var last int64
+	return func(ctx context.Context, offsets stream.Offsets) error {
+		mu.Lock()
+		defer mu.Unlock()
+		next := offsets["t"][0].Offset
+		assert.GreaterOrEqual(t, next, last, "commit went backwards")
+		assert.GreaterOrEqual(t, int64(snapshotOf(t, store).Messages), next, "committed past unwritten events")
+		last = next
+		return recorder.commit(ctx, offsets)
+	}
+}
+
+func TestBatcher_AddDoesNotWaitForSlowWrites(t *testing.T) {
+	store := &slowStore{InMemoryStats: stream.NewInMemoryStats(), delay: func(int) time.Duration { return 100 * time.Millisecond }}
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 1, time.Hour)
+	b.WithCommitter(checkedCommits(t, store, recorder))
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Start(ctx)
+
+	start := time.Now()
+	for offset := int64(0); offset < 20; offset++ {
+		b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: offset})
+	}
+	assert.Less(t, time.Since(start), 100*time.Millisecond, "adding waited for the store")
+
+	cancel()
+	b.Stop()
+	assert.Equal(t, 20, snapshotOf(t, store).Messages)
+	commits := recorder.all()
+	if assert.NotEmpty(t, commits) {
+		assert.Equal(t, int64(20), commits[len(commits)-1]["t"][0].Offset)
+	}
+}
+
+func TestBatcher_ConcurrentFlushesCommitInOrder(t *testing.T) {
+	// Earlier batches take longer, so they finish after later ones.
+	store := &slowStore{InMemoryStats: stream.NewInMemoryStats(), delay: func(call int) time.Duration {
+		return time.Duration(50-call*10) * time.Millisecond
+	}}
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 1, time.Hour).WithMaxInFlight(3)
+	b.WithCommitter(checkedCommits(t, store, recorder))
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Start(ctx)
+
+	for offset := int64(0); offset < 5; offset++ {
+		b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: offset})
+		time.Sleep(2 * time.Millisecond)
+	}
+	_, err := b.Flush(context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, 5, snapshotOf(t, store).Messages)
+	assert.Greater(t, store.overlap(), 1, "flushes did not overlap")
+	assert.LessOrEqual(t, store.overlap(), 3)
+	commits := recorder.all()
+	if assert.NotEmpty(t, commits) {
+		assert.Equal(t, int64(5), commits[len(commits)-1]["t"][0].Offset)
+	}
+
+	cancel()
+	b.Stop()
+}
+
+func TestBatcher_FailedFlushHoldsBackLaterCommits(t *testing.T) {
+	// The first batch fails after the second one has been written.
+	store := &slowStore{
+		InMemoryStats: stream.NewInMemoryStats(),
+		delay: func(call int) time.Duration {
+			if call == 0 {
+				return 50 * time.Millisecond
+			}
+			return time.Millisecond
+		},
+		fail: map[int]bool{0: true},
+	}
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 1, time.Hour).WithMaxInFlight(2).WithRetry(1, 0)
+	b.WithCommitter(checkedCommits(t, store, recorder))
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Start(ctx)
+
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 0})
+	time.Sleep(5 * time.Millisecond)
+	b.AddRecord(stream.Event{Domain: "b"}, &kgo.Record{Topic: "t", Offset: 1})
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, snapshotOf(t, store).Messages)
+	assert.Empty(t, recorder.all(), "committed past the failed batch")
+
+	// The failed event is retried with the next flush, which commits both.
+	_, err := b.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, snapshotOf(t, store).Messages)
+	commits := recorder.all()
+	if assert.Len(t, commits, 1) {
+		assert.Equal(t, int64(2), commits[0]["t"][0].Offset)
+	}
+
+	cancel()
+	b.Stop()
+}
+
+func TestBatcher_ObservesFlushSizeAndDuration(t *testing.T) {
+	sizes := histogramCount(t, stream.BatcherFlushSize)
+	durations := histogramCount(t, stream.BatcherFlushDuration)
+
+	store := &slowStore{InMemoryStats: stream.NewInMemoryStats(), delay: func(int) time.Duration { return time.Millisecond }}
+	b := stream.NewBatcher(store, 10, time.Hour)
+	for i := 0; i < 3; i++ {
+		b.Add(stream.Event{Domain: "a"})
+	}
+	_, err := b.Flush(context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, sizes+1, histogramCount(t, stream.BatcherFlushSize))
+	assert.Equal(t, durations+1, histogramCount(t, stream.BatcherFlushDuration))
+}
+
+func histogramCount(t *testing.T, h prometheus.Histogram) uint64 {
+	t.Helper()
+	var m dto.Metric
+	assert.NoError(t, h.Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestBatcher_ShutdownBoundsTheFinalFlush(t *testing.T) {
+	store := &gatedStore{domain: "a", release: make(chan struct{})}
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 100, time.Hour).WithCommitter(recorder.commit)
+	b.Start(context.Background())
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	b.Shutdown(ctx)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Empty(t, recorder.all())
+}
+
+func TestBatcher_StopIsIdempotentAndSafeWithLateAdds(t *testing.T) {
+	store := stream.NewInMemoryStats()
+	recorder := &commitRecorder{}
+	b := stream.NewBatcher(store, 1, time.Hour).WithCommitter(recorder.commit)
+	b.Start(context.Background())
+
+	b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 0})
+	b.Stop()
+	b.Stop()
+
+	// Adding after Stop used to send on a closed channel.
+	assert.NotPanics(t, func() {
+		b.AddRecord(stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 1})
+	})
+	_, err := b.Flush(context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, snapshotOf(t, store).Messages)
+	commits := recorder.all()
+	if assert.NotEmpty(t, commits) {
+		assert.Equal(t, int64(2), commits[len(commits)-1]["t"][0].Offset)
+	}
+}
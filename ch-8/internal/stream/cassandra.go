@@ -1,7 +1,14 @@
 package stream
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/hll"
 )
 
 type Session interface {
@@ -9,7 +16,11 @@ type Session interface {
 }
 
 type Query interface {
+	WithContext(ctx context.Context) Query
 	Exec() error
+	// MapScanCAS runs a lightweight transaction and reports whether it
+	// applied. On failure dest receives the current row.
+	MapScanCAS(dest map[string]interface{}) (bool, error)
 	Iter() Iter
 }
 
@@ -18,68 +29,794 @@ type Iter interface {
 	Close() error
 }
 
+// PingCassandra runs a trivial query to tell whether session can reach the
+// cluster.
+func PingCassandra(ctx context.Context, session Session) error {
+	return session.Query(`SELECT now() FROM system.local`).WithContext(ctx).Exec()
+}
+
+// defaultWriteConcurrency bounds the counter UPDATEs a RecordMany call has
+// in flight at once.
+const defaultWriteConcurrency = 8
+
+// defaultBucketRetention is how long CassandraStats keeps minute and hour
+// buckets before Prune deletes them. Day buckets are kept for good.
+var defaultBucketRetention = map[Granularity]time.Duration{
+	GranularityMinute: 7 * 24 * time.Hour,
+	GranularityHour:   90 * 24 * time.Hour,
+}
+
 type CassandraStats struct {
-	session Session
+	session          Session
+	writeConcurrency int
+	now              func() time.Time
+
+	pruneMu   sync.Mutex
+	retention map[Granularity]time.Duration
+	// prunedTo is, per granularity, the start of the oldest bucket Prune
+	// has not deleted yet.
+	prunedTo map[Granularity]time.Time
+
+	// flushMu serialises FlushSketches; sketchMu guards the sketches
+	// waiting for it.
+	flushMu         sync.Mutex
+	sketchMu        sync.Mutex
+	pendingSketches map[[2]string]*hll.Sketch
+	droppedSketches int
 }
 
 func NewCassandraStats(session Session) *CassandraStats {
-	return &CassandraStats{session: session}
+	retention := make(map[Granularity]time.Duration, len(defaultBucketRetention))
+	for g, keep := range defaultBucketRetention {
+		retention[g] = keep
+	}
+	return &CassandraStats{
+		session:          session,
+		writeConcurrency: defaultWriteConcurrency,
+		now:              time.Now,
+		retention:        retention,
+		prunedTo:         make(map[Granularity]time.Time),
+		pendingSketches:  make(map[[2]string]*hll.Sketch),
+	}
 }
 
-func (c *CassandraStats) Record(event Event) {
-	if err := c.session.Query(`
-		UPDATE stats_by_domain SET count = count + 1 WHERE domain = ?
-	`, event.Domain).Exec(); err != nil {
-		log.Printf("failed to update stats_by_domain: %v", err)
+// WithWriteConcurrency overrides how many counter UPDATEs run in parallel.
+func (c *CassandraStats) WithWriteConcurrency(n int) *CassandraStats {
+	if n < 1 {
+		n = 1
 	}
+	c.writeConcurrency = n
+	return c
+}
+
+// WithClock replaces time.Now, for tests.
+func (c *CassandraStats) WithClock(now func() time.Time) *CassandraStats {
+	c.now = now
+	return c
+}
 
-	if err := c.session.Query(`
-		UPDATE stats_by_user SET count = count + 1 WHERE user = ?
-	`, event.User).Exec(); err != nil {
-		log.Printf("failed to update stats_by_user: %v", err)
+// WithRetention overrides how long buckets of g are kept. Zero keeps them
+// for good.
+func (c *CassandraStats) WithRetention(g Granularity, keep time.Duration) *CassandraStats {
+	c.pruneMu.Lock()
+	defer c.pruneMu.Unlock()
+	if keep <= 0 {
+		delete(c.retention, g)
+	} else {
+		c.retention[g] = keep
 	}
+	return c
 }
 
-func (c *CassandraStats) RecordMany(events []Event) {
+func (c *CassandraStats) Record(ctx context.Context, event Event) error {
+	return c.RecordMany(ctx, []Event{event})
+}
+
+// RecordMany folds the batch into one increment per counter row, e.g.
+// en.wikipedia.org +14, and writes them concurrently. Counter increments are
+// not idempotent, so if some writes fail after others were applied it
+// returns a *PartialWriteError whose Resume writes only the failed ones. The
+// batch's distinct users are only folded into local sketches here, for
+// FlushSketches to merge into Cassandra, so a contended sketch never fails
+// or replays the counters.
+func (c *CassandraStats) RecordMany(ctx context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	now := c.now()
+	sketches := aggregateSketches(events, now)
+	return c.writeCounters(ctx, aggregateCounters(events, now), func() { c.deferSketches(sketches) })
+}
+
+// writeCounters applies updates and then calls done. If only some of them
+// are applied, the *PartialWriteError it returns resumes with the others.
+func (c *CassandraStats) writeCounters(ctx context.Context, updates []counterUpdate, done func()) error {
+	applied := make([]bool, len(updates))
+	tasks := make([]func(context.Context) error, 0, len(updates))
+	for i, u := range updates {
+		tasks = append(tasks, func(ctx context.Context) error {
+			if err := c.session.Query(u.stmt, u.values()...).WithContext(ctx).Exec(); err != nil {
+				return fmt.Errorf("failed to update %s: %w", u.table, err)
+			}
+			applied[i] = true
+			return nil
+		})
+	}
+	err := c.run(ctx, tasks)
+	if err == nil {
+		done()
+		return nil
+	}
+
+	var rest []counterUpdate
+	for i, u := range updates {
+		if !applied[i] {
+			rest = append(rest, u)
+		}
+	}
+	if len(rest) == len(updates) {
+		return err
+	}
+	return &PartialWriteError{Err: err, Resume: func(ctx context.Context) error {
+		return c.writeCounters(ctx, rest, done)
+	}}
+}
+
+// counterUpdate adds deltas to the counter columns of the row named by keys.
+// Its statement binds the deltas first, then the keys.
+type counterUpdate struct {
+	table  string
+	stmt   string
+	keys   []interface{}
+	deltas []int64
+}
+
+func (u counterUpdate) values() []interface{} {
+	values := make([]interface{}, 0, len(u.deltas)+len(u.keys))
+	for _, d := range u.deltas {
+		values = append(values, d)
+	}
+	return append(values, u.keys...)
+}
+
+// counterTables lists the per-key counter tables and how each event maps to
+// a row. Empty text keys are skipped: Cassandra rejects them, and events
+// from older producers carry no type, wiki or server URL.
+var counterTables = []struct {
+	table string
+	stmt  string
+	key   func(Event) (interface{}, bool)
+}{
+	{"stats_by_server_url", `UPDATE stats_by_server_url SET count = count + ? WHERE server_url = ?`,
+		func(e Event) (interface{}, bool) { return e.ServerURL, e.ServerURL != "" }},
+	{"stats_by_domain", `UPDATE stats_by_domain SET count = count + ? WHERE domain = ?`,
+		func(e Event) (interface{}, bool) { return e.Domain, true }},
+	{"stats_by_user", `UPDATE stats_by_user SET count = count + ? WHERE user = ?`,
+		func(e Event) (interface{}, bool) { return e.User, true }},
+	{"stats_by_type", `UPDATE stats_by_type SET count = count + ? WHERE type = ?`,
+		func(e Event) (interface{}, bool) { return e.Type, e.Type != "" }},
+	{"stats_by_namespace", `UPDATE stats_by_namespace SET count = count + ? WHERE namespace = ?`,
+		func(e Event) (interface{}, bool) { return e.Namespace, true }},
+	{"stats_by_wiki", `UPDATE stats_by_wiki SET count = count + ? WHERE wiki = ?`,
+		func(e Event) (interface{}, bool) { return e.Wiki, e.Wiki != "" }},
+}
+
+const (
+	summaryUpdate = `UPDATE stats_summary SET total_messages = total_messages + ?, bot_count = bot_count + ?, non_bot_count = non_bot_count + ? WHERE id = 'global'`
+
+	bucketSummaryUpdate = `UPDATE stats_by_bucket SET total_messages = total_messages + ?, bot_count = bot_count + ?, non_bot_count = non_bot_count + ? WHERE granularity = ? AND period = ? AND bucket = ?`
+	bucketDomainUpdate  = `UPDATE stats_by_domain_bucket SET count = count + ? WHERE granularity = ? AND bucket = ? AND domain = ?`
+	bucketUserUpdate    = `UPDATE stats_by_user_bucket SET count = count + ? WHERE granularity = ? AND bucket = ? AND user = ?`
+)
+
+// counterBatch merges increments that hit the same row.
+type counterBatch struct {
+	index   map[string]int
+	updates []counterUpdate
+}
+
+func (b *counterBatch) add(table, stmt string, keys []interface{}, deltas ...int64) {
+	rowKey := fmt.Sprint(stmt, keys)
+	if pos, seen := b.index[rowKey]; seen {
+		for i, d := range deltas {
+			b.updates[pos].deltas[i] += d
+		}
+		return
+	}
+	b.index[rowKey] = len(b.updates)
+	b.updates = append(b.updates, counterUpdate{table: table, stmt: stmt, keys: keys, deltas: deltas})
+}
+
+// aggregateCounters turns a batch into one update per touched row, including
+// the minute, hour and day buckets of each event. now stands in for events
+// without a timestamp.
+func aggregateCounters(events []Event, now time.Time) []counterUpdate {
+	batch := counterBatch{index: make(map[string]int)}
+
 	for _, event := range events {
-		if err := c.session.Query(`
-			UPDATE stats_by_domain SET count = count + 1 WHERE domain = ?
-		`, event.Domain).Exec(); err != nil {
-			log.Printf("failed to update stats_by_domain: %v", err)
+		var bot, nonBot int64 = 0, 1
+		if event.Bot {
+			bot, nonBot = 1, 0
+		}
+		batch.add("stats_summary", summaryUpdate, nil, 1, bot, nonBot)
+
+		for _, t := range counterTables {
+			key, ok := t.key(event)
+			if !ok {
+				continue
+			}
+			batch.add(t.table, t.stmt, []interface{}{key}, 1)
+		}
+
+		at := eventTime(event, now)
+		for _, g := range Granularities {
+			bucket := g.Truncate(at)
+			batch.add("stats_by_bucket", bucketSummaryUpdate, []interface{}{string(g), bucketPeriod(g, bucket), bucket}, 1, bot, nonBot)
+			batch.add("stats_by_domain_bucket", bucketDomainUpdate, []interface{}{string(g), bucket, event.Domain}, 1)
+			batch.add("stats_by_user_bucket", bucketUserUpdate, []interface{}{string(g), bucket, event.User}, 1)
+		}
+	}
+	return batch.updates
+}
+
+// bucketPeriod is the start of the stats_by_bucket partition holding the
+// bucket of g that starts at start: its UTC day for minute buckets, month for
+// hour buckets and year for day buckets, so no partition holds more than
+// 1440 rows.
+func bucketPeriod(g Granularity, start time.Time) time.Time {
+	y, m, d := start.UTC().Date()
+	switch g {
+	case GranularityMinute:
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	case GranularityHour:
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(y, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// nextPeriod is the start of the partition after period.
+func nextPeriod(g Granularity, period time.Time) time.Time {
+	switch g {
+	case GranularityMinute:
+		return period.AddDate(0, 0, 1)
+	case GranularityHour:
+		return period.AddDate(0, 1, 0)
+	default:
+		return period.AddDate(1, 0, 0)
+	}
+}
+
+// Counter tables cannot carry a TTL, so buckets past their retention are
+// deleted by Prune instead.
+const (
+	bucketSummaryDelete = `DELETE FROM stats_by_bucket WHERE granularity = ? AND period = ? AND bucket = ?`
+	bucketDomainDelete  = `DELETE FROM stats_by_domain_bucket WHERE granularity = ? AND bucket = ?`
+	bucketUserDelete    = `DELETE FROM stats_by_user_bucket WHERE granularity = ? AND bucket = ?`
+
+	// PruneInterval is how often Run prunes.
+	PruneInterval = 10 * time.Minute
+	// pruneLookback is how many buckets before the retention cutoff the
+	// first Prune deletes; later calls carry on from where it stopped.
+	// Buckets that aged out while nothing was pruning, further back than
+	// this, are left behind.
+	pruneLookback = 1440
+)
+
+// Prune deletes the minute and hour buckets, with their per-domain and
+// per-user rows, that have aged out of retention since the last call. It is
+// idempotent, so every consumer may run it.
+func (c *CassandraStats) Prune(ctx context.Context) error {
+	c.pruneMu.Lock()
+	defer c.pruneMu.Unlock()
+
+	now := c.now()
+	for _, g := range Granularities {
+		keep, ok := c.retention[g]
+		if !ok {
+			continue
+		}
+		cutoff := g.Truncate(now.Add(-keep))
+		from, ok := c.prunedTo[g]
+		if !ok {
+			from = cutoff.Add(-pruneLookback * g.Duration())
 		}
 
-		if err := c.session.Query(`
-			UPDATE stats_by_user SET count = count + 1 WHERE user = ?
-		`, event.User).Exec(); err != nil {
-			log.Printf("failed to update stats_by_user: %v", err)
+		var tasks []func(context.Context) error
+		for bucket := from; bucket.Before(cutoff); bucket = bucket.Add(g.Duration()) {
+			period := bucketPeriod(g, bucket)
+			tasks = append(tasks,
+				c.deleteTask("stats_by_bucket", bucketSummaryDelete, string(g), period, bucket),
+				c.deleteTask("stats_by_domain_bucket", bucketDomainDelete, string(g), bucket),
+				c.deleteTask("stats_by_user_bucket", bucketUserDelete, string(g), bucket),
+			)
 		}
+		if err := c.run(ctx, tasks); err != nil {
+			return err
+		}
+		if cutoff.After(from) {
+			c.prunedTo[g] = cutoff
+		}
+	}
+	return nil
+}
+
+func (c *CassandraStats) deleteTask(table, stmt string, values ...interface{}) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if err := c.session.Query(stmt, values...).WithContext(ctx).Exec(); err != nil {
+			return fmt.Errorf("failed to prune %s: %w", table, err)
+		}
+		return nil
 	}
 }
 
-func (c *CassandraStats) GetSnapshot() StatsSnapshot {
+// Run flushes deferred sketches every SketchFlushInterval and prunes
+// expired buckets now and every PruneInterval, until ctx is done. Failures
+// are logged and retried on the next tick. Sketches still waiting when ctx
+// is done are left for a final FlushSketches.
+func (c *CassandraStats) Run(ctx context.Context) {
+	flush := time.NewTicker(SketchFlushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(PruneInterval)
+	defer prune.Stop()
+
+	c.prune(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C:
+			if err := c.FlushSketches(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("⚠️ Failed to write distinct-user sketches, will retry: %v", err)
+			}
+		case <-prune.C:
+			c.prune(ctx)
+		}
+	}
+}
+
+func (c *CassandraStats) prune(ctx context.Context) {
+	if err := c.Prune(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("⚠️ Failed to prune expired stats buckets: %v", err)
+	}
+}
+
+// run executes tasks with at most writeConcurrency in flight. The first
+// failure cancels the rest and is returned.
+func (c *CassandraStats) run(ctx context.Context, tasks []func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		sem      = make(chan struct{}, c.writeConcurrency)
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	for _, task := range tasks {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			fail(ctx.Err())
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(task func(context.Context) error) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := task(ctx); err != nil {
+				fail(err)
+			}
+		}(task)
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// Distinct users are HyperLogLog sketches stored as blobs: the global row
+// and one row per time bucket in user_sketches, keyed by scope and key, and
+// one row per domain in domain_user_sketches, so GetSnapshot can read them
+// all at once.
+const (
+	sketchScopeGlobal = "global"
+	sketchScopeDomain = "domain"
+
+	// maxSketchMergeAttempts bounds the compare-and-set retries when other
+	// consumers keep winning the race for the same row.
+	maxSketchMergeAttempts = 5
+	// maxPendingSketches bounds the sketches waiting for FlushSketches,
+	// about 16 KiB each.
+	maxPendingSketches = 4096
+
+	// SketchFlushInterval is how often Run flushes sketches.
+	SketchFlushInterval = 10 * time.Second
+)
+
+var ErrSketchContended = errors.New("sketch merge kept losing to concurrent writers")
+
+type scopedSketch struct {
+	scope, key string
+	sketch     *hll.Sketch
+}
+
+// sketchTable is where sketches of some scopes are stored. read and insert
+// bind the keys first, insert then the blob and TTL; update binds the TTL
+// and blob, then the keys and the blob it read.
+type sketchTable struct {
+	name   string
+	read   string
+	insert string
+	update string
+	keys   func(scope, key string) []interface{}
+}
+
+var (
+	userSketches = sketchTable{
+		name:   "user_sketches",
+		read:   `SELECT sketch FROM user_sketches WHERE scope = ? AND key = ?`,
+		insert: `INSERT INTO user_sketches (scope, key, sketch) VALUES (?, ?, ?) IF NOT EXISTS USING TTL ?`,
+		update: `UPDATE user_sketches USING TTL ? SET sketch = ? WHERE scope = ? AND key = ? IF sketch = ?`,
+		keys:   func(scope, key string) []interface{} { return []interface{}{scope, key} },
+	}
+	domainSketches = sketchTable{
+		name:   "domain_user_sketches",
+		read:   `SELECT sketch FROM domain_user_sketches WHERE domain = ?`,
+		insert: `INSERT INTO domain_user_sketches (domain, sketch) VALUES (?, ?) IF NOT EXISTS USING TTL ?`,
+		update: `UPDATE domain_user_sketches USING TTL ? SET sketch = ? WHERE domain = ? IF sketch = ?`,
+		keys:   func(_, domain string) []interface{} { return []interface{}{domain} },
+	}
+)
+
+func sketchTableFor(scope string) sketchTable {
+	if scope == sketchScopeDomain {
+		return domainSketches
+	}
+	return userSketches
+}
+
+// sketchTTL is how long the sketch of scope is kept after its last write:
+// as long as the buckets of that granularity are, or for good.
+func (c *CassandraStats) sketchTTL(scope string) int {
+	c.pruneMu.Lock()
+	defer c.pruneMu.Unlock()
+	return int(c.retention[Granularity(scope)] / time.Second)
+}
+
+// deferSketches folds sketches into those waiting for FlushSketches. Past
+// maxPendingSketches rows, sketches for rows not already waiting are
+// dropped, which only lowers the distinct-user estimates.
+func (c *CassandraStats) deferSketches(sketches []scopedSketch) {
+	c.sketchMu.Lock()
+	defer c.sketchMu.Unlock()
+	for _, s := range sketches {
+		k := [2]string{s.scope, s.key}
+		if pending, ok := c.pendingSketches[k]; ok {
+			if err := pending.Merge(s.sketch); err != nil {
+				c.droppedSketches++
+			}
+			continue
+		}
+		if len(c.pendingSketches) >= maxPendingSketches {
+			c.droppedSketches++
+			continue
+		}
+		c.pendingSketches[k] = s.sketch
+	}
+}
+
+// FlushSketches merges the sketches RecordMany deferred into user_sketches.
+// Those that could not be merged, e.g. because other consumers kept winning
+// the compare-and-set, wait for the next flush; merging a sketch twice is
+// harmless. It returns the first failure.
+func (c *CassandraStats) FlushSketches(ctx context.Context) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.sketchMu.Lock()
+	pending, dropped := c.pendingSketches, c.droppedSketches
+	c.pendingSketches, c.droppedSketches = make(map[[2]string]*hll.Sketch), 0
+	c.sketchMu.Unlock()
+	if dropped > 0 {
+		log.Printf("⚠️ Dropped %d distinct-user sketches with %d already waiting to be written", dropped, maxPendingSketches)
+	}
+
+	var (
+		mu     sync.Mutex
+		merged = make(map[[2]string]bool, len(pending))
+		tasks  = make([]func(context.Context) error, 0, len(pending))
+	)
+	for k, sketch := range pending {
+		tasks = append(tasks, func(ctx context.Context) error {
+			if err := c.mergeSketch(ctx, k[0], k[1], sketch); err != nil {
+				return err
+			}
+			mu.Lock()
+			merged[k] = true
+			mu.Unlock()
+			return nil
+		})
+	}
+	err := c.run(ctx, tasks)
+
+	var retry []scopedSketch
+	for k, sketch := range pending {
+		if !merged[k] {
+			retry = append(retry, scopedSketch{scope: k[0], key: k[1], sketch: sketch})
+		}
+	}
+	c.deferSketches(retry)
+	return err
+}
+
+func bucketSketchKey(start time.Time) string {
+	return start.UTC().Format(time.RFC3339)
+}
+
+// aggregateSketches builds the batch's contribution to every sketch it
+// touches.
+func aggregateSketches(events []Event, now time.Time) []scopedSketch {
+	index := make(map[[2]string]int)
+	var sketches []scopedSketch
+	add := func(scope, key, user string) {
+		k := [2]string{scope, key}
+		pos, ok := index[k]
+		if !ok {
+			pos = len(sketches)
+			index[k] = pos
+			sketches = append(sketches, scopedSketch{scope: scope, key: key, sketch: hll.New()})
+		}
+		sketches[pos].sketch.Add(user)
+	}
+
+	for _, event := range events {
+		add(sketchScopeGlobal, sketchScopeGlobal, event.User)
+		add(sketchScopeDomain, event.Domain, event.User)
+		at := eventTime(event, now)
+		for _, g := range Granularities {
+			add(string(g), bucketSketchKey(g.Truncate(at)), event.User)
+		}
+	}
+	return sketches
+}
+
+// mergeSketch folds local into the stored sketch with a read, merge and
+// conditional write, retrying when another writer got there first.
+func (c *CassandraStats) mergeSketch(ctx context.Context, scope, key string, local *hll.Sketch) error {
+	table := sketchTableFor(scope)
+	keys := table.keys(scope, key)
+	ttl := c.sketchTTL(scope)
+	for attempt := 0; attempt < maxSketchMergeAttempts; attempt++ {
+		stored, current, err := c.readSketch(ctx, scope, key)
+		if err != nil {
+			return err
+		}
+
+		merged := local
+		if stored != nil {
+			merged = stored
+			if err := merged.Merge(local); err != nil {
+				return fmt.Errorf("failed to merge %s %s/%s: %w", table.name, scope, key, err)
+			}
+		}
+		blob, err := merged.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		var q Query
+		if current == nil {
+			q = c.session.Query(table.insert, append(keys, blob, ttl)...)
+		} else {
+			q = c.session.Query(table.update, append(append([]interface{}{ttl, blob}, keys...), current)...)
+		}
+		applied, err := q.WithContext(ctx).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return fmt.Errorf("failed to update %s: %w", table.name, err)
+		}
+		if applied {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to update %s %s/%s: %w", table.name, scope, key, ErrSketchContended)
+}
+
+// readSketch returns the stored sketch and its raw blob, or nils if the row
+// does not exist yet.
+func (c *CassandraStats) readSketch(ctx context.Context, scope, key string) (*hll.Sketch, []byte, error) {
+	table := sketchTableFor(scope)
+	iter := c.session.Query(table.read, table.keys(scope, key)...).WithContext(ctx).Iter()
+	var blob []byte
+	found := iter.Scan(&blob)
+	if err := iter.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", table.name, err)
+	}
+	if !found || len(blob) == 0 {
+		return nil, nil, nil
+	}
+
+	var sketch hll.Sketch
+	if err := sketch.UnmarshalBinary(blob); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode %s %s/%s: %w", table.name, scope, key, err)
+	}
+	return &sketch, blob, nil
+}
+
+func (c *CassandraStats) GetSnapshot(ctx context.Context) (StatsSnapshot, error) {
 	snapshot := StatsSnapshot{
-		ByDomain: make(map[string]int),
-		ByUser:   make(map[string]int),
+		ByServerURL: make(map[string]int),
+		ByDomain:    make(map[string]int),
+		ByUser:      make(map[string]int),
+		ByType:      make(map[string]int),
+		ByNamespace: make(map[int]int),
+		ByWiki:      make(map[string]int),
+
+		DistinctUsersByDomain: make(map[string]int),
 	}
 
-	iter := c.session.Query(`SELECT domain, count FROM stats_by_domain`).Iter()
+	iter := c.session.Query(`SELECT domain, count FROM stats_by_domain`).WithContext(ctx).Iter()
 	var domain string
 	var count int
 	for iter.Scan(&domain, &count) {
 		snapshot.ByDomain[domain] = count
 	}
 	if err := iter.Close(); err != nil {
-		log.Printf("error closing stats_by_domain iterator: %v", err)
+		return StatsSnapshot{}, fmt.Errorf("failed to read stats_by_domain: %w", err)
 	}
 
-	iter = c.session.Query(`SELECT user, count FROM stats_by_user`).Iter()
+	iter = c.session.Query(`SELECT user, count FROM stats_by_user`).WithContext(ctx).Iter()
 	var user string
 	for iter.Scan(&user, &count) {
 		snapshot.ByUser[user] = count
 	}
 	if err := iter.Close(); err != nil {
-		log.Printf("error closing stats_by_user iterator: %v", err)
+		return StatsSnapshot{}, fmt.Errorf("failed to read stats_by_user: %w", err)
 	}
 
-	return snapshot
+	users, _, err := c.readSketch(ctx, sketchScopeGlobal, sketchScopeGlobal)
+	if err != nil {
+		return StatsSnapshot{}, err
+	}
+	if users == nil {
+		users = hll.New()
+	}
+	snapshot.DistinctUsers = int(users.Estimate())
+	snapshot.DistinctUsersStdError = users.StdError()
+
+	iter = c.session.Query(`SELECT domain, sketch FROM domain_user_sketches`).WithContext(ctx).Iter()
+	var blob []byte
+	for iter.Scan(&domain, &blob) {
+		var sketch hll.Sketch
+		if err := sketch.UnmarshalBinary(blob); err != nil {
+			iter.Close()
+			return StatsSnapshot{}, fmt.Errorf("failed to decode domain_user_sketches %s: %w", domain, err)
+		}
+		snapshot.DistinctUsersByDomain[domain] = int(sketch.Estimate())
+	}
+	if err := iter.Close(); err != nil {
+		return StatsSnapshot{}, fmt.Errorf("failed to read domain_user_sketches: %w", err)
+	}
+
+	iter = c.session.Query(`SELECT type, count FROM stats_by_type`).WithContext(ctx).Iter()
+	var changeType string
+	for iter.Scan(&changeType, &count) {
+		snapshot.ByType[changeType] = count
+	}
+	if err := iter.Close(); err != nil {
+		return StatsSnapshot{}, fmt.Errorf("failed to read stats_by_type: %w", err)
+	}
+
+	iter = c.session.Query(`SELECT namespace, count FROM stats_by_namespace`).WithContext(ctx).Iter()
+	var namespace int
+	for iter.Scan(&namespace, &count) {
+		snapshot.ByNamespace[namespace] = count
+	}
+	if err := iter.Close(); err != nil {
+		return StatsSnapshot{}, fmt.Errorf("failed to read stats_by_namespace: %w", err)
+	}
+
+	iter = c.session.Query(`SELECT wiki, count FROM stats_by_wiki`).WithContext(ctx).Iter()
+	var wiki string
+	for iter.Scan(&wiki, &count) {
+		snapshot.ByWiki[wiki] = count
+	}
+	if err := iter.Close(); err != nil {
+		return StatsSnapshot{}, fmt.Errorf("failed to read stats_by_wiki: %w", err)
+	}
+
+	iter = c.session.Query(`SELECT server_url, count FROM stats_by_server_url`).WithContext(ctx).Iter()
+	var serverURL string
+	for iter.Scan(&serverURL, &count) {
+		snapshot.ByServerURL[serverURL] = count
+	}
+	if err := iter.Close(); err != nil {
+		return StatsSnapshot{}, fmt.Errorf("failed to read stats_by_server_url: %w", err)
+	}
+
+	iter = c.session.Query(`SELECT total_messages, bot_count, non_bot_count FROM stats_summary WHERE id = 'global'`).WithContext(ctx).Iter()
+	iter.Scan(&snapshot.Messages, &snapshot.Bots, &snapshot.NonBots)
+	if err := iter.Close(); err != nil {
+		return StatsSnapshot{}, fmt.Errorf("failed to read stats_summary: %w", err)
+	}
+
+	return snapshot, nil
+}
+
+// GetTimeSeries reads the bucket totals with one range query per partition
+// the range spans, then the per-domain and per-user rows and the user sketch
+// of each non-empty bucket.
+func (c *CassandraStats) GetTimeSeries(ctx context.Context, q SeriesQuery) (TimeSeries, error) {
+	if err := q.Validate(); err != nil {
+		return TimeSeries{}, err
+	}
+
+	starts := q.Buckets()
+	series := TimeSeries{Granularity: q.Granularity, From: q.From, To: q.To}
+	byStart := make(map[time.Time]int, len(starts))
+	for i, start := range starts {
+		series.Buckets = append(series.Buckets, newSeriesBucket(start))
+		byStart[start] = i
+	}
+
+	for period := bucketPeriod(q.Granularity, starts[0]); period.Before(q.To); period = nextPeriod(q.Granularity, period) {
+		iter := c.session.Query(`SELECT bucket, total_messages, bot_count, non_bot_count FROM stats_by_bucket WHERE granularity = ? AND period = ? AND bucket >= ? AND bucket < ?`,
+			string(q.Granularity), period, starts[0], q.To).WithContext(ctx).Iter()
+		var (
+			start                   time.Time
+			messages, bots, nonBots int
+		)
+		for iter.Scan(&start, &messages, &bots, &nonBots) {
+			if i, ok := byStart[start.UTC()]; ok {
+				b := &series.Buckets[i]
+				b.Messages, b.Bots, b.NonBots = messages, bots, nonBots
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return TimeSeries{}, fmt.Errorf("failed to read stats_by_bucket: %w", err)
+		}
+	}
+
+	for i := range series.Buckets {
+		b := &series.Buckets[i]
+		if b.Messages == 0 {
+			continue
+		}
+		if err := c.readBucketCounts(ctx, "stats_by_domain_bucket", "domain", q.Granularity, b.Start, b.ByDomain); err != nil {
+			return TimeSeries{}, err
+		}
+		if err := c.readBucketCounts(ctx, "stats_by_user_bucket", "user", q.Granularity, b.Start, b.ByUser); err != nil {
+			return TimeSeries{}, err
+		}
+		users, _, err := c.readSketch(ctx, string(q.Granularity), bucketSketchKey(b.Start))
+		if err != nil {
+			return TimeSeries{}, err
+		}
+		if users != nil {
+			b.DistinctUsers = int(users.Estimate())
+		}
+	}
+	return series, nil
+}
+
+func (c *CassandraStats) readBucketCounts(ctx context.Context, table, column string, g Granularity, start time.Time, into map[string]int) error {
+	stmt := fmt.Sprintf(`SELECT %s, count FROM %s WHERE granularity = ? AND bucket = ?`, column, table)
+	iter := c.session.Query(stmt, string(g), start).WithContext(ctx).Iter()
+	var key string
+	var count int
+	for iter.Scan(&key, &count) {
+		into[key] = count
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", table, err)
+	}
+	return nil
 }
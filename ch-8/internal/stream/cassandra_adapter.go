@@ -1,6 +1,10 @@
 package stream
 
-import "github.com/gocql/gocql"
+import (
+	"context"
+
+	"github.com/gocql/gocql"
+)
 
 type CassandraSessionAdapter struct {
 	sess *gocql.Session
@@ -18,10 +22,18 @@ type CassandraQueryAdapter struct {
 	q *gocql.Query
 }
 
+func (c *CassandraQueryAdapter) WithContext(ctx context.Context) Query {
+	return &CassandraQueryAdapter{q: c.q.WithContext(ctx)}
+}
+
 func (c *CassandraQueryAdapter) Exec() error {
 	return c.q.Exec()
 }
 
+func (c *CassandraQueryAdapter) MapScanCAS(dest map[string]interface{}) (bool, error) {
+	return c.q.MapScanCAS(dest)
+}
+
 func (c *CassandraQueryAdapter) Iter() Iter {
 	return &CassandraIterAdapter{i: c.q.Iter()}
 }
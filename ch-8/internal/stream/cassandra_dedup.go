@@ -0,0 +1,51 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	processedEventSelect = `SELECT event_id FROM processed_events WHERE event_id = ?`
+	processedEventInsert = `INSERT INTO processed_events (event_id) VALUES (?) USING TTL ?`
+
+	// DefaultProcessedEventTTL is how long processed_events remembers an id.
+	DefaultProcessedEventTTL = 24 * time.Hour
+)
+
+// CassandraDeduplicator remembers processed event ids in the
+// processed_events table, each for a TTL. It is shared by every consumer
+// and survives restarts, at the cost of a read per event; put a SeenSet in
+// front of it with NewTieredDeduplicator.
+type CassandraDeduplicator struct {
+	session Session
+	ttl     time.Duration
+}
+
+func NewCassandraDeduplicator(session Session, ttl time.Duration) *CassandraDeduplicator {
+	if ttl < time.Second {
+		ttl = DefaultProcessedEventTTL
+	}
+	return &CassandraDeduplicator{session: session, ttl: ttl}
+}
+
+func (c *CassandraDeduplicator) Seen(ctx context.Context, id string) (bool, error) {
+	iter := c.session.Query(processedEventSelect, id).WithContext(ctx).Iter()
+	var got string
+	found := iter.Scan(&got)
+	if err := iter.Close(); err != nil {
+		return false, fmt.Errorf("failed to read processed_events: %w", err)
+	}
+	return found, nil
+}
+
+func (c *CassandraDeduplicator) Processed(ctx context.Context, ids []string) error {
+	ttl := int(c.ttl / time.Second)
+	for _, id := range ids {
+		if err := c.session.Query(processedEventInsert, id, ttl).WithContext(ctx).Exec(); err != nil {
+			return fmt.Errorf("failed to write processed_events: %w", err)
+		}
+	}
+	return nil
+}
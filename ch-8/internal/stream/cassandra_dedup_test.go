@@ -0,0 +1,53 @@
+package stream_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCassandraDeduplicator_Seen(t *testing.T) {
+	session := &mockSession{queryOverride: func(_ string, values ...interface{}) stream.Query {
+		if values[0] == "old" {
+			return &mockQuery{iter: &mockRowIter{rows: [][]interface{}{{"old"}}}}
+		}
+		return &mockQuery{iter: &mockRowIter{}}
+	}}
+	d := stream.NewCassandraDeduplicator(session, time.Hour)
+
+	assert.True(t, seen(t, d, "old"))
+	assert.False(t, seen(t, d, "new"))
+	assert.True(t, strings.HasPrefix(session.calledQueries[0], "SELECT event_id FROM processed_events"))
+}
+
+func TestCassandraDeduplicator_ReadError(t *testing.T) {
+	session := &mockSession{iter: &mockIter{closeErr: errors.New("timeout")}}
+	_, err := stream.NewCassandraDeduplicator(session, time.Hour).Seen(context.Background(), "e-1")
+	assert.ErrorContains(t, err, "processed_events")
+}
+
+func TestCassandraDeduplicator_ProcessedWritesWithTTL(t *testing.T) {
+	session := &mockSession{}
+	d := stream.NewCassandraDeduplicator(session, 2*time.Hour)
+
+	assert.NoError(t, d.Processed(context.Background(), []string{"e-1", "e-2"}))
+	assert.Len(t, session.calls, 2)
+	for i, id := range []string{"e-1", "e-2"} {
+		assert.Contains(t, session.calls[i].stmt, "USING TTL ?")
+		assert.Equal(t, []interface{}{id, 7200}, session.calls[i].values)
+	}
+}
+
+func TestCassandraDeduplicator_ProcessedStopsOnError(t *testing.T) {
+	session := &mockSession{queryOverride: func(string, ...interface{}) stream.Query {
+		return &mockQuery{execFunc: func() error { return errors.New("unavailable") }}
+	}}
+	err := stream.NewCassandraDeduplicator(session, time.Hour).Processed(context.Background(), []string{"e-1", "e-2"})
+	assert.ErrorContains(t, err, "unavailable")
+	assert.Len(t, session.calls, 1)
+}
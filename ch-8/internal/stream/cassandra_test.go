@@ -1,17 +1,31 @@
 package stream_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/hll"
 	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
 	"github.com/stretchr/testify/assert"
 )
 
 type mockQuery struct {
 	execFunc func() error
+	casFunc  func() (bool, error)
 	iter     stream.Iter
 }
 
+func (m *mockQuery) WithContext(_ context.Context) stream.Query {
+	return m
+}
+
 func (m *mockQuery) Exec() error {
 	if m.execFunc != nil {
 		return m.execFunc()
@@ -19,7 +33,17 @@ func (m *mockQuery) Exec() error {
 	return nil
 }
 
+func (m *mockQuery) MapScanCAS(_ map[string]interface{}) (bool, error) {
+	if m.casFunc != nil {
+		return m.casFunc()
+	}
+	return true, nil
+}
+
 func (m *mockQuery) Iter() stream.Iter {
+	if m.iter == nil {
+		return &mockIter{}
+	}
 	return m.iter
 }
 
@@ -34,7 +58,12 @@ func (m *mockIter) Scan(dest ...interface{}) bool {
 		return false
 	}
 	row := m.data[m.index]
-	*dest[0].(*string) = row[0].(string)
+	switch key := dest[0].(type) {
+	case *string:
+		*key = row[0].(string)
+	case *int:
+		*key = row[0].(int)
+	}
 	*dest[1].(*int) = row[1].(int)
 	m.index++
 	return true
@@ -44,30 +73,217 @@ func (m *mockIter) Close() error {
 	return m.closeErr
 }
 
+type mockRowIter struct {
+	rows  [][]interface{}
+	index int
+}
+
+func (m *mockRowIter) Scan(dest ...interface{}) bool {
+	if m.index >= len(m.rows) {
+		return false
+	}
+	for i, v := range m.rows[m.index] {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(v))
+	}
+	m.index++
+	return true
+}
+
+func (m *mockRowIter) Close() error {
+	return nil
+}
+
+type mockCall struct {
+	stmt   string
+	values []interface{}
+}
+
 type mockSession struct {
+	mu            sync.Mutex
 	calledQueries []string
+	calls         []mockCall
 	iter          stream.Iter
 	queryOverride func(string, ...interface{}) stream.Query
 }
 
 func (m *mockSession) Query(stmt string, values ...interface{}) stream.Query {
+	m.mu.Lock()
 	m.calledQueries = append(m.calledQueries, stmt)
+	m.calls = append(m.calls, mockCall{stmt: stmt, values: values})
+	m.mu.Unlock()
 	if m.queryOverride != nil {
 		return m.queryOverride(stmt, values...)
 	}
 	return &mockQuery{iter: m.iter}
 }
 
+// updatedTables returns the table named by each UPDATE, in any order.
+func (m *mockSession) updatedTables() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var tables []string
+	for _, q := range m.calledQueries {
+		fields := strings.Fields(q)
+		if len(fields) > 1 && fields[0] == "UPDATE" {
+			tables = append(tables, fields[1])
+		}
+	}
+	return tables
+}
+
+// update returns the values bound to the UPDATE of table whose key is key.
+func (m *mockSession) update(table string, key interface{}) []interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.calls {
+		if strings.Contains(c.stmt, "UPDATE "+table+" ") && c.values[len(c.values)-1] == key {
+			return c.values
+		}
+	}
+	return nil
+}
+
+// bucketTables are the rows one event touches across the minute, hour and
+// day buckets.
+var bucketTables = []string{
+	"stats_by_bucket", "stats_by_domain_bucket", "stats_by_user_bucket",
+	"stats_by_bucket", "stats_by_domain_bucket", "stats_by_user_bucket",
+	"stats_by_bucket", "stats_by_domain_bucket", "stats_by_user_bucket",
+}
+
 func TestCassandraStats_Record(t *testing.T) {
 	mock := &mockSession{}
 	stats := stream.NewCassandraStats(mock)
 
-	event := stream.Event{Domain: "en.wikipedia.org", User: "alice"}
-	stats.Record(event)
+	event := stream.Event{
+		Domain:    "en.wikipedia.org",
+		User:      "alice",
+		Type:      "edit",
+		Wiki:      "enwiki",
+		ServerURL: "https://en.wikipedia.org",
+	}
+	assert.NoError(t, stats.Record(context.Background(), event))
+
+	assert.ElementsMatch(t, append([]string{
+		"stats_summary",
+		"stats_by_server_url",
+		"stats_by_domain",
+		"stats_by_user",
+		"stats_by_type",
+		"stats_by_namespace",
+		"stats_by_wiki",
+	}, bucketTables...), mock.updatedTables())
+	assert.Equal(t, []interface{}{int64(1), "en.wikipedia.org"}, mock.update("stats_by_domain", "en.wikipedia.org"))
+}
+
+func TestCassandraStats_Record_Bot(t *testing.T) {
+	mock := &mockSession{}
+	stats := stream.NewCassandraStats(mock)
+
+	assert.NoError(t, stats.Record(context.Background(), stream.Event{Domain: "en.wikipedia.org", User: "bot", Bot: true}))
 
-	assert.Len(t, mock.calledQueries, 2)
-	assert.Contains(t, mock.calledQueries[0], "UPDATE stats_by_domain")
-	assert.Contains(t, mock.calledQueries[1], "UPDATE stats_by_user")
+	for _, c := range mock.calls {
+		if strings.Contains(c.stmt, "stats_summary") || strings.Contains(c.stmt, "stats_by_bucket") {
+			assert.Equal(t, []interface{}{int64(1), int64(1), int64(0)}, c.values[:3])
+		}
+	}
+}
+
+func TestCassandraStats_Record_SkipsEmptyTypeAndWiki(t *testing.T) {
+	mock := &mockSession{}
+	stats := stream.NewCassandraStats(mock)
+
+	assert.NoError(t, stats.Record(context.Background(), stream.Event{Domain: "en.wikipedia.org", User: "alice"}))
+
+	assert.ElementsMatch(t, append([]string{
+		"stats_summary",
+		"stats_by_domain",
+		"stats_by_user",
+		"stats_by_namespace",
+	}, bucketTables...), mock.updatedTables())
+}
+
+func TestCassandraStats_RecordMany_AggregatesPerRow(t *testing.T) {
+	mock := &mockSession{}
+	stats := stream.NewCassandraStats(mock)
+
+	ts := time.Date(2025, 6, 1, 12, 0, 30, 0, time.UTC).Unix()
+	var events []stream.Event
+	for i := 0; i < 14; i++ {
+		events = append(events, stream.Event{Domain: "en.wikipedia.org", User: "alice", Timestamp: ts})
+	}
+	for i := 0; i < 6; i++ {
+		events = append(events, stream.Event{Domain: "de.wikipedia.org", User: "bob", Bot: true, Timestamp: ts})
+	}
+
+	assert.NoError(t, stats.RecordMany(context.Background(), events))
+
+	// summary + 2 domains + 2 users + 1 namespace, plus per granularity one
+	// bucket summary, 2 domains and 2 users: 21 instead of 20 * 13.
+	assert.Len(t, mock.updatedTables(), 21)
+	assert.Len(t, mock.calledQueries, 21, "sketches wait for FlushSketches")
+
+	// One sketch each for global, the 2 domains and the 3 buckets.
+	assert.NoError(t, stats.FlushSketches(context.Background()))
+	var inserts int
+	for _, q := range mock.calledQueries {
+		if strings.HasPrefix(q, "INSERT INTO") && strings.Contains(q, "sketches") {
+			inserts++
+		}
+	}
+	assert.Equal(t, 6, inserts)
+	assert.Equal(t, int64(14), mock.update("stats_by_domain", "en.wikipedia.org")[0])
+	assert.Equal(t, int64(6), mock.update("stats_by_domain", "de.wikipedia.org")[0])
+	assert.Equal(t, int64(20), mock.update("stats_by_namespace", 0)[0])
+	for _, c := range mock.calls {
+		if strings.Contains(c.stmt, "stats_summary") {
+			assert.Equal(t, []interface{}{int64(20), int64(6), int64(14)}, c.values)
+		}
+	}
+
+	minute := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, c := range mock.calls {
+		if strings.Contains(c.stmt, "stats_by_domain_bucket") && c.values[1] == "minute" && c.values[3] == "en.wikipedia.org" {
+			assert.Equal(t, []interface{}{int64(14), "minute", minute, "en.wikipedia.org"}, c.values)
+		}
+	}
+}
+
+func TestCassandraStats_RecordMany_Empty(t *testing.T) {
+	mock := &mockSession{}
+	stats := stream.NewCassandraStats(mock)
+
+	assert.NoError(t, stats.RecordMany(context.Background(), nil))
+	assert.Empty(t, mock.calledQueries)
+}
+
+func TestCassandraStats_RecordMany_BoundedConcurrency(t *testing.T) {
+	var inFlight, peak int32
+	mock := &mockSession{
+		queryOverride: func(stmt string, values ...interface{}) stream.Query {
+			return &mockQuery{execFunc: func() error {
+				n := atomic.AddInt32(&inFlight, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&inFlight, -1)
+				return nil
+			}}
+		},
+	}
+	stats := stream.NewCassandraStats(mock).WithWriteConcurrency(2)
+
+	var events []stream.Event
+	for i := 0; i < 10; i++ {
+		events = append(events, stream.Event{Domain: fmt.Sprintf("d%d", i), User: "u"})
+	}
+	assert.NoError(t, stats.RecordMany(context.Background(), events))
+
+	assert.LessOrEqual(t, atomic.LoadInt32(&peak), int32(2))
 }
 
 func TestCassandraStats_GetSnapshot(t *testing.T) {
@@ -81,7 +297,7 @@ func TestCassandraStats_GetSnapshot(t *testing.T) {
 	mock := &mockSession{iter: iter}
 	stats := stream.NewCassandraStats(mock)
 
-	snapshot := stats.GetSnapshot()
+	snapshot := snapshotOf(t, stats)
 
 	assert.Equal(t, 5, snapshot.ByDomain["en.wikipedia.org"])
 	assert.Equal(t, 3, snapshot.ByDomain["de.wikipedia.org"])
@@ -100,7 +316,50 @@ func TestCassandraStats_Record_WithExecError(t *testing.T) {
 	stats := stream.NewCassandraStats(mock)
 
 	event := stream.Event{Domain: "test.com", User: "alice"}
-	stats.Record(event)
+	err := stats.Record(context.Background(), event)
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Contains(t, err.Error(), "failed to update")
+}
+
+func TestCassandraStats_RecordMany_ReturnsWriteError(t *testing.T) {
+	mock := &mockSession{
+		queryOverride: func(stmt string, values ...interface{}) stream.Query {
+			return &mockQuery{execFunc: func() error { return assert.AnError }}
+		},
+	}
+	stats := stream.NewCassandraStats(mock)
+
+	err := stats.RecordMany(context.Background(), []stream.Event{{Domain: "a", User: "u"}, {Domain: "b", User: "v"}})
+	assert.ErrorIs(t, err, assert.AnError)
+}
+
+func TestCassandraStats_RecordMany_ResumesOnlyFailedCounters(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	mock := &mockSession{
+		queryOverride: func(stmt string, _ ...interface{}) stream.Query {
+			if strings.HasPrefix(stmt, "UPDATE stats_by_domain ") && fail.Load() {
+				return &mockQuery{execFunc: func() error { return assert.AnError }}
+			}
+			return &mockQuery{}
+		},
+	}
+	stats := stream.NewCassandraStats(mock).WithWriteConcurrency(1)
+
+	err := stats.RecordMany(context.Background(), []stream.Event{{Domain: "a", User: "u"}})
+	var partial *stream.PartialWriteError
+	if !assert.ErrorAs(t, err, &partial) {
+		return
+	}
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Contains(t, mock.updatedTables(), "stats_summary")
+
+	mock.calls, mock.calledQueries = nil, nil
+	fail.Store(false)
+	assert.NoError(t, partial.Resume(context.Background()))
+	resumed := mock.updatedTables()
+	assert.Contains(t, resumed, "stats_by_domain")
+	assert.NotContains(t, resumed, "stats_summary", "applied counters are not incremented again")
 }
 
 func TestCassandraStats_GetSnapshot_WithCloseError(t *testing.T) {
@@ -108,13 +367,14 @@ func TestCassandraStats_GetSnapshot_WithCloseError(t *testing.T) {
 		data: [][2]interface{}{
 			{"test.com", 1},
 		},
-		closeErr: assert.AnError, // this triggers the log error branch
+		closeErr: assert.AnError,
 	}
 
 	mock := &mockSession{iter: iter}
 	stats := stream.NewCassandraStats(mock)
 
-	_ = stats.GetSnapshot() // capture log path on iter.Close()
+	_, err := stats.GetSnapshot(context.Background())
+	assert.ErrorIs(t, err, assert.AnError)
 }
 
 func TestCassandraStats_GetSnapshot_FullCoverage(t *testing.T) {
@@ -130,22 +390,408 @@ func TestCassandraStats_GetSnapshot_FullCoverage(t *testing.T) {
 		},
 	}
 
+	typeIter := &mockIter{data: [][2]interface{}{{"edit", 4}}}
+	namespaceIter := &mockIter{data: [][2]interface{}{{0, 6}}}
+	wikiIter := &mockIter{data: [][2]interface{}{{"enwiki", 7}}}
+	serverIter := &mockIter{data: [][2]interface{}{{"https://en.wikipedia.org", 8}}}
+	summaryIter := &mockRowIter{rows: [][]interface{}{{10, 4, 6}}}
+	usersIter := &mockRowIter{rows: [][]interface{}{{sketchOf(t, "alice", "bob")}}}
+	domainUsersIter := &mockRowIter{rows: [][]interface{}{{"en.wikipedia.org", sketchOf(t, "alice")}}}
+
 	mock := &mockSession{
 		queryOverride: func(stmt string, values ...interface{}) stream.Query {
 			switch {
+			case strings.HasPrefix(stmt, "SELECT sketch FROM user_sketches"):
+				return &mockQuery{iter: usersIter}
+			case stmt == "SELECT domain, sketch FROM domain_user_sketches":
+				return &mockQuery{iter: domainUsersIter}
 			case stmt == "SELECT domain, count FROM stats_by_domain":
 				return &mockQuery{iter: domainIter}
 			case stmt == "SELECT user, count FROM stats_by_user":
 				return &mockQuery{iter: userIter}
+			case stmt == "SELECT type, count FROM stats_by_type":
+				return &mockQuery{iter: typeIter}
+			case stmt == "SELECT namespace, count FROM stats_by_namespace":
+				return &mockQuery{iter: namespaceIter}
+			case stmt == "SELECT wiki, count FROM stats_by_wiki":
+				return &mockQuery{iter: wikiIter}
+			case stmt == "SELECT server_url, count FROM stats_by_server_url":
+				return &mockQuery{iter: serverIter}
+			case strings.HasPrefix(stmt, "SELECT total_messages"):
+				return &mockQuery{iter: summaryIter}
 			default:
-				return &mockQuery{}
+				return &mockQuery{iter: &mockIter{}}
 			}
 		},
 	}
 
 	stats := stream.NewCassandraStats(mock)
-	snapshot := stats.GetSnapshot()
+	snapshot := snapshotOf(t, stats)
 
 	assert.Equal(t, 3, snapshot.ByDomain["en.wikipedia.org"])
 	assert.Equal(t, 2, snapshot.ByUser["alice"]) // ✅ triggers the final uncovered line
+	assert.Equal(t, 4, snapshot.ByType["edit"])
+	assert.Equal(t, 6, snapshot.ByNamespace[0])
+	assert.Equal(t, 7, snapshot.ByWiki["enwiki"])
+	assert.Equal(t, 8, snapshot.ByServerURL["https://en.wikipedia.org"])
+	assert.Equal(t, 10, snapshot.Messages)
+	assert.Equal(t, 4, snapshot.Bots)
+	assert.Equal(t, 6, snapshot.NonBots)
+	assert.Equal(t, 2, snapshot.DistinctUsers)
+	assert.InDelta(t, 0.0081, snapshot.DistinctUsersStdError, 0.0001)
+	assert.Equal(t, map[string]int{"en.wikipedia.org": 1}, snapshot.DistinctUsersByDomain)
+}
+
+func sketchOf(t testing.TB, users ...string) []byte {
+	t.Helper()
+	s := hll.New()
+	for _, u := range users {
+		s.Add(u)
+	}
+	blob, err := s.MarshalBinary()
+	assert.NoError(t, err)
+	return blob
+}
+
+func TestCassandraStats_FlushSketches_MergesExistingSketch(t *testing.T) {
+	stored := sketchOf(t, "alice", "carol")
+	var written []byte
+	mock := &mockSession{}
+	mock.queryOverride = func(stmt string, values ...interface{}) stream.Query {
+		switch {
+		case strings.HasPrefix(stmt, "SELECT sketch") && values[0] == "global":
+			return &mockQuery{iter: &mockRowIter{rows: [][]interface{}{{stored}}}}
+		case strings.HasPrefix(stmt, "UPDATE user_sketches") && values[2] == "global":
+			assert.Equal(t, 0, values[0], "the global sketch never expires")
+			written = values[1].([]byte)
+			assert.Equal(t, stored, values[4], "update must be conditional on the blob it read")
+		}
+		return &mockQuery{}
+	}
+	stats := stream.NewCassandraStats(mock).WithWriteConcurrency(1)
+
+	assert.NoError(t, stats.RecordMany(context.Background(), []stream.Event{
+		{Domain: "en.wikipedia.org", User: "alice"},
+	}))
+	assert.NoError(t, stats.RecordMany(context.Background(), []stream.Event{
+		{Domain: "en.wikipedia.org", User: "bob"},
+	}))
+	assert.NoError(t, stats.FlushSketches(context.Background()))
+
+	var merged hll.Sketch
+	assert.NoError(t, merged.UnmarshalBinary(written))
+	assert.Equal(t, uint64(3), merged.Estimate())
+}
+
+func TestCassandraStats_FlushSketches_ExpiresBucketSketches(t *testing.T) {
+	mock := &mockSession{}
+	stats := stream.NewCassandraStats(mock).WithRetention(stream.GranularityHour, 48*time.Hour)
+
+	ts := time.Date(2025, 6, 1, 12, 0, 30, 0, time.UTC).Unix()
+	assert.NoError(t, stats.Record(context.Background(), stream.Event{Domain: "en.wikipedia.org", User: "alice", Timestamp: ts}))
+	assert.NoError(t, stats.FlushSketches(context.Background()))
+
+	ttls := make(map[string]interface{})
+	for _, c := range mock.calls {
+		if !strings.HasPrefix(c.stmt, "INSERT INTO") {
+			continue
+		}
+		table := strings.Fields(c.stmt)[2]
+		ttls[table+" "+fmt.Sprint(c.values[:len(c.values)-2])] = c.values[len(c.values)-1]
+	}
+	assert.Equal(t, map[string]interface{}{
+		"user_sketches [global global]":               0,
+		"user_sketches [minute 2025-06-01T12:00:00Z]": 7 * 24 * 60 * 60,
+		"user_sketches [hour 2025-06-01T12:00:00Z]":   48 * 60 * 60,
+		"user_sketches [day 2025-06-01T00:00:00Z]":    0,
+		"domain_user_sketches [en.wikipedia.org]":     0,
+	}, ttls)
+}
+
+func TestCassandraStats_FlushSketches_RetriesLostSketchRace(t *testing.T) {
+	var attempts int32
+	mock := &mockSession{
+		queryOverride: func(stmt string, values ...interface{}) stream.Query {
+			if strings.HasPrefix(stmt, "INSERT INTO user_sketches") && values[0] == "global" {
+				return &mockQuery{casFunc: func() (bool, error) {
+					return atomic.AddInt32(&attempts, 1) > 2, nil
+				}}
+			}
+			return &mockQuery{}
+		},
+	}
+	stats := stream.NewCassandraStats(mock)
+
+	assert.NoError(t, stats.Record(context.Background(), stream.Event{Domain: "a", User: "u"}))
+	assert.NoError(t, stats.FlushSketches(context.Background()))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestCassandraStats_ContendedSketchDoesNotFailCounters(t *testing.T) {
+	var contended atomic.Bool
+	contended.Store(true)
+	mock := &mockSession{
+		queryOverride: func(stmt string, values ...interface{}) stream.Query {
+			return &mockQuery{casFunc: func() (bool, error) { return !contended.Load(), nil }}
+		},
+	}
+	stats := stream.NewCassandraStats(mock)
+
+	assert.NoError(t, stats.Record(context.Background(), stream.Event{Domain: "a", User: "u"}))
+	counters := len(mock.updatedTables())
+
+	err := stats.FlushSketches(context.Background())
+	assert.ErrorIs(t, err, stream.ErrSketchContended)
+	assert.Len(t, mock.updatedTables(), counters, "a contended sketch must not replay the counters")
+
+	// The sketches are kept and written by the next flush.
+	contended.Store(false)
+	mock.calls, mock.calledQueries = nil, nil
+	assert.NoError(t, stats.FlushSketches(context.Background()))
+	var inserts int
+	for _, q := range mock.calledQueries {
+		if strings.HasPrefix(q, "INSERT INTO") && strings.Contains(q, "sketches") {
+			inserts++
+		}
+	}
+	assert.Equal(t, 5, inserts, "global, the domain and the 3 buckets")
+
+	mock.calls, mock.calledQueries = nil, nil
+	assert.NoError(t, stats.FlushSketches(context.Background()))
+	assert.Empty(t, mock.calledQueries, "nothing left to flush")
+}
+
+func TestCassandraStats_RecordMany_FailedCountersDeferNoSketches(t *testing.T) {
+	mock := &mockSession{
+		queryOverride: func(string, ...interface{}) stream.Query {
+			return &mockQuery{execFunc: func() error { return assert.AnError }}
+		},
+	}
+	stats := stream.NewCassandraStats(mock)
+
+	assert.Error(t, stats.Record(context.Background(), stream.Event{Domain: "a", User: "u"}))
+	mock.calls, mock.calledQueries = nil, nil
+	assert.NoError(t, stats.FlushSketches(context.Background()))
+	assert.Empty(t, mock.calledQueries, "the retried batch brings its users again")
+}
+
+func TestCassandraStats_GetTimeSeries(t *testing.T) {
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	summaryIter := &mockRowIter{rows: [][]interface{}{{base.Add(time.Minute), 5, 2, 3}}}
+
+	mock := &mockSession{
+		queryOverride: func(stmt string, values ...interface{}) stream.Query {
+			switch {
+			case strings.Contains(stmt, "FROM stats_by_bucket"):
+				return &mockQuery{iter: summaryIter}
+			case strings.Contains(stmt, "FROM stats_by_domain_bucket"):
+				return &mockQuery{iter: &mockIter{data: [][2]interface{}{{"en.wikipedia.org", 5}}}}
+			case strings.Contains(stmt, "FROM stats_by_user_bucket"):
+				return &mockQuery{iter: &mockIter{data: [][2]interface{}{{"alice", 4}, {"bot", 1}}}}
+			case strings.Contains(stmt, "FROM user_sketches"):
+				assert.Equal(t, []interface{}{"minute", "2025-06-01T12:01:00Z"}, values)
+				return &mockQuery{iter: &mockRowIter{rows: [][]interface{}{{sketchOf(t, "alice", "bot")}}}}
+			default:
+				return &mockQuery{iter: &mockIter{}}
+			}
+		},
+	}
+	stats := stream.NewCassandraStats(mock)
+
+	series, err := stats.GetTimeSeries(context.Background(), stream.SeriesQuery{
+		Granularity: stream.GranularityMinute,
+		From:        base,
+		To:          base.Add(3 * time.Minute),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, series.Buckets, 3)
+	assert.Equal(t, 0, series.Buckets[0].Messages)
+
+	b := series.Buckets[1]
+	assert.Equal(t, base.Add(time.Minute), b.Start)
+	assert.Equal(t, 5, b.Messages)
+	assert.Equal(t, 2, b.Bots)
+	assert.Equal(t, 3, b.NonBots)
+	assert.Equal(t, 5, b.ByDomain["en.wikipedia.org"])
+	assert.Equal(t, 4, b.ByUser["alice"])
+	assert.Equal(t, 2, b.DistinctUsers)
+
+	// Only the non-empty bucket needs its domain, user and sketch rows read.
+	assert.Len(t, mock.calledQueries, 4)
+	day := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, []interface{}{"minute", day, base, base.Add(3 * time.Minute)}, mock.calls[0].values)
+}
+
+func TestCassandraStats_GetTimeSeries_ReadsEachPeriod(t *testing.T) {
+	tests := []struct {
+		name        string
+		granularity stream.Granularity
+		from, to    time.Time
+		periods     []time.Time
+	}{
+		{
+			name:        "minutes across midnight",
+			granularity: stream.GranularityMinute,
+			from:        time.Date(2025, 6, 1, 23, 58, 0, 0, time.UTC),
+			to:          time.Date(2025, 6, 2, 0, 2, 0, 0, time.UTC),
+			periods:     []time.Time{time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:        "hours across a month",
+			granularity: stream.GranularityHour,
+			from:        time.Date(2025, 6, 30, 22, 0, 0, 0, time.UTC),
+			to:          time.Date(2025, 7, 1, 2, 0, 0, 0, time.UTC),
+			periods:     []time.Time{time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:        "days within a year",
+			granularity: stream.GranularityDay,
+			from:        time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+			to:          time.Date(2025, 6, 8, 0, 0, 0, 0, time.UTC),
+			periods:     []time.Time{time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockSession{}
+			stats := stream.NewCassandraStats(mock)
+
+			_, err := stats.GetTimeSeries(context.Background(), stream.SeriesQuery{Granularity: tt.granularity, From: tt.from, To: tt.to})
+			assert.NoError(t, err)
+
+			var periods []time.Time
+			for _, c := range mock.calls {
+				assert.Contains(t, c.stmt, "FROM stats_by_bucket WHERE granularity = ? AND period = ?")
+				periods = append(periods, c.values[1].(time.Time))
+			}
+			assert.Equal(t, tt.periods, periods)
+		})
+	}
+}
+
+func TestCassandraStats_Prune(t *testing.T) {
+	now := time.Date(2025, 6, 10, 12, 30, 30, 0, time.UTC)
+	mock := &mockSession{}
+	stats := stream.NewCassandraStats(mock).
+		WithClock(func() time.Time { return now }).
+		WithRetention(stream.GranularityHour, 0)
+
+	// deleted returns the minute buckets deleted from each table since the
+	// last call.
+	deleted := func() map[string][]time.Time {
+		mock.mu.Lock()
+		defer mock.mu.Unlock()
+		byTable := make(map[string][]time.Time)
+		for _, c := range mock.calls {
+			fields := strings.Fields(c.stmt)
+			assert.Equal(t, "DELETE", fields[0])
+			assert.Equal(t, "minute", c.values[0])
+			byTable[fields[2]] = append(byTable[fields[2]], c.values[len(c.values)-1].(time.Time))
+		}
+		mock.calls = nil
+		return byTable
+	}
+
+	cutoff := time.Date(2025, 6, 3, 12, 30, 0, 0, time.UTC)
+	assert.NoError(t, stats.Prune(context.Background()))
+	first := deleted()
+	for _, table := range []string{"stats_by_bucket", "stats_by_domain_bucket", "stats_by_user_bucket"} {
+		assert.Len(t, first[table], 1440, table)
+		assert.Contains(t, first[table], cutoff.Add(-time.Minute), table)
+		assert.NotContains(t, first[table], cutoff, table)
+	}
+
+	// A later run deletes only what has aged out since.
+	now = now.Add(3 * time.Minute)
+	assert.NoError(t, stats.Prune(context.Background()))
+	assert.ElementsMatch(t, []time.Time{cutoff, cutoff.Add(time.Minute), cutoff.Add(2 * time.Minute)}, deleted()["stats_by_bucket"])
+}
+
+func TestCassandraStats_Prune_RetriesAfterError(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	mock := &mockSession{queryOverride: func(string, ...interface{}) stream.Query {
+		return &mockQuery{execFunc: func() error {
+			if fail.Load() {
+				return assert.AnError
+			}
+			return nil
+		}}
+	}}
+	stats := stream.NewCassandraStats(mock).WithRetention(stream.GranularityHour, 0)
+
+	err := stats.Prune(context.Background())
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Contains(t, err.Error(), "failed to prune")
+
+	fail.Store(false)
+	mock.calls = nil
+	assert.NoError(t, stats.Prune(context.Background()))
+	assert.Len(t, mock.calls, 3*1440, "a failed prune is redone in full")
+}
+
+func TestCassandraStats_GetTimeSeries_ReadError(t *testing.T) {
+	mock := &mockSession{iter: &mockIter{closeErr: assert.AnError}}
+	stats := stream.NewCassandraStats(mock)
+
+	base := time.Now()
+	_, err := stats.GetTimeSeries(context.Background(), stream.SeriesQuery{Granularity: stream.GranularityHour, From: base, To: base.Add(time.Hour)})
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Contains(t, err.Error(), "stats_by_bucket")
+}
+
+// batchOf builds a Batcher-sized batch with the skew RecentChange shows:
+// most edits land on a handful of wikis and users.
+func batchOf(n int) []stream.Event {
+	domains := []string{"en.wikipedia.org", "en.wikipedia.org", "en.wikipedia.org", "commons.wikimedia.org", "www.wikidata.org"}
+	events := make([]stream.Event, n)
+	for i := range events {
+		events[i] = stream.Event{
+			Domain:    domains[i%len(domains)],
+			User:      fmt.Sprintf("user%d", i%4),
+			Type:      "edit",
+			Wiki:      "enwiki",
+			ServerURL: "https://" + domains[i%len(domains)],
+		}
+	}
+	return events
+}
+
+func BenchmarkCassandraStats_RecordPerEvent(b *testing.B) {
+	events := batchOf(20)
+	mock := &mockSession{}
+	stats := stream.NewCassandraStats(mock)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, e := range events {
+			_ = stats.Record(ctx, e)
+		}
+	}
+	b.ReportMetric(float64(len(mock.calledQueries))/float64(b.N), "stmts/op")
+}
+
+func BenchmarkCassandraStats_RecordManyAggregated(b *testing.B) {
+	events := batchOf(20)
+	mock := &mockSession{}
+	stats := stream.NewCassandraStats(mock)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = stats.RecordMany(ctx, events)
+	}
+	b.ReportMetric(float64(len(mock.calledQueries))/float64(b.N), "stmts/op")
+}
+
+func TestPingCassandra(t *testing.T) {
+	session := &mockSession{}
+	assert.NoError(t, stream.PingCassandra(context.Background(), session))
+	assert.Equal(t, []string{"SELECT now() FROM system.local"}, session.calledQueries)
+
+	session.queryOverride = func(string, ...interface{}) stream.Query {
+		return &mockQuery{execFunc: func() error { return errors.New("no hosts available") }}
+	}
+	assert.EqualError(t, stream.PingCassandra(context.Background(), session), "no hosts available")
 }
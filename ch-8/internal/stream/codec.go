@@ -0,0 +1,277 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/registry"
+	pb "github.com/joshua-daniels-red/go-backend-challenge/ch-8/proto"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeJSON = "application/json"
+	ContentTypeAvro = "application/avro"
+)
+
+// Codec converts events to and from one serialization format. The format
+// travels in the content-type header, so a topic can move between formats
+// record by record while consumers read all of them.
+type Codec interface {
+	// Name is the format's name in configuration: protobuf, json or avro.
+	Name() string
+	ContentType() string
+	// Schema is what the codec registers with a schema registry.
+	Schema() registry.Schema
+	Marshal(event Event) ([]byte, error)
+	Unmarshal(data []byte) (Event, error)
+}
+
+var codecs = []Codec{ProtobufCodec{}, JSONCodec{}, AvroCodec{}}
+
+// CodecByName returns the codec for a configured format.
+func CodecByName(name string) (Codec, error) {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown event format %q: want protobuf, json or avro", name)
+}
+
+// CodecForContentType returns the codec that reads records with the
+// content-type header ct. Records without one predate the header and are
+// protobuf.
+func CodecForContentType(ct string) (Codec, bool) {
+	if ct == "" {
+		return ProtobufCodec{}, true
+	}
+	for _, c := range codecs {
+		if c.ContentType() == ct {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// ProtobufCodec writes proto/event.proto.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Name() string        { return "protobuf" }
+func (ProtobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (ProtobufCodec) Schema() registry.Schema {
+	return registry.Schema{Type: registry.TypeProtobuf, Schema: pb.EventSchema}
+}
+
+func (ProtobufCodec) Marshal(event Event) ([]byte, error) {
+	return proto.Marshal(event.ToProto())
+}
+
+func (ProtobufCodec) Unmarshal(data []byte) (Event, error) {
+	var p pb.Event
+	if err := proto.Unmarshal(data, &p); err != nil {
+		return Event{}, err
+	}
+	return EventFromProto(&p), nil
+}
+
+// JSONCodec writes Event's JSON form, the format before protobuf. Unknown
+// fields are ignored and missing ones read as zero, like protobuf.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string        { return "json" }
+func (JSONCodec) ContentType() string { return ContentTypeJSON }
+
+func (JSONCodec) Schema() registry.Schema {
+	return registry.Schema{Type: registry.TypeJSON, Schema: eventJSONSchema}
+}
+
+// The event id travels in a header, never in the payload.
+func (JSONCodec) Marshal(event Event) ([]byte, error) {
+	event.EventID = ""
+	return json.Marshal(event)
+}
+
+func (JSONCodec) Unmarshal(data []byte) (Event, error) {
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return Event{}, err
+	}
+	event.EventID = ""
+	return event, nil
+}
+
+const eventJSONSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "Event",
+  "type": "object",
+  "required": ["domain", "title", "user"],
+  "properties": {
+    "domain": {"type": "string"},
+    "title": {"type": "string"},
+    "user": {"type": "string"},
+    "id": {"type": "integer"},
+    "type": {"type": "string"},
+    "namespace": {"type": "integer"},
+    "timestamp": {"type": "integer"},
+    "wiki": {"type": "string"},
+    "server_url": {"type": "string"},
+    "bot": {"type": "boolean"},
+    "minor": {"type": "boolean"},
+    "length_old": {"type": "integer"},
+    "length_new": {"type": "integer"},
+    "revision_old": {"type": "integer"},
+    "revision_new": {"type": "integer"}
+  }
+}`
+
+// Encoder marshals events for the producer, framing them in schema
+// registry wire format once it knows the schema id.
+type Encoder struct {
+	codec Codec
+	frame []byte
+}
+
+func NewEncoder(codec Codec) *Encoder {
+	return &Encoder{codec: codec}
+}
+
+// WithSchemaID frames every value with id, which must be the id of
+// Codec().Schema().
+func (e *Encoder) WithSchemaID(id int) *Encoder {
+	e.frame = appendFrame(nil, e.codec.Schema().Type, id)
+	return e
+}
+
+func (e *Encoder) Encode(event Event) ([]byte, error) {
+	data, err := e.codec.Marshal(event)
+	if err != nil || e.frame == nil {
+		return data, err
+	}
+	return append(append(make([]byte, 0, len(e.frame)+len(data)), e.frame...), data...), nil
+}
+
+// Protobuf frames also say which message in the schema file the value is.
+func appendFrame(dst []byte, t registry.SchemaType, id int) []byte {
+	if t == registry.TypeProtobuf {
+		return registry.AppendProtobufFrame(dst, id, pb.EventMessageIndexes)
+	}
+	return registry.AppendFrame(dst, id)
+}
+
+// SchemaLookup resolves schema registry ids; *registry.Client implements
+// it.
+type SchemaLookup interface {
+	SchemaByID(ctx context.Context, id int) (registry.Schema, error)
+}
+
+// Decoder turns consumed records back into events, choosing the codec from
+// each record's content-type header.
+//
+// Values in schema registry wire format are checked against the schema
+// they name, which must be of the codec's type. Protobuf and JSON read
+// every compatible version of Event, since new fields are skipped and
+// missing ones read as zero. Avro needs the writer's schema to decode, so
+// only the schema AvroCodec writes is accepted. Unframed values predate the
+// registry and are decoded as they are.
+type Decoder struct {
+	schemas SchemaLookup
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// WithSchemaRegistry lets the decoder read framed values. Without it they
+// are rejected.
+func (d *Decoder) WithSchemaRegistry(schemas SchemaLookup) *Decoder {
+	d.schemas = schemas
+	return d
+}
+
+// ErrSchemaUnavailable wraps a schema registry failure other than an
+// unknown id, such as a timeout or a 5xx. The record may well be fine, so
+// it should be decoded again later rather than dead-lettered.
+var ErrSchemaUnavailable = errors.New("schema registry unavailable")
+
+// Decode reads a record's standard headers and decodes its value. On
+// failure it says why, for the dead letter, unless the error is
+// ErrSchemaUnavailable.
+func (d *Decoder) Decode(ctx context.Context, record *kgo.Record) (Event, RecordMetadata, DeadLetterReason, error) {
+	meta, err := ParseRecordMetadata(record.Headers)
+	if err != nil {
+		return Event{}, meta, ReasonInvalidHeaders, err
+	}
+	codec, ok := CodecForContentType(meta.ContentType)
+	if !ok {
+		return Event{}, meta, ReasonUnsupportedContentType, fmt.Errorf("content type %q", meta.ContentType)
+	}
+
+	payload := record.Value
+	if registry.IsFramed(payload) {
+		var reason DeadLetterReason
+		if payload, reason, err = d.unframe(ctx, codec, payload); err != nil {
+			return Event{}, meta, reason, err
+		}
+	}
+
+	event, err := codec.Unmarshal(payload)
+	if err != nil {
+		return Event{}, meta, ReasonDecodeFailed, err
+	}
+	event.EventID = meta.EventID
+	return event, meta, "", nil
+}
+
+// unframe checks a framed value's schema against the registry and returns
+// the encoded event.
+func (d *Decoder) unframe(ctx context.Context, codec Codec, value []byte) ([]byte, DeadLetterReason, error) {
+	want := codec.Schema()
+	var id int
+	var payload []byte
+	var err error
+	if want.Type == registry.TypeProtobuf {
+		var indexes []int
+		if id, indexes, payload, err = registry.ParseProtobufFrame(value); err == nil && !slices.Equal(indexes, pb.EventMessageIndexes) {
+			return nil, ReasonUnknownSchema, fmt.Errorf("schema %d message %v is not Event", id, indexes)
+		}
+	} else {
+		id, payload, err = registry.ParseFrame(value)
+	}
+	if err != nil {
+		return nil, ReasonDecodeFailed, err
+	}
+
+	if d.schemas == nil {
+		return nil, ReasonUnknownSchema, fmt.Errorf("record uses schema %d but no schema registry is configured", id)
+	}
+	schema, err := d.schemas.SchemaByID(ctx, id)
+	switch {
+	case errors.Is(err, registry.ErrNotFound):
+		return nil, ReasonUnknownSchema, err
+	case err != nil:
+		return nil, "", fmt.Errorf("%w: %w", ErrSchemaUnavailable, err)
+	}
+	if schema.Type != want.Type {
+		return nil, ReasonUnknownSchema, fmt.Errorf("schema %d is %s, but the record is %s", id, schema.Type, codec.ContentType())
+	}
+	if schema.Type == registry.TypeAvro && !sameJSON(schema.Schema, want.Schema) {
+		return nil, ReasonUnknownSchema, fmt.Errorf("schema %d is not the Avro schema this consumer reads", id)
+	}
+	return payload, "", nil
+}
+
+// sameJSON compares two JSON documents ignoring whitespace.
+func sameJSON(a, b string) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, []byte(a)) != nil || json.Compact(&cb, []byte(b)) != nil {
+		return false
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
@@ -0,0 +1,174 @@
+package stream_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/registry"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	pb "github.com/joshua-daniels-red/go-backend-challenge/ch-8/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+var codecEvent = stream.Event{
+	Domain: "en.wikipedia.org", Title: "Go", User: "alice",
+	ID: 42, Type: "edit", Namespace: -1, Timestamp: 1700000000,
+	Wiki: "enwiki", ServerURL: "https://en.wikipedia.org", Bot: true,
+	LengthOld: 10, LengthNew: 12, RevisionOld: 100, RevisionNew: 101,
+}
+
+func allCodecs() []stream.Codec {
+	return []stream.Codec{stream.ProtobufCodec{}, stream.JSONCodec{}, stream.AvroCodec{}}
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	for _, codec := range allCodecs() {
+		event := codecEvent
+		event.EventID = "header only"
+		data, err := codec.Marshal(event)
+		assert.NoError(t, err, codec.Name())
+
+		got, err := codec.Unmarshal(data)
+		assert.NoError(t, err, codec.Name())
+		assert.Equal(t, codecEvent, got, codec.Name())
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	for _, codec := range allCodecs() {
+		byName, err := stream.CodecByName(codec.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, codec, byName)
+
+		byType, ok := stream.CodecForContentType(codec.ContentType())
+		assert.True(t, ok)
+		assert.Equal(t, codec, byType)
+	}
+	_, err := stream.CodecByName("xml")
+	assert.Error(t, err)
+
+	legacy, ok := stream.CodecForContentType("")
+	assert.True(t, ok)
+	assert.Equal(t, stream.ProtobufCodec{}, legacy)
+	_, ok = stream.CodecForContentType("text/csv")
+	assert.False(t, ok)
+}
+
+func TestAvroCodec_RejectsBadInput(t *testing.T) {
+	data, _ := stream.AvroCodec{}.Marshal(codecEvent)
+	for name, bad := range map[string][]byte{
+		"truncated": data[:len(data)-1],
+		"trailing":  append(append([]byte(nil), data...), 0),
+		"length":    {0x7f},
+	} {
+		_, err := stream.AvroCodec{}.Unmarshal(bad)
+		assert.Error(t, err, name)
+	}
+}
+
+func record(codec stream.Codec, value []byte) *kgo.Record {
+	return &kgo.Record{Value: value, Headers: stream.RecordMetadata{
+		ContentType: codec.ContentType(),
+		EventID:     "e-1",
+	}.Headers()}
+}
+
+// schemaIDs is a registry that knows each codec's schema by a fixed id.
+type schemaIDs map[int]registry.Schema
+
+func (s schemaIDs) SchemaByID(_ context.Context, id int) (registry.Schema, error) {
+	if schema, ok := s[id]; ok {
+		return schema, nil
+	}
+	return registry.Schema{}, registry.ErrNotFound
+}
+
+func TestDecoder_ReadsEveryFormat(t *testing.T) {
+	schemas := schemaIDs{}
+	decoder := stream.NewDecoder().WithSchemaRegistry(schemas)
+	for i, codec := range allCodecs() {
+		schemas[i+1] = codec.Schema()
+
+		bare, err := stream.NewEncoder(codec).Encode(codecEvent)
+		assert.NoError(t, err)
+		framed, err := stream.NewEncoder(codec).WithSchemaID(i + 1).Encode(codecEvent)
+		assert.NoError(t, err)
+		assert.True(t, registry.IsFramed(framed), codec.Name())
+
+		for _, value := range [][]byte{bare, framed} {
+			event, meta, _, err := decoder.Decode(context.Background(), record(codec, value))
+			assert.NoError(t, err, codec.Name())
+			assert.Equal(t, "e-1", event.EventID)
+			assert.Equal(t, codec.ContentType(), meta.ContentType)
+			event.EventID = ""
+			assert.Equal(t, codecEvent, event, codec.Name())
+		}
+	}
+}
+
+func TestDecoder_RejectsUnknownSchemas(t *testing.T) {
+	avroV2 := stream.AvroCodec{}.Schema()
+	avroV2.Schema = `{"type": "record", "name": "Event", "fields": []}`
+	schemas := schemaIDs{
+		1: stream.ProtobufCodec{}.Schema(),
+		2: avroV2,
+	}
+	decoder := stream.NewDecoder().WithSchemaRegistry(schemas)
+	encode := func(codec stream.Codec, id int) *kgo.Record {
+		value, err := stream.NewEncoder(codec).WithSchemaID(id).Encode(codecEvent)
+		assert.NoError(t, err)
+		return record(codec, value)
+	}
+
+	for name, r := range map[string]*kgo.Record{
+		"unregistered id":         encode(stream.ProtobufCodec{}, 9),
+		"json under proto schema": encode(stream.JSONCodec{}, 1),
+		"other avro schema":       encode(stream.AvroCodec{}, 2),
+		"other proto message":     record(stream.ProtobufCodec{}, registry.AppendProtobufFrame(nil, 1, []int{1})),
+	} {
+		_, _, reason, err := decoder.Decode(context.Background(), r)
+		assert.Error(t, err, name)
+		assert.Equal(t, stream.ReasonUnknownSchema, reason, name)
+	}
+
+	_, _, reason, err := stream.NewDecoder().Decode(context.Background(), encode(stream.ProtobufCodec{}, 1))
+	assert.Error(t, err, "framed records need a registry")
+	assert.Equal(t, stream.ReasonUnknownSchema, reason)
+}
+
+func TestDecoder_RegistryOutagesAreNotUnknownSchema(t *testing.T) {
+	value, _ := stream.NewEncoder(stream.JSONCodec{}).WithSchemaID(1).Encode(codecEvent)
+	for name, lookupErr := range map[string]error{
+		"timeout":      context.DeadlineExceeded,
+		"server error": &registry.Error{StatusCode: http.StatusServiceUnavailable, Message: "Service Unavailable"},
+	} {
+		decoder := stream.NewDecoder().WithSchemaRegistry(failingLookup{lookupErr})
+		_, _, reason, err := decoder.Decode(context.Background(), record(stream.JSONCodec{}, value))
+		assert.ErrorIs(t, err, stream.ErrSchemaUnavailable, name)
+		assert.ErrorIs(t, err, lookupErr, name)
+		assert.Empty(t, reason, name)
+	}
+
+	notFound := &registry.Error{StatusCode: http.StatusNotFound, Code: 40403, Message: "Schema not found"}
+	decoder := stream.NewDecoder().WithSchemaRegistry(failingLookup{notFound})
+	_, _, reason, err := decoder.Decode(context.Background(), record(stream.JSONCodec{}, value))
+	assert.NotErrorIs(t, err, stream.ErrSchemaUnavailable)
+	assert.Equal(t, stream.ReasonUnknownSchema, reason)
+}
+
+type failingLookup struct{ err error }
+
+func (f failingLookup) SchemaByID(context.Context, int) (registry.Schema, error) {
+	return registry.Schema{}, f.err
+}
+
+func TestProtobufCodec_ReadsLegacyRecords(t *testing.T) {
+	// Values written before the content-type header or the registry.
+	data, _ := stream.ProtobufCodec{}.Marshal(stream.Event{Domain: "a"})
+	event, _, _, err := stream.NewDecoder().Decode(context.Background(), &kgo.Record{Value: data})
+	assert.NoError(t, err)
+	assert.Equal(t, "a", event.Domain)
+	assert.Equal(t, pb.EventSchema, stream.ProtobufCodec{}.Schema().Schema)
+}
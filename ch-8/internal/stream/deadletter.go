@@ -0,0 +1,209 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Dead-letter record headers. The record value is always the original
+// bytes, untouched, so a fixed consumer or producer can replay it.
+const (
+	HeaderDeadLetterReason          = "dlq-reason"
+	HeaderDeadLetterError           = "dlq-error"
+	HeaderDeadLetterSourceTopic     = "dlq-source-topic"
+	HeaderDeadLetterSourcePartition = "dlq-source-partition"
+	HeaderDeadLetterSourceOffset    = "dlq-source-offset"
+	HeaderDeadLetterSourceTimestamp = "dlq-source-timestamp"
+	HeaderDeadLetterTimestamp       = "dlq-timestamp"
+)
+
+// DeadLetterReason classifies why a record was set aside.
+type DeadLetterReason string
+
+const (
+	// ReasonMalformedJSON: the producer could not parse a stream event.
+	ReasonMalformedJSON DeadLetterReason = "malformed_json"
+	// ReasonMissingFields: the event lacks its domain, title or user.
+	ReasonMissingFields DeadLetterReason = "missing_fields"
+	// ReasonEncodeFailed: the producer could not encode a valid event.
+	ReasonEncodeFailed DeadLetterReason = "encode_failed"
+	// ReasonDecodeFailed: the consumer could not decode a record.
+	ReasonDecodeFailed DeadLetterReason = "decode_failed"
+	// ReasonInvalidHeaders: a standard record header could not be parsed.
+	ReasonInvalidHeaders DeadLetterReason = "invalid_headers"
+	// ReasonUnsupportedContentType: the record is in an encoding the
+	// consumer cannot decode.
+	ReasonUnsupportedContentType DeadLetterReason = "unsupported_content_type"
+	// ReasonUnknownSchema: the record names a schema registry id the
+	// consumer cannot resolve, or a schema that does not describe Event.
+	ReasonUnknownSchema DeadLetterReason = "unknown_schema"
+)
+
+var ErrNotDeadLetter = errors.New("record is not a dead letter")
+
+// DeadLetter is a record that could not be processed, with enough context
+// to find where it came from. Events rejected by the producer never reached
+// a topic, so their SourceTopic is empty and SourcePartition and
+// SourceOffset are -1.
+type DeadLetter struct {
+	Reason          DeadLetterReason
+	Err             string
+	SourceTopic     string
+	SourcePartition int32
+	SourceOffset    int64
+	// SourceTimestamp is the original record's timestamp, if it had one.
+	SourceTimestamp time.Time
+	// Timestamp is when the record was dead-lettered.
+	Timestamp time.Time
+	Key       []byte
+	Value     []byte
+	// Headers are the original record's headers.
+	Headers []kgo.RecordHeader
+}
+
+// NewDeadLetter describes a consumed record that could not be processed.
+func NewDeadLetter(reason DeadLetterReason, err error, record *kgo.Record) DeadLetter {
+	return DeadLetter{
+		Reason:          reason,
+		Err:             errorString(err),
+		SourceTopic:     record.Topic,
+		SourcePartition: record.Partition,
+		SourceOffset:    record.Offset,
+		SourceTimestamp: record.Timestamp,
+		Key:             record.Key,
+		Value:           record.Value,
+		Headers:         record.Headers,
+	}
+}
+
+// NewRejectedEvent describes raw input the producer refused to publish.
+func NewRejectedEvent(reason DeadLetterReason, err error, value []byte) DeadLetter {
+	return DeadLetter{
+		Reason:          reason,
+		Err:             errorString(err),
+		SourcePartition: -1,
+		SourceOffset:    -1,
+		Value:           value,
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func isDeadLetterHeader(key string) bool {
+	switch key {
+	case HeaderDeadLetterReason, HeaderDeadLetterError, HeaderDeadLetterSourceTopic, HeaderDeadLetterSourcePartition,
+		HeaderDeadLetterSourceOffset, HeaderDeadLetterSourceTimestamp, HeaderDeadLetterTimestamp:
+		return true
+	}
+	return false
+}
+
+// Record encodes d for topic, appending the dead-letter headers to the
+// original ones. A zero Timestamp is set to now.
+func (d DeadLetter) Record(topic string) *kgo.Record {
+	ts := d.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	headers := append(append([]kgo.RecordHeader(nil), d.Headers...),
+		kgo.RecordHeader{Key: HeaderDeadLetterReason, Value: []byte(d.Reason)},
+		kgo.RecordHeader{Key: HeaderDeadLetterError, Value: []byte(d.Err)},
+		kgo.RecordHeader{Key: HeaderDeadLetterSourceTopic, Value: []byte(d.SourceTopic)},
+		kgo.RecordHeader{Key: HeaderDeadLetterSourcePartition, Value: []byte(strconv.FormatInt(int64(d.SourcePartition), 10))},
+		kgo.RecordHeader{Key: HeaderDeadLetterSourceOffset, Value: []byte(strconv.FormatInt(d.SourceOffset, 10))},
+		kgo.RecordHeader{Key: HeaderDeadLetterTimestamp, Value: []byte(ts.UTC().Format(time.RFC3339Nano))},
+	)
+	if !d.SourceTimestamp.IsZero() {
+		headers = append(headers, kgo.RecordHeader{
+			Key:   HeaderDeadLetterSourceTimestamp,
+			Value: []byte(d.SourceTimestamp.UTC().Format(time.RFC3339Nano)),
+		})
+	}
+	return &kgo.Record{Topic: topic, Key: d.Key, Value: d.Value, Headers: headers}
+}
+
+// ParseDeadLetter decodes a record read from a dead-letter topic.
+func ParseDeadLetter(record *kgo.Record) (DeadLetter, error) {
+	headers := make(map[string]string, len(record.Headers))
+	var original []kgo.RecordHeader
+	for _, h := range record.Headers {
+		if !isDeadLetterHeader(h.Key) {
+			original = append(original, h)
+			continue
+		}
+		headers[h.Key] = string(h.Value)
+	}
+	reason, ok := headers[HeaderDeadLetterReason]
+	if !ok {
+		return DeadLetter{}, fmt.Errorf("%w: no %s header", ErrNotDeadLetter, HeaderDeadLetterReason)
+	}
+
+	d := DeadLetter{
+		Reason:      DeadLetterReason(reason),
+		Err:         headers[HeaderDeadLetterError],
+		SourceTopic: headers[HeaderDeadLetterSourceTopic],
+		Key:         record.Key,
+		Value:       record.Value,
+		Headers:     original,
+	}
+	partition, err := strconv.ParseInt(headers[HeaderDeadLetterSourcePartition], 10, 32)
+	if err != nil {
+		return DeadLetter{}, fmt.Errorf("%w: bad %s: %v", ErrNotDeadLetter, HeaderDeadLetterSourcePartition, err)
+	}
+	d.SourcePartition = int32(partition)
+	if d.SourceOffset, err = strconv.ParseInt(headers[HeaderDeadLetterSourceOffset], 10, 64); err != nil {
+		return DeadLetter{}, fmt.Errorf("%w: bad %s: %v", ErrNotDeadLetter, HeaderDeadLetterSourceOffset, err)
+	}
+	if d.Timestamp, err = time.Parse(time.RFC3339Nano, headers[HeaderDeadLetterTimestamp]); err != nil {
+		return DeadLetter{}, fmt.Errorf("%w: bad %s: %v", ErrNotDeadLetter, HeaderDeadLetterTimestamp, err)
+	}
+	if v, ok := headers[HeaderDeadLetterSourceTimestamp]; ok {
+		if d.SourceTimestamp, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return DeadLetter{}, fmt.Errorf("%w: bad %s: %v", ErrNotDeadLetter, HeaderDeadLetterSourceTimestamp, err)
+		}
+	}
+	return d, nil
+}
+
+// ProduceFunc writes one record and returns once the broker has it.
+type ProduceFunc func(ctx context.Context, record *kgo.Record) error
+
+// DeadLetterQueue publishes dead letters to a topic. With an empty topic it
+// only counts them, which is the old drop-and-log behaviour.
+type DeadLetterQueue struct {
+	topic   string
+	produce ProduceFunc
+}
+
+func NewDeadLetterQueue(topic string, produce ProduceFunc) *DeadLetterQueue {
+	return &DeadLetterQueue{topic: topic, produce: produce}
+}
+
+func (q *DeadLetterQueue) Topic() string {
+	return q.topic
+}
+
+// Send publishes d synchronously. Dead letters are rare, so waiting for the
+// broker keeps the record from being committed past before it is safe.
+func (q *DeadLetterQueue) Send(ctx context.Context, d DeadLetter) error {
+	if q.topic == "" || q.produce == nil {
+		EventsDeadLettered.WithLabelValues(string(d.Reason), "dropped").Inc()
+		return nil
+	}
+	if err := q.produce(ctx, d.Record(q.topic)); err != nil {
+		EventsDeadLettered.WithLabelValues(string(d.Reason), "failed").Inc()
+		return fmt.Errorf("dead-letter to %s: %w", q.topic, err)
+	}
+	EventsDeadLettered.WithLabelValues(string(d.Reason), "sent").Inc()
+	return nil
+}
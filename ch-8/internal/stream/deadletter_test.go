@@ -0,0 +1,82 @@
+package stream_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestDeadLetter_RoundTripsThroughHeaders(t *testing.T) {
+	source := &kgo.Record{
+		Topic:     "wikipedia.protobuf",
+		Partition: 3,
+		Offset:    1234,
+		Timestamp: time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC),
+		Key:       []byte("k"),
+		Value:     []byte{0xff, 0x00},
+		Headers:   []kgo.RecordHeader{{Key: stream.HeaderEventID, Value: []byte("e-1")}},
+	}
+	d := stream.NewDeadLetter(stream.ReasonDecodeFailed, errors.New("bad wire type"), source)
+	d.Timestamp = time.Date(2025, 6, 1, 12, 0, 5, 0, time.UTC)
+
+	record := d.Record("wikipedia.dlq")
+	assert.Equal(t, "wikipedia.dlq", record.Topic)
+	assert.Equal(t, source.Value, record.Value)
+	assert.Equal(t, source.Key, record.Key)
+
+	parsed, err := stream.ParseDeadLetter(record)
+	assert.NoError(t, err)
+	assert.Equal(t, d, parsed)
+	assert.Equal(t, source.Headers, parsed.Headers, "original headers survive for replay")
+}
+
+func TestDeadLetter_RejectedEventHasNoSource(t *testing.T) {
+	d := stream.NewRejectedEvent(stream.ReasonMalformedJSON, errors.New("unexpected EOF"), []byte("{"))
+	parsed, err := stream.ParseDeadLetter(d.Record("dlq"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", parsed.SourceTopic)
+	assert.Equal(t, int32(-1), parsed.SourcePartition)
+	assert.Equal(t, int64(-1), parsed.SourceOffset)
+	assert.True(t, parsed.SourceTimestamp.IsZero())
+	assert.False(t, parsed.Timestamp.IsZero(), "Record stamps the time it was built")
+}
+
+func TestParseDeadLetter_RejectsOrdinaryRecord(t *testing.T) {
+	_, err := stream.ParseDeadLetter(&kgo.Record{Value: []byte("x")})
+	assert.ErrorIs(t, err, stream.ErrNotDeadLetter)
+
+	bad := stream.NewRejectedEvent(stream.ReasonMissingFields, nil, nil).Record("dlq")
+	for i, h := range bad.Headers {
+		if h.Key == stream.HeaderDeadLetterSourceOffset {
+			bad.Headers[i].Value = []byte("nope")
+		}
+	}
+	_, err = stream.ParseDeadLetter(bad)
+	assert.ErrorIs(t, err, stream.ErrNotDeadLetter)
+}
+
+func TestDeadLetterQueue_Send(t *testing.T) {
+	var produced []*kgo.Record
+	q := stream.NewDeadLetterQueue("wikipedia.dlq", func(_ context.Context, r *kgo.Record) error {
+		produced = append(produced, r)
+		return nil
+	})
+	d := stream.NewRejectedEvent(stream.ReasonMissingFields, nil, []byte("{}"))
+
+	assert.NoError(t, q.Send(context.Background(), d))
+	assert.Len(t, produced, 1)
+	assert.Equal(t, "wikipedia.dlq", produced[0].Topic)
+
+	failing := stream.NewDeadLetterQueue("wikipedia.dlq", func(context.Context, *kgo.Record) error {
+		return errors.New("broker down")
+	})
+	assert.ErrorContains(t, failing.Send(context.Background(), d), "broker down")
+
+	// Without a topic dead letters are only counted.
+	assert.NoError(t, stream.NewDeadLetterQueue("", nil).Send(context.Background(), d))
+}
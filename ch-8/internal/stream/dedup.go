@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Deduplicator recognises events that were already counted, by event id.
+// Together with the Batcher it gives effectively-once counting: an event is
+// checked before it is buffered and marked processed once its batch is
+// written. Only a crash between the write and the mark lets a redelivered
+// copy be counted again.
+type Deduplicator interface {
+	// Seen reports whether id was processed before, or is already buffered
+	// by this consumer.
+	Seen(ctx context.Context, id string) (bool, error)
+	// Processed records ids whose events were durably written.
+	Processed(ctx context.Context, ids []string) error
+}
+
+// SeenSet is an in-memory Deduplicator that remembers event ids for window,
+// and at most capacity of them, forgetting the oldest first. It catches the
+// duplicates a redelivery or a re-produce creates shortly after the
+// original, within one consumer process.
+//
+// Seen marks an id the first time it is asked about, so a duplicate is
+// caught even while the original is still buffered.
+type SeenSet struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	ids     map[string]struct{}
+	entries []seenEntry // ring buffer in insertion order
+	head    int
+	size    int
+}
+
+type seenEntry struct {
+	id string
+	at time.Time
+}
+
+// NewSeenSet remembers up to capacity ids for window each. A window of 0
+// keeps ids until capacity pushes them out.
+func NewSeenSet(capacity int, window time.Duration) *SeenSet {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &SeenSet{
+		window:  window,
+		now:     time.Now,
+		ids:     make(map[string]struct{}, capacity),
+		entries: make([]seenEntry, capacity),
+	}
+}
+
+// WithClock replaces time.Now, for tests.
+func (s *SeenSet) WithClock(now func() time.Time) *SeenSet {
+	s.now = now
+	return s
+}
+
+func (s *SeenSet) Seen(_ context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.expire(now)
+	if _, ok := s.ids[id]; ok {
+		return true, nil
+	}
+
+	if s.size == len(s.entries) {
+		s.evictOldest()
+	}
+	s.entries[(s.head+s.size)%len(s.entries)] = seenEntry{id: id, at: now}
+	s.size++
+	s.ids[id] = struct{}{}
+	return false, nil
+}
+
+// Processed is a no-op: Seen already remembered the ids.
+func (s *SeenSet) Processed(context.Context, []string) error {
+	return nil
+}
+
+// Len is the number of ids currently remembered.
+func (s *SeenSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// expire drops entries older than the window. Entries are in insertion
+// order, so it stops at the first one still inside it.
+func (s *SeenSet) expire(now time.Time) {
+	if s.window <= 0 {
+		return
+	}
+	for s.size > 0 && now.Sub(s.entries[s.head].at) >= s.window {
+		s.evictOldest()
+	}
+}
+
+func (s *SeenSet) evictOldest() {
+	delete(s.ids, s.entries[s.head].id)
+	s.entries[s.head] = seenEntry{}
+	s.head = (s.head + 1) % len(s.entries)
+	s.size--
+}
+
+// TieredDeduplicator checks a fast in-memory set before a shared,
+// persistent store such as CassandraDeduplicator, which catches duplicates
+// across restarts and consumer group members.
+type TieredDeduplicator struct {
+	memory *SeenSet
+	store  Deduplicator
+}
+
+func NewTieredDeduplicator(memory *SeenSet, store Deduplicator) *TieredDeduplicator {
+	return &TieredDeduplicator{memory: memory, store: store}
+}
+
+func (t *TieredDeduplicator) Seen(ctx context.Context, id string) (bool, error) {
+	if seen, _ := t.memory.Seen(ctx, id); seen {
+		return true, nil
+	}
+	return t.store.Seen(ctx, id)
+}
+
+func (t *TieredDeduplicator) Processed(ctx context.Context, ids []string) error {
+	return t.store.Processed(ctx, ids)
+}
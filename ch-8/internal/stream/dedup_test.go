@@ -0,0 +1,77 @@
+package stream_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/stretchr/testify/assert"
+)
+
+func seen(t *testing.T, d stream.Deduplicator, id string) bool {
+	t.Helper()
+	ok, err := d.Seen(context.Background(), id)
+	assert.NoError(t, err)
+	return ok
+}
+
+func TestSeenSet_CapacityEvictsOldest(t *testing.T) {
+	s := stream.NewSeenSet(2, 0)
+
+	assert.False(t, seen(t, s, "a"))
+	assert.True(t, seen(t, s, "a"))
+	assert.False(t, seen(t, s, "b"))
+
+	// "c" evicts the oldest id, "a".
+	assert.False(t, seen(t, s, "c"))
+	assert.False(t, seen(t, s, "a"), "a was forgotten")
+	assert.True(t, seen(t, s, "c"))
+	assert.False(t, seen(t, s, "b"), "b was evicted by a")
+	assert.Equal(t, 2, s.Len())
+}
+
+func TestSeenSet_WindowExpiresIDs(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := stream.NewSeenSet(100, time.Minute).WithClock(func() time.Time { return now })
+
+	assert.False(t, seen(t, s, "a"))
+	now = now.Add(30 * time.Second)
+	assert.False(t, seen(t, s, "b"))
+	assert.True(t, seen(t, s, "a"))
+
+	now = now.Add(40 * time.Second)
+	assert.False(t, seen(t, s, "a"), "a is older than the window")
+	assert.True(t, seen(t, s, "b"))
+	assert.Equal(t, 2, s.Len())
+}
+
+// recordingDeduplicator stands in for a persistent store.
+type recordingDeduplicator struct {
+	known     map[string]bool
+	processed []string
+	checked   []string
+}
+
+func (r *recordingDeduplicator) Seen(_ context.Context, id string) (bool, error) {
+	r.checked = append(r.checked, id)
+	return r.known[id], nil
+}
+
+func (r *recordingDeduplicator) Processed(_ context.Context, ids []string) error {
+	r.processed = append(r.processed, ids...)
+	return nil
+}
+
+func TestTieredDeduplicator_ChecksMemoryFirst(t *testing.T) {
+	store := &recordingDeduplicator{known: map[string]bool{"old": true}}
+	d := stream.NewTieredDeduplicator(stream.NewSeenSet(10, time.Hour), store)
+
+	assert.True(t, seen(t, d, "old"), "processed before a restart")
+	assert.False(t, seen(t, d, "new"))
+	assert.True(t, seen(t, d, "new"), "caught in memory")
+	assert.Equal(t, []string{"old", "new"}, store.checked)
+
+	assert.NoError(t, d.Processed(context.Background(), []string{"new"}))
+	assert.Equal(t, []string{"new"}, store.processed)
+}
@@ -0,0 +1,531 @@
+package stream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter decides which events the producer publishes. It is parsed from an
+// expression such as
+//
+//	domain in ("en.wikipedia.org", "de.wikipedia.org") and not bot and namespace == 0
+//
+// Expressions combine comparisons with and, or, not and parentheses:
+//
+//	field == value, field != value      any field
+//	field < value, <=, >, >=            number fields
+//	field in (value, ...)               string and number fields
+//	field                               bool fields, alone or after not
+//
+// String fields are domain, title, user, type, wiki and server_url; number
+// fields are id, namespace, timestamp, length_old, length_new,
+// revision_old and revision_new; bool fields are bot and minor. Strings
+// are double-quoted Go strings.
+//
+// Each operand of the top-level and is a rule. An event is published when
+// every rule matches; otherwise it is counted against the first rule that
+// did not.
+type Filter struct {
+	rules []filterNode
+}
+
+// ParseFilter parses expr. An empty expression matches every event.
+func ParseFilter(expr string) (*Filter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return &Filter{}, nil
+	}
+	p := &filterParser{lex: filterLexer{src: expr}}
+	p.next()
+	node, err := p.parseOr()
+	if err == nil && p.tok.kind != tokEOF {
+		err = p.errorf("unexpected %s", p.tok)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %w", expr, err)
+	}
+	if and, ok := node.(andNode); ok {
+		return &Filter{rules: and}, nil
+	}
+	return &Filter{rules: []filterNode{node}}, nil
+}
+
+// Rules returns each rule in canonical form, the label it is counted
+// under.
+func (f *Filter) Rules() []string {
+	rules := make([]string, len(f.rules))
+	for i, r := range f.rules {
+		rules[i] = r.String()
+	}
+	return rules
+}
+
+// Match reports whether event passes the filter and, if not, which rule
+// rejected it.
+func (f *Filter) Match(event Event) (ok bool, rule string) {
+	for _, r := range f.rules {
+		if !r.eval(event) {
+			return false, r.String()
+		}
+	}
+	return true, ""
+}
+
+func (f *Filter) String() string {
+	return andNode(f.rules).String()
+}
+
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindNumber
+	kindBool
+)
+
+func (k fieldKind) String() string {
+	return [...]string{"string", "number", "bool"}[k]
+}
+
+// filterValue is a field's value or a literal.
+type filterValue struct {
+	kind fieldKind
+	s    string
+	n    int64
+	b    bool
+}
+
+func (v filterValue) String() string {
+	switch v.kind {
+	case kindString:
+		return strconv.Quote(v.s)
+	case kindNumber:
+		return strconv.FormatInt(v.n, 10)
+	default:
+		return strconv.FormatBool(v.b)
+	}
+}
+
+type filterField struct {
+	kind fieldKind
+	get  func(Event) filterValue
+}
+
+func stringField(get func(Event) string) filterField {
+	return filterField{kindString, func(e Event) filterValue { return filterValue{kind: kindString, s: get(e)} }}
+}
+
+func numberField(get func(Event) int64) filterField {
+	return filterField{kindNumber, func(e Event) filterValue { return filterValue{kind: kindNumber, n: get(e)} }}
+}
+
+func boolField(get func(Event) bool) filterField {
+	return filterField{kindBool, func(e Event) filterValue { return filterValue{kind: kindBool, b: get(e)} }}
+}
+
+var filterFields = map[string]filterField{
+	"domain":       stringField(func(e Event) string { return e.Domain }),
+	"title":        stringField(func(e Event) string { return e.Title }),
+	"user":         stringField(func(e Event) string { return e.User }),
+	"type":         stringField(func(e Event) string { return e.Type }),
+	"wiki":         stringField(func(e Event) string { return e.Wiki }),
+	"server_url":   stringField(func(e Event) string { return e.ServerURL }),
+	"id":           numberField(func(e Event) int64 { return e.ID }),
+	"namespace":    numberField(func(e Event) int64 { return int64(e.Namespace) }),
+	"timestamp":    numberField(func(e Event) int64 { return e.Timestamp }),
+	"length_old":   numberField(func(e Event) int64 { return e.LengthOld }),
+	"length_new":   numberField(func(e Event) int64 { return e.LengthNew }),
+	"revision_old": numberField(func(e Event) int64 { return e.RevisionOld }),
+	"revision_new": numberField(func(e Event) int64 { return e.RevisionNew }),
+	"bot":          boolField(func(e Event) bool { return e.Bot }),
+	"minor":        boolField(func(e Event) bool { return e.Minor }),
+}
+
+type filterNode interface {
+	eval(Event) bool
+	String() string
+}
+
+type andNode []filterNode
+
+func (n andNode) eval(e Event) bool {
+	for _, c := range n {
+		if !c.eval(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n andNode) String() string { return joinNodes(n, " and ") }
+
+type orNode []filterNode
+
+func (n orNode) eval(e Event) bool {
+	for _, c := range n {
+		if c.eval(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n orNode) String() string { return joinNodes(n, " or ") }
+
+// joinNodes parenthesises nested and/or so the text parses back the same.
+func joinNodes(nodes []filterNode, sep string) string {
+	parts := make([]string, len(nodes))
+	for i, c := range nodes {
+		switch c.(type) {
+		case andNode, orNode:
+			parts[i] = "(" + c.String() + ")"
+		default:
+			parts[i] = c.String()
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+type notNode struct{ node filterNode }
+
+func (n notNode) eval(e Event) bool { return !n.node.eval(e) }
+
+func (n notNode) String() string {
+	switch n.node.(type) {
+	case andNode, orNode:
+		return "not (" + n.node.String() + ")"
+	}
+	return "not " + n.node.String()
+}
+
+type boolNode struct {
+	name  string
+	field filterField
+}
+
+func (n boolNode) eval(e Event) bool { return n.field.get(e).b }
+func (n boolNode) String() string    { return n.name }
+
+type compareNode struct {
+	name  string
+	field filterField
+	op    string
+	value filterValue
+}
+
+func (n compareNode) eval(e Event) bool {
+	v := n.field.get(e)
+	switch n.op {
+	case "==":
+		return v == n.value
+	case "!=":
+		return v != n.value
+	case "<":
+		return v.n < n.value.n
+	case "<=":
+		return v.n <= n.value.n
+	case ">":
+		return v.n > n.value.n
+	default:
+		return v.n >= n.value.n
+	}
+}
+
+func (n compareNode) String() string { return n.name + " " + n.op + " " + n.value.String() }
+
+type inNode struct {
+	name   string
+	field  filterField
+	values []filterValue
+}
+
+func (n inNode) eval(e Event) bool {
+	v := n.field.get(e)
+	for _, want := range n.values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+func (n inNode) String() string {
+	parts := make([]string, len(n.values))
+	for i, v := range n.values {
+		parts[i] = v.String()
+	}
+	return n.name + " in (" + strings.Join(parts, ", ") + ")"
+}
+
+type filterParser struct {
+	lex filterLexer
+	tok filterToken
+	err error
+}
+
+func (p *filterParser) next() {
+	if p.err == nil {
+		p.tok, p.err = p.lex.next()
+	}
+}
+
+// errorf reports a syntax error at the current token, or the lexer's error
+// if it could not read one.
+func (p *filterParser) errorf(format string, args ...any) error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf("at %d: %s", p.tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) keyword(word string) bool {
+	return p.tok.kind == tokIdent && p.tok.text == word
+}
+
+// parseOr and parseAnd flatten nested lists of their own kind, so
+// "(a and b) and c" has three rules.
+func (p *filterParser) parseOr() (filterNode, error) {
+	var nodes orNode
+	for {
+		n, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if or, ok := n.(orNode); ok {
+			nodes = append(nodes, or...)
+		} else {
+			nodes = append(nodes, n)
+		}
+		if !p.keyword("or") {
+			break
+		}
+		p.next()
+	}
+	if len(nodes) == 1 {
+		return nodes[0], p.err
+	}
+	return nodes, p.err
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	var nodes andNode
+	for {
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if and, ok := n.(andNode); ok {
+			nodes = append(nodes, and...)
+		} else {
+			nodes = append(nodes, n)
+		}
+		if !p.keyword("and") {
+			break
+		}
+		p.next()
+	}
+	if len(nodes) == 1 {
+		return nodes[0], p.err
+	}
+	return nodes, p.err
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.keyword("not") {
+		p.next()
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind == tokLParen {
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected ), got %s", p.tok)
+		}
+		p.next()
+		return n, p.err
+	}
+
+	if p.tok.kind != tokIdent {
+		return nil, p.errorf("expected a field, got %s", p.tok)
+	}
+	name := p.tok.text
+	field, ok := filterFields[name]
+	if !ok {
+		return nil, p.errorf("unknown field %q", name)
+	}
+	p.next()
+
+	switch {
+	case p.tok.kind == tokOp:
+		op := p.tok.text
+		if field.kind != kindNumber && op != "==" && op != "!=" {
+			return nil, p.errorf("%s is a %s field; only == and != apply", name, field.kind)
+		}
+		p.next()
+		v, err := p.parseValue(name, field.kind)
+		if err != nil {
+			return nil, err
+		}
+		return compareNode{name: name, field: field, op: op, value: v}, nil
+
+	case p.keyword("in"):
+		if field.kind == kindBool {
+			return nil, p.errorf("%s is a bool field; in does not apply", name)
+		}
+		p.next()
+		if p.tok.kind != tokLParen {
+			return nil, p.errorf("expected ( after in, got %s", p.tok)
+		}
+		var values []filterValue
+		for {
+			p.next()
+			v, err := p.parseValue(name, field.kind)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if p.tok.kind != tokComma {
+				break
+			}
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected , or ), got %s", p.tok)
+		}
+		p.next()
+		return inNode{name: name, field: field, values: values}, p.err
+
+	case field.kind == kindBool:
+		return boolNode{name: name, field: field}, p.err
+
+	default:
+		return nil, p.errorf("expected an operator after %s, got %s", name, p.tok)
+	}
+}
+
+// parseValue reads a literal of the field's kind.
+func (p *filterParser) parseValue(name string, kind fieldKind) (filterValue, error) {
+	if p.err != nil {
+		return filterValue{}, p.err
+	}
+	var v filterValue
+	switch {
+	case p.tok.kind == tokString && kind == kindString:
+		v = filterValue{kind: kindString, s: p.tok.text}
+	case p.tok.kind == tokNumber && kind == kindNumber:
+		n, err := strconv.ParseInt(p.tok.text, 10, 64)
+		if err != nil {
+			return filterValue{}, p.errorf("bad number %s", p.tok.text)
+		}
+		v = filterValue{kind: kindNumber, n: n}
+	case p.tok.kind == tokIdent && kind == kindBool && (p.tok.text == "true" || p.tok.text == "false"):
+		v = filterValue{kind: kindBool, b: p.tok.text == "true"}
+	default:
+		return filterValue{}, p.errorf("%s is a %s field, got %s", name, kind, p.tok)
+	}
+	p.next()
+	return v, p.err
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t filterToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of filter"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+type filterLexer struct {
+	src string
+	pos int
+}
+
+func (l *filterLexer) next() (filterToken, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(rune(l.src[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return filterToken{kind: tokEOF, pos: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return filterToken{kind: tokLParen, text: "(", pos: start}, nil
+	case c == ')':
+		l.pos++
+		return filterToken{kind: tokRParen, text: ")", pos: start}, nil
+	case c == ',':
+		l.pos++
+		return filterToken{kind: tokComma, text: ",", pos: start}, nil
+	case c == '"':
+		quoted, err := strconv.QuotedPrefix(l.src[l.pos:])
+		if err != nil {
+			return filterToken{}, fmt.Errorf("at %d: unterminated string", start+1)
+		}
+		l.pos += len(quoted)
+		s, _ := strconv.Unquote(quoted)
+		return filterToken{kind: tokString, text: s, pos: start}, nil
+	case strings.ContainsRune("=!<>", rune(c)):
+		for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+			if strings.HasPrefix(l.src[l.pos:], op) {
+				l.pos += len(op)
+				return filterToken{kind: tokOp, text: op, pos: start}, nil
+			}
+		}
+		return filterToken{}, fmt.Errorf("at %d: unknown operator %q", start+1, string(c))
+	case c == '-' || isDigit(c):
+		l.pos++
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		return filterToken{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isDigit(l.src[l.pos]) || unicode.IsLetter(rune(l.src[l.pos]))) {
+			l.pos++
+		}
+		return filterToken{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	}
+	return filterToken{}, fmt.Errorf("at %d: unexpected %q", start+1, string(c))
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
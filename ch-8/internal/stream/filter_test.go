@@ -0,0 +1,100 @@
+package stream_test
+
+import (
+	"testing"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter_Example(t *testing.T) {
+	f, err := stream.ParseFilter(`domain in ("en.wikipedia.org","de.wikipedia.org") and not bot and namespace == 0`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`domain in ("en.wikipedia.org", "de.wikipedia.org")`, "not bot", "namespace == 0"}, f.Rules())
+
+	for _, tc := range []struct {
+		event stream.Event
+		ok    bool
+		rule  string
+	}{
+		{stream.Event{Domain: "en.wikipedia.org"}, true, ""},
+		{stream.Event{Domain: "de.wikipedia.org", Namespace: 0}, true, ""},
+		{stream.Event{Domain: "fr.wikipedia.org"}, false, `domain in ("en.wikipedia.org", "de.wikipedia.org")`},
+		{stream.Event{Domain: "en.wikipedia.org", Bot: true}, false, "not bot"},
+		{stream.Event{Domain: "en.wikipedia.org", Bot: true, Namespace: 1}, false, "not bot"},
+		{stream.Event{Domain: "en.wikipedia.org", Namespace: 14}, false, "namespace == 0"},
+	} {
+		ok, rule := f.Match(tc.event)
+		assert.Equal(t, tc.ok, ok, "%+v", tc.event)
+		assert.Equal(t, tc.rule, rule, "%+v", tc.event)
+	}
+}
+
+func TestFilter_Operators(t *testing.T) {
+	event := stream.Event{
+		Domain: "en.wikipedia.org", User: "alice", Type: "new",
+		Namespace: 2, LengthNew: 500, Minor: true,
+	}
+	for expr, want := range map[string]bool{
+		``:                                       true,
+		`user == "alice"`:                        true,
+		`user != "alice"`:                        false,
+		`namespace < 2`:                          false,
+		`namespace <= 2`:                         true,
+		`length_new > 100 and length_new >= 500`: true,
+		`namespace in (0, 1) or type == "new"`:   true,
+		`not (minor or bot)`:                     false,
+		`minor == true and bot == false`:         true,
+		`namespace == -1`:                        false,
+		`user == "al\"ice"`:                      false,
+		`(namespace == 2 or bot) and (not bot)`:  true,
+	} {
+		f, err := stream.ParseFilter(expr)
+		if assert.NoError(t, err, expr) {
+			ok, _ := f.Match(event)
+			assert.Equal(t, want, ok, expr)
+		}
+	}
+}
+
+func TestFilter_StringParsesBack(t *testing.T) {
+	for _, expr := range []string{
+		`not (bot or minor) and (namespace == 0 or namespace > 100)`,
+		`(wiki == "enwiki" and not bot) or user in ("a", "b")`,
+	} {
+		f, err := stream.ParseFilter(expr)
+		assert.NoError(t, err)
+		again, err := stream.ParseFilter(f.String())
+		assert.NoError(t, err)
+		assert.Equal(t, f.Rules(), again.Rules())
+	}
+
+	f, err := stream.ParseFilter(`(not bot and minor) and namespace == 0`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"not bot", "minor", "namespace == 0"}, f.Rules(), "nested and is flattened into rules")
+}
+
+func TestParseFilter_Errors(t *testing.T) {
+	for expr, msg := range map[string]string{
+		`domain`:                            "expected an operator after domain",
+		`colour == "red"`:                   `unknown field "colour"`,
+		`namespace == "0"`:                  "namespace is a number field",
+		`domain < "m"`:                      "only == and != apply",
+		`bot in (true)`:                     "in does not apply",
+		`domain in "en"`:                    "expected ( after in",
+		`domain in ("en" "de")`:             "expected , or )",
+		`(bot`:                              "expected ), got end of filter",
+		`bot and`:                           "expected a field, got end of filter",
+		`bot minor`:                         `unexpected "minor"`,
+		`domain == "en`:                     "unterminated string",
+		`namespace = 0`:                     "unknown operator",
+		`namespace == 99999999999999999999`: "bad number",
+		`bot & minor`:                       `unexpected "&"`,
+	} {
+		_, err := stream.ParseFilter(expr)
+		assert.ErrorContains(t, err, msg, expr)
+	}
+
+	_, err := stream.ParseFilter(`bot and namespace == x`)
+	assert.ErrorContains(t, err, "at 22:")
+}
@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Standard headers on every record the producer publishes.
+const (
+	HeaderSchemaVersion  = "schema-version"
+	HeaderContentType    = "content-type"
+	HeaderProducerHost   = "producer-host"
+	HeaderEventID        = "event-id"
+	HeaderEventTimestamp = "event-timestamp"
+)
+
+const (
+	// SchemaVersion is the version of proto/event.proto the producer writes.
+	SchemaVersion = 1
+
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// PartitionKey chooses the record key, and with it the partition, for an
+// event. Events with the same key stay in order.
+type PartitionKey string
+
+const (
+	// PartitionByNone leaves records unkeyed, so the client spreads them
+	// over partitions with no ordering between them.
+	PartitionByNone   PartitionKey = "none"
+	PartitionByDomain PartitionKey = "domain"
+	PartitionByUser   PartitionKey = "user"
+	PartitionByTitle  PartitionKey = "title"
+)
+
+func ParsePartitionKey(s string) (PartitionKey, error) {
+	switch k := PartitionKey(s); k {
+	case PartitionByNone, PartitionByDomain, PartitionByUser, PartitionByTitle:
+		return k, nil
+	default:
+		return "", fmt.Errorf("unknown partition key %q: want domain, user, title or none", s)
+	}
+}
+
+// For returns the record key for event, or nil for PartitionByNone. Titles
+// are keyed together with their domain, since titles repeat across wikis.
+func (k PartitionKey) For(event Event) []byte {
+	switch k {
+	case PartitionByDomain:
+		return []byte(event.Domain)
+	case PartitionByUser:
+		return []byte(event.User)
+	case PartitionByTitle:
+		return []byte(event.Domain + "/" + event.Title)
+	default:
+		return nil
+	}
+}
+
+// RecordMetadata is what the standard headers say about a record. Records
+// from producers that predate the headers parse to the zero value.
+type RecordMetadata struct {
+	SchemaVersion int
+	ContentType   string
+	ProducerHost  string
+	// EventID identifies the Wikimedia event, so redelivered or re-produced
+	// copies of it can be recognised.
+	EventID string
+	// EventTime is when the change happened on the wiki.
+	EventTime time.Time
+}
+
+// Headers encodes m, leaving out empty fields.
+func (m RecordMetadata) Headers() []kgo.RecordHeader {
+	var headers []kgo.RecordHeader
+	add := func(key, value string) {
+		if value != "" {
+			headers = append(headers, kgo.RecordHeader{Key: key, Value: []byte(value)})
+		}
+	}
+	if m.SchemaVersion > 0 {
+		add(HeaderSchemaVersion, strconv.Itoa(m.SchemaVersion))
+	}
+	add(HeaderContentType, m.ContentType)
+	add(HeaderProducerHost, m.ProducerHost)
+	add(HeaderEventID, m.EventID)
+	if !m.EventTime.IsZero() {
+		add(HeaderEventTimestamp, m.EventTime.UTC().Format(time.RFC3339Nano))
+	}
+	return headers
+}
+
+// ParseRecordMetadata reads the standard headers and ignores any others.
+func ParseRecordMetadata(headers []kgo.RecordHeader) (RecordMetadata, error) {
+	var m RecordMetadata
+	for _, h := range headers {
+		value := string(h.Value)
+		switch h.Key {
+		case HeaderSchemaVersion:
+			v, err := strconv.Atoi(value)
+			if err != nil || v < 1 {
+				return RecordMetadata{}, fmt.Errorf("invalid %s header %q", HeaderSchemaVersion, value)
+			}
+			m.SchemaVersion = v
+		case HeaderContentType:
+			m.ContentType = value
+		case HeaderProducerHost:
+			m.ProducerHost = value
+		case HeaderEventID:
+			m.EventID = value
+		case HeaderEventTimestamp:
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return RecordMetadata{}, fmt.Errorf("invalid %s header %q", HeaderEventTimestamp, value)
+			}
+			m.EventTime = t
+		}
+	}
+	return m, nil
+}
+
+// ObserveLag records how long ago the event happened on the wiki and how
+// long ago the record was produced, as of now.
+func ObserveLag(m RecordMetadata, record *kgo.Record, now time.Time) {
+	if !m.EventTime.IsZero() {
+		ConsumerLagSeconds.WithLabelValues("event").Observe(now.Sub(m.EventTime).Seconds())
+	}
+	if !record.Timestamp.IsZero() {
+		ConsumerLagSeconds.WithLabelValues("produce").Observe(now.Sub(record.Timestamp).Seconds())
+	}
+}
@@ -0,0 +1,61 @@
+package stream_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestPartitionKey_For(t *testing.T) {
+	event := stream.Event{Domain: "en.wikipedia.org", User: "alice", Title: "Go"}
+
+	assert.Nil(t, stream.PartitionByNone.For(event))
+	assert.Equal(t, []byte("en.wikipedia.org"), stream.PartitionByDomain.For(event))
+	assert.Equal(t, []byte("alice"), stream.PartitionByUser.For(event))
+	assert.Equal(t, []byte("en.wikipedia.org/Go"), stream.PartitionByTitle.For(event))
+}
+
+func TestParsePartitionKey(t *testing.T) {
+	for _, s := range []string{"none", "domain", "user", "title"} {
+		k, err := stream.ParsePartitionKey(s)
+		assert.NoError(t, err)
+		assert.Equal(t, stream.PartitionKey(s), k)
+	}
+	_, err := stream.ParsePartitionKey("wiki")
+	assert.Error(t, err)
+}
+
+func TestRecordMetadata_RoundTrip(t *testing.T) {
+	m := stream.RecordMetadata{
+		SchemaVersion: stream.SchemaVersion,
+		ContentType:   stream.ContentTypeProtobuf,
+		ProducerHost:  "producer-7d9f",
+		EventID:       "2f1c3e1a-0000-4000-8000-000000000001",
+		EventTime:     time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	headers := m.Headers()
+	assert.Len(t, headers, 5)
+
+	parsed, err := stream.ParseRecordMetadata(append(headers, kgo.RecordHeader{Key: "trace-id", Value: []byte("x")}))
+	assert.NoError(t, err)
+	assert.Equal(t, m, parsed)
+}
+
+func TestRecordMetadata_EmptyFieldsAreLeftOut(t *testing.T) {
+	assert.Empty(t, stream.RecordMetadata{}.Headers())
+
+	parsed, err := stream.ParseRecordMetadata(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, stream.RecordMetadata{}, parsed)
+}
+
+func TestParseRecordMetadata_RejectsBadValues(t *testing.T) {
+	_, err := stream.ParseRecordMetadata([]kgo.RecordHeader{{Key: stream.HeaderSchemaVersion, Value: []byte("v2")}})
+	assert.ErrorContains(t, err, stream.HeaderSchemaVersion)
+
+	_, err = stream.ParseRecordMetadata([]kgo.RecordHeader{{Key: stream.HeaderEventTimestamp, Value: []byte("yesterday")}})
+	assert.ErrorContains(t, err, stream.HeaderEventTimestamp)
+}
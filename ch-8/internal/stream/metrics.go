@@ -21,6 +21,18 @@ var (
 			Help: "Number of events produced to Redpanda",
 		},
 	)
+	EventsFailedToProduce = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "events_failed_to_produce_total",
+			Help: "Number of events Redpanda did not accept after the client's retries",
+		},
+	)
+	ProducerInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "producer_in_flight_records",
+			Help: "Number of produced records awaiting delivery",
+		},
+	)
 	EventsConsumedFromRedpanda = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "events_consumed_from_redpanda_total",
@@ -39,6 +51,88 @@ var (
 			Help: "Number of events that failed during processing",
 		},
 	)
+	StoreWriteFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "store_write_failures_total",
+			Help: "Number of batch flushes that could not be written to the stats store",
+		},
+	)
+	WorkerQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "consumer_worker_queue_depth",
+			Help: "Number of records waiting in each consumer worker's queue",
+		},
+		[]string{"worker"},
+	)
+	BatcherBufferedEvents = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "batcher_buffered_events",
+			Help: "Number of events buffered in each consumer worker's batcher, awaiting a flush",
+		},
+		[]string{"worker"},
+	)
+	BatcherBufferedBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "batcher_buffered_bytes",
+			Help: "Estimated bytes buffered in each consumer worker's batcher",
+		},
+		[]string{"worker"},
+	)
+	BatcherFlushLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "batcher_flush_latency_seconds",
+			Help:    "Time from the oldest event in a batch being buffered until the batch was written",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+		},
+	)
+	BatcherFlushSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "batcher_flush_size_events",
+			Help:    "Number of events written to the stats store per batch",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+		},
+	)
+	BatcherFlushDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "batcher_flush_duration_seconds",
+			Help:    "Time spent writing a batch to the stats store, retries included, whether or not it succeeded",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+		},
+	)
+	ConsumerFetchPaused = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "consumer_fetch_paused",
+			Help: "1 while the consumer has paused fetching because its batchers are full",
+		},
+	)
+	ConsumerLagSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "consumer_lag_seconds",
+			Help:    "Time from the wiki edit (since=event) or from producing the record (since=produce) until the consumer read it",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+		},
+		[]string{"since"},
+	)
+	DuplicateEventsSkipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "duplicate_events_skipped_total",
+			Help: "Number of records skipped because their event id was already processed",
+		},
+	)
+	EventsFiltered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "events_filtered_total",
+			Help: "Number of stream events the producer filter left out, by the rule that rejected them",
+		},
+		[]string{"rule"},
+	)
+	EventsDeadLettered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "events_dead_lettered_total",
+			Help: "Number of records set aside as dead letters, by reason and whether the dead-letter topic took them",
+		},
+		[]string{"reason", "result"},
+	)
 )
 
 func RegisterMetrics() {
@@ -46,9 +140,23 @@ func RegisterMetrics() {
 		prometheus.MustRegister(
 			EventsConsumedFromStream,
 			EventsProducedToRedpanda,
+			EventsFailedToProduce,
+			ProducerInFlight,
 			EventsConsumedFromRedpanda,
 			EventsProcessedSuccessfully,
 			EventsFailedToProcess,
+			StoreWriteFailures,
+			WorkerQueueDepth,
+			BatcherBufferedEvents,
+			BatcherBufferedBytes,
+			BatcherFlushLatency,
+			BatcherFlushSize,
+			BatcherFlushDuration,
+			ConsumerFetchPaused,
+			EventsFiltered,
+			EventsDeadLettered,
+			ConsumerLagSeconds,
+			DuplicateEventsSkipped,
 		)
 	})
 }
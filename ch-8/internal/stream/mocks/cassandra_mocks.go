@@ -1,6 +1,7 @@
 package mocks
 
 import (
+	"context"
 	"errors"
 
 	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
@@ -11,6 +12,10 @@ type MockQuery struct {
 	iter     stream.Iter
 }
 
+func (m *MockQuery) WithContext(_ context.Context) stream.Query {
+	return m
+}
+
 func (m *MockQuery) Exec() error {
 	if m.ExecFunc != nil {
 		return m.ExecFunc()
@@ -18,6 +23,13 @@ func (m *MockQuery) Exec() error {
 	return nil
 }
 
+func (m *MockQuery) MapScanCAS(_ map[string]interface{}) (bool, error) {
+	if m.ExecFunc != nil {
+		return true, m.ExecFunc()
+	}
+	return true, nil
+}
+
 func (m *MockQuery) Iter() stream.Iter {
 	return m.iter
 }
@@ -0,0 +1,531 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// DispatchKey decides which worker receives a record.
+type DispatchKey string
+
+const (
+	// KeyByPartition sends every record of a partition to the same worker,
+	// so events are recorded in partition order while one flush per worker
+	// is in flight.
+	KeyByPartition DispatchKey = "partition"
+	// KeyByDomain sends every event of a domain to the same worker, which
+	// spreads a hot partition over several workers. Order is kept per domain
+	// but not per partition.
+	KeyByDomain DispatchKey = "domain"
+)
+
+func ParseDispatchKey(s string) (DispatchKey, error) {
+	switch k := DispatchKey(s); k {
+	case KeyByPartition, KeyByDomain:
+		return k, nil
+	default:
+		return "", fmt.Errorf("unknown dispatch key %q: want partition or domain", s)
+	}
+}
+
+const defaultWorkerQueueSize = 256
+
+type dispatchItem struct {
+	event  Event
+	record *kgo.Record
+	// barrier, when set, asks the worker to flush everything queued before
+	// it and report the result instead of carrying an event.
+	barrier chan error
+}
+
+type poolWorker struct {
+	id      int
+	label   string
+	queue   chan dispatchItem
+	batcher *Batcher
+}
+
+// WorkerPool fans records from a single poll loop out to a fixed set of
+// workers, each with its own Batcher. A record goes to the worker chosen by
+// its DispatchKey, and each worker handles its queue in order.
+//
+// Offsets are committed through the pool rather than by each batcher: a
+// partition is only committed up to its oldest record that some worker has
+// not yet written, so no worker can commit past another worker's buffer.
+type WorkerPool struct {
+	store         StatsStore
+	size          int
+	batchSize     int
+	flushInterval time.Duration
+	key           DispatchKey
+	queueSize     int
+	tracker       *offsetTracker
+	dedup         Deduplicator
+	maxEvents     int
+	maxBytes      int
+	maxInFlight   int
+
+	// mu guards workers against Start and stopped against queues being
+	// closed while Flush is sending barriers from a rebalance callback.
+	mu      sync.RWMutex
+	stopped bool
+	// stopCtx, set by Shutdown, bounds each worker's final flush.
+	stopCtx context.Context
+	workers []*poolWorker
+	wg      sync.WaitGroup
+	cancel  context.CancelFunc
+}
+
+func NewWorkerPool(store StatsStore, size, batchSize int, flushInterval time.Duration) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &WorkerPool{
+		store:         store,
+		size:          size,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		key:           KeyByPartition,
+		queueSize:     defaultWorkerQueueSize,
+		tracker:       newOffsetTracker(),
+	}
+}
+
+// WithDispatchKey chooses how records are assigned to workers.
+func (p *WorkerPool) WithDispatchKey(key DispatchKey) *WorkerPool {
+	p.key = key
+	return p
+}
+
+// WithQueueSize bounds each worker's queue. Dispatch blocks while the
+// target worker's queue is full.
+func (p *WorkerPool) WithQueueSize(n int) *WorkerPool {
+	if n < 1 {
+		n = 1
+	}
+	p.queueSize = n
+	return p
+}
+
+// WithCommitter registers fn to commit offsets once every record below them
+// has been written.
+func (p *WorkerPool) WithCommitter(fn CommitFunc) *WorkerPool {
+	p.tracker.commit = fn
+	return p
+}
+
+// WithDeduplicator makes workers skip events whose id d has seen, before
+// they reach the batcher, and record ids as processed after each write.
+func (p *WorkerPool) WithDeduplicator(d Deduplicator) *WorkerPool {
+	p.dedup = d
+	return p
+}
+
+// WithBufferLimits bounds each worker's batcher; see Batcher.WithLimits. A
+// worker with a full batcher stops taking records from its queue until a
+// flush makes room.
+func (p *WorkerPool) WithBufferLimits(maxEvents, maxBytes int) *WorkerPool {
+	p.maxEvents = maxEvents
+	p.maxBytes = maxBytes
+	return p
+}
+
+// WithMaxInFlightFlushes lets each worker's batcher write up to n batches
+// at once; see Batcher.WithMaxInFlight. Offsets are still committed in
+// order, but with n above 1 events of one key may reach the store out of
+// order.
+func (p *WorkerPool) WithMaxInFlightFlushes(n int) *WorkerPool {
+	p.maxInFlight = n
+	return p
+}
+
+// Start launches the workers. Their batchers run on a context of their own
+// so that cancelling the poll loop does not cut a drain short; call Stop to
+// drain and shut down.
+func (p *WorkerPool) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	// A rebalance callback may already be calling Flush, which reads the
+	// workers under p.mu.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cancel = cancel
+
+	for i := 0; i < p.size; i++ {
+		w := &poolWorker{
+			id:    i,
+			label: strconv.Itoa(i),
+			queue: make(chan dispatchItem, p.queueSize),
+		}
+		w.batcher = NewBatcher(p.store, p.batchSize, p.flushInterval).
+			WithLimits(p.maxEvents, p.maxBytes).
+			WithMaxInFlight(p.maxInFlight).
+			WithLabel(w.label).
+			WithCommitter(func(ctx context.Context, offsets Offsets) error {
+				return p.tracker.done(ctx, w.id, offsets)
+			})
+		w.batcher.Start(ctx)
+		WorkerQueueDepth.WithLabelValues(w.label).Set(0)
+		p.workers = append(p.workers, w)
+
+		p.wg.Add(1)
+		go p.runWorker(ctx, w)
+	}
+}
+
+func (p *WorkerPool) runWorker(ctx context.Context, w *poolWorker) {
+	defer p.wg.Done()
+	for item := range w.queue {
+		WorkerQueueDepth.WithLabelValues(w.label).Set(float64(len(w.queue)))
+		if item.barrier != nil {
+			_, err := w.batcher.Flush(ctx)
+			item.barrier <- err
+			continue
+		}
+		if p.duplicate(ctx, item.event) {
+			DuplicateEventsSkipped.Inc()
+			if item.record != nil {
+				w.batcher.SkipRecord(item.record)
+			}
+			continue
+		}
+		// A full batch is flushed in the background, so the worker goes
+		// on to the next record while it is written.
+		if err := w.batcher.AddRecordContext(ctx, item.event, item.record); err != nil {
+			// Only the pool's context ends the wait, once it is shut down.
+			continue
+		}
+	}
+	// The queue is closed and empty: flush what is left and commit it,
+	// within Shutdown's deadline if it was given one.
+	p.mu.RLock()
+	stopCtx := p.stopCtx
+	p.mu.RUnlock()
+	if stopCtx != nil {
+		w.batcher.Shutdown(stopCtx)
+	} else {
+		w.batcher.Stop()
+	}
+}
+
+// duplicate reports whether event was already counted. If the check fails
+// the event is counted: a rare double count beats losing it.
+func (p *WorkerPool) duplicate(ctx context.Context, event Event) bool {
+	if p.dedup == nil || event.EventID == "" {
+		return false
+	}
+	seen, err := p.dedup.Seen(ctx, event.EventID)
+	if err != nil {
+		log.Printf("⚠️ Dedup check for %s failed, counting it: %v", event.EventID, err)
+		return false
+	}
+	return seen
+}
+
+// Dispatch queues event for its worker. It blocks while that worker's queue
+// is full and gives up when ctx is cancelled; a record that was not queued
+// is never committed, so it is redelivered after a restart.
+func (p *WorkerPool) Dispatch(ctx context.Context, event Event, record *kgo.Record) error {
+	w := p.workers[p.workerFor(event, record)]
+	if record != nil {
+		p.tracker.begin(w.id, record)
+	}
+
+	select {
+	case w.queue <- dispatchItem{event: event, record: record}:
+		WorkerQueueDepth.WithLabelValues(w.label).Set(float64(len(w.queue)))
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *WorkerPool) workerFor(event Event, record *kgo.Record) int {
+	h := fnv.New32a()
+	if p.key == KeyByDomain || record == nil {
+		h.Write([]byte(event.Domain))
+	} else {
+		fmt.Fprintf(h, "%s/%d", record.Topic, record.Partition)
+	}
+	return int(h.Sum32() % uint32(p.size))
+}
+
+// Flush makes every worker write and commit all records dispatched so far,
+// and waits for them. It returns the first flush error, or ctx's error if
+// the workers do not finish in time. After Stop it is a no-op: draining has
+// already flushed everything.
+func (p *WorkerPool) Flush(ctx context.Context) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		return nil
+	}
+
+	barriers := make([]chan error, len(p.workers))
+	for i, w := range p.workers {
+		barriers[i] = make(chan error, 1)
+		select {
+		case w.queue <- dispatchItem{barrier: barriers[i]}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var firstErr error
+	for _, barrier := range barriers {
+		select {
+		case err := <-barrier:
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return firstErr
+}
+
+// Saturated reports whether any worker's batcher is full, meaning the store
+// is not keeping up and more records would only queue up in memory.
+func (p *WorkerPool) Saturated() bool {
+	for _, w := range p.workers {
+		if w.batcher.Full() {
+			return true
+		}
+	}
+	return false
+}
+
+// capacityPollInterval is how often WaitForCapacity checks the batchers.
+const capacityPollInterval = 25 * time.Millisecond
+
+// WaitForCapacity blocks while the pool is saturated, or until ctx is done.
+func (p *WorkerPool) WaitForCapacity(ctx context.Context) error {
+	ticker := time.NewTicker(capacityPollInterval)
+	defer ticker.Stop()
+	for p.Saturated() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Partitions lists the partitions the pool has dispatched records from and
+// not since forgotten.
+func (p *WorkerPool) Partitions() map[string][]int32 {
+	return p.tracker.partitionList()
+}
+
+// Revoke runs before partitions move to another group member. It flushes
+// and commits everything dispatched so far, so the new owner resumes right
+// after what this member wrote, then forgets the partitions' offsets. Events
+// whose write fails stay buffered and will also be counted by the new owner.
+func (p *WorkerPool) Revoke(ctx context.Context, partitions map[string][]int32) error {
+	err := p.Flush(ctx)
+	p.tracker.forget(partitions)
+	return err
+}
+
+// Forget drops offset tracking for partitions that were lost or newly
+// assigned; commits for them could rewind another member's progress.
+func (p *WorkerPool) Forget(partitions map[string][]int32) {
+	p.tracker.forget(partitions)
+}
+
+// Stop closes the queues, waits for every worker to write and commit what
+// it holds, and returns once the pool is drained. Dispatch must not be
+// called after Stop. Calling it again waits for the same drain.
+func (p *WorkerPool) Stop() {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		for _, w := range p.workers {
+			close(w.queue)
+		}
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	if p.cancel != nil {
+		p.cancel()
+	}
+}
+
+// Shutdown is Stop with a deadline, which also bounds the workers' final
+// flushes. If the workers have not drained when ctx is done it returns
+// ctx's error and leaves the flushes in flight to finish in the background;
+// whatever they have not committed is redelivered.
+func (p *WorkerPool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopCtx = ctx
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// offsetTracker turns per-worker flushes into safe per-partition commits.
+// For each partition it remembers, per worker, the offsets dispatched but
+// not yet written. A partition can be committed up to the smallest of
+// those, or past everything dispatched once nothing is outstanding.
+type offsetTracker struct {
+	commit CommitFunc
+	// commitMu is held from picking offsets until they are committed, so
+	// commits reach the broker in increasing order without blocking begin.
+	commitMu sync.Mutex
+
+	mu         sync.Mutex
+	partitions map[topicPartition]*partitionProgress
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+type partitionProgress struct {
+	pending   map[int][]int64
+	next      kgo.EpochOffset
+	committed int64
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[topicPartition]*partitionProgress)}
+}
+
+func (t *offsetTracker) begin(worker int, record *kgo.Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tp := topicPartition{record.Topic, record.Partition}
+	p, ok := t.partitions[tp]
+	if !ok {
+		p = &partitionProgress{
+			pending:   make(map[int][]int64),
+			next:      kgo.EpochOffset{Epoch: -1, Offset: -1},
+			committed: -1,
+		}
+		t.partitions[tp] = p
+	}
+	p.pending[worker] = append(p.pending[worker], record.Offset)
+	next := kgo.EpochOffset{Epoch: record.LeaderEpoch, Offset: record.Offset + 1}
+	if p.next.Less(next) {
+		p.next = next
+	}
+}
+
+func (t *offsetTracker) partitionList() map[string][]int32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	partitions := make(map[string][]int32)
+	for tp := range t.partitions {
+		partitions[tp.topic] = append(partitions[tp.topic], tp.partition)
+	}
+	return partitions
+}
+
+func (t *offsetTracker) forget(partitions map[string][]int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for topic, ps := range partitions {
+		for _, partition := range ps {
+			delete(t.partitions, topicPartition{topic, partition})
+		}
+	}
+}
+
+// done records that worker has written everything it was given below
+// offsets, then commits whatever partitions that unblocked. The commit runs
+// outside t.mu, so dispatching does not wait for the broker.
+func (t *offsetTracker) done(ctx context.Context, worker int, offsets Offsets) error {
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+
+	toCommit := t.unblocked(worker, offsets)
+	if len(toCommit) == 0 || t.commit == nil {
+		return nil
+	}
+	if err := t.commit(ctx, toCommit); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for topic, partitions := range toCommit {
+		for partition, offset := range partitions {
+			// The partition may have been revoked meanwhile.
+			if p, ok := t.partitions[topicPartition{topic, partition}]; ok && offset.Offset > p.committed {
+				p.committed = offset.Offset
+			}
+		}
+	}
+	return nil
+}
+
+// unblocked drops worker's pending offsets below offsets and returns the
+// partitions whose watermark moved past their last commit.
+func (t *offsetTracker) unblocked(worker int, offsets Offsets) Offsets {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	toCommit := make(Offsets)
+	for topic, partitions := range offsets {
+		for partition, written := range partitions {
+			p, ok := t.partitions[topicPartition{topic, partition}]
+			if !ok {
+				continue
+			}
+			pending := p.pending[worker]
+			i := 0
+			for i < len(pending) && pending[i] < written.Offset {
+				i++
+			}
+			if i == len(pending) {
+				delete(p.pending, worker)
+			} else {
+				p.pending[worker] = pending[i:]
+			}
+
+			watermark := p.watermark()
+			if watermark.Offset <= p.committed {
+				continue
+			}
+			if toCommit[topic] == nil {
+				toCommit[topic] = make(map[int32]kgo.EpochOffset)
+			}
+			toCommit[topic][partition] = watermark
+		}
+	}
+	return toCommit
+}
+
+// watermark is the next offset that is safe to commit.
+func (p *partitionProgress) watermark() kgo.EpochOffset {
+	w := p.next
+	for _, pending := range p.pending {
+		if len(pending) > 0 && pending[0] < w.Offset {
+			w.Offset = pending[0]
+		}
+	}
+	return w
+}
@@ -0,0 +1,314 @@
+package stream_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// orderStore remembers the order in which events were written.
+type orderStore struct {
+	stream.StatsStore
+	mu      sync.Mutex
+	written []stream.Event
+}
+
+func (s *orderStore) RecordMany(_ context.Context, events []stream.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written = append(s.written, events...)
+	return nil
+}
+
+func (s *orderStore) all() []stream.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stream.Event(nil), s.written...)
+}
+
+// gatedStore blocks writes that contain the gated domain until release.
+type gatedStore struct {
+	stream.StatsStore
+	domain  string
+	release chan struct{}
+}
+
+func (s *gatedStore) RecordMany(ctx context.Context, events []stream.Event) error {
+	for _, e := range events {
+		if e.Domain == s.domain {
+			select {
+			case <-s.release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+func TestWorkerPool_KeepsPartitionOrder(t *testing.T) {
+	store := &orderStore{}
+	recorder := &commitRecorder{}
+	pool := stream.NewWorkerPool(store, 4, 3, time.Hour).WithCommitter(recorder.commit)
+	pool.Start()
+
+	for offset := int64(0); offset < 50; offset++ {
+		for partition := int32(0); partition < 6; partition++ {
+			event := stream.Event{Domain: fmt.Sprint(partition), ID: offset}
+			assert.NoError(t, pool.Dispatch(context.Background(), event, &kgo.Record{Topic: "t", Partition: partition, Offset: offset}))
+		}
+	}
+	pool.Stop()
+
+	last := map[string]int64{}
+	for _, e := range store.all() {
+		if prev, ok := last[e.Domain]; ok {
+			assert.Greater(t, e.ID, prev, "partition %s out of order", e.Domain)
+		}
+		last[e.Domain] = e.ID
+	}
+	assert.Len(t, store.all(), 300)
+
+	final := map[int32]int64{}
+	for _, c := range recorder.all() {
+		for p, o := range c["t"] {
+			assert.Greater(t, o.Offset, final[p]-1, "commits must not go backwards")
+			final[p] = o.Offset
+		}
+	}
+	for p := int32(0); p < 6; p++ {
+		assert.Equal(t, int64(50), final[p])
+	}
+}
+
+func TestWorkerPool_ByDomainNeverCommitsPastAnotherWorkersBuffer(t *testing.T) {
+	store := &gatedStore{domain: "slow", release: make(chan struct{})}
+	recorder := &commitRecorder{}
+	// "slow" and "fast" hash to different workers.
+	pool := stream.NewWorkerPool(store, 2, 1, time.Hour).
+		WithDispatchKey(stream.KeyByDomain).
+		WithCommitter(recorder.commit)
+	pool.Start()
+
+	ctx := context.Background()
+	assert.NoError(t, pool.Dispatch(ctx, stream.Event{Domain: "slow"}, &kgo.Record{Topic: "t", Offset: 0}))
+	assert.NoError(t, pool.Dispatch(ctx, stream.Event{Domain: "fast"}, &kgo.Record{Topic: "t", Offset: 1}))
+
+	time.Sleep(50 * time.Millisecond)
+	for _, c := range recorder.all() {
+		assert.LessOrEqual(t, c["t"][0].Offset, int64(0), "committed past an unwritten record")
+	}
+
+	close(store.release)
+	pool.Stop()
+
+	commits := recorder.all()
+	if assert.NotEmpty(t, commits) {
+		assert.Equal(t, int64(2), commits[len(commits)-1]["t"][0].Offset)
+	}
+}
+
+func TestWorkerPool_StopDrainsQueuedRecords(t *testing.T) {
+	store := stream.NewInMemoryStats()
+	recorder := &commitRecorder{}
+	pool := stream.NewWorkerPool(store, 3, 100, time.Hour).WithCommitter(recorder.commit)
+	pool.Start()
+
+	for i := int64(0); i < 10; i++ {
+		assert.NoError(t, pool.Dispatch(context.Background(), stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Partition: 1, Offset: i}))
+	}
+	pool.Stop()
+
+	assert.Equal(t, 10, snapshotOf(t, store).Messages)
+	commits := recorder.all()
+	assert.Len(t, commits, 1)
+	assert.Equal(t, int64(10), commits[0]["t"][1].Offset)
+}
+
+func TestWorkerPool_DispatchGivesUpWhenQueueFullAndCancelled(t *testing.T) {
+	store := &gatedStore{domain: "a", release: make(chan struct{})}
+	recorder := &commitRecorder{}
+	// Offset 0 is stuck in the store, 1 fills the buffer, the worker waits
+	// to add 2 and 3 fills the queue.
+	pool := stream.NewWorkerPool(store, 1, 1, time.Hour).WithQueueSize(1).WithBufferLimits(1, 0).WithCommitter(recorder.commit)
+	pool.Start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var err error
+	for i := int64(0); i < 6 && err == nil; i++ {
+		dispatchCtx, dispatchCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		err = pool.Dispatch(dispatchCtx, stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: i})
+		dispatchCancel()
+	}
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(store.release)
+	pool.Stop()
+
+	// Offset 4 never made it into a queue, so it holds the commit back.
+	commits := recorder.all()
+	if assert.NotEmpty(t, commits) {
+		assert.Equal(t, int64(4), commits[len(commits)-1]["t"][0].Offset)
+	}
+}
+
+func TestParseDispatchKey(t *testing.T) {
+	k, err := stream.ParseDispatchKey("domain")
+	assert.NoError(t, err)
+	assert.Equal(t, stream.KeyByDomain, k)
+
+	_, err = stream.ParseDispatchKey("title")
+	assert.Error(t, err)
+}
+
+func TestWorkerPool_RevokeForgetsPartition(t *testing.T) {
+	recorder := &commitRecorder{}
+	pool := stream.NewWorkerPool(stream.NewInMemoryStats(), 1, 100, time.Hour).WithCommitter(recorder.commit)
+	pool.Start()
+	defer pool.Stop()
+
+	ctx := context.Background()
+	assert.NoError(t, pool.Dispatch(ctx, stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 9}))
+	assert.NoError(t, pool.Revoke(ctx, map[string][]int32{"t": {0}}))
+	assert.Len(t, recorder.all(), 1)
+
+	// Re-assigned later from an older committed offset: commits start over
+	// instead of being suppressed by the offset committed before the revoke.
+	assert.NoError(t, pool.Dispatch(ctx, stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 4}))
+	assert.NoError(t, pool.Flush(ctx))
+	commits := recorder.all()
+	assert.Len(t, commits, 2)
+	assert.Equal(t, int64(5), commits[1]["t"][0].Offset)
+}
+
+func TestWorkerPool_DispatchDoesNotWaitForCommits(t *testing.T) {
+	committing := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	pool := stream.NewWorkerPool(stream.NewInMemoryStats(), 1, 1, time.Hour).
+		WithCommitter(func(context.Context, stream.Offsets) error {
+			once.Do(func() { close(committing) })
+			<-release
+			return nil
+		})
+	pool.Start()
+
+	assert.NoError(t, pool.Dispatch(context.Background(), stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 0}))
+	<-committing
+
+	dispatched := make(chan error, 1)
+	go func() {
+		dispatched <- pool.Dispatch(context.Background(), stream.Event{Domain: "a"}, &kgo.Record{Topic: "t", Offset: 1})
+	}()
+	select {
+	case err := <-dispatched:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Error("Dispatch waited for the commit in flight")
+	}
+
+	close(release)
+	pool.Stop()
+}
+
+func TestWorkerPool_FlushWhileStartingIsSafe(t *testing.T) {
+	pool := stream.NewWorkerPool(stream.NewInMemoryStats(), 4, 10, time.Hour)
+	flushed := make(chan error, 1)
+	go func() { flushed <- pool.Flush(context.Background()) }()
+	pool.Start()
+	assert.NoError(t, <-flushed)
+	pool.Stop()
+}
+
+func TestWorkerPool_FlushTimesOutOnStuckWorker(t *testing.T) {
+	store := &gatedStore{domain: "a", release: make(chan struct{})}
+	pool := stream.NewWorkerPool(store, 1, 100, time.Hour)
+	pool.Start()
+
+	assert.NoError(t, pool.Dispatch(context.Background(), stream.Event{Domain: "a"}, &kgo.Record{Topic: "t"}))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, pool.Flush(ctx), context.DeadlineExceeded)
+
+	close(store.release)
+	pool.Stop()
+}
+
+func TestWorkerPool_SkipsDuplicatesBeforeBatcher(t *testing.T) {
+	store := &orderStore{}
+	recorder := &commitRecorder{}
+	pool := stream.NewWorkerPool(store, 2, 100, time.Hour).
+		WithCommitter(recorder.commit).
+		WithDeduplicator(stream.NewSeenSet(100, time.Hour))
+	pool.Start()
+
+	ctx := context.Background()
+	// The duplicate lands on another partition, and so another worker.
+	assert.NoError(t, pool.Dispatch(ctx, stream.Event{Domain: "a", EventID: "e-1"}, &kgo.Record{Topic: "t", Partition: 0, Offset: 0}))
+	assert.NoError(t, pool.Flush(ctx))
+	assert.NoError(t, pool.Dispatch(ctx, stream.Event{Domain: "a", EventID: "e-1"}, &kgo.Record{Topic: "t", Partition: 1, Offset: 0}))
+	assert.NoError(t, pool.Dispatch(ctx, stream.Event{Domain: "b"}, &kgo.Record{Topic: "t", Partition: 2, Offset: 0}))
+	pool.Stop()
+
+	assert.Len(t, store.all(), 2)
+	committed := map[int32]int64{}
+	for _, c := range recorder.all() {
+		for p, o := range c["t"] {
+			committed[p] = o.Offset
+		}
+	}
+	assert.Equal(t, map[int32]int64{0: 1, 1: 1, 2: 1}, committed, "the skipped record is committed too")
+}
+
+func TestWorkerPool_SaturatedUntilStoreCatchesUp(t *testing.T) {
+	store := &gatedStore{StatsStore: stream.NewInMemoryStats(), domain: "slow", release: make(chan struct{})}
+	pool := stream.NewWorkerPool(store, 1, 10, time.Hour).WithBufferLimits(2, 0)
+	pool.Start()
+	defer pool.Stop()
+
+	ctx := context.Background()
+	assert.False(t, pool.Saturated())
+	// Two events are stuck in the store, two fill the buffer and the fifth
+	// waits for room.
+	for offset := int64(0); offset < 5; offset++ {
+		assert.NoError(t, pool.Dispatch(ctx, stream.Event{Domain: "slow"}, &kgo.Record{Topic: "t", Partition: 4, Offset: offset}))
+	}
+	assert.Eventually(t, pool.Saturated, time.Second, 5*time.Millisecond)
+	assert.Equal(t, map[string][]int32{"t": {4}}, pool.Partitions())
+
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, pool.WaitForCapacity(waitCtx), context.DeadlineExceeded)
+
+	close(store.release)
+	assert.NoError(t, pool.WaitForCapacity(ctx))
+	assert.False(t, pool.Saturated())
+}
+
+func TestWorkerPool_ShutdownGivesUpAtDeadline(t *testing.T) {
+	store := &gatedStore{StatsStore: stream.NewInMemoryStats(), domain: "slow", release: make(chan struct{})}
+	recorder := &commitRecorder{}
+	pool := stream.NewWorkerPool(store, 1, 1, time.Hour).WithCommitter(recorder.commit)
+	pool.Start()
+	assert.NoError(t, pool.Dispatch(context.Background(), stream.Event{Domain: "slow"}, &kgo.Record{Topic: "t", Offset: 0}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, pool.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Empty(t, recorder.all())
+
+	// The workers finish in the background once the store recovers.
+	close(store.release)
+	assert.NoError(t, pool.Shutdown(context.Background()))
+	commits := recorder.all()
+	if assert.NotEmpty(t, commits) {
+		assert.Equal(t, int64(1), commits[len(commits)-1]["t"][0].Offset)
+	}
+}
@@ -1,17 +1,18 @@
 package stream
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"net/http"
-	"strings"
+	"os"
 	"time"
 
-	pb "github.com/joshua-daniels-red/go-backend-challenge/ch-8/proto"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/health"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/registry"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/sse"
 	"github.com/twmb/franz-go/pkg/kgo"
-	"google.golang.org/protobuf/proto"
 )
 
 type streamProducer interface {
@@ -41,22 +42,107 @@ func (r *realKafkaClient) Close() {
 	r.Client.Close()
 }
 
+// pinger is implemented by clients that can check broker connectivity.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
 var kafkaClientOverride streamProducer
 
 func SetKafkaClientForTest(p streamProducer) {
 	kafkaClientOverride = p
 }
 
-func StreamWikipediaEvents(ctx context.Context, broker string, wikipediaURL string, topic string) error {
+// ProducerConfig configures StreamWikipediaEvents.
+type ProducerConfig struct {
+	Broker    string
+	StreamURL string
+	Topic     string
+	// DeadLetterTopic receives events that cannot be parsed or published,
+	// with the original payload. Empty drops them.
+	DeadLetterTopic string
+	// MaxInFlight bounds how many records await delivery; 0 means
+	// DefaultMaxInFlight.
+	MaxInFlight int
+	// PartitionKey picks each record's key; empty means PartitionByNone.
+	PartitionKey PartitionKey
+	// Hostname goes into the producer-host header; empty means
+	// os.Hostname.
+	Hostname string
+	// Router picks each event's topic; nil sends all of them to Topic.
+	Router *Router
+	// Filter picks the events to publish; nil publishes all of them.
+	Filter *Filter
+	// Codec encodes events; nil means ProtobufCodec.
+	Codec Codec
+	// SchemaRegistryURL, when set, registers the codec's schema under the
+	// topic's value subject and frames every record with the schema id.
+	// Empty writes bare values.
+	SchemaRegistryURL string
+	// Health, when set, gets a "kafka" check that pings the brokers once
+	// the client exists.
+	Health *health.Checker
+	// Heartbeat, when set, beats for every event read from the stream.
+	Heartbeat *health.Heartbeat
+}
+
+// producerFlushTimeout bounds how long shutdown waits for buffered records.
+const producerFlushTimeout = 10 * time.Second
+
+// topicEncoders encodes each topic's records. With a schema registry, the
+// codec's schema is registered under every topic's own subject, as the
+// topic name strategy expects, the first time the topic is written to.
+// It is not safe for concurrent use.
+type topicEncoders struct {
+	codec   Codec
+	schemas *registry.Client
+	byTopic map[string]*Encoder
+}
+
+func newTopicEncoders(codec Codec) *topicEncoders {
+	return &topicEncoders{codec: codec, byTopic: make(map[string]*Encoder)}
+}
+
+func (e *topicEncoders) forTopic(ctx context.Context, topic string) (*Encoder, error) {
+	if e.schemas == nil {
+		topic = ""
+	}
+	if encoder, ok := e.byTopic[topic]; ok {
+		return encoder, nil
+	}
+	encoder := NewEncoder(e.codec)
+	if e.schemas != nil {
+		subject := registry.TopicSubject(topic)
+		id, err := e.schemas.Register(ctx, subject, e.codec.Schema())
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("🧾 Writing %s as %s with schema id %d", subject, e.codec.Name(), id)
+		encoder.WithSchemaID(id)
+	}
+	e.byTopic[topic] = encoder
+	return encoder, nil
+}
+
+// StreamWikipediaEvents publishes every valid RecentChange event that
+// passes cfg.Filter to the topic cfg.Router picks, cfg.Topic by default,
+// until ctx is cancelled, then flushes what is still buffered.
+func StreamWikipediaEvents(ctx context.Context, cfg ProducerConfig) error {
 	var client streamProducer
 	var err error
 
+	maxInFlight := cfg.MaxInFlight
+	if maxInFlight < 1 {
+		maxInFlight = DefaultMaxInFlight
+	}
+
 	if kafkaClientOverride != nil {
 		client = kafkaClientOverride
 	} else {
 		c, err := kgo.NewClient(
-			kgo.SeedBrokers(broker),
+			kgo.SeedBrokers(cfg.Broker),
 			kgo.ProducerLinger(100*time.Millisecond),
+			kgo.MaxBufferedRecords(maxInFlight),
 		)
 		if err != nil {
 			return err
@@ -64,90 +150,126 @@ func StreamWikipediaEvents(ctx context.Context, broker string, wikipediaURL stri
 		client = &realKafkaClient{Client: c}
 	}
 	defer client.Close()
+	if p, ok := client.(pinger); ok && cfg.Health != nil {
+		cfg.Health.WithCheck("kafka", p.Ping)
+	}
 
-	resp, err := http.Get(wikipediaURL)
-	if err != nil {
-		return err
+	codec := cfg.Codec
+	if codec == nil {
+		codec = ProtobufCodec{}
 	}
-	defer resp.Body.Close()
-
-	log.Println("🌐 Connected to Wikipedia stream. Streaming events...")
-	scanner := bufio.NewScanner(resp.Body)
-
-	for scanner.Scan() {
-		select {
-		case <-ctx.Done():
-			log.Println("🛑 Context cancelled, flushing pending messages before shutdown...")
-			client.Flush(context.Background()) // flush with fresh context
-			log.Println("✅ Producer flushed and shutting down.")
-			return nil
-		default:
-			line := scanner.Text()
-
-			if !strings.HasPrefix(line, "data: ") {
-				continue
+	encoders := newTopicEncoders(codec)
+	if cfg.SchemaRegistryURL != "" {
+		encoders.schemas = registry.NewClient(cfg.SchemaRegistryURL)
+		// Topics known up front are registered now, so a registry that
+		// is down stops the producer before it reads the stream.
+		topics := []string{cfg.Topic}
+		if cfg.Router != nil {
+			topics = append(topics, cfg.Router.Topics()...)
+		}
+		for _, topic := range topics {
+			if _, err := encoders.forTopic(ctx, topic); err != nil {
+				return err
 			}
+		}
+	}
 
-			var raw map[string]interface{}
-			if err := json.Unmarshal([]byte(line[6:]), &raw); err != nil {
-				log.Printf("❌ Skipping malformed JSON event: %v", err)
-				continue
-			}
+	hostname := cfg.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
 
-			metaMap, ok := raw["meta"].(map[string]interface{})
-			if !ok {
-				log.Println("❌ Skipping event: missing 'meta' field")
-				continue
-			}
+	publisher := NewPublisher(client, maxInFlight)
+	deadLetters := NewDeadLetterQueue(cfg.DeadLetterTopic, client.ProduceSync)
+	reject := func(reason DeadLetterReason, cause error, data string) {
+		if err := deadLetters.Send(ctx, NewRejectedEvent(reason, cause, []byte(data))); err != nil {
+			log.Printf("❌ Failed to dead-letter %s event: %v", reason, err)
+		}
+	}
 
-			domain, _ := metaMap["domain"].(string)
-			title, _ := raw["title"].(string)
-			user, _ := raw["user"].(string)
+	reader := sse.NewReader(cfg.StreamURL)
+	err = reader.Run(ctx, func(ev sse.Event) {
+		EventsConsumedFromStream.Inc()
+		if cfg.Heartbeat != nil {
+			cfg.Heartbeat.Beat()
+		}
 
-			if domain == "" || title == "" || user == "" {
-				pretty, _ := json.MarshalIndent(raw, "", "  ")
-				log.Printf("❌ Skipping event - missing field(s): domain='%s', title='%s', user='%s'\n⚠️ Full event:\n%s",
-					domain, title, user, pretty)
-				continue
-			}
+		var rc RecentChange
+		if err := json.Unmarshal([]byte(ev.Data), &rc); err != nil {
+			log.Printf("❌ Skipping malformed JSON event: %v", err)
+			reject(ReasonMalformedJSON, err, ev.Data)
+			return
+		}
 
-			event := Event{
-				Domain: domain,
-				Title:  title,
-				User:   user,
-			}
+		if rc.Meta == nil {
+			log.Println("❌ Skipping event: missing 'meta' field")
+			reject(ReasonMissingFields, errors.New("missing meta"), ev.Data)
+			return
+		}
 
-			protoEvent := &pb.Event{
-				Domain: event.Domain,
-				Title:  event.Title,
-				User:   event.User,
-			}
+		event := rc.Event()
+		if event.Domain == "" || event.Title == "" || event.User == "" {
+			log.Printf("❌ Skipping event - missing field(s): domain='%s', title='%s', user='%s'\n⚠️ Full event:\n%s",
+				event.Domain, event.Title, event.User, ev.Data)
+			reject(ReasonMissingFields, fmt.Errorf("domain=%q title=%q user=%q", event.Domain, event.Title, event.User), ev.Data)
+			return
+		}
 
-			data, err := proto.Marshal(protoEvent)
-			if err != nil {
-				log.Printf("❌ Failed to marshal protobuf: %v", err)
-				continue
+		if cfg.Filter != nil {
+			if ok, rule := cfg.Filter.Match(event); !ok {
+				EventsFiltered.WithLabelValues(rule).Inc()
+				return
 			}
+		}
 
-			record := &kgo.Record{
-				Topic: topic,
-				Value: data,
-			}
+		topic := cfg.Topic
+		if cfg.Router != nil {
+			topic = cfg.Router.Topic(event)
+		}
 
-			log.Printf("📦 Sending event to topic %s: %+v", topic, protoEvent)
-			err = client.ProduceSync(ctx, record)
-			if err != nil {
-				log.Printf("❌ Failed to produce message: %v", err)
-			} else {
-				log.Printf("✅ Produced message to topic %s", record.Topic)
-			}
+		encoder, err := encoders.forTopic(ctx, topic)
+		if err != nil {
+			log.Printf("❌ Failed to register the schema for %s: %v", topic, err)
+			reject(ReasonEncodeFailed, err, ev.Data)
+			return
+		}
+		data, err := encoder.Encode(event)
+		if err != nil {
+			log.Printf("❌ Failed to encode %s: %v", codec.Name(), err)
+			reject(ReasonEncodeFailed, err, ev.Data)
+			return
+		}
 
+		record := &kgo.Record{
+			Topic: topic,
+			Key:   cfg.PartitionKey.For(event),
+			Value: data,
+			Headers: RecordMetadata{
+				SchemaVersion: SchemaVersion,
+				ContentType:   codec.ContentType(),
+				ProducerHost:  hostname,
+				EventID:       rc.EventID(),
+				EventTime:     rc.EventTime(),
+			}.Headers(),
 		}
-	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("error reading stream: %v", err)
-	}
+		log.Printf("📦 Sending event to topic %s: %+v", topic, event)
+		if err := publisher.Publish(ctx, record); err != nil {
+			// Only a cancelled ctx stops Publish; the event is dropped
+			// like any other that arrives during shutdown.
+			log.Printf("❌ Dropping event during shutdown: %v", err)
+		}
+	})
 
-	return nil
+	// Flush even when the reader failed: everything already published
+	// should still reach the broker.
+	log.Printf("🛑 Flushing %d pending messages before shutdown...", publisher.InFlight())
+	flushCtx, cancel := context.WithTimeout(context.Background(), producerFlushTimeout)
+	defer cancel()
+	if flushErr := publisher.Flush(flushCtx); flushErr != nil {
+		log.Printf("❌ Flush incomplete, %d messages undelivered: %v", publisher.InFlight(), flushErr)
+	} else {
+		log.Println("✅ Producer flushed and shutting down.")
+	}
+	return err
 }
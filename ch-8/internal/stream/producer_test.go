@@ -1,19 +1,27 @@
 package stream_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/health"
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/registry"
 	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	pb "github.com/joshua-daniels-red/go-backend-challenge/ch-8/proto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"google.golang.org/protobuf/proto"
 )
 
 type mockProducer struct {
@@ -21,10 +29,11 @@ type mockProducer struct {
 	lock     sync.Mutex
 }
 
-func (m *mockProducer) Produce(_ context.Context, record *kgo.Record, _ func(*kgo.Record, error)) {
+func (m *mockProducer) Produce(_ context.Context, record *kgo.Record, cb func(*kgo.Record, error)) {
 	m.lock.Lock()
-	defer m.lock.Unlock()
 	m.produced = append(m.produced, record)
+	m.lock.Unlock()
+	cb(record, nil)
 }
 
 func (m *mockProducer) Close() {}
@@ -66,7 +75,26 @@ func TestStreamWikipediaEvents_Success(t *testing.T) {
 	}
 	eventJSON, _ := json.Marshal(event)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "data: %s\n", eventJSON)
+		fmt.Fprintf(w, "data: %s\n\n", eventJSON)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	mock := &mockProducer{}
+	stream.SetKafkaClientForTest(mock)
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{Broker: "broker", StreamURL: ts.URL, Topic: "test.topic"})
+	assert.NoError(t, err)
+	assert.Len(t, mock.produced, 1)
+}
+
+func TestStreamWikipediaEvents_CarriesBotFlag(t *testing.T) {
+	var compact bytes.Buffer
+	assert.NoError(t, json.Compact(&compact, []byte(recentChangeJSON)))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "data: %s\n\n", compact.String())
 	}))
 	defer ts.Close()
 
@@ -75,9 +103,16 @@ func TestStreamWikipediaEvents_Success(t *testing.T) {
 
 	mock := &mockProducer{}
 	stream.SetKafkaClientForTest(mock)
-	err := stream.StreamWikipediaEvents(ctx, "broker", ts.URL, "test.topic")
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{Broker: "broker", StreamURL: ts.URL, Topic: "test.topic"})
 	assert.NoError(t, err)
 	assert.Len(t, mock.produced, 1)
+
+	record := mock.produced[0]
+	var decoded pb.Event
+	assert.NoError(t, proto.Unmarshal(record.Value, &decoded))
+	assert.True(t, decoded.GetBot())
+	assert.Equal(t, "edit", decoded.GetType())
+	assert.Equal(t, int64(1234), decoded.GetId())
 }
 
 func TestStreamWikipediaEvents_ProduceError(t *testing.T) {
@@ -91,7 +126,7 @@ func TestStreamWikipediaEvents_ProduceError(t *testing.T) {
 	eventJSON, _ := json.Marshal(event)
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "data: %s\n", eventJSON)
+		fmt.Fprintf(w, "data: %s\n\n", eventJSON)
 	}))
 	defer ts.Close()
 
@@ -99,36 +134,51 @@ func TestStreamWikipediaEvents_ProduceError(t *testing.T) {
 	defer cancel()
 
 	stream.SetKafkaClientForTest(&mockProducerWithError{})
-	err := stream.StreamWikipediaEvents(ctx, "broker", ts.URL, "test.topic")
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{Broker: "broker", StreamURL: ts.URL, Topic: "test.topic"})
 	assert.NoError(t, err)
 }
 
 func TestStreamWikipediaEvents_MalformedJSON(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprint(w, "data: {bad json}\n")
+		fmt.Fprint(w, "data: {bad json}\n\n")
 	}))
 	defer ts.Close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
 	defer cancel()
 
-	stream.SetKafkaClientForTest(&mockProducer{})
-	err := stream.StreamWikipediaEvents(ctx, "fake", ts.URL, "test.topic")
+	mock := &mockProducer{}
+	stream.SetKafkaClientForTest(mock)
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{Broker: "fake", StreamURL: ts.URL, Topic: "test.topic", DeadLetterTopic: "test.dlq"})
 	assert.NoError(t, err)
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	if assert.NotEmpty(t, mock.produced) {
+		record := mock.produced[0]
+		assert.Equal(t, "test.dlq", record.Topic)
+		assert.Equal(t, "{bad json}", string(record.Value))
+
+		d, err := stream.ParseDeadLetter(record)
+		assert.NoError(t, err)
+		assert.Equal(t, stream.ReasonMalformedJSON, d.Reason)
+		assert.NotEmpty(t, d.Err)
+		assert.Equal(t, int32(-1), d.SourcePartition)
+	}
 }
 
 func TestStreamWikipediaEvents_BadConnection(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
 	defer cancel()
 
-	err := stream.StreamWikipediaEvents(ctx, "fake", "http://127.0.0.1:0", "test.topic")
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{Broker: "fake", StreamURL: "http://127.0.0.1:0", Topic: "test.topic"})
 	assert.Error(t, err)
 }
 
 func TestStreamWikipediaEvents_GracefulShutdown(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(100 * time.Millisecond)
-		fmt.Fprint(w, "data: {}\n")
+		fmt.Fprint(w, "data: {}\n\n")
 	}))
 	defer ts.Close()
 
@@ -136,7 +186,7 @@ func TestStreamWikipediaEvents_GracefulShutdown(t *testing.T) {
 	stream.SetKafkaClientForTest(&mockProducer{})
 	cancel()
 
-	err := stream.StreamWikipediaEvents(ctx, "unused", ts.URL, "test.topic")
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{Broker: "unused", StreamURL: ts.URL, Topic: "test.topic"})
 	assert.NoError(t, err)
 }
 
@@ -148,13 +198,13 @@ func TestStreamWikipediaEvents_ShutdownMidScan(t *testing.T) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "data: %s\n", data)
+		fmt.Fprintf(w, "data: %s\n\n", data)
 		time.AfterFunc(50*time.Millisecond, cancel)
 	}))
 	defer ts.Close()
 
 	stream.SetKafkaClientForTest(&mockProducer{})
-	err := stream.StreamWikipediaEvents(ctx, "unused", ts.URL, "test.topic")
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{Broker: "unused", StreamURL: ts.URL, Topic: "test.topic"})
 	assert.NoError(t, err)
 }
 
@@ -165,14 +215,14 @@ func TestStreamWikipediaEvents_MissingMeta(t *testing.T) {
 	data, _ := json.Marshal(payload)
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "data: %s\n", data)
+		fmt.Fprintf(w, "data: %s\n\n", data)
 	}))
 	defer ts.Close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 	stream.SetKafkaClientForTest(&mockProducer{})
-	_ = stream.StreamWikipediaEvents(ctx, "unused", ts.URL, "test.topic")
+	_ = stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{Broker: "unused", StreamURL: ts.URL, Topic: "test.topic"})
 }
 
 func TestStreamWikipediaEvents_IncompleteFields(t *testing.T) {
@@ -182,14 +232,24 @@ func TestStreamWikipediaEvents_IncompleteFields(t *testing.T) {
 	data, _ := json.Marshal(payload)
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "data: %s\n", data)
+		fmt.Fprintf(w, "data: %s\n\n", data)
 	}))
 	defer ts.Close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
-	stream.SetKafkaClientForTest(&mockProducer{})
-	_ = stream.StreamWikipediaEvents(ctx, "unused", ts.URL, "test.topic")
+	mock := &mockProducer{}
+	stream.SetKafkaClientForTest(mock)
+	_ = stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{Broker: "unused", StreamURL: ts.URL, Topic: "test.topic", DeadLetterTopic: "test.dlq"})
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	if assert.NotEmpty(t, mock.produced) {
+		d, err := stream.ParseDeadLetter(mock.produced[0])
+		assert.NoError(t, err)
+		assert.Equal(t, stream.ReasonMissingFields, d.Reason)
+		assert.Equal(t, string(data), string(d.Value))
+	}
 }
 
 type errReader struct{}
@@ -208,6 +268,8 @@ func TestStreamWikipediaEvents_ScannerError(t *testing.T) {
 	}))
 	defer ts.Close()
 
+	originalClient := http.DefaultClient
+	t.Cleanup(func() { http.DefaultClient = originalClient })
 	http.DefaultClient = &http.Client{
 		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
 			resp, err := http.DefaultTransport.RoundTrip(req)
@@ -222,7 +284,7 @@ func TestStreamWikipediaEvents_ScannerError(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 	stream.SetKafkaClientForTest(&mockProducer{})
-	err := stream.StreamWikipediaEvents(ctx, "unused", ts.URL, "test.topic")
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{Broker: "unused", StreamURL: ts.URL, Topic: "test.topic"})
 	assert.NoError(t, err)
 }
 
@@ -231,3 +293,330 @@ type roundTripperFunc func(req *http.Request) (*http.Response, error)
 func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
 	return f(req)
 }
+
+// slowAckProducer acknowledges records asynchronously and counts them.
+type slowAckProducer struct {
+	latencyProducer
+	produced, delivered atomic.Int64
+}
+
+func (s *slowAckProducer) Produce(ctx context.Context, record *kgo.Record, cb func(*kgo.Record, error)) {
+	s.produced.Add(1)
+	s.latencyProducer.Produce(ctx, record, func(r *kgo.Record, err error) {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if err == nil {
+			s.delivered.Add(1)
+		}
+		cb(r, err)
+	})
+}
+
+func TestStreamWikipediaEvents_ShutdownFlushesBufferedRecords(t *testing.T) {
+	event := map[string]interface{}{
+		"title": "T", "user": "U", "meta": map[string]interface{}{"domain": "D"},
+	}
+	data, _ := json.Marshal(event)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		w.(http.Flusher).Flush()
+		time.AfterFunc(10*time.Millisecond, cancel)
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	producer := &slowAckProducer{latencyProducer: latencyProducer{latency: 50 * time.Millisecond}}
+	stream.SetKafkaClientForTest(producer)
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{Broker: "unused", StreamURL: ts.URL, Topic: "test.topic"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(5), producer.produced.Load())
+	assert.Equal(t, int64(5), producer.delivered.Load(), "records buffered at shutdown are delivered, not failed")
+}
+
+func TestStreamWikipediaEvents_KeysAndHeaders(t *testing.T) {
+	var compact bytes.Buffer
+	assert.NoError(t, json.Compact(&compact, []byte(recentChangeJSON)))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "data: %s\n\n", compact.String())
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	mock := &mockProducer{}
+	stream.SetKafkaClientForTest(mock)
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{
+		StreamURL:    ts.URL,
+		Topic:        "test.topic",
+		PartitionKey: stream.PartitionByUser,
+		Hostname:     "producer-0",
+	})
+	assert.NoError(t, err)
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	if !assert.NotEmpty(t, mock.produced) {
+		return
+	}
+	record := mock.produced[0]
+	assert.Equal(t, []byte("alice"), record.Key)
+
+	meta, err := stream.ParseRecordMetadata(record.Headers)
+	assert.NoError(t, err)
+	assert.Equal(t, stream.RecordMetadata{
+		SchemaVersion: stream.SchemaVersion,
+		ContentType:   stream.ContentTypeProtobuf,
+		ProducerHost:  "producer-0",
+		EventID:       "1234",
+		EventTime:     time.Unix(1700000000, 0).UTC(),
+	}, meta)
+}
+
+func TestStreamWikipediaEvents_FramesRecordsWithRegisteredSchema(t *testing.T) {
+	var compact bytes.Buffer
+	assert.NoError(t, json.Compact(&compact, []byte(recentChangeJSON)))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "data: %s\n\n", compact.String())
+	}))
+	defer ts.Close()
+
+	var registered map[string]string
+	reg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/subjects/test.topic-value/versions", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&registered))
+		fmt.Fprint(w, `{"id": 7}`)
+	}))
+	defer reg.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	mock := &mockProducer{}
+	stream.SetKafkaClientForTest(mock)
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{
+		StreamURL:         ts.URL,
+		Topic:             "test.topic",
+		SchemaRegistryURL: reg.URL,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "PROTOBUF", registered["schemaType"])
+	assert.Equal(t, pb.EventSchema, registered["schema"])
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	if !assert.NotEmpty(t, mock.produced) {
+		return
+	}
+	id, indexes, payload, err := registry.ParseProtobufFrame(mock.produced[0].Value)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, id)
+	assert.Equal(t, pb.EventMessageIndexes, indexes)
+	var event pb.Event
+	assert.NoError(t, proto.Unmarshal(payload, &event))
+	assert.Equal(t, "alice", event.User)
+}
+
+func TestStreamWikipediaEvents_RegistersSchemaPerRoutedTopic(t *testing.T) {
+	human, _ := json.Marshal(map[string]interface{}{
+		"title": "T", "user": "bob", "wiki": "dewiki", "meta": map[string]interface{}{"domain": "de.wikipedia.org"},
+	})
+	var bot bytes.Buffer
+	assert.NoError(t, json.Compact(&bot, []byte(recentChangeJSON)))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "data: %s\n\ndata: %s\n\n", bot.String(), human)
+	}))
+	defer ts.Close()
+
+	var (
+		mu       sync.Mutex
+		subjects []string
+	)
+	reg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions")
+		subjects = append(subjects, subject)
+		fmt.Fprintf(w, `{"id": %d}`, len(subjects))
+	}))
+	defer reg.Close()
+
+	router, err := stream.ParseRoutes(`bot => wikipedia.bots; => wikipedia.{wiki}`, "test.topic")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	mock := &mockProducer{}
+	stream.SetKafkaClientForTest(mock)
+	assert.NoError(t, stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{
+		StreamURL:         ts.URL,
+		Topic:             "test.topic",
+		Router:            router,
+		SchemaRegistryURL: reg.URL,
+	}))
+
+	mu.Lock()
+	assert.Equal(t, []string{"test.topic-value", "wikipedia.bots-value", "wikipedia.dewiki-value"}, subjects,
+		"fixed topics are registered up front, templated ones on first use, each once")
+	mu.Unlock()
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	ids := make(map[string]int)
+	for _, r := range mock.produced {
+		id, _, _, err := registry.ParseProtobufFrame(r.Value)
+		assert.NoError(t, err)
+		ids[r.Topic] = id
+	}
+	assert.Equal(t, map[string]int{"wikipedia.bots": 2, "wikipedia.dewiki": 3}, ids)
+}
+
+func TestStreamWikipediaEvents_RegistryUnavailable(t *testing.T) {
+	reg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer reg.Close()
+
+	stream.SetKafkaClientForTest(&mockProducer{})
+	err := stream.StreamWikipediaEvents(context.Background(), stream.ProducerConfig{
+		StreamURL:         "http://unused",
+		Topic:             "test.topic",
+		SchemaRegistryURL: reg.URL,
+	})
+	assert.ErrorContains(t, err, "register schema")
+}
+
+func TestStreamWikipediaEvents_UsesConfiguredCodec(t *testing.T) {
+	var compact bytes.Buffer
+	assert.NoError(t, json.Compact(&compact, []byte(recentChangeJSON)))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "data: %s\n\n", compact.String())
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	mock := &mockProducer{}
+	stream.SetKafkaClientForTest(mock)
+	err := stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{
+		StreamURL: ts.URL,
+		Topic:     "test.topic",
+		Codec:     stream.JSONCodec{},
+	})
+	assert.NoError(t, err)
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	if !assert.NotEmpty(t, mock.produced) {
+		return
+	}
+	event, meta, _, err := stream.NewDecoder().Decode(context.Background(), mock.produced[0])
+	assert.NoError(t, err)
+	assert.Equal(t, stream.ContentTypeJSON, meta.ContentType)
+	assert.Equal(t, "alice", event.User)
+	assert.Equal(t, byte('{'), mock.produced[0].Value[0])
+}
+
+func TestStreamWikipediaEvents_AppliesFilter(t *testing.T) {
+	human, _ := json.Marshal(map[string]interface{}{
+		"title": "T", "user": "bob", "meta": map[string]interface{}{"domain": "en.wikipedia.org"},
+	})
+	var bot bytes.Buffer
+	assert.NoError(t, json.Compact(&bot, []byte(recentChangeJSON)))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "data: %s\n\ndata: %s\n\n", bot.String(), human)
+	}))
+	defer ts.Close()
+
+	filter, err := stream.ParseFilter(`domain == "en.wikipedia.org" and not bot`)
+	assert.NoError(t, err)
+	filtered := testutil.ToFloat64(stream.EventsFiltered.WithLabelValues("not bot"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	mock := &mockProducer{}
+	stream.SetKafkaClientForTest(mock)
+	assert.NoError(t, stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{StreamURL: ts.URL, Topic: "test.topic", Filter: filter}))
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	if assert.Len(t, mock.produced, 1) {
+		event, _, _, err := stream.NewDecoder().Decode(context.Background(), mock.produced[0])
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", event.User)
+	}
+	assert.Equal(t, filtered+1, testutil.ToFloat64(stream.EventsFiltered.WithLabelValues("not bot")))
+}
+
+func TestStreamWikipediaEvents_RoutesToTopics(t *testing.T) {
+	human, _ := json.Marshal(map[string]interface{}{
+		"title": "T", "user": "bob", "type": "new", "meta": map[string]interface{}{"domain": "en.wikipedia.org"},
+	})
+	var bot bytes.Buffer
+	assert.NoError(t, json.Compact(&bot, []byte(recentChangeJSON)))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "data: %s\n\ndata: %s\n\n", bot.String(), human)
+	}))
+	defer ts.Close()
+
+	router, err := stream.ParseRoutes(`bot => wikipedia.bots; type == "new" => wikipedia.creations`, "test.topic")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	mock := &mockProducer{}
+	stream.SetKafkaClientForTest(mock)
+	assert.NoError(t, stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{StreamURL: ts.URL, Topic: "test.topic", Router: router}))
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	var topics []string
+	for _, r := range mock.produced {
+		topics = append(topics, r.Topic)
+	}
+	assert.Equal(t, []string{"wikipedia.bots", "wikipedia.creations"}, topics)
+}
+
+// pingingProducer is a mockProducer that can ping the brokers.
+type pingingProducer struct {
+	mockProducer
+	pingErr error
+}
+
+func (p *pingingProducer) Ping(context.Context) error {
+	return p.pingErr
+}
+
+func TestStreamWikipediaEvents_ReportsHealth(t *testing.T) {
+	var event bytes.Buffer
+	assert.NoError(t, json.Compact(&event, []byte(recentChangeJSON)))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "data: %s\n\n", event.String())
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	mock := &pingingProducer{pingErr: errors.New("connection refused")}
+	stream.SetKafkaClientForTest(mock)
+	checker := health.NewChecker()
+	heartbeat := &health.Heartbeat{}
+	assert.NoError(t, stream.StreamWikipediaEvents(ctx, stream.ProducerConfig{
+		StreamURL: ts.URL,
+		Topic:     "test.topic",
+		Health:    checker,
+		Heartbeat: heartbeat,
+	}))
+
+	assert.False(t, heartbeat.Last().IsZero(), "no heartbeat for a stream event")
+	report := checker.Run(context.Background())
+	assert.Equal(t, "connection refused", report.Checks["kafka"].Error)
+}
@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// DefaultMaxInFlight bounds how many records a Publisher lets the client
+// buffer before Publish blocks.
+const DefaultMaxInFlight = 1000
+
+// Publisher produces records asynchronously so the client can batch them
+// within its linger window. At most maxInFlight records await delivery at a
+// time; each delivery callback updates the produce metrics and frees a slot.
+type Publisher struct {
+	client   streamProducer
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewPublisher(client streamProducer, maxInFlight int) *Publisher {
+	if maxInFlight < 1 {
+		maxInFlight = DefaultMaxInFlight
+	}
+	return &Publisher{client: client, inFlight: make(chan struct{}, maxInFlight)}
+}
+
+// Publish hands record to the client and returns without waiting for the
+// broker. It blocks while maxInFlight records are outstanding and gives up
+// with ctx's error if ctx ends first.
+//
+// The record is produced on a context that is never cancelled: kgo fails
+// buffered records whose context ends, and a shutdown should flush them, not
+// drop them.
+func (p *Publisher) Publish(ctx context.Context, record *kgo.Record) error {
+	select {
+	case p.inFlight <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.wg.Add(1)
+	ProducerInFlight.Inc()
+	p.client.Produce(context.WithoutCancel(ctx), record, p.onDelivery)
+	return nil
+}
+
+func (p *Publisher) onDelivery(record *kgo.Record, err error) {
+	defer func() {
+		<-p.inFlight
+		ProducerInFlight.Dec()
+		p.wg.Done()
+	}()
+	if err != nil {
+		EventsFailedToProduce.Inc()
+		log.Printf("❌ Failed to produce message to %s: %v", record.Topic, err)
+		return
+	}
+	EventsProducedToRedpanda.Inc()
+}
+
+// Flush waits until every published record has been delivered or failed.
+// It returns ctx's error if that takes longer than ctx allows.
+func (p *Publisher) Flush(ctx context.Context) error {
+	if err := p.client.Flush(ctx); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// InFlight is the number of records awaiting delivery.
+func (p *Publisher) InFlight() int {
+	return len(p.inFlight)
+}
@@ -0,0 +1,142 @@
+package stream_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// heldProducer keeps every delivery callback until release is called, like
+// a broker that has not acknowledged anything yet.
+type heldProducer struct {
+	mu       sync.Mutex
+	pending  []func()
+	produced atomic.Int64
+	ctxs     []context.Context
+	err      error
+}
+
+func (h *heldProducer) Produce(ctx context.Context, record *kgo.Record, cb func(*kgo.Record, error)) {
+	h.produced.Add(1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ctxs = append(h.ctxs, ctx)
+	err := h.err
+	h.pending = append(h.pending, func() { cb(record, err) })
+}
+
+func (h *heldProducer) release() {
+	h.mu.Lock()
+	pending := h.pending
+	h.pending = nil
+	h.mu.Unlock()
+	for _, deliver := range pending {
+		deliver()
+	}
+}
+
+func (h *heldProducer) ProduceSync(context.Context, *kgo.Record) error { return nil }
+func (h *heldProducer) Flush(context.Context) error                    { return nil }
+func (h *heldProducer) Close()                                         {}
+
+func TestPublisher_BoundsInFlightRecords(t *testing.T) {
+	producer := &heldProducer{}
+	publisher := stream.NewPublisher(producer, 2)
+
+	ctx := context.Background()
+	assert.NoError(t, publisher.Publish(ctx, &kgo.Record{}))
+	assert.NoError(t, publisher.Publish(ctx, &kgo.Record{}))
+	assert.Equal(t, 2, publisher.InFlight())
+
+	blocked, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, publisher.Publish(blocked, &kgo.Record{}), context.DeadlineExceeded)
+	assert.Equal(t, int64(2), producer.produced.Load())
+
+	producer.release()
+	assert.Equal(t, 0, publisher.InFlight())
+	assert.NoError(t, publisher.Publish(ctx, &kgo.Record{}))
+}
+
+func TestPublisher_ProducesOnUncancelledContext(t *testing.T) {
+	producer := &heldProducer{}
+	publisher := stream.NewPublisher(producer, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, publisher.Publish(ctx, &kgo.Record{}))
+	cancel()
+
+	assert.NoError(t, producer.ctxs[0].Err(), "a shutdown must not fail buffered records")
+}
+
+func TestPublisher_FlushWaitsForEveryCallback(t *testing.T) {
+	producer := &heldProducer{err: errors.New("record too large")}
+	publisher := stream.NewPublisher(producer, 10)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, publisher.Publish(context.Background(), &kgo.Record{}))
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, publisher.Flush(short), context.DeadlineExceeded)
+
+	time.AfterFunc(10*time.Millisecond, producer.release)
+	assert.NoError(t, publisher.Flush(context.Background()))
+	assert.Equal(t, 0, publisher.InFlight(), "failed deliveries free their slot too")
+}
+
+// latencyProducer acknowledges each record after a fixed broker round trip.
+// ProduceSync waits for it; Produce calls back from another goroutine, so
+// many records share the wait as they would share a linger batch.
+type latencyProducer struct {
+	latency time.Duration
+}
+
+func (l *latencyProducer) Produce(_ context.Context, record *kgo.Record, cb func(*kgo.Record, error)) {
+	time.AfterFunc(l.latency, func() { cb(record, nil) })
+}
+
+func (l *latencyProducer) ProduceSync(context.Context, *kgo.Record) error {
+	time.Sleep(l.latency)
+	return nil
+}
+
+func (l *latencyProducer) Flush(context.Context) error { return nil }
+func (l *latencyProducer) Close()                      {}
+
+const benchmarkLatency = time.Millisecond
+
+func BenchmarkProduce_Sync(b *testing.B) {
+	producer := &latencyProducer{latency: benchmarkLatency}
+	record := &kgo.Record{Topic: "bench", Value: []byte("event")}
+	ctx := context.Background()
+
+	for i := 0; i < b.N; i++ {
+		if err := producer.ProduceSync(ctx, record); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProduce_Async(b *testing.B) {
+	producer := &latencyProducer{latency: benchmarkLatency}
+	publisher := stream.NewPublisher(producer, stream.DefaultMaxInFlight)
+	record := &kgo.Record{Topic: "bench", Value: []byte("event")}
+	ctx := context.Background()
+
+	for i := 0; i < b.N; i++ {
+		if err := publisher.Publish(ctx, record); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := publisher.Flush(ctx); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,204 @@
+package stream
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Router picks the topic for each event from an ordered list of routes.
+// Routes are written one per line, or separated by semicolons:
+//
+//	bot => wikipedia.bots
+//	type == "new" => wikipedia.creations
+//	namespace == 0 => wikipedia.{wiki}
+//
+// The left side is a Filter expression, the right side a topic template.
+// The first route whose filter matches wins; an empty filter matches
+// everything. Events no route takes go to the default topic.
+//
+// A template may name any string or number field in braces, such as {wiki}
+// or {namespace}. Characters Kafka does not allow in topic names become
+// underscores. A route whose template would use an empty field is skipped.
+type Router struct {
+	routes       []route
+	defaultTopic string
+}
+
+type route struct {
+	filter *Filter
+	topic  topicTemplate
+}
+
+// ParseRoutes parses spec. An empty spec sends every event to
+// defaultTopic.
+func ParseRoutes(spec, defaultTopic string) (*Router, error) {
+	r := &Router{defaultTopic: defaultTopic}
+	for i, line := range splitRoutes(spec) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		arrow := strings.LastIndex(line, "=>")
+		if arrow < 0 {
+			return nil, fmt.Errorf("route %d %q: want <filter> => <topic>", i+1, line)
+		}
+		filter, err := ParseFilter(line[:arrow])
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i+1, err)
+		}
+		topic, err := parseTopicTemplate(strings.TrimSpace(line[arrow+2:]))
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i+1, err)
+		}
+		r.routes = append(r.routes, route{filter: filter, topic: topic})
+	}
+	return r, nil
+}
+
+// splitRoutes splits spec on newlines and on semicolons outside quoted
+// strings.
+func splitRoutes(spec string) []string {
+	var lines []string
+	start, quoted := 0, false
+	for i := 0; i < len(spec); i++ {
+		switch c := spec[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case (c == ';' && !quoted) || c == '\n':
+			lines = append(lines, spec[start:i])
+			start = i + 1
+		}
+	}
+	return append(lines, spec[start:])
+}
+
+// Topic returns the topic event is published to.
+func (r *Router) Topic(event Event) string {
+	for _, rt := range r.routes {
+		if ok, _ := rt.filter.Match(event); !ok {
+			continue
+		}
+		if topic, ok := rt.topic.render(event); ok {
+			return topic
+		}
+	}
+	return r.defaultTopic
+}
+
+// Topics lists the default topic, then every route topic that names no
+// field: all the topics known before any event arrives.
+func (r *Router) Topics() []string {
+	topics := []string{r.defaultTopic}
+	for _, rt := range r.routes {
+		if len(rt.topic.fields) > 0 {
+			continue
+		}
+		if topic := rt.topic.parts[0]; !slices.Contains(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// String lists the routes in canonical form, ending with the default.
+func (r *Router) String() string {
+	var parts []string
+	for _, rt := range r.routes {
+		parts = append(parts, strings.TrimSpace(rt.filter.String()+" => "+rt.topic.String()))
+	}
+	return strings.Join(append(parts, "=> "+r.defaultTopic), "; ")
+}
+
+// topicTemplate alternates literal text and field names: parts[0] is
+// text, parts[1] a field, parts[2] text and so on.
+type topicTemplate struct {
+	parts  []string
+	fields []filterField
+}
+
+func parseTopicTemplate(s string) (topicTemplate, error) {
+	if s == "" {
+		return topicTemplate{}, fmt.Errorf("empty topic")
+	}
+	var t topicTemplate
+	rest := s
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.parts = append(t.parts, rest)
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return topicTemplate{}, fmt.Errorf("topic %q: unclosed {", s)
+		}
+		name := rest[open+1 : open+end]
+		field, ok := filterFields[name]
+		if !ok || field.kind == kindBool {
+			return topicTemplate{}, fmt.Errorf("topic %q: unknown field {%s}", s, name)
+		}
+		t.parts = append(t.parts, rest[:open], name)
+		t.fields = append(t.fields, field)
+		rest = rest[open+end+1:]
+	}
+	for i := 0; i < len(t.parts); i += 2 {
+		if strings.ContainsAny(t.parts[i], "{}") || !validTopicName(t.parts[i]) {
+			return topicTemplate{}, fmt.Errorf("topic %q: only letters, digits, '.', '_' and '-' are allowed", s)
+		}
+	}
+	return t, nil
+}
+
+func (t topicTemplate) render(event Event) (string, bool) {
+	var b strings.Builder
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+			continue
+		}
+		v := t.fields[i/2].get(event)
+		value := v.s
+		if v.kind == kindNumber {
+			value = strconv.FormatInt(v.n, 10)
+		}
+		if value == "" {
+			return "", false
+		}
+		b.WriteString(sanitizeTopicName(value))
+	}
+	return b.String(), true
+}
+
+func (t topicTemplate) String() string {
+	var b strings.Builder
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+		} else {
+			b.WriteString("{" + part + "}")
+		}
+	}
+	return b.String()
+}
+
+func validTopicChar(c rune) bool {
+	return c == '.' || c == '_' || c == '-' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func validTopicName(s string) bool {
+	return strings.IndexFunc(s, func(c rune) bool { return !validTopicChar(c) }) < 0
+}
+
+func sanitizeTopicName(s string) string {
+	return strings.Map(func(c rune) rune {
+		if validTopicChar(c) {
+			return c
+		}
+		return '_'
+	}, s)
+}
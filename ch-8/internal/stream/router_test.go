@@ -0,0 +1,76 @@
+package stream_test
+
+import (
+	"testing"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/stretchr/testify/assert"
+)
+
+const exampleRoutes = `
+bot => wikipedia.bots
+type == "new" => wikipedia.creations
+=> wikipedia.{wiki}
+`
+
+func TestRouter_FirstMatchingRouteWins(t *testing.T) {
+	r, err := stream.ParseRoutes(exampleRoutes, "wikipedia.protobuf")
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		event stream.Event
+		topic string
+	}{
+		{stream.Event{Bot: true, Type: "new", Wiki: "enwiki"}, "wikipedia.bots"},
+		{stream.Event{Type: "new", Wiki: "enwiki"}, "wikipedia.creations"},
+		{stream.Event{Type: "edit", Wiki: "dewiki"}, "wikipedia.dewiki"},
+		{stream.Event{Type: "edit"}, "wikipedia.protobuf"},
+	} {
+		assert.Equal(t, tc.topic, r.Topic(tc.event), "%+v", tc.event)
+	}
+}
+
+func TestRouter_Templates(t *testing.T) {
+	r, err := stream.ParseRoutes(`namespace > 0 => talk.{namespace}; => {domain}`, "default")
+	assert.NoError(t, err)
+	assert.Equal(t, "talk.1", r.Topic(stream.Event{Namespace: 1}))
+	assert.Equal(t, "en.wikipedia.org", r.Topic(stream.Event{Domain: "en.wikipedia.org"}))
+	assert.Equal(t, "commons_wiki_", r.Topic(stream.Event{Domain: "commons/wiki!"}), "invalid characters are replaced")
+}
+
+func TestRouter_SemicolonsInStrings(t *testing.T) {
+	r, err := stream.ParseRoutes(`user == "a;b" => semi; user == "q\"x;" => quoted`, "default")
+	assert.NoError(t, err)
+	assert.Equal(t, "semi", r.Topic(stream.Event{User: "a;b"}))
+	assert.Equal(t, "quoted", r.Topic(stream.Event{User: `q"x;`}))
+	assert.Equal(t, `user == "a;b" => semi; user == "q\"x;" => quoted; => default`, r.String())
+}
+
+func TestRouter_EmptySpec(t *testing.T) {
+	r, err := stream.ParseRoutes("  \n", "wikipedia.protobuf")
+	assert.NoError(t, err)
+	assert.Equal(t, "wikipedia.protobuf", r.Topic(stream.Event{Bot: true}))
+}
+
+func TestRouter_Topics(t *testing.T) {
+	r, err := stream.ParseRoutes(exampleRoutes+"minor => wikipedia.bots", "wikipedia.protobuf")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"wikipedia.protobuf", "wikipedia.bots", "wikipedia.creations"}, r.Topics(),
+		"templated topics are unknown until an event arrives")
+}
+
+func TestParseRoutes_Errors(t *testing.T) {
+	for spec, msg := range map[string]string{
+		`bot wikipedia.bots`:    "want <filter> => <topic>",
+		`bot =>`:                "empty topic",
+		`bot == => x`:           "route 1: filter",
+		`bot => a; => {colour}`: "route 2",
+		`=> {bot}`:              "unknown field {bot}",
+		`=> wikipedia.{wiki`:    "unclosed {",
+		`=> wikipedia/bots`:     "only letters, digits",
+		`=> wikipedia.}{wiki}`:  "only letters, digits",
+	} {
+		_, err := stream.ParseRoutes(spec, "default")
+		assert.ErrorContains(t, err, msg, spec)
+	}
+}
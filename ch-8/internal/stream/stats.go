@@ -1,69 +1,215 @@
 package stream
 
 import (
+	"context"
 	"sync"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/hll"
 )
 
 // Snapshot represents an aggregate view of stats
 type StatsSnapshot struct {
-	ByDomain map[string]int `json:"by_domain"`
-	ByUser   map[string]int `json:"by_user"`
+	Messages int `json:"messages"`
+	// DistinctUsers is a HyperLogLog estimate; DistinctUsersStdError is its
+	// relative standard error, e.g. 0.0081 for ±0.81%.
+	DistinctUsers         int            `json:"distinct_users"`
+	DistinctUsersStdError float64        `json:"distinct_users_std_error"`
+	DistinctUsersByDomain map[string]int `json:"distinct_users_by_domain"`
+	Bots                  int            `json:"bots"`
+	NonBots               int            `json:"non_bots"`
+
+	ByServerURL map[string]int `json:"by_server_url"`
+	ByDomain    map[string]int `json:"by_domain"`
+	ByUser      map[string]int `json:"by_user"`
+	ByType      map[string]int `json:"by_type"`
+	ByNamespace map[int]int    `json:"by_namespace"`
+	ByWiki      map[string]int `json:"by_wiki"`
 }
 
-// StatsStore defines an interface for tracking and retrieving stats
+// StatsStore defines an interface for tracking and retrieving stats.
+// Implementations backed by a database return an error when a write or read
+// did not complete, so callers never treat lost data as durable. A write
+// that was partly applied returns a *PartialWriteError, so callers retry
+// only the rest.
 type StatsStore interface {
-	Record(event Event)
-	RecordMany([]Event)
-	GetSnapshot() StatsSnapshot
+	Record(ctx context.Context, event Event) error
+	RecordMany(ctx context.Context, events []Event) error
+	GetSnapshot(ctx context.Context) (StatsSnapshot, error)
+	GetTimeSeries(ctx context.Context, q SeriesQuery) (TimeSeries, error)
+}
+
+// PartialWriteError is returned by a RecordMany that applied part of a
+// batch before failing. Writing the whole batch again would count that part
+// twice, so callers call Resume instead, which writes only the rest and may
+// itself return a *PartialWriteError.
+type PartialWriteError struct {
+	Err    error
+	Resume func(ctx context.Context) error
+}
+
+func (e *PartialWriteError) Error() string {
+	return "partially written: " + e.Err.Error()
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// Default number of buckets InMemoryStats keeps per granularity: two hours
+// of minutes, two days of hours and a month of days.
+var defaultRetention = map[Granularity]int{
+	GranularityMinute: 120,
+	GranularityHour:   48,
+	GranularityDay:    30,
 }
 
 type InMemoryStats struct {
-	mu       sync.RWMutex
-	domainCt map[string]int
-	userCt   map[string]int
+	mu          sync.RWMutex
+	total       int
+	botCt       int
+	nonBotCt    int
+	serverCt    map[string]int
+	domainCt    map[string]int
+	userCt      map[string]int
+	typeCt      map[string]int
+	namespaceCt map[int]int
+	wikiCt      map[string]int
+	users       *hll.Sketch
+	domainUsers map[string]*hll.Sketch
+	buckets     map[Granularity]*bucketRing
+	now         func() time.Time
 }
 
 func NewInMemoryStats() *InMemoryStats {
-	return &InMemoryStats{
-		domainCt: make(map[string]int),
-		userCt:   make(map[string]int),
+	s := &InMemoryStats{
+		serverCt:    make(map[string]int),
+		domainCt:    make(map[string]int),
+		userCt:      make(map[string]int),
+		typeCt:      make(map[string]int),
+		namespaceCt: make(map[int]int),
+		wikiCt:      make(map[string]int),
+		users:       hll.New(),
+		domainUsers: make(map[string]*hll.Sketch),
+		buckets:     make(map[Granularity]*bucketRing),
+		now:         time.Now,
 	}
+	for g, n := range defaultRetention {
+		s.buckets[g] = newBucketRing(g, n)
+	}
+	return s
 }
 
-func (s *InMemoryStats) Record(event Event) {
+// WithRetention keeps the last n buckets of granularity g. Older buckets read
+// back as empty. It discards buckets already recorded at that granularity.
+func (s *InMemoryStats) WithRetention(g Granularity, n int) *InMemoryStats {
+	if n < 1 {
+		n = 1
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.buckets[g] = newBucketRing(g, n)
+	return s
+}
 
-	s.domainCt[event.Domain]++
-	s.userCt[event.User]++
+func (s *InMemoryStats) Record(_ context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.record(event, s.now())
+	return nil
 }
 
-func (s *InMemoryStats) RecordMany(events []Event) {
+func (s *InMemoryStats) RecordMany(_ context.Context, events []Event) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	now := s.now()
 	for _, event := range events {
-		s.domainCt[event.Domain]++
-		s.userCt[event.User]++
+		s.record(event, now)
 	}
+	return nil
 }
 
-func (s *InMemoryStats) GetSnapshot() StatsSnapshot {
+// record must be called with s.mu held.
+func (s *InMemoryStats) record(event Event, now time.Time) {
+	s.total++
+	if event.Bot {
+		s.botCt++
+	} else {
+		s.nonBotCt++
+	}
+	if event.ServerURL != "" {
+		s.serverCt[event.ServerURL]++
+	}
+	s.domainCt[event.Domain]++
+	s.userCt[event.User]++
+	s.users.Add(event.User)
+	domainUsers, ok := s.domainUsers[event.Domain]
+	if !ok {
+		domainUsers = hll.New()
+		s.domainUsers[event.Domain] = domainUsers
+	}
+	domainUsers.Add(event.User)
+	if event.Type != "" {
+		s.typeCt[event.Type]++
+	}
+	s.namespaceCt[event.Namespace]++
+	if event.Wiki != "" {
+		s.wikiCt[event.Wiki]++
+	}
+
+	at := eventTime(event, now)
+	for _, ring := range s.buckets {
+		ring.add(event, at)
+	}
+}
+
+func (s *InMemoryStats) GetSnapshot(_ context.Context) (StatsSnapshot, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	domainCopy := make(map[string]int, len(s.domainCt))
-	for k, v := range s.domainCt {
-		domainCopy[k] = v
+	byDomain := make(map[string]int, len(s.domainUsers))
+	for domain, sketch := range s.domainUsers {
+		byDomain[domain] = int(sketch.Estimate())
 	}
 
-	userCopy := make(map[string]int, len(s.userCt))
-	for k, v := range s.userCt {
-		userCopy[k] = v
+	return StatsSnapshot{
+		Messages:              s.total,
+		DistinctUsers:         int(s.users.Estimate()),
+		DistinctUsersStdError: s.users.StdError(),
+		DistinctUsersByDomain: byDomain,
+		Bots:                  s.botCt,
+		NonBots:               s.nonBotCt,
+		ByServerURL:           copyCounts(s.serverCt),
+		ByDomain:              copyCounts(s.domainCt),
+		ByUser:                copyCounts(s.userCt),
+		ByType:                copyCounts(s.typeCt),
+		ByNamespace:           copyCounts(s.namespaceCt),
+		ByWiki:                copyCounts(s.wikiCt),
+	}, nil
+}
+
+func (s *InMemoryStats) GetTimeSeries(_ context.Context, q SeriesQuery) (TimeSeries, error) {
+	if err := q.Validate(); err != nil {
+		return TimeSeries{}, err
 	}
 
-	return StatsSnapshot{
-		ByDomain: domainCopy,
-		ByUser:   userCopy,
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	series := TimeSeries{Granularity: q.Granularity, From: q.From, To: q.To}
+	ring := s.buckets[q.Granularity]
+	for _, start := range q.Buckets() {
+		series.Buckets = append(series.Buckets, ring.get(start))
+	}
+	return series, nil
+}
+
+func copyCounts[K comparable](src map[K]int) map[K]int {
+	dst := make(map[K]int, len(src))
+	for k, v := range src {
+		dst[k] = v
 	}
+	return dst
 }
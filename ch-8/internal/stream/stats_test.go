@@ -1,13 +1,22 @@
 package stream_test
 
 import (
+	"context"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
 	"github.com/stretchr/testify/assert"
 )
 
+func snapshotOf(t *testing.T, store stream.StatsStore) stream.StatsSnapshot {
+	t.Helper()
+	snapshot, err := store.GetSnapshot(context.Background())
+	assert.NoError(t, err)
+	return snapshot
+}
+
 func TestNewInMemoryStats(t *testing.T) {
 	store := stream.NewInMemoryStats()
 	assert.NotNil(t, store)
@@ -20,9 +29,9 @@ func TestInMemoryStats_RecordSingleEvent(t *testing.T) {
 		Domain: "en.wikipedia.org",
 		User:   "alice",
 	}
-	store.Record(event)
+	store.Record(context.Background(), event)
 
-	snapshot := store.GetSnapshot()
+	snapshot := snapshotOf(t, store)
 	assert.Equal(t, 1, snapshot.ByDomain["en.wikipedia.org"])
 	assert.Equal(t, 1, snapshot.ByUser["alice"])
 }
@@ -37,10 +46,10 @@ func TestInMemoryStats_RecordMultipleEvents(t *testing.T) {
 	}
 
 	for _, e := range events {
-		store.Record(e)
+		store.Record(context.Background(), e)
 	}
 
-	snapshot := store.GetSnapshot()
+	snapshot := snapshotOf(t, store)
 	assert.Equal(t, 2, snapshot.ByUser["alice"])
 	assert.Equal(t, 1, snapshot.ByUser["bob"])
 	assert.Equal(t, 2, snapshot.ByDomain["en.wikipedia.org"])
@@ -50,15 +59,15 @@ func TestInMemoryStats_RecordMultipleEvents(t *testing.T) {
 func TestInMemoryStats_SnapshotIsCopy(t *testing.T) {
 	store := stream.NewInMemoryStats()
 
-	store.Record(stream.Event{Domain: "test.com", User: "user1"})
-	snapshot := store.GetSnapshot()
+	store.Record(context.Background(), stream.Event{Domain: "test.com", User: "user1"})
+	snapshot := snapshotOf(t, store)
 
 	// Modify snapshot
 	snapshot.ByDomain["test.com"] = 999
 	snapshot.ByUser["user1"] = 999
 
 	// Get new snapshot and ensure original data is unchanged
-	newSnapshot := store.GetSnapshot()
+	newSnapshot := snapshotOf(t, store)
 	assert.Equal(t, 1, newSnapshot.ByDomain["test.com"])
 	assert.Equal(t, 1, newSnapshot.ByUser["user1"])
 }
@@ -72,9 +81,9 @@ func TestInMemoryStats_RecordMany(t *testing.T) {
 		{Domain: "de.wikipedia.org", User: "alice"},
 	}
 
-	store.RecordMany(events)
+	store.RecordMany(context.Background(), events)
 
-	snapshot := store.GetSnapshot()
+	snapshot := snapshotOf(t, store)
 	assert.Equal(t, 2, snapshot.ByUser["alice"])
 	assert.Equal(t, 1, snapshot.ByUser["bob"])
 	assert.Equal(t, 2, snapshot.ByDomain["en.wikipedia.org"])
@@ -95,13 +104,13 @@ func TestInMemoryStats_ConcurrentWrites(t *testing.T) {
 		go func() {
 			defer wg.Done()
 			for _, e := range events {
-				store.Record(e)
+				store.Record(context.Background(), e)
 			}
 		}()
 	}
 	wg.Wait()
 
-	snapshot := store.GetSnapshot()
+	snapshot := snapshotOf(t, store)
 	total := snapshot.ByUser["alice"] + snapshot.ByUser["bob"] + snapshot.ByUser["charlie"]
 	assert.Equal(t, 10*len(events), total)
 }
@@ -118,13 +127,137 @@ func TestInMemoryStats_ConcurrentRecordMany(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			store.RecordMany(events)
+			store.RecordMany(context.Background(), events)
 		}()
 	}
 	wg.Wait()
 
-	snapshot := store.GetSnapshot()
+	snapshot := snapshotOf(t, store)
 	assert.Equal(t, 10*2, snapshot.ByUser["alice"]+snapshot.ByUser["bob"])
 	assert.Equal(t, 10, snapshot.ByDomain["en.wikipedia.org"])
 	assert.Equal(t, 10, snapshot.ByDomain["de.wikipedia.org"])
 }
+
+func TestInMemoryStats_RecordsNewDimensions(t *testing.T) {
+	store := stream.NewInMemoryStats()
+
+	store.RecordMany(context.Background(), []stream.Event{
+		{Domain: "en.wikipedia.org", User: "alice", Type: "edit", Namespace: 0, Wiki: "enwiki"},
+		{Domain: "en.wikipedia.org", User: "bob", Type: "new", Namespace: 0, Wiki: "enwiki"},
+		{Domain: "commons.wikimedia.org", User: "carol", Type: "log", Namespace: 6, Wiki: "commonswiki"},
+	})
+
+	snapshot := snapshotOf(t, store)
+	assert.Equal(t, map[string]int{"edit": 1, "new": 1, "log": 1}, snapshot.ByType)
+	assert.Equal(t, map[int]int{0: 2, 6: 1}, snapshot.ByNamespace)
+	assert.Equal(t, map[string]int{"enwiki": 2, "commonswiki": 1}, snapshot.ByWiki)
+}
+
+func TestInMemoryStats_TotalsBotsAndDistinctUsers(t *testing.T) {
+	store := stream.NewInMemoryStats()
+
+	store.RecordMany(context.Background(), []stream.Event{
+		{Domain: "en.wikipedia.org", User: "alice", ServerURL: "https://en.wikipedia.org"},
+		{Domain: "en.wikipedia.org", User: "alice", ServerURL: "https://en.wikipedia.org"},
+		{Domain: "de.wikipedia.org", User: "InternetArchiveBot", Bot: true, ServerURL: "https://de.wikipedia.org"},
+	})
+
+	snapshot := snapshotOf(t, store)
+	assert.Equal(t, 3, snapshot.Messages)
+	assert.Equal(t, 2, snapshot.DistinctUsers)
+	assert.Equal(t, 1, snapshot.Bots)
+	assert.Equal(t, 2, snapshot.NonBots)
+	assert.Equal(t, map[string]int{"https://en.wikipedia.org": 2, "https://de.wikipedia.org": 1}, snapshot.ByServerURL)
+}
+
+func TestInMemoryStats_GetTimeSeries(t *testing.T) {
+	store := stream.NewInMemoryStats()
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.NoError(t, store.RecordMany(context.Background(), []stream.Event{
+		{Domain: "en.wikipedia.org", User: "alice", Timestamp: base.Add(10 * time.Second).Unix()},
+		{Domain: "en.wikipedia.org", User: "bot", Bot: true, Timestamp: base.Add(50 * time.Second).Unix()},
+		{Domain: "de.wikipedia.org", User: "alice", Timestamp: base.Add(2*time.Minute + time.Second).Unix()},
+	}))
+
+	series, err := store.GetTimeSeries(context.Background(), stream.SeriesQuery{
+		Granularity: stream.GranularityMinute,
+		From:        base,
+		To:          base.Add(3 * time.Minute),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, series.Buckets, 3)
+
+	first := series.Buckets[0]
+	assert.Equal(t, base, first.Start)
+	assert.Equal(t, 2, first.Messages)
+	assert.Equal(t, 1, first.Bots)
+	assert.Equal(t, 2, first.ByDomain["en.wikipedia.org"])
+
+	assert.Equal(t, 0, series.Buckets[1].Messages)
+	assert.Equal(t, 1, series.Buckets[2].ByDomain["de.wikipedia.org"])
+
+	hours, err := store.GetTimeSeries(context.Background(), stream.SeriesQuery{
+		Granularity: stream.GranularityHour,
+		From:        base,
+		To:          base.Add(time.Hour),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, hours.Buckets[0].Messages)
+	assert.Equal(t, 2, hours.Buckets[0].ByUser["alice"])
+}
+
+func TestInMemoryStats_GetTimeSeries_RingEvictsOldBuckets(t *testing.T) {
+	store := stream.NewInMemoryStats().WithRetention(stream.GranularityMinute, 2)
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		ts := base.Add(time.Duration(i) * time.Minute).Unix()
+		assert.NoError(t, store.Record(context.Background(), stream.Event{Domain: "a", User: "u", Timestamp: ts}))
+	}
+	// Late event for a bucket the ring has already dropped.
+	assert.NoError(t, store.Record(context.Background(), stream.Event{Domain: "a", User: "u", Timestamp: base.Unix()}))
+
+	series, err := store.GetTimeSeries(context.Background(), stream.SeriesQuery{
+		Granularity: stream.GranularityMinute,
+		From:        base,
+		To:          base.Add(3 * time.Minute),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 1}, []int{series.Buckets[0].Messages, series.Buckets[1].Messages, series.Buckets[2].Messages})
+	assert.Equal(t, 4, snapshotOf(t, store).Messages)
+}
+
+func TestInMemoryStats_GetTimeSeries_InvalidQuery(t *testing.T) {
+	store := stream.NewInMemoryStats()
+	now := time.Now()
+
+	_, err := store.GetTimeSeries(context.Background(), stream.SeriesQuery{Granularity: stream.GranularityMinute, From: now, To: now})
+	assert.ErrorIs(t, err, stream.ErrInvalidRange)
+}
+
+func TestInMemoryStats_DistinctUsersEstimate(t *testing.T) {
+	store := stream.NewInMemoryStats()
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.NoError(t, store.RecordMany(context.Background(), []stream.Event{
+		{Domain: "en.wikipedia.org", User: "alice", Timestamp: base.Unix()},
+		{Domain: "en.wikipedia.org", User: "bob", Timestamp: base.Unix()},
+		{Domain: "en.wikipedia.org", User: "alice", Timestamp: base.Unix()},
+		{Domain: "de.wikipedia.org", User: "alice", Timestamp: base.Add(time.Hour).Unix()},
+	}))
+
+	snapshot := snapshotOf(t, store)
+	assert.Equal(t, 2, snapshot.DistinctUsers)
+	assert.InDelta(t, 0.0081, snapshot.DistinctUsersStdError, 0.0001)
+	assert.Equal(t, map[string]int{"en.wikipedia.org": 2, "de.wikipedia.org": 1}, snapshot.DistinctUsersByDomain)
+
+	series, err := store.GetTimeSeries(context.Background(), stream.SeriesQuery{
+		Granularity: stream.GranularityHour,
+		From:        base,
+		To:          base.Add(2 * time.Hour),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, series.Buckets[0].DistinctUsers)
+	assert.Equal(t, 1, series.Buckets[1].DistinctUsers)
+}
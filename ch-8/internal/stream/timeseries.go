@@ -0,0 +1,199 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/hll"
+)
+
+// Granularity is the width of a time bucket.
+type Granularity string
+
+const (
+	GranularityMinute Granularity = "minute"
+	GranularityHour   Granularity = "hour"
+	GranularityDay    Granularity = "day"
+)
+
+// Granularities lists every bucket width a store maintains.
+var Granularities = []Granularity{GranularityMinute, GranularityHour, GranularityDay}
+
+// MaxSeriesBuckets caps how many buckets a single query may span, e.g. one
+// day of minutes.
+const MaxSeriesBuckets = 1440
+
+var (
+	ErrUnknownGranularity = errors.New("unknown granularity")
+	ErrInvalidRange       = errors.New("invalid time range")
+)
+
+func ParseGranularity(s string) (Granularity, error) {
+	for _, g := range Granularities {
+		if string(g) == s {
+			return g, nil
+		}
+	}
+	return "", fmt.Errorf("%w %q: want minute, hour or day", ErrUnknownGranularity, s)
+}
+
+func (g Granularity) Duration() time.Duration {
+	switch g {
+	case GranularityHour:
+		return time.Hour
+	case GranularityDay:
+		return 24 * time.Hour
+	default:
+		return time.Minute
+	}
+}
+
+// Truncate returns the start of the bucket containing t. Days are UTC days.
+func (g Granularity) Truncate(t time.Time) time.Time {
+	return t.UTC().Truncate(g.Duration())
+}
+
+// SeriesQuery selects the buckets of one granularity whose start lies in
+// [From, To).
+type SeriesQuery struct {
+	Granularity Granularity
+	From        time.Time
+	To          time.Time
+}
+
+func (q SeriesQuery) Validate() error {
+	if _, err := ParseGranularity(string(q.Granularity)); err != nil {
+		return err
+	}
+	if !q.From.Before(q.To) {
+		return fmt.Errorf("%w: from must be before to", ErrInvalidRange)
+	}
+	if n := len(q.Buckets()); n > MaxSeriesBuckets {
+		return fmt.Errorf("%w: %d %s buckets exceeds the limit of %d", ErrInvalidRange, n, q.Granularity, MaxSeriesBuckets)
+	}
+	return nil
+}
+
+// Buckets returns the start of every bucket the query covers, oldest first.
+func (q SeriesQuery) Buckets() []time.Time {
+	step := q.Granularity.Duration()
+	var starts []time.Time
+	for t := q.Granularity.Truncate(q.From); t.Before(q.To); t = t.Add(step) {
+		starts = append(starts, t)
+		if len(starts) > MaxSeriesBuckets {
+			break
+		}
+	}
+	return starts
+}
+
+// SeriesBucket holds the counts for events whose timestamp falls in
+// [Start, Start+granularity).
+type SeriesBucket struct {
+	Start    time.Time `json:"start"`
+	Messages int       `json:"messages"`
+	// DistinctUsers is a HyperLogLog estimate with the same relative
+	// standard error as StatsSnapshot.DistinctUsersStdError.
+	DistinctUsers int            `json:"distinct_users"`
+	Bots          int            `json:"bots"`
+	NonBots       int            `json:"non_bots"`
+	ByDomain      map[string]int `json:"by_domain"`
+	ByUser        map[string]int `json:"by_user"`
+
+	// users is allocated on the first event so empty buckets stay small.
+	users *hll.Sketch
+}
+
+func newSeriesBucket(start time.Time) SeriesBucket {
+	return SeriesBucket{
+		Start:    start,
+		ByDomain: make(map[string]int),
+		ByUser:   make(map[string]int),
+	}
+}
+
+func (b *SeriesBucket) add(event Event) {
+	b.Messages++
+	if event.Bot {
+		b.Bots++
+	} else {
+		b.NonBots++
+	}
+	b.ByDomain[event.Domain]++
+	b.ByUser[event.User]++
+	if b.users == nil {
+		b.users = hll.New()
+	}
+	b.users.Add(event.User)
+}
+
+// TimeSeries is the answer to a SeriesQuery. Every bucket in the range is
+// present, including empty ones.
+type TimeSeries struct {
+	Granularity Granularity    `json:"granularity"`
+	From        time.Time      `json:"from"`
+	To          time.Time      `json:"to"`
+	Buckets     []SeriesBucket `json:"buckets"`
+}
+
+// eventTime is when the change happened on the wiki. Events from producers
+// that predate the timestamp field are bucketed at now.
+func eventTime(event Event, now time.Time) time.Time {
+	if event.Timestamp > 0 {
+		return time.Unix(event.Timestamp, 0).UTC()
+	}
+	return now.UTC()
+}
+
+// bucketRing keeps the most recent len(slots) buckets of one granularity.
+// A slot is reused once its bucket falls out of the window.
+type bucketRing struct {
+	granularity Granularity
+	slots       []SeriesBucket
+}
+
+func newBucketRing(g Granularity, size int) *bucketRing {
+	return &bucketRing{granularity: g, slots: make([]SeriesBucket, size)}
+}
+
+func (r *bucketRing) slot(start time.Time) *SeriesBucket {
+	n := start.Unix() / int64(r.granularity.Duration()/time.Second)
+	size := int64(len(r.slots))
+	return &r.slots[(n%size+size)%size]
+}
+
+func (r *bucketRing) add(event Event, at time.Time) {
+	start := r.granularity.Truncate(at)
+	s := r.slot(start)
+	switch {
+	case s.Start.Equal(start):
+	case s.Start.IsZero() || s.Start.Before(start):
+		*s = newSeriesBucket(start)
+	default:
+		// Older than everything the ring still holds.
+		return
+	}
+	s.add(event)
+}
+
+// get returns a copy of the bucket starting at start, or an empty bucket if
+// the ring no longer (or never) held it.
+func (r *bucketRing) get(start time.Time) SeriesBucket {
+	s := r.slot(start)
+	if !s.Start.Equal(start) {
+		return newSeriesBucket(start)
+	}
+	b := SeriesBucket{
+		Start:    s.Start,
+		Messages: s.Messages,
+		Bots:     s.Bots,
+		NonBots:  s.NonBots,
+		ByDomain: copyCounts(s.ByDomain),
+		ByUser:   copyCounts(s.ByUser),
+	}
+	if s.users != nil {
+		b.DistinctUsers = int(s.users.Estimate())
+	}
+	return b
+}
@@ -0,0 +1,54 @@
+package stream_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGranularity(t *testing.T) {
+	for _, s := range []string{"minute", "hour", "day"} {
+		g, err := stream.ParseGranularity(s)
+		assert.NoError(t, err)
+		assert.Equal(t, stream.Granularity(s), g)
+	}
+
+	_, err := stream.ParseGranularity("week")
+	assert.ErrorIs(t, err, stream.ErrUnknownGranularity)
+}
+
+func TestGranularity_Truncate(t *testing.T) {
+	ts := time.Date(2025, 6, 1, 23, 59, 30, 0, time.FixedZone("CEST", 2*60*60))
+
+	assert.Equal(t, time.Date(2025, 6, 1, 21, 59, 0, 0, time.UTC), stream.GranularityMinute.Truncate(ts))
+	assert.Equal(t, time.Date(2025, 6, 1, 21, 0, 0, 0, time.UTC), stream.GranularityHour.Truncate(ts))
+	assert.Equal(t, time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), stream.GranularityDay.Truncate(ts))
+}
+
+func TestSeriesQuery_Buckets(t *testing.T) {
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	q := stream.SeriesQuery{
+		Granularity: stream.GranularityHour,
+		From:        base.Add(30 * time.Minute),
+		To:          base.Add(2*time.Hour + time.Minute),
+	}
+
+	assert.Equal(t, []time.Time{base, base.Add(time.Hour), base.Add(2 * time.Hour)}, q.Buckets())
+}
+
+func TestSeriesQuery_Validate(t *testing.T) {
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.NoError(t, stream.SeriesQuery{Granularity: stream.GranularityDay, From: base, To: base.Add(time.Hour)}.Validate())
+
+	err := stream.SeriesQuery{Granularity: "week", From: base, To: base.Add(time.Hour)}.Validate()
+	assert.ErrorIs(t, err, stream.ErrUnknownGranularity)
+
+	err = stream.SeriesQuery{Granularity: stream.GranularityMinute, From: base, To: base.Add(-time.Minute)}.Validate()
+	assert.ErrorIs(t, err, stream.ErrInvalidRange)
+
+	err = stream.SeriesQuery{Granularity: stream.GranularityMinute, From: base, To: base.Add(48 * time.Hour)}.Validate()
+	assert.ErrorIs(t, err, stream.ErrInvalidRange)
+}
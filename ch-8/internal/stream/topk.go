@@ -0,0 +1,237 @@
+package stream
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// SpaceSaving tracks the most frequent keys of a stream in bounded memory
+// (Metwally et al., "Efficient Computation of Frequent and Top-k Elements in
+// Data Streams"). It keeps at most capacity counters. When a new key arrives
+// and all counters are taken, it evicts the smallest counter and inherits
+// its count as the new key's error.
+//
+// Over a stream of N observations, a reported count overestimates the true
+// count by at most its MaxError, which is never more than N/capacity, and any
+// key seen more than N/capacity times is always tracked.
+//
+// SpaceSaving is not safe for concurrent use.
+type SpaceSaving struct {
+	capacity int
+	total    int64
+	index    map[string]*ssCounter
+	counters ssHeap
+}
+
+type ssCounter struct {
+	key   string
+	count int64
+	err   int64
+	pos   int
+}
+
+func NewSpaceSaving(capacity int) *SpaceSaving {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &SpaceSaving{
+		capacity: capacity,
+		index:    make(map[string]*ssCounter, capacity),
+		counters: make(ssHeap, 0, capacity),
+	}
+}
+
+// Add records n observations of key.
+func (s *SpaceSaving) Add(key string, n int64) {
+	s.total += n
+	if c, ok := s.index[key]; ok {
+		c.count += n
+		heap.Fix(&s.counters, c.pos)
+		return
+	}
+	if len(s.counters) < s.capacity {
+		c := &ssCounter{key: key, count: n}
+		s.index[key] = c
+		heap.Push(&s.counters, c)
+		return
+	}
+
+	smallest := s.counters[0]
+	delete(s.index, smallest.key)
+	smallest.key, smallest.err, smallest.count = key, smallest.count, smallest.count+n
+	s.index[key] = smallest
+	heap.Fix(&s.counters, 0)
+}
+
+// HeavyHitter is one entry of a top-k answer. Count - MaxError <= true
+// count <= Count. Guaranteed is set when the key is certainly among the
+// top k, i.e. its lower bound is at least the next entry's upper bound.
+type HeavyHitter struct {
+	Key        string `json:"key"`
+	Count      int64  `json:"count"`
+	MaxError   int64  `json:"max_error"`
+	Guaranteed bool   `json:"guaranteed"`
+}
+
+// TopK is the answer to a top-k query.
+type TopK struct {
+	Items []HeavyHitter `json:"items"`
+	// Total is the number of observations the sketch has seen.
+	Total int64 `json:"total"`
+	// Capacity is how many counters the sketch keeps.
+	Capacity int `json:"capacity"`
+	// ErrorBound caps MaxError for every item: Total/Capacity.
+	ErrorBound int64 `json:"error_bound"`
+}
+
+// Top returns the k keys with the highest counts, highest first.
+func (s *SpaceSaving) Top(k int) TopK {
+	sorted := make([]*ssCounter, len(s.counters))
+	copy(sorted, s.counters)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].key < sorted[j].key
+	})
+
+	if k > len(sorted) {
+		k = len(sorted)
+	}
+	// A key we never tracked may still have up to the smallest count once
+	// the sketch is full.
+	var next int64
+	if k < len(sorted) {
+		next = sorted[k].count
+	} else if len(s.counters) == s.capacity && len(s.counters) > 0 {
+		next = s.counters[0].count
+	}
+
+	top := TopK{
+		Items:      make([]HeavyHitter, 0, k),
+		Total:      s.total,
+		Capacity:   s.capacity,
+		ErrorBound: s.total / int64(s.capacity),
+	}
+	for _, c := range sorted[:k] {
+		top.Items = append(top.Items, HeavyHitter{
+			Key:        c.key,
+			Count:      c.count,
+			MaxError:   c.err,
+			Guaranteed: c.count-c.err >= next,
+		})
+	}
+	return top
+}
+
+// ssHeap is a min-heap of counters by count.
+type ssHeap []*ssCounter
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *ssHeap) Push(x interface{}) {
+	c := x.(*ssCounter)
+	c.pos = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *ssHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// TopDimension names what a top-k query ranks.
+type TopDimension string
+
+const (
+	TopUsers   TopDimension = "users"
+	TopDomains TopDimension = "domains"
+)
+
+var ErrInvalidK = errors.New("invalid k")
+
+// TopKStats wraps a StatsStore and feeds every event it durably records
+// into per-user and per-domain SpaceSaving sketches. The sketches live in
+// this process, so they cover the events it has recorded since it started.
+type TopKStats struct {
+	StatsStore
+
+	mu      sync.Mutex
+	users   *SpaceSaving
+	domains *SpaceSaving
+}
+
+// NewTopKStats keeps capacity counters per dimension. Larger capacities
+// tighten the error bound at the cost of memory.
+func NewTopKStats(store StatsStore, capacity int) *TopKStats {
+	return &TopKStats{
+		StatsStore: store,
+		users:      NewSpaceSaving(capacity),
+		domains:    NewSpaceSaving(capacity),
+	}
+}
+
+func (t *TopKStats) Record(ctx context.Context, event Event) error {
+	return t.RecordMany(ctx, []Event{event})
+}
+
+// RecordMany only counts events once the wrapped store has accepted them,
+// so a retried batch is not counted twice.
+func (t *TopKStats) RecordMany(ctx context.Context, events []Event) error {
+	return t.countWritten(t.StatsStore.RecordMany(ctx, events), events)
+}
+
+// countWritten counts events if err says the wrapped store wrote them. For
+// a partial write it counts them once Resume has written the rest.
+func (t *TopKStats) countWritten(err error, events []Event) error {
+	var partial *PartialWriteError
+	if errors.As(err, &partial) {
+		return &PartialWriteError{Err: partial.Err, Resume: func(ctx context.Context) error {
+			return t.countWritten(partial.Resume(ctx), events)
+		}}
+	}
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, event := range events {
+		t.users.Add(event.User, 1)
+		t.domains.Add(event.Domain, 1)
+	}
+	return nil
+}
+
+// Top returns the k heaviest keys of dim. k must be between 1 and the
+// sketch capacity; beyond that the counts carry no guarantee.
+func (t *TopKStats) Top(dim TopDimension, k int) (TopK, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var sketch *SpaceSaving
+	switch dim {
+	case TopUsers:
+		sketch = t.users
+	case TopDomains:
+		sketch = t.domains
+	default:
+		return TopK{}, fmt.Errorf("unknown top-k dimension %q", dim)
+	}
+	if k < 1 || k > sketch.capacity {
+		return TopK{}, fmt.Errorf("%w: %d, want 1..%d", ErrInvalidK, k, sketch.capacity)
+	}
+	return sketch.Top(k), nil
+}
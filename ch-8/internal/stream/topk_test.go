@@ -0,0 +1,120 @@
+package stream_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpaceSaving_ExactBelowCapacity(t *testing.T) {
+	s := stream.NewSpaceSaving(10)
+	for _, key := range []string{"a", "b", "a", "c", "a", "b"} {
+		s.Add(key, 1)
+	}
+
+	top := s.Top(2)
+	assert.Equal(t, int64(6), top.Total)
+	assert.Equal(t, []stream.HeavyHitter{
+		{Key: "a", Count: 3, Guaranteed: true},
+		{Key: "b", Count: 2, Guaranteed: true},
+	}, top.Items)
+}
+
+func TestSpaceSaving_EvictionCarriesError(t *testing.T) {
+	s := stream.NewSpaceSaving(2)
+	s.Add("a", 5)
+	s.Add("b", 2)
+	s.Add("c", 1) // evicts b and inherits its count
+
+	top := s.Top(2)
+	assert.Equal(t, stream.HeavyHitter{Key: "a", Count: 5, Guaranteed: true}, top.Items[0])
+	assert.Equal(t, stream.HeavyHitter{Key: "c", Count: 3, MaxError: 2}, top.Items[1])
+	assert.Equal(t, int64(4), top.ErrorBound)
+}
+
+func TestSpaceSaving_HeadIsAccurateOnSkewedStream(t *testing.T) {
+	const capacity = 100
+	s := stream.NewSpaceSaving(capacity)
+	truth := make(map[string]int64)
+	rng := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(rng, 1.2, 1, 50000)
+
+	for i := 0; i < 200000; i++ {
+		key := fmt.Sprintf("user%d", zipf.Uint64())
+		truth[key]++
+		s.Add(key, 1)
+	}
+
+	top := s.Top(10)
+	assert.Len(t, top.Items, 10)
+	for _, item := range top.Items {
+		assert.LessOrEqual(t, item.MaxError, top.ErrorBound)
+		assert.GreaterOrEqual(t, item.Count, truth[item.Key])
+		assert.LessOrEqual(t, item.Count-item.MaxError, truth[item.Key])
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, fmt.Sprintf("user%d", i), top.Items[i].Key)
+		assert.True(t, top.Items[i].Guaranteed)
+	}
+}
+
+type failingStore struct{ stream.StatsStore }
+
+func (failingStore) RecordMany(context.Context, []stream.Event) error {
+	return errors.New("write timeout")
+}
+
+func TestTopKStats_CountsOnlyRecordedEvents(t *testing.T) {
+	ok := stream.NewTopKStats(stream.NewInMemoryStats(), 10)
+	assert.NoError(t, ok.RecordMany(context.Background(), []stream.Event{
+		{Domain: "en.wikipedia.org", User: "alice"},
+		{Domain: "en.wikipedia.org", User: "bob"},
+	}))
+	assert.NoError(t, ok.Record(context.Background(), stream.Event{Domain: "de.wikipedia.org", User: "alice"}))
+
+	users, err := ok.Top(stream.TopUsers, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", users.Items[0].Key)
+	domains, err := ok.Top(stream.TopDomains, 5)
+	assert.NoError(t, err)
+	assert.Len(t, domains.Items, 2)
+	assert.Equal(t, 3, snapshotOf(t, ok).Messages)
+
+	failing := stream.NewTopKStats(failingStore{}, 10)
+	assert.Error(t, failing.Record(context.Background(), stream.Event{Domain: "x", User: "y"}))
+	users, err = failing.Top(stream.TopUsers, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, users.Items)
+}
+
+func TestTopKStats_CountsAPartialWriteOnceResumed(t *testing.T) {
+	s := stream.NewTopKStats(&partialStore{InMemoryStats: stream.NewInMemoryStats()}, 10)
+
+	err := s.RecordMany(context.Background(), []stream.Event{{Domain: "a", User: "alice"}, {Domain: "a", User: "bob"}})
+	var partial *stream.PartialWriteError
+	if !assert.ErrorAs(t, err, &partial) {
+		return
+	}
+	users, _ := s.Top(stream.TopUsers, 5)
+	assert.Empty(t, users.Items)
+
+	assert.NoError(t, partial.Resume(context.Background()))
+	users, _ = s.Top(stream.TopUsers, 5)
+	assert.Len(t, users.Items, 2)
+}
+
+func TestTopKStats_InvalidK(t *testing.T) {
+	s := stream.NewTopKStats(stream.NewInMemoryStats(), 10)
+
+	for _, k := range []int{0, 11} {
+		_, err := s.Top(stream.TopUsers, k)
+		assert.ErrorIs(t, err, stream.ErrInvalidK)
+	}
+	_, err := s.Top("titles", 1)
+	assert.Error(t, err)
+}
@@ -1,7 +1,154 @@
 package stream
 
+import (
+	"strconv"
+	"time"
+
+	pb "github.com/joshua-daniels-red/go-backend-challenge/ch-8/proto"
+)
+
 type Event struct {
 	Domain string `json:"domain"`
 	Title  string `json:"title"`
 	User   string `json:"user"`
+
+	ID          int64  `json:"id"`
+	Type        string `json:"type"`
+	Namespace   int    `json:"namespace"`
+	Timestamp   int64  `json:"timestamp"`
+	Wiki        string `json:"wiki"`
+	ServerURL   string `json:"server_url"`
+	Bot         bool   `json:"bot"`
+	Minor       bool   `json:"minor"`
+	LengthOld   int64  `json:"length_old"`
+	LengthNew   int64  `json:"length_new"`
+	RevisionOld int64  `json:"revision_old"`
+	RevisionNew int64  `json:"revision_new"`
+
+	// EventID comes from the record's event-id header rather than the
+	// payload; it is empty for records from producers without headers.
+	EventID string `json:"event_id,omitempty"`
+}
+
+// RecentChange mirrors the subset of the Wikimedia RecentChange JSON schema
+// the producer cares about.
+type RecentChange struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	Namespace int    `json:"namespace"`
+	Title     string `json:"title"`
+	User      string `json:"user"`
+	Bot       bool   `json:"bot"`
+	Minor     bool   `json:"minor"`
+	Timestamp int64  `json:"timestamp"`
+	Wiki      string `json:"wiki"`
+	ServerURL string `json:"server_url"`
+	Meta      *struct {
+		// ID is the event's UUID, unique per event across all streams.
+		ID     string `json:"id"`
+		Domain string `json:"domain"`
+		// Dt is the event time in RFC 3339.
+		Dt string `json:"dt"`
+	} `json:"meta"`
+	Length *struct {
+		Old int64 `json:"old"`
+		New int64 `json:"new"`
+	} `json:"length"`
+	Revision *struct {
+		Old int64 `json:"old"`
+		New int64 `json:"new"`
+	} `json:"revision"`
+}
+
+// Event flattens a RecentChange into the pipeline's Event.
+func (rc *RecentChange) Event() Event {
+	e := Event{
+		Title:     rc.Title,
+		User:      rc.User,
+		ID:        rc.ID,
+		Type:      rc.Type,
+		Namespace: rc.Namespace,
+		Timestamp: rc.Timestamp,
+		Wiki:      rc.Wiki,
+		ServerURL: rc.ServerURL,
+		Bot:       rc.Bot,
+		Minor:     rc.Minor,
+	}
+	if rc.Meta != nil {
+		e.Domain = rc.Meta.Domain
+	}
+	if rc.Length != nil {
+		e.LengthOld, e.LengthNew = rc.Length.Old, rc.Length.New
+	}
+	if rc.Revision != nil {
+		e.RevisionOld, e.RevisionNew = rc.Revision.Old, rc.Revision.New
+	}
+	return e
+}
+
+// EventID is the Wikimedia event UUID, or the RecentChange id for events
+// without one, or "" if the event has neither.
+func (rc *RecentChange) EventID() string {
+	if rc.Meta != nil && rc.Meta.ID != "" {
+		return rc.Meta.ID
+	}
+	if rc.ID != 0 {
+		return strconv.FormatInt(rc.ID, 10)
+	}
+	return ""
+}
+
+// EventTime is when the change happened: meta.dt, falling back to the
+// second-resolution timestamp, or the zero time if neither is set.
+func (rc *RecentChange) EventTime() time.Time {
+	if rc.Meta != nil && rc.Meta.Dt != "" {
+		if t, err := time.Parse(time.RFC3339, rc.Meta.Dt); err == nil {
+			return t.UTC()
+		}
+	}
+	if rc.Timestamp > 0 {
+		return time.Unix(rc.Timestamp, 0).UTC()
+	}
+	return time.Time{}
+}
+
+// ToProto converts the event into its wire representation.
+func (e Event) ToProto() *pb.Event {
+	return &pb.Event{
+		Domain:    e.Domain,
+		Title:     e.Title,
+		User:      e.User,
+		Id:        e.ID,
+		Type:      e.Type,
+		Namespace: int32(e.Namespace),
+		Timestamp: e.Timestamp,
+		Wiki:      e.Wiki,
+		ServerUrl: e.ServerURL,
+		Bot:       e.Bot,
+		Minor:     e.Minor,
+		Length:    &pb.Event_Length{Old: e.LengthOld, New: e.LengthNew},
+		Revision:  &pb.Event_Revision{Old: e.RevisionOld, New: e.RevisionNew},
+	}
+}
+
+// EventFromProto converts a wire event back into an Event. Fields missing
+// from older producers decode as zero values.
+func EventFromProto(p *pb.Event) Event {
+	return Event{
+		Domain:      p.GetDomain(),
+		Title:       p.GetTitle(),
+		User:        p.GetUser(),
+		ID:          p.GetId(),
+		Type:        p.GetType(),
+		Namespace:   int(p.GetNamespace()),
+		Timestamp:   p.GetTimestamp(),
+		Wiki:        p.GetWiki(),
+		ServerURL:   p.GetServerUrl(),
+		Bot:         p.GetBot(),
+		Minor:       p.GetMinor(),
+		LengthOld:   p.GetLength().GetOld(),
+		LengthNew:   p.GetLength().GetNew(),
+		RevisionOld: p.GetRevision().GetOld(),
+		RevisionNew: p.GetRevision().GetNew(),
+	}
 }
@@ -0,0 +1,96 @@
+package stream_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/joshua-daniels-red/go-backend-challenge/ch-8/internal/stream"
+	pb "github.com/joshua-daniels-red/go-backend-challenge/ch-8/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+const recentChangeJSON = `{
+	"id": 1234,
+	"type": "edit",
+	"namespace": 0,
+	"title": "Go (programming language)",
+	"user": "alice",
+	"bot": true,
+	"minor": true,
+	"timestamp": 1700000000,
+	"wiki": "enwiki",
+	"server_url": "https://en.wikipedia.org",
+	"meta": {"domain": "en.wikipedia.org"},
+	"length": {"old": 100, "new": 120},
+	"revision": {"old": 10, "new": 11}
+}`
+
+func TestRecentChange_Event(t *testing.T) {
+	var rc stream.RecentChange
+	assert.NoError(t, json.Unmarshal([]byte(recentChangeJSON), &rc))
+
+	assert.Equal(t, stream.Event{
+		Domain:      "en.wikipedia.org",
+		Title:       "Go (programming language)",
+		User:        "alice",
+		ID:          1234,
+		Type:        "edit",
+		Namespace:   0,
+		Timestamp:   1700000000,
+		Wiki:        "enwiki",
+		ServerURL:   "https://en.wikipedia.org",
+		Bot:         true,
+		Minor:       true,
+		LengthOld:   100,
+		LengthNew:   120,
+		RevisionOld: 10,
+		RevisionNew: 11,
+	}, rc.Event())
+}
+
+func TestEvent_ProtoRoundTrip(t *testing.T) {
+	var rc stream.RecentChange
+	assert.NoError(t, json.Unmarshal([]byte(recentChangeJSON), &rc))
+	event := rc.Event()
+
+	data, err := proto.Marshal(event.ToProto())
+	assert.NoError(t, err)
+
+	var decoded pb.Event
+	assert.NoError(t, proto.Unmarshal(data, &decoded))
+	assert.Equal(t, event, stream.EventFromProto(&decoded))
+}
+
+func TestEventFromProto_OldProducerPayload(t *testing.T) {
+	// Only the original three fields, as written by older producers.
+	data, err := proto.Marshal(&pb.Event{Domain: "en.wikipedia.org", Title: "T", User: "U"})
+	assert.NoError(t, err)
+
+	var decoded pb.Event
+	assert.NoError(t, proto.Unmarshal(data, &decoded))
+
+	assert.Equal(t, stream.Event{Domain: "en.wikipedia.org", Title: "T", User: "U"}, stream.EventFromProto(&decoded))
+}
+
+func TestRecentChange_EventIDAndTime(t *testing.T) {
+	var rc stream.RecentChange
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"id": 1234,
+		"timestamp": 1700000000,
+		"meta": {"id": "5d3a7c0e-uuid", "domain": "en.wikipedia.org", "dt": "2023-11-14T22:13:20.5Z"}
+	}`), &rc))
+	assert.Equal(t, "5d3a7c0e-uuid", rc.EventID())
+	assert.Equal(t, time.Date(2023, 11, 14, 22, 13, 20, 500000000, time.UTC), rc.EventTime())
+
+	// Older payloads without meta.id and meta.dt fall back to the rcid and
+	// the second-resolution timestamp.
+	var old stream.RecentChange
+	assert.NoError(t, json.Unmarshal([]byte(recentChangeJSON), &old))
+	assert.Equal(t, "1234", old.EventID())
+	assert.Equal(t, time.Unix(1700000000, 0).UTC(), old.EventTime())
+
+	assert.Equal(t, "", (&stream.RecentChange{}).EventID())
+	assert.True(t, (&stream.RecentChange{}).EventTime().IsZero())
+}
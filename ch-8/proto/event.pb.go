@@ -21,11 +21,28 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// Event is a trimmed-down Wikimedia RecentChange event.
+//
+// Fields 1-3 are the original schema; everything after was added later and
+// is optional on the wire, so older producers and consumers keep working.
 type Event struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Domain        string                 `protobuf:"bytes,1,opt,name=domain,proto3" json:"domain,omitempty"`
-	Title         string                 `protobuf:"bytes,2,opt,name=title,proto3" json:"title,omitempty"`
-	User          string                 `protobuf:"bytes,3,opt,name=user,proto3" json:"user,omitempty"`
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Domain string                 `protobuf:"bytes,1,opt,name=domain,proto3" json:"domain,omitempty"`
+	Title  string                 `protobuf:"bytes,2,opt,name=title,proto3" json:"title,omitempty"`
+	User   string                 `protobuf:"bytes,3,opt,name=user,proto3" json:"user,omitempty"`
+	// RecentChange event id (rcid).
+	Id int64 `protobuf:"varint,4,opt,name=id,proto3" json:"id,omitempty"`
+	// edit, new, log, categorize or external.
+	Type      string `protobuf:"bytes,5,opt,name=type,proto3" json:"type,omitempty"`
+	Namespace int32  `protobuf:"varint,6,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	// Unix timestamp in seconds.
+	Timestamp     int64           `protobuf:"varint,7,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Wiki          string          `protobuf:"bytes,8,opt,name=wiki,proto3" json:"wiki,omitempty"`
+	ServerUrl     string          `protobuf:"bytes,9,opt,name=server_url,json=serverUrl,proto3" json:"server_url,omitempty"`
+	Bot           bool            `protobuf:"varint,10,opt,name=bot,proto3" json:"bot,omitempty"`
+	Minor         bool            `protobuf:"varint,11,opt,name=minor,proto3" json:"minor,omitempty"`
+	Length        *Event_Length   `protobuf:"bytes,12,opt,name=length,proto3" json:"length,omitempty"`
+	Revision      *Event_Revision `protobuf:"bytes,13,opt,name=revision,proto3" json:"revision,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -81,15 +98,207 @@ func (x *Event) GetUser() string {
 	return ""
 }
 
+func (x *Event) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Event) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Event) GetNamespace() int32 {
+	if x != nil {
+		return x.Namespace
+	}
+	return 0
+}
+
+func (x *Event) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Event) GetWiki() string {
+	if x != nil {
+		return x.Wiki
+	}
+	return ""
+}
+
+func (x *Event) GetServerUrl() string {
+	if x != nil {
+		return x.ServerUrl
+	}
+	return ""
+}
+
+func (x *Event) GetBot() bool {
+	if x != nil {
+		return x.Bot
+	}
+	return false
+}
+
+func (x *Event) GetMinor() bool {
+	if x != nil {
+		return x.Minor
+	}
+	return false
+}
+
+func (x *Event) GetLength() *Event_Length {
+	if x != nil {
+		return x.Length
+	}
+	return nil
+}
+
+func (x *Event) GetRevision() *Event_Revision {
+	if x != nil {
+		return x.Revision
+	}
+	return nil
+}
+
+type Event_Length struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Old           int64                  `protobuf:"varint,1,opt,name=old,proto3" json:"old,omitempty"`
+	New           int64                  `protobuf:"varint,2,opt,name=new,proto3" json:"new,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Event_Length) Reset() {
+	*x = Event_Length{}
+	mi := &file_proto_event_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event_Length) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event_Length) ProtoMessage() {}
+
+func (x *Event_Length) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_event_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event_Length.ProtoReflect.Descriptor instead.
+func (*Event_Length) Descriptor() ([]byte, []int) {
+	return file_proto_event_proto_rawDescGZIP(), []int{0, 0}
+}
+
+func (x *Event_Length) GetOld() int64 {
+	if x != nil {
+		return x.Old
+	}
+	return 0
+}
+
+func (x *Event_Length) GetNew() int64 {
+	if x != nil {
+		return x.New
+	}
+	return 0
+}
+
+type Event_Revision struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Old           int64                  `protobuf:"varint,1,opt,name=old,proto3" json:"old,omitempty"`
+	New           int64                  `protobuf:"varint,2,opt,name=new,proto3" json:"new,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Event_Revision) Reset() {
+	*x = Event_Revision{}
+	mi := &file_proto_event_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event_Revision) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event_Revision) ProtoMessage() {}
+
+func (x *Event_Revision) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_event_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event_Revision.ProtoReflect.Descriptor instead.
+func (*Event_Revision) Descriptor() ([]byte, []int) {
+	return file_proto_event_proto_rawDescGZIP(), []int{0, 1}
+}
+
+func (x *Event_Revision) GetOld() int64 {
+	if x != nil {
+		return x.Old
+	}
+	return 0
+}
+
+func (x *Event_Revision) GetNew() int64 {
+	if x != nil {
+		return x.New
+	}
+	return 0
+}
+
 var File_proto_event_proto protoreflect.FileDescriptor
 
 const file_proto_event_proto_rawDesc = "" +
 	"\n" +
-	"\x11proto/event.proto\x12\x05proto\"I\n" +
+	"\x11proto/event.proto\x12\x05proto\"\xc2\x03\n" +
 	"\x05Event\x12\x16\n" +
 	"\x06domain\x18\x01 \x01(\tR\x06domain\x12\x14\n" +
 	"\x05title\x18\x02 \x01(\tR\x05title\x12\x12\n" +
-	"\x04user\x18\x03 \x01(\tR\x04userBEZCgithub.com/joshua-daniels-red/go-backend-challenge/ch-6/proto;protob\x06proto3"
+	"\x04user\x18\x03 \x01(\tR\x04user\x12\x0e\n" +
+	"\x02id\x18\x04 \x01(\x03R\x02id\x12\x12\n" +
+	"\x04type\x18\x05 \x01(\tR\x04type\x12\x1c\n" +
+	"\tnamespace\x18\x06 \x01(\x05R\tnamespace\x12\x1c\n" +
+	"\ttimestamp\x18\a \x01(\x03R\ttimestamp\x12\x12\n" +
+	"\x04wiki\x18\b \x01(\tR\x04wiki\x12\x1d\n" +
+	"\n" +
+	"server_url\x18\t \x01(\tR\tserverUrl\x12\x10\n" +
+	"\x03bot\x18\n" +
+	" \x01(\bR\x03bot\x12\x14\n" +
+	"\x05minor\x18\v \x01(\bR\x05minor\x12+\n" +
+	"\x06length\x18\f \x01(\v2\x13.proto.Event.LengthR\x06length\x121\n" +
+	"\brevision\x18\r \x01(\v2\x15.proto.Event.RevisionR\brevision\x1a,\n" +
+	"\x06Length\x12\x10\n" +
+	"\x03old\x18\x01 \x01(\x03R\x03old\x12\x10\n" +
+	"\x03new\x18\x02 \x01(\x03R\x03new\x1a.\n" +
+	"\bRevision\x12\x10\n" +
+	"\x03old\x18\x01 \x01(\x03R\x03old\x12\x10\n" +
+	"\x03new\x18\x02 \x01(\x03R\x03newBEZCgithub.com/joshua-daniels-red/go-backend-challenge/ch-6/proto;protob\x06proto3"
 
 var (
 	file_proto_event_proto_rawDescOnce sync.Once
@@ -103,16 +312,20 @@ func file_proto_event_proto_rawDescGZIP() []byte {
 	return file_proto_event_proto_rawDescData
 }
 
-var file_proto_event_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_proto_event_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
 var file_proto_event_proto_goTypes = []any{
-	(*Event)(nil), // 0: proto.Event
+	(*Event)(nil),          // 0: proto.Event
+	(*Event_Length)(nil),   // 1: proto.Event.Length
+	(*Event_Revision)(nil), // 2: proto.Event.Revision
 }
 var file_proto_event_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	1, // 0: proto.Event.length:type_name -> proto.Event.Length
+	2, // 1: proto.Event.revision:type_name -> proto.Event.Revision
+	2, // [2:2] is the sub-list for method output_type
+	2, // [2:2] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
 }
 
 func init() { file_proto_event_proto_init() }
@@ -126,7 +339,7 @@ func file_proto_event_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_event_proto_rawDesc), len(file_proto_event_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   1,
+			NumMessages:   3,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -0,0 +1,13 @@
+package proto
+
+import _ "embed"
+
+// EventSchema is the source of event.proto, as registered with the schema
+// registry.
+//
+//go:embed event.proto
+var EventSchema string
+
+// EventMessageIndexes locates Event in EventSchema for the wire format: it
+// is the first message in the file.
+var EventMessageIndexes = []int{0}
@@ -35,12 +35,6 @@ kubectl wait --for=condition=complete job/cassandra-init --timeout=180s|| {
   exit 1
 }
 
-# 🔍 Actively check that the keyspace exists
-echo "⏳ Probing Cassandra keyspace readiness..."
-until kubectl exec cassandra-0 -- cqlsh -e "DESCRIBE KEYSPACE goanalytics" > /dev/null 2>&1; do
-  echo "[WAIT] Keyspace not ready yet..."; sleep 2;
-done
-
 
 echo "🪞 Deploying Redpanda..."
 kubectl apply -f k8s/redpanda/
@@ -57,6 +51,12 @@ kubectl apply -f k8s/config/
 kubectl apply -f k8s/producer/
 kubectl apply -f k8s/consumer/
 
+# /readyz only passes once each service reaches Kafka and, for the
+# consumer, Cassandra and its consumer group.
+echo "⏳ Waiting for producer and consumer to report ready..."
+kubectl wait --for=condition=Ready pod -l app=producer --timeout=180s
+kubectl wait --for=condition=Ready pod -l app=consumer --timeout=180s
+
 
 echo "📊 Deploying Prometheus and Grafana..."
 kubectl apply -f k8s/prometheus/